@@ -1,10 +1,14 @@
 module github.com/maisem/proxy-apiserver
 
 require (
+	github.com/evanphx/json-patch v4.2.0+incompatible
 	github.com/go-logr/logr v0.1.0 // indirect
 	github.com/go-logr/zapr v0.1.1 // indirect
+	github.com/prometheus/client_golang v0.9.2
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.3
+	golang.org/x/time v0.0.0-20161028155119-f51c12702a4d
 	k8s.io/api v0.0.0-20190806064354-8b51d7113622
 	k8s.io/apimachinery v0.0.0-20190806215851-162a2dabc72f
 	k8s.io/apiserver v0.0.0-20190807221330-f03b723bf5be
@@ -12,6 +16,7 @@ require (
 	k8s.io/component-base v0.0.0-20190807101431-d6d4632c35d0
 	k8s.io/klog v0.3.1
 	sigs.k8s.io/controller-runtime v0.1.12
+	sigs.k8s.io/yaml v1.1.0
 )
 
 go 1.12
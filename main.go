@@ -19,6 +19,7 @@ func main() {
 	stopCh := genericapiserver.SetupSignalHandler()
 	options := apiserver.NewServerOptions(os.Stdout, os.Stderr)
 	cmd := apiserver.NewCommandStartServer(options, stopCh)
+	cmd.AddCommand(apiserver.NewCommandGenerateManifests(apiserver.NewManifestOptions(os.Stdout)))
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 	if err := cmd.Execute(); err != nil {
 		klog.Fatal(err)
@@ -2,8 +2,14 @@ package apiserver
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
 	"github.com/maisem/proxy-apiserver/pkg/storage"
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -13,12 +19,13 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/version"
 	genericapi "k8s.io/apiserver/pkg/endpoints"
 	"k8s.io/apiserver/pkg/endpoints/discovery"
 	"k8s.io/apiserver/pkg/registry/rest"
 	genericapiserver "k8s.io/apiserver/pkg/server"
-	"k8s.io/client-go/dynamic"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
 	"k8s.io/klog"
 
 	"k8s.io/apiserver/pkg/apis/audit/install"
@@ -59,7 +66,13 @@ func init() {
 // ExtraConfig holds custom apiserver config
 type ExtraConfig struct {
 	// Place you custom config here.
-	Client dynamic.Interface
+	Upstream storage.Upstream
+	// Mapping lists the served resources. mapping.Default() is used if it
+	// is nil.
+	Mapping *mapping.Config
+	// ProxyResources also serves the resources configured by ProxyResource
+	// objects in the upstream cluster.
+	ProxyResources bool
 }
 
 // Config defines the config for the apiserver
@@ -71,11 +84,28 @@ type Config struct {
 // Server contains state for a Kubernetes cluster master/api server.
 type Server struct {
 	GenericAPIServer *genericapiserver.GenericAPIServer
+
+	config completedConfig
+	// mu serializes reloads.
+	mu sync.Mutex
+	// mapping and storages are the served resources and their storages by
+	// external resource.
+	mapping  *mapping.Config
+	storages map[schema.GroupVersionResource]map[string]rest.Storage
+	// static is the mapping given to Reload and proxyResources the
+	// resources given to SetProxyResources, which make up mapping.
+	static         *mapping.Config
+	proxyResources []mapping.Resource
 }
 
 type completedConfig struct {
 	GenericConfig genericapiserver.CompletedConfig
 	ExtraConfig   *ExtraConfig
+	// watches tracks the watches served, so that reloads can end those of
+	// replaced resources.
+	watches *watchDrainer
+	// deprecations holds the deprecated resources served.
+	deprecations *deprecations
 }
 
 // CompletedConfig embeds a private pointer that cannot be instantiated outside of this package.
@@ -85,9 +115,18 @@ type CompletedConfig struct {
 
 // Complete fills in any fields not set that are required to have valid data. It's mutating the receiver.
 func (cfg *Config) Complete() CompletedConfig {
+	// Followed logs stay open like watches.
+	cfg.GenericConfig.LongRunningFunc = genericfilters.BasicLongRunningRequestCheck(sets.NewString("watch"), sets.NewString("logs"))
+	watches, deprecations := newWatchDrainer(), newDeprecations()
+	buildHandlerChain := cfg.GenericConfig.BuildHandlerChainFunc
+	cfg.GenericConfig.BuildHandlerChainFunc = func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		return withWatchDraining(buildHandlerChain(withDeprecationWarnings(apiHandler, deprecations), c), watches, c.RequestInfoResolver)
+	}
 	c := completedConfig{
 		cfg.GenericConfig.Complete(),
 		cfg.ExtraConfig,
+		watches,
+		deprecations,
 	}
 
 	c.GenericConfig.Version = &version.Info{
@@ -98,36 +137,186 @@ func (cfg *Config) Complete() CompletedConfig {
 	return CompletedConfig{&c}
 }
 
-func (c completedConfig) apiGroup() *genericapiserver.APIGroupInfo {
-	v1alpha1storage := map[string]rest.Storage{}
-	extR := storage.GroupVersionKindResource{
-		GroupVersion: schema.GroupVersion{
-			Group:   "apps.maisem.dev",
-			Version: "v1",
-		},
-		Kind:     "Deployment",
-		Resource: "deployments",
-	}
-	intR := storage.GroupVersionKindResource{
-		GroupVersion: schema.GroupVersion{
-			Group:   "apps",
-			Version: "v1",
-		},
-		Kind:     "Deployment",
-		Resource: "deployments",
-	}
-	v1alpha1storage["deployments"] = storage.NewREST(extR, intR, true, c.ExtraConfig.Client, []string{"mdep"}, []string{"all"})
-	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo("apps.maisem.dev", Scheme, metav1.ParameterCodec, Codecs)
-	apiGroupInfo.VersionedResourcesStorageMap["v1"] = v1alpha1storage
-	apiGroupInfo.PrioritizedVersions = []schema.GroupVersion{
-		{
-			Group: "apps.maisem.dev", Version: "v1",
-		},
+func toStorageGVKR(r mapping.GroupVersionKindResource) storage.GroupVersionKindResource {
+	return storage.GroupVersionKindResource{
+		GroupVersion: r.GroupVersion(),
+		Kind:         r.Kind,
+		Resource:     r.Resource,
+	}
+}
+
+// storageFor returns the storage serving res.
+func (c completedConfig) storageFor(res mapping.Resource) (rest.Storage, error) {
+	extR := toStorageGVKR(res.External)
+	if f := res.Backend.File; f != nil {
+		return storage.NewFileREST(extR, !res.ClusterScoped, f.Directory, res.ShortNames, res.Categories), nil
+	}
+	if g := res.Backend.Git; g != nil {
+		return storage.NewGitREST(extR, !res.ClusterScoped, g.Directory, res.ShortNames, res.Categories)
+	}
+	if comp := res.Backend.Composite; comp != nil {
+		var parts []storage.CompositePart
+		for _, p := range comp.Parts {
+			parts = append(parts, storage.CompositePart{Name: p.Name, Resource: toStorageGVKR(p.Resource)})
+		}
+		return storage.NewCompositeREST(extR, !res.ClusterScoped, comp.Label, parts, c.ExtraConfig.Upstream, res.ShortNames, res.Categories), nil
 	}
+	if t := res.Backend.Template; t != nil {
+		var children []storage.TemplateChild
+		for _, ch := range t.Children {
+			children = append(children, storage.TemplateChild{Resource: toStorageGVKR(ch.Resource), Template: ch.Template})
+		}
+		return storage.NewTemplateREST(extR, !res.ClusterScoped, children, c.ExtraConfig.Upstream, res.ShortNames, res.Categories)
+	}
+	intR := toStorageGVKR(res.Internal)
+	policy, err := policyFor(res)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewREST(extR, intR, !res.ClusterScoped, c.GenericConfig.AdmissionControl != nil, c.ExtraConfig.Upstream, res.ShortNames, res.Categories, policy), nil
+}
+
+// policyFor returns the storage policy configured for res.
+func policyFor(res mapping.Resource) (storage.Policy, error) {
+	var p storage.Policy
+	for _, rd := range res.Redact {
+		path, err := fieldpath.Parse(rd.Path)
+		if err != nil {
+			return p, err
+		}
+		action := storage.RedactMask
+		if rd.Action == "remove" {
+			action = storage.RedactRemove
+		}
+		p.Redactions = append(p.Redactions, storage.Redaction{Path: path, Action: action})
+	}
+	for _, fa := range res.FieldAccess {
+		path, err := fieldpath.Parse(fa.Path)
+		if err != nil {
+			return p, err
+		}
+		p.FieldAccess = append(p.FieldAccess, storage.FieldAccess{
+			Path:    path,
+			Readers: toStorageSubjects(fa.Readers),
+			Writers: toStorageSubjects(fa.Writers),
+			Above:   fa.Above,
+		})
+	}
+	for _, d := range res.Defaults {
+		path, err := fieldpath.Parse(d.Path)
+		if err != nil {
+			return p, err
+		}
+		v, err := d.DecodedValue()
+		if err != nil {
+			return p, err
+		}
+		p.Defaults = append(p.Defaults, storage.FieldDefault{Path: path, Value: v, OnUpdate: d.OnUpdate})
+	}
+	for _, s := range res.Immutable {
+		path, err := fieldpath.Parse(s)
+		if err != nil {
+			return p, err
+		}
+		p.Immutable = append(p.Immutable, path)
+	}
+	if q := res.Quota; q != nil {
+		p.Quota = &storage.Quota{TenantLabel: q.TenantLabel, MaxObjects: q.MaxObjects}
+		for _, sum := range q.Sums {
+			path, err := fieldpath.Parse(sum.Path)
+			if err != nil {
+				return p, err
+			}
+			p.Quota.Sums = append(p.Quota.Sums, storage.QuotaSum{Path: path, Max: sum.Max})
+		}
+	}
+	return p, nil
+}
 
+func toStorageSubjects(s *mapping.Subjects) *storage.Subjects {
+	if s == nil {
+		return nil
+	}
+	return &storage.Subjects{Users: s.Users, Groups: s.Groups}
+}
+
+// resourceMapping returns the configured mapping or the default one.
+func (c completedConfig) resourceMapping() *mapping.Config {
+	if c.ExtraConfig.Mapping == nil {
+		return mapping.Default()
+	}
+	return c.ExtraConfig.Mapping
+}
+
+// resourceStorage returns the storages serving res and its subresources,
+// keyed by their path under the group version.
+func (c completedConfig) resourceStorage(res mapping.Resource) (map[string]rest.Storage, error) {
+	s, err := c.storageFor(res)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up storage for %s: %v", res.External, err)
+	}
+	out := map[string]rest.Storage{res.External.Resource: s}
+	for _, action := range res.Actions {
+		as, err := storage.NewActionREST(s, action)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up storage for %s/%s: %v", res.External, action, err)
+		}
+		out[res.External.Resource+"/"+action] = as
+	}
+	if res.Logs {
+		ls, err := storage.NewLogsREST(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up storage for %s/logs: %v", res.External, err)
+		}
+		out[res.External.Resource+"/logs"] = ls
+	}
+	return out, nil
+}
+
+// apiGroupInfo returns the APIGroupInfo of group in m. storages holds the
+// storages of the resources of m, as returned by resourceStorage.
+func apiGroupInfo(m *mapping.Config, group string, storages map[schema.GroupVersionResource]map[string]rest.Storage) *genericapiserver.APIGroupInfo {
+	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(group, Scheme, metav1.ParameterCodec, Codecs)
+	apiGroupInfo.NegotiatedSerializer = unstructuredCodecs{Codecs, typedScheme(m, group)}
+	// Only the versions in the mapping are served, whatever is in the
+	// scheme.
+	apiGroupInfo.PrioritizedVersions = PrioritizedVersions(m, group)
+	for _, res := range m.Resources {
+		if res.External.Group != group {
+			continue
+		}
+		gv := res.External.GroupVersion()
+		versionStorage, ok := apiGroupInfo.VersionedResourcesStorageMap[gv.Version]
+		if !ok {
+			versionStorage = map[string]rest.Storage{}
+			apiGroupInfo.VersionedResourcesStorageMap[gv.Version] = versionStorage
+		}
+		for path, s := range storages[res.External.GroupVersionResource()] {
+			versionStorage[path] = s
+		}
+	}
 	return &apiGroupInfo
 }
 
+// PrioritizedVersions returns the versions of group in m, most preferred
+// first. Versions are prioritized in the order they first appear, deprecated
+// versions last.
+func PrioritizedVersions(m *mapping.Config, group string) []schema.GroupVersion {
+	var versions []schema.GroupVersion
+	seen := map[schema.GroupVersion]bool{}
+	for _, res := range m.Resources {
+		gv := res.External.GroupVersion()
+		if res.External.Group == group && !seen[gv] {
+			seen[gv] = true
+			versions = append(versions, gv)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return !deprecatedVersion(m, versions[i]) && deprecatedVersion(m, versions[j])
+	})
+	return versions
+}
+
 // installAPIResources is a private method for installing the REST storage backing each api groupversionresource
 func installAPIResources(apiPrefix string, apiGroupInfo *genericapiserver.APIGroupInfo, s *genericapiserver.GenericAPIServer) error {
 	for _, groupVersion := range apiGroupInfo.PrioritizedVersions {
@@ -149,8 +338,7 @@ func installAPIResources(apiPrefix string, apiGroupInfo *genericapiserver.APIGro
 	return nil
 }
 
-func (c completedConfig) installAPIGroup(s *genericapiserver.GenericAPIServer) error {
-	apiGroupInfo := c.apiGroup()
+func (c completedConfig) installAPIGroup(s *genericapiserver.GenericAPIServer, apiGroupInfo *genericapiserver.APIGroupInfo) error {
 	if err := installAPIResources("/apis", apiGroupInfo, s); err != nil {
 		return fmt.Errorf("unable to install api resources: %v", err)
 	}
@@ -218,8 +406,22 @@ func (c completedConfig) New() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := c.installAPIGroup(s); err != nil {
+	server := &Server{
+		GenericAPIServer: s,
+		config:           c,
+		mapping:          &mapping.Config{},
+	}
+	if err := server.Reload(c.resourceMapping()); err != nil {
+		return nil, err
+	}
+	if c.ExtraConfig.ProxyResources {
+		if err := server.installProxyResources(); err != nil {
+			return nil, err
+		}
+	}
+	if err := server.installHealthChecks(); err != nil {
 		return nil, err
 	}
-	return &Server{s}, nil
+	metrics.Register()
+	return server, nil
 }
@@ -0,0 +1,155 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+)
+
+// deprecatedCategory lists the deprecated resources in discovery, so that
+// `kubectl get deprecated` shows what is left to migrate.
+const deprecatedCategory = "deprecated"
+
+// servedResource returns res as it is served in m, with its deprecation
+// taking that of its version into account.
+func servedResource(m *mapping.Config, res mapping.Resource) mapping.Resource {
+	d := m.DeprecationOf(res)
+	if d == nil {
+		return res
+	}
+	res.Deprecation = d
+	for _, c := range res.Categories {
+		if c == deprecatedCategory {
+			return res
+		}
+	}
+	res.Categories = append(append([]string(nil), res.Categories...), deprecatedCategory)
+	return res
+}
+
+// deprecatedVersion reports whether all resources of gv in m are
+// deprecated, in which case clients should not prefer it.
+func deprecatedVersion(m *mapping.Config, gv schema.GroupVersion) bool {
+	for _, res := range m.Resources {
+		if res.External.GroupVersion() == gv && m.DeprecationOf(res) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// deprecations holds the deprecations of the served resources.
+type deprecations struct {
+	mu         sync.RWMutex
+	byResource map[schema.GroupVersionResource]mapping.Deprecation
+}
+
+func newDeprecations() *deprecations {
+	return &deprecations{byResource: map[schema.GroupVersionResource]mapping.Deprecation{}}
+}
+
+// set replaces the deprecations with those of m.
+func (d *deprecations) set(m *mapping.Config) {
+	byResource := map[schema.GroupVersionResource]mapping.Deprecation{}
+	for _, res := range m.Resources {
+		if dep := m.DeprecationOf(res); dep != nil {
+			byResource[res.External.GroupVersionResource()] = *dep
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byResource = byResource
+}
+
+func (d *deprecations) get(gvr schema.GroupVersionResource) (mapping.Deprecation, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	dep, ok := d.byResource[gvr]
+	return dep, ok
+}
+
+// withDeprecationWarnings adds a Warning header, and a Sunset header if the
+// removal date is known, to the responses for deprecated resources, and
+// counts who still calls them.
+func withDeprecationWarnings(handler http.Handler, d *deprecations) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		gvr := schema.GroupVersionResource{Group: info.APIGroup, Version: info.APIVersion, Resource: info.Resource}
+		if dep, ok := d.get(gvr); ok {
+			w.Header().Add("Warning", warning(gvr, dep))
+			if t, err := dep.RemovalTime(); err == nil && !t.IsZero() {
+				w.Header().Set("Sunset", t.UTC().Format(http.TimeFormat))
+			}
+			var user string
+			if u, ok := request.UserFrom(req.Context()); ok {
+				user = u.GetName()
+			}
+			// Callers are logged rather than counted, which would make the
+			// metric grow with every user and client version.
+			klog.V(2).Infof("Deprecated %s of %s by user %q with user agent %q", info.Verb, gvr, user, req.UserAgent())
+			metrics.DeprecatedRequest(gvr.Group, gvr.Version, gvr.Resource, info.Verb, knownClient(req))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// warning returns the value of the Warning header for requests to the
+// deprecated resource gvr, e.g.
+//
+//   299 - "apps.maisem.dev/v1 deployments is deprecated and will be removed after 2020-06-30; use apps.maisem.dev/v2"
+func warning(gvr schema.GroupVersionResource, d mapping.Deprecation) string {
+	text := fmt.Sprintf("%s %s is deprecated", gvr.GroupVersion(), gvr.Resource)
+	if d.Removal != "" {
+		text += " and will be removed after " + d.Removal
+	}
+	if d.Replacement != "" {
+		text += "; use " + d.Replacement
+	}
+	if d.Message != "" {
+		text += ". " + d.Message
+	}
+	return fmt.Sprintf("299 - %q", text)
+}
+
+// knownClients are the clients counted by name in the metric of deprecated
+// requests; the others are counted as otherClient.
+var knownClients = sets.NewString(
+	"kubectl",
+	"kubelet",
+	"kube-controller-manager",
+	"kube-scheduler",
+	"helm",
+	"argocd-application-controller",
+	"argocd-server",
+	"kustomize-controller",
+	"helm-controller",
+)
+
+const otherClient = "other"
+
+// knownClient returns the product name of the user agent of req, e.g.
+// kubectl for kubectl/v1.15.0 (linux/amd64), if it is one of knownClients,
+// or otherClient.
+func knownClient(req *http.Request) string {
+	product := req.UserAgent()
+	if i := strings.IndexAny(product, "/ "); i >= 0 {
+		product = product[:i]
+	}
+	if product = strings.ToLower(product); knownClients.Has(product) {
+		return product
+	}
+	return otherClient
+}
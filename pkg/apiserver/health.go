@@ -0,0 +1,102 @@
+package apiserver
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/maisem/proxy-apiserver/pkg/health"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/proxyresource"
+)
+
+// healthCheckTimeout bounds each upstream request of the health checks.
+const healthCheckTimeout = 5 * time.Second
+
+var (
+	podsGVR        = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	eventsGVR      = schema.GroupVersionResource{Version: "v1", Resource: "events"}
+	replicaSetsGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+)
+
+// installHealthChecks adds the upstream connectivity check to /healthz and
+// /readyz, and the resources and permissions checks of the served resources
+// to /readyz.
+func (s *Server) installHealthChecks() error {
+	config := s.config.ExtraConfig.Upstream.Config()
+	if config == nil {
+		return nil
+	}
+	config.Timeout = healthCheckTimeout
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := s.GenericAPIServer.AddHealthzChecks(health.Connectivity(client)); err != nil {
+		return err
+	}
+	events := s.config.ExtraConfig.Upstream.Recorder != nil
+	proxyResources := s.config.ExtraConfig.ProxyResources
+	resources := func() []health.Resource {
+		return UpstreamResources(s.currentMapping(), events, proxyResources)
+	}
+	return s.GenericAPIServer.AddReadyzChecks(health.Resources(client, resources), health.Permissions(client, resources))
+}
+
+// UpstreamResources returns the upstream resources the proxy uses to serve m
+// and the verbs it needs on them. events is whether events are recorded and
+// proxyResources whether ProxyResources are watched.
+func UpstreamResources(m *mapping.Config, events, proxyResources bool) []health.Resource {
+	type key struct {
+		gvr         schema.GroupVersionResource
+		subresource string
+	}
+	verbs := map[key]sets.String{}
+	add := func(gvr schema.GroupVersionResource, subresource string, vs ...string) {
+		k := key{gvr, subresource}
+		if verbs[k] == nil {
+			verbs[k] = sets.NewString()
+		}
+		verbs[k].Insert(vs...)
+	}
+	for _, res := range m.Resources {
+		switch b := res.Backend; {
+		case b.Upstream():
+			add(res.Internal.GroupVersionResource(), "", "get", "list", "watch", "create", "update", "patch", "delete", "deletecollection")
+		case b.Composite != nil:
+			for _, p := range b.Composite.Parts {
+				add(p.Resource.GroupVersionResource(), "", "list", "watch")
+			}
+		case b.Template != nil:
+			for _, ch := range b.Template.Children {
+				add(ch.Resource.GroupVersionResource(), "", "list", "watch", "create", "update", "delete")
+			}
+		}
+		for _, a := range res.Actions {
+			if a == "rollback" {
+				add(replicaSetsGVR, "", "list")
+			}
+		}
+		if res.Logs {
+			add(podsGVR, "", "list")
+			add(podsGVR, "log", "get")
+		}
+	}
+	if events && len(verbs) > 0 {
+		add(eventsGVR, "", "create", "patch")
+	}
+	if proxyResources {
+		add(proxyresource.GroupVersionResource, "", "list", "watch")
+		add(proxyresource.GroupVersionResource, "status", "update")
+	}
+
+	var out []health.Resource
+	for k, vs := range verbs {
+		out = append(out, health.Resource{GroupVersionResource: k.gvr, Subresource: k.subresource, Verbs: vs.List()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].String() < out[j].String() })
+	return out
+}
@@ -0,0 +1,29 @@
+package apiserver
+
+import (
+	"fmt"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/discovery"
+
+	"github.com/maisem/proxy-apiserver/pkg/proxyresource"
+)
+
+// installProxyResources starts serving the resources of the ProxyResources
+// in the upstream cluster once the server runs.
+func (s *Server) installProxyResources() error {
+	upstream := s.config.ExtraConfig.Upstream
+	config := upstream.Config()
+	if upstream.Client == nil || config == nil {
+		return fmt.Errorf("ProxyResources require the upstream cluster to be configured")
+	}
+	disc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	controller := proxyresource.NewController(upstream.Client, disc, s.staticMapping, s.SetProxyResources)
+	return s.GenericAPIServer.AddPostStartHook("proxy-resources", func(ctx genericapiserver.PostStartHookContext) error {
+		go controller.Run(ctx.StopCh)
+		return nil
+	})
+}
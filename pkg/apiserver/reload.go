@@ -0,0 +1,378 @@
+package apiserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/klog"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/storage"
+)
+
+// Reload serves the resources of m instead of the current ones, along with
+// the resources set by SetProxyResources. Routes and discovery of the groups
+// with added, removed or modified resources are replaced, and watches of
+// removed or modified resources are ended so that clients start over.
+// Unchanged resources keep their storage; the storages of the others are
+// destroyed. On error the current resources are still served.
+func (s *Server) Reload(m *mapping.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.serve(withProxyResources(m, s.proxyResources)); err != nil {
+		return err
+	}
+	s.static = m
+	return nil
+}
+
+// SetProxyResources serves rs along with the mapping given to Reload,
+// replacing the resources of the previous call. Resources of rs that the
+// mapping already serves are ignored.
+func (s *Server) SetProxyResources(rs []mapping.Resource) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.serve(withProxyResources(s.static, rs)); err != nil {
+		return err
+	}
+	s.proxyResources = rs
+	return nil
+}
+
+// withProxyResources returns m with the resources of rs it does not serve.
+func withProxyResources(m *mapping.Config, rs []mapping.Resource) *mapping.Config {
+	if len(rs) == 0 {
+		return m
+	}
+	out := *m
+	out.Resources = append([]mapping.Resource(nil), m.Resources...)
+	served := map[schema.GroupVersionResource]bool{}
+	for _, res := range m.Resources {
+		served[res.External.GroupVersionResource()] = true
+	}
+	for _, res := range rs {
+		if served[res.External.GroupVersionResource()] {
+			klog.V(2).Infof("Ignoring ProxyResource for %s, which is served by the mapping", res.External)
+			continue
+		}
+		out.Resources = append(out.Resources, res)
+	}
+	return &out
+}
+
+// serve replaces the served resources with those of m. s.mu must be held.
+func (s *Server) serve(m *mapping.Config) error {
+	if err := m.Validate(); err != nil {
+		return fmt.Errorf("invalid mapping: %v", err)
+	}
+	if m.UsesUpstream() && s.config.ExtraConfig.Upstream.Client == nil {
+		return fmt.Errorf("the mapping uses the upstream cluster, which was not configured when the server started")
+	}
+	d := diffMappings(s.mapping, m)
+	if d.empty() {
+		s.config.deprecations.set(m)
+		klog.V(2).Infof("Mapping is unchanged")
+		return nil
+	}
+
+	// Set up all storages first so that a broken resource leaves the
+	// current ones in place.
+	storages := map[schema.GroupVersionResource]map[string]rest.Storage{}
+	var created []map[string]rest.Storage
+	for _, res := range m.Resources {
+		gvr := res.External.GroupVersionResource()
+		if rs, ok := s.storages[gvr]; ok && !d.modified.Has(gvr.String()) {
+			storages[gvr] = rs
+			continue
+		}
+		rs, err := s.config.resourceStorage(servedResource(m, res))
+		if err != nil {
+			destroyStorages(created...)
+			return err
+		}
+		storages[gvr] = rs
+		created = append(created, rs)
+	}
+
+	served := sets.NewString(m.Groups()...)
+	var replaced []string
+	for _, group := range d.groups.List() {
+		s.uninstallAPIGroup(group)
+		replaced = append(replaced, group)
+		if !served.Has(group) {
+			continue
+		}
+		if err := s.config.installAPIGroup(s.GenericAPIServer, apiGroupInfo(m, group, storages)); err != nil {
+			s.restoreAPIGroups(replaced)
+			destroyStorages(created...)
+			return fmt.Errorf("unable to install group %s: %v", group, err)
+		}
+	}
+	for _, gvr := range append(d.removed.List(), d.modified.List()...) {
+		s.config.watches.drain(gvr)
+	}
+	var old []map[string]rest.Storage
+	for gvr, rs := range s.storages {
+		if d.removed.Has(gvr.String()) || d.modified.Has(gvr.String()) {
+			old = append(old, rs)
+		}
+	}
+	destroyStorages(old...)
+	s.config.deprecations.set(m)
+	s.mapping, s.storages = m, storages
+	klog.Infof("Mapping changed: %v", d)
+	return nil
+}
+
+// restoreAPIGroups serves groups as they were before a failed reload.
+func (s *Server) restoreAPIGroups(groups []string) {
+	previous := sets.NewString(s.mapping.Groups()...)
+	for _, group := range groups {
+		s.uninstallAPIGroup(group)
+		if !previous.Has(group) {
+			continue
+		}
+		if err := s.config.installAPIGroup(s.GenericAPIServer, apiGroupInfo(s.mapping, group, s.storages)); err != nil {
+			klog.Errorf("Unable to restore group %s: %v", group, err)
+		}
+	}
+}
+
+// destroyStorages releases the resources held by the storages of resources
+// that are no longer served.
+func destroyStorages(storages ...map[string]rest.Storage) {
+	for _, rs := range storages {
+		for _, st := range rs {
+			if d, ok := st.(storage.Destroyer); ok {
+				d.Destroy()
+			}
+		}
+	}
+}
+
+// currentMapping returns the served resources.
+func (s *Server) currentMapping() *mapping.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mapping
+}
+
+// staticMapping returns the mapping given to Reload.
+func (s *Server) staticMapping() *mapping.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.static
+}
+
+// uninstallAPIGroup removes the routes and discovery of group.
+func (s *Server) uninstallAPIGroup(group string) {
+	container := s.GenericAPIServer.Handler.GoRestfulContainer
+	root := "/apis/" + group
+	for _, ws := range container.RegisteredWebServices() {
+		if ws.RootPath() == root || strings.HasPrefix(ws.RootPath(), root+"/") {
+			if err := container.Remove(ws); err != nil {
+				klog.Errorf("Unable to remove routes of %s: %v", ws.RootPath(), err)
+			}
+		}
+	}
+	s.GenericAPIServer.DiscoveryGroupManager.RemoveGroup(group)
+}
+
+// WatchMapping reloads the mapping from path whenever its content changes,
+// checking every interval until stopCh is closed. Mappings that fail to load
+// are logged and ignored.
+func (s *Server) WatchMapping(path string, interval time.Duration, stopCh <-chan struct{}) {
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		klog.Errorf("Unable to read mapping %s: %v", path, err)
+	}
+	wait.Until(func() {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("Unable to read mapping %s: %v", path, err)
+			return
+		}
+		if bytes.Equal(b, last) {
+			return
+		}
+		last = b
+		m, err := mapping.Load(path)
+		if err == nil {
+			err = s.Reload(m)
+		}
+		if err != nil {
+			klog.Errorf("Unable to reload mapping %s, still serving the previous one: %v", path, err)
+		}
+	}, interval, stopCh)
+}
+
+// mappingDiff lists the external resources that differ between two mappings
+// and the groups they belong to.
+type mappingDiff struct {
+	added, removed, modified sets.String
+	groups                   sets.String
+}
+
+func diffMappings(from, to *mapping.Config) mappingDiff {
+	d := mappingDiff{added: sets.NewString(), removed: sets.NewString(), modified: sets.NewString(), groups: sets.NewString()}
+	resources := func(m *mapping.Config) map[schema.GroupVersionResource]mapping.Resource {
+		out := map[schema.GroupVersionResource]mapping.Resource{}
+		for _, res := range m.Resources {
+			out[res.External.GroupVersionResource()] = servedResource(m, res)
+		}
+		return out
+	}
+	before, after := resources(from), resources(to)
+	for gvr, res := range after {
+		prev, ok := before[gvr]
+		switch {
+		case !ok:
+			d.added.Insert(gvr.String())
+		case !reflect.DeepEqual(prev, res):
+			d.modified.Insert(gvr.String())
+		default:
+			continue
+		}
+		d.groups.Insert(gvr.Group)
+	}
+	for gvr := range before {
+		if _, ok := after[gvr]; !ok {
+			d.removed.Insert(gvr.String())
+			d.groups.Insert(gvr.Group)
+		}
+	}
+	return d
+}
+
+func (d mappingDiff) empty() bool {
+	return d.groups.Len() == 0
+}
+
+func (d mappingDiff) String() string {
+	var parts []string
+	for _, c := range []struct {
+		name string
+		set  sets.String
+	}{{"added", d.added}, {"removed", d.removed}, {"modified", d.modified}} {
+		if c.set.Len() > 0 {
+			parts = append(parts, fmt.Sprintf("%s %s", c.name, strings.Join(c.set.List(), ", ")))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// watchDrainer tracks the watches being served by resource so that they can
+// be ended when the resource is replaced.
+type watchDrainer struct {
+	mu      sync.Mutex
+	watches map[string]map[chan struct{}]bool
+}
+
+func newWatchDrainer() *watchDrainer {
+	return &watchDrainer{watches: map[string]map[chan struct{}]bool{}}
+}
+
+func (d *watchDrainer) add(gvr string) chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ch := make(chan struct{})
+	if d.watches[gvr] == nil {
+		d.watches[gvr] = map[chan struct{}]bool{}
+	}
+	d.watches[gvr][ch] = true
+	return ch
+}
+
+func (d *watchDrainer) remove(gvr string, ch chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.watches[gvr], ch)
+}
+
+// drain ends the watches of gvr.
+func (d *watchDrainer) drain(gvr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n int
+	for ch := range d.watches[gvr] {
+		close(ch)
+		n++
+	}
+	delete(d.watches, gvr)
+	if n > 0 {
+		klog.V(2).Infof("Ended %d watches of %s", n, gvr)
+	}
+}
+
+// withWatchDraining tracks the watch requests served by handler in d. The
+// watch handler ends when the connection is closed, so a drained watch is
+// made to look like a closed connection. It must wrap the whole handler
+// chain, as the watch handler writes to the response writer the logging
+// filter was given.
+func withWatchDraining(handler http.Handler, d *watchDrainer, resolver request.RequestInfoResolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, err := resolver.NewRequestInfo(req)
+		if err != nil || !info.IsResourceRequest || info.Verb != "watch" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		gvr := schema.GroupVersionResource{Group: info.APIGroup, Version: info.APIVersion, Resource: info.Resource}.String()
+		drained := d.add(gvr)
+		done := make(chan struct{})
+		defer func() {
+			close(done)
+			d.remove(gvr, drained)
+		}()
+		handler.ServeHTTP(&drainWriter{ResponseWriter: w, drained: drained, done: done}, req)
+	})
+}
+
+// drainWriter reports the connection closed once drained is closed.
+type drainWriter struct {
+	http.ResponseWriter
+	drained <-chan struct{}
+	// done is closed when the request is over.
+	done <-chan struct{}
+
+	once   sync.Once
+	closed chan bool
+}
+
+func (w *drainWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns the same channel on every call, as the watch handler
+// calls it for every event.
+func (w *drainWriter) CloseNotify() <-chan bool {
+	w.once.Do(func() {
+		var closed <-chan bool
+		if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+			closed = cn.CloseNotify()
+		}
+		w.closed = make(chan bool, 1)
+		go func() {
+			select {
+			case <-closed:
+			case <-w.drained:
+			case <-w.done:
+				return
+			}
+			w.closed <- true
+		}()
+	})
+	return w.closed
+}
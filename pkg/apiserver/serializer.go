@@ -0,0 +1,177 @@
+package apiserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/apimachinery/pkg/runtime/serializer/versioning"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+// unstructuredCodecs encodes the unstructured objects returned by the
+// storages as they are. Scheme only knows the kinds of the built-in mapping,
+// so converting the lists of other resources through it fails.
+//
+// JSON lists are streamed item by item. Protobuf is only offered if typed is
+// set, as it needs the Go types of the objects.
+type unstructuredCodecs struct {
+	serializer.CodecFactory
+	// typed holds the Go types of the external kinds of a group, see
+	// typedScheme.
+	typed *runtime.Scheme
+}
+
+func (f unstructuredCodecs) SupportedMediaTypes() []runtime.SerializerInfo {
+	var out []runtime.SerializerInfo
+	for _, info := range f.CodecFactory.SupportedMediaTypes() {
+		switch info.MediaType {
+		case runtime.ContentTypeJSON:
+			info.Serializer = listStreamingSerializer{info.Serializer}
+		case runtime.ContentTypeProtobuf:
+			if f.typed == nil {
+				continue
+			}
+			info.Serializer = typedSerializer{Serializer: protobuf.NewSerializer(f.typed, f.typed), scheme: f.typed, fallback: info.Serializer}
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+func (f unstructuredCodecs) EncoderForVersion(encoder runtime.Encoder, gv runtime.GroupVersioner) runtime.Encoder {
+	return versioning.NewCodec(encoder, nil, unstructuredConvertor{runtime.UnsafeObjectConvertor(Scheme)}, Scheme, Scheme, Scheme, gv, nil, Scheme.Name())
+}
+
+// unstructuredConvertor passes unstructured objects already in the target
+// version through.
+type unstructuredConvertor struct {
+	runtime.ObjectConvertor
+}
+
+func (c unstructuredConvertor) ConvertToVersion(in runtime.Object, target runtime.GroupVersioner) (runtime.Object, error) {
+	if _, ok := in.(runtime.Unstructured); ok {
+		gvk := in.GetObjectKind().GroupVersionKind()
+		if t, ok := target.KindForGroupVersionKinds([]schema.GroupVersionKind{gvk}); ok && t == gvk {
+			return in, nil
+		}
+	}
+	return c.ObjectConvertor.ConvertToVersion(in, target)
+}
+
+// listStreamingSerializer writes unstructured lists one item at a time
+// instead of building the whole document in memory first, as the JSON
+// serializer does.
+type listStreamingSerializer struct {
+	runtime.Serializer
+}
+
+func (s listStreamingSerializer) Encode(obj runtime.Object, w io.Writer) error {
+	l, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return s.Serializer.Encode(obj, w)
+	}
+	head, err := json.Marshal(l.Object)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	// head is the list without items, e.g. {"apiVersion":...,"metadata":{...}}.
+	bw.Write(head[:len(head)-1])
+	if len(head) > 2 {
+		bw.WriteByte(',')
+	}
+	bw.WriteString(`"items":[`)
+	enc := json.NewEncoder(bw)
+	for i := range l.Items {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		if err := enc.Encode(l.Items[i].Object); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
+
+// typedSerializer serializes unstructured objects as their Go types in
+// scheme, which protobuf requires. Other objects, like statuses and options,
+// are left to fallback.
+type typedSerializer struct {
+	runtime.Serializer
+	scheme   *runtime.Scheme
+	fallback runtime.Serializer
+}
+
+func (s typedSerializer) Encode(obj runtime.Object, w io.Writer) error {
+	u, ok := obj.(runtime.Unstructured)
+	if !ok {
+		return s.fallback.Encode(obj, w)
+	}
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	typed, err := s.scheme.New(gvk)
+	if err != nil {
+		return err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), typed); err != nil {
+		return err
+	}
+	typed.GetObjectKind().SetGroupVersionKind(gvk)
+	return s.Serializer.Encode(typed, w)
+}
+
+func (s typedSerializer) Decode(data []byte, defaults *schema.GroupVersionKind, into runtime.Object) (runtime.Object, *schema.GroupVersionKind, error) {
+	u, ok := into.(*unstructured.Unstructured)
+	if !ok {
+		return s.fallback.Decode(data, defaults, into)
+	}
+	typed, gvk, err := s.Serializer.Decode(data, defaults, nil)
+	if err != nil {
+		return nil, gvk, err
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(typed)
+	if err != nil {
+		return nil, gvk, err
+	}
+	u.SetUnstructuredContent(content)
+	u.SetGroupVersionKind(*gvk)
+	return u, gvk, nil
+}
+
+// typedScheme returns a scheme with the Go types of the external kinds of
+// the resources of group in m, or nil if not all of them have one. Only
+// resources proxied to built-in upstream kinds have Go types, unless their
+// values are masked, which may change their types.
+func typedScheme(m *mapping.Config, group string) *runtime.Scheme {
+	s := runtime.NewScheme()
+	for _, res := range m.Resources {
+		if res.External.Group != group {
+			continue
+		}
+		if !res.Backend.Upstream() {
+			return nil
+		}
+		for _, r := range res.Redact {
+			if r.Action != "remove" {
+				return nil
+			}
+		}
+		external, internal := res.External.GroupVersion(), res.Internal.GroupVersion()
+		for _, suffix := range []string{"", "List"} {
+			obj, err := clientgoscheme.Scheme.New(internal.WithKind(res.Internal.Kind + suffix))
+			if err != nil {
+				return nil
+			}
+			s.AddKnownTypeWithName(external.WithKind(res.External.Kind+suffix), obj)
+		}
+	}
+	return s
+}
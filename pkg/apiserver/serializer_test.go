@@ -0,0 +1,162 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+var facadeGV = schema.GroupVersion{Group: "apps.maisem.dev", Version: "v1"}
+
+func newDeploymentList(n int) *unstructured.UnstructuredList {
+	l := &unstructured.UnstructuredList{}
+	l.SetAPIVersion(facadeGV.String())
+	l.SetKind("DeploymentList")
+	l.SetResourceVersion("42")
+	for i := 0; i < n; i++ {
+		u := unstructured.Unstructured{}
+		u.SetAPIVersion(facadeGV.String())
+		u.SetKind("Deployment")
+		u.SetName(fmt.Sprintf("web-%d", i))
+		u.SetNamespace("default")
+		u.SetLabels(map[string]string{"app": "web", "team": "shop"})
+		unstructured.SetNestedField(u.Object, int64(3), "spec", "replicas")
+		unstructured.SetNestedStringMap(u.Object, map[string]string{"app": "web"}, "spec", "selector", "matchLabels")
+		unstructured.SetNestedSlice(u.Object, []interface{}{map[string]interface{}{
+			"name":  "web",
+			"image": "nginx:1.17",
+			"ports": []interface{}{map[string]interface{}{"containerPort": int64(80)}},
+		}}, "spec", "template", "spec", "containers")
+		l.Items = append(l.Items, u)
+	}
+	return l
+}
+
+// serializerFor returns the serializer codecs negotiates for mediaType, or
+// nil if it is not supported.
+func serializerFor(codecs runtime.NegotiatedSerializer, mediaType string) runtime.Serializer {
+	info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		return nil
+	}
+	return info.Serializer
+}
+
+func TestListStreaming(t *testing.T) {
+	codecs := unstructuredCodecs{Codecs, nil}
+	for _, n := range []int{0, 1, 3} {
+		l := newDeploymentList(n)
+		var streamed, buffered bytes.Buffer
+		if err := codecs.EncoderForVersion(serializerFor(codecs, runtime.ContentTypeJSON), facadeGV).Encode(l, &streamed); err != nil {
+			t.Fatal(err)
+		}
+		if err := serializerFor(Codecs, runtime.ContentTypeJSON).Encode(l, &buffered); err != nil {
+			t.Fatal(err)
+		}
+		var got, want interface{}
+		if err := json.Unmarshal(streamed.Bytes(), &got); err != nil {
+			t.Fatalf("streamed list of %d items is not valid JSON: %v\n%s", n, err, streamed.String())
+		}
+		json.Unmarshal(buffered.Bytes(), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("streamed list of %d items = %s, want %s", n, streamed.String(), buffered.String())
+		}
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	codecs := unstructuredCodecs{Codecs, typedScheme(mapping.Default(), facadeGV.Group)}
+	pb := serializerFor(codecs, runtime.ContentTypeProtobuf)
+	if pb == nil {
+		t.Fatal("protobuf is not offered for typed resources")
+	}
+	encoder := codecs.EncoderForVersion(pb, facadeGV)
+	decoder := codecs.DecoderToVersion(pb, facadeGV)
+
+	l := newDeploymentList(2)
+	var buf bytes.Buffer
+	if err := encoder.Encode(l, &buf); err != nil {
+		t.Fatal(err)
+	}
+	obj, gvk, err := pb.Decode(buf.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatalf("encoded list does not decode: %v", err)
+	}
+	if list, ok := obj.(*appsv1.DeploymentList); !ok || len(list.Items) != 2 || *gvk != facadeGV.WithKind("DeploymentList") {
+		t.Errorf("decoded %s %#v, want a DeploymentList of 2 items", gvk, obj)
+	}
+
+	buf.Reset()
+	if err := encoder.Encode(&l.Items[1], &buf); err != nil {
+		t.Fatal(err)
+	}
+	u := &unstructured.Unstructured{}
+	if _, _, err := decoder.Decode(buf.Bytes(), nil, u); err != nil {
+		t.Fatal(err)
+	}
+	if u.GetName() != "web-1" || u.GroupVersionKind() != facadeGV.WithKind("Deployment") {
+		t.Errorf("decoded %s %s, want web-1 Deployment", u.GroupVersionKind(), u.GetName())
+	}
+	if replicas, _, _ := unstructured.NestedInt64(u.Object, "spec", "replicas"); replicas != 3 {
+		t.Errorf("decoded spec.replicas = %d, want 3", replicas)
+	}
+}
+
+func TestTypedScheme(t *testing.T) {
+	for name, res := range map[string]mapping.Resource{
+		"file backend": {
+			External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Note", Resource: "notes"},
+			Backend:  mapping.Backend{File: &mapping.FileBackend{Directory: "/tmp"}},
+		},
+		"custom upstream kind": {
+			External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Note", Resource: "notes"},
+			Internal: mapping.GroupVersionKindResource{Group: "notes.example.com", Version: "v1", Kind: "Note", Resource: "notes"},
+		},
+		"masked values": {
+			External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Secret", Resource: "secrets"},
+			Internal: mapping.GroupVersionKindResource{Version: "v1", Kind: "Secret", Resource: "secrets"},
+			Redact:   []mapping.Redaction{{Path: "data"}},
+		},
+	} {
+		m := mapping.Default()
+		m.Resources = append(m.Resources, res)
+		if s := typedScheme(m, "notes.maisem.dev"); s != nil {
+			t.Errorf("%s: typedScheme() = %v, want nil", name, s)
+		}
+		if s := typedScheme(m, facadeGV.Group); s == nil || !s.Recognizes(facadeGV.WithKind("DeploymentList")) {
+			t.Errorf("%s: typedScheme() of another group does not know DeploymentList", name)
+		}
+	}
+}
+
+func BenchmarkEncodeList(b *testing.B) {
+	l := newDeploymentList(1000)
+	typed := unstructuredCodecs{Codecs, typedScheme(mapping.Default(), facadeGV.Group)}
+	for _, bc := range []struct {
+		name    string
+		encoder runtime.Encoder
+	}{
+		{"json", serializerFor(Codecs, runtime.ContentTypeJSON)},
+		{"json-streaming", typed.EncoderForVersion(serializerFor(typed, runtime.ContentTypeJSON), facadeGV)},
+		{"protobuf", typed.EncoderForVersion(serializerFor(typed, runtime.ContentTypeProtobuf), facadeGV)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bc.encoder.Encode(l, ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
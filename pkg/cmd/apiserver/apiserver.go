@@ -1,8 +1,12 @@
 package apiserver
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -11,11 +15,13 @@ import (
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	genericoptions "k8s.io/apiserver/pkg/server/options"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
 	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 
 	//"k8s.io/sample-apiserver/pkg/apis/wardle/v1alpha1"
 	"github.com/maisem/proxy-apiserver/pkg/apiserver"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/storage"
 	//	informers "k8s.io/sample-apiserver/pkg/generated/informers/externalversions"
 )
 
@@ -30,6 +36,31 @@ type ServerOptions struct {
 	// ProcessInfo is used to identify events created by the server.
 	ProcessInfo *genericoptions.ProcessInfo
 
+	// MappingConfig is the path of the file listing the served resources.
+	// The built-in mapping is used if it is empty.
+	MappingConfig string
+	// MappingReloadInterval is how often MappingConfig is checked for
+	// changes, which are applied without a restart. 0 disables reloading.
+	MappingReloadInterval time.Duration
+	// ProxyResources also serves the resources configured by ProxyResource
+	// objects in the upstream cluster.
+	ProxyResources bool
+
+	// UpstreamName identifies the upstream cluster in metrics. Defaults to
+	// the host of the upstream API server.
+	UpstreamName string
+	// UpstreamQPS, UpstreamBurst and UpstreamTimeout bound the load the proxy
+	// puts on the upstream API server across all facade callers.
+	UpstreamQPS     float32
+	UpstreamBurst   int
+	UpstreamTimeout time.Duration
+	// ContinueTokenKeyFile holds the key List continue tokens are signed
+	// with. Replicas must share it. A random key is used if it is empty.
+	ContinueTokenKeyFile string
+
+	Tracing   *TracingOptions
+	RateLimit *RateLimitOptions
+
 	StdOut io.Writer
 	StdErr io.Writer
 }
@@ -37,12 +68,17 @@ type ServerOptions struct {
 // NewServerOptions returns a new ServerOptions
 func NewServerOptions(out, errOut io.Writer) *ServerOptions {
 	o := &ServerOptions{
-		SecureServing:  genericoptions.NewSecureServingOptions().WithLoopback(),
-		ProcessInfo:    genericoptions.NewProcessInfo("proxy-apiserver", "proxy"),
-		Authentication: genericoptions.NewDelegatingAuthenticationOptions(),
-		Authorization:  genericoptions.NewDelegatingAuthorizationOptions(),
-		StdOut:         out,
-		StdErr:         errOut,
+		SecureServing:         genericoptions.NewSecureServingOptions().WithLoopback(),
+		ProcessInfo:           genericoptions.NewProcessInfo("proxy-apiserver", "proxy"),
+		Authentication:        genericoptions.NewDelegatingAuthenticationOptions(),
+		Authorization:         genericoptions.NewDelegatingAuthorizationOptions(),
+		MappingReloadInterval: 10 * time.Second,
+		UpstreamQPS:           rest.DefaultQPS,
+		UpstreamBurst:         rest.DefaultBurst,
+		Tracing:               NewTracingOptions(),
+		RateLimit:             NewRateLimitOptions(),
+		StdOut:                out,
+		StdErr:                errOut,
 	}
 	return o
 }
@@ -75,10 +111,20 @@ func NewCommandStartServer(defaults *ServerOptions, stopCh <-chan struct{}) *cob
 	return cmd
 }
 
-func (o ServerOptions) AddFlags(fs *pflag.FlagSet) {
+func (o *ServerOptions) AddFlags(fs *pflag.FlagSet) {
 	o.SecureServing.AddFlags(fs)
 	o.Authentication.AddFlags(fs)
 	o.Authorization.AddFlags(fs)
+	fs.StringVar(&o.MappingConfig, "mapping-config", o.MappingConfig, "Path to a YAML file listing the resources served by the proxy and their backends. Defaults to the built-in Deployment mapping.")
+	fs.DurationVar(&o.MappingReloadInterval, "mapping-reload-interval", o.MappingReloadInterval, "How often the --mapping-config file is checked for changes, which are applied without a restart. 0 disables reloading.")
+	fs.BoolVar(&o.ProxyResources, "proxy-resources", o.ProxyResources, "Also serve the resources configured by ProxyResource objects in the upstream cluster. Resources of --mapping-config take precedence.")
+	fs.StringVar(&o.UpstreamName, "upstream-name", o.UpstreamName, "Name of the upstream cluster used to label metrics. Defaults to the upstream API server host.")
+	fs.Float32Var(&o.UpstreamQPS, "upstream-qps", o.UpstreamQPS, "Maximum sustained requests per second the proxy sends to the upstream API server.")
+	fs.IntVar(&o.UpstreamBurst, "upstream-burst", o.UpstreamBurst, "Maximum burst of requests the proxy sends to the upstream API server.")
+	fs.DurationVar(&o.UpstreamTimeout, "upstream-timeout", o.UpstreamTimeout, "Timeout for individual requests to the upstream API server, except watches and log streams. 0 means no timeout.")
+	fs.StringVar(&o.ContinueTokenKeyFile, "continue-token-key-file", o.ContinueTokenKeyFile, "File holding the key List continue tokens are signed with. Replicas serving the same API must share it. Defaults to a random key per process.")
+	o.Tracing.AddFlags(fs)
+	o.RateLimit.AddFlags(fs)
 }
 
 func (o ServerOptions) Complete() error {
@@ -90,6 +136,20 @@ func (o ServerOptions) Validate(args []string) error {
 	errs := append([]error{}, o.SecureServing.Validate()...)
 	errs = append(errs, o.Authentication.Validate()...)
 	errs = append(errs, o.Authorization.Validate()...)
+	if o.UpstreamQPS <= 0 {
+		errs = append(errs, fmt.Errorf("--upstream-qps must be positive"))
+	}
+	if o.UpstreamBurst <= 0 {
+		errs = append(errs, fmt.Errorf("--upstream-burst must be positive"))
+	}
+	if o.MappingReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("--mapping-reload-interval must not be negative"))
+	}
+	if o.UpstreamTimeout < 0 {
+		errs = append(errs, fmt.Errorf("--upstream-timeout must not be negative"))
+	}
+	errs = append(errs, o.Tracing.Validate()...)
+	errs = append(errs, o.RateLimit.Validate()...)
 	return utilerrors.NewAggregate(errs)
 }
 
@@ -107,23 +167,68 @@ func (o *ServerOptions) ApplyTo(cfg *genericapiserver.RecommendedConfig) error {
 }
 
 // Config returns config for the api server given ServerOptions
-func (o *ServerOptions) Config() (*apiserver.Config, error) {
+func (o *ServerOptions) Config(stopCh <-chan struct{}) (*apiserver.Config, error) {
 	serverConfig := genericapiserver.NewRecommendedConfig(apiserver.Codecs)
 	if err := o.ApplyTo(serverConfig); err != nil {
 		return nil, err
 	}
+	if err := o.Tracing.ApplyTo(serverConfig, stopCh); err != nil {
+		return nil, err
+	}
+	if err := o.RateLimit.ApplyTo(serverConfig, stopCh); err != nil {
+		return nil, err
+	}
+	if o.ContinueTokenKeyFile != "" {
+		key, err := ioutil.ReadFile(o.ContinueTokenKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key = bytes.TrimSpace(key); len(key) == 0 {
+			return nil, fmt.Errorf("--continue-token-key-file %s is empty", o.ContinueTokenKeyFile)
+		}
+		storage.SetContinueTokenKey(key)
+	}
+	m := mapping.Default()
+	if o.MappingConfig != "" {
+		var err error
+		if m, err = mapping.Load(o.MappingConfig); err != nil {
+			return nil, err
+		}
+	}
 	config := &apiserver.Config{
 		GenericConfig: serverConfig,
 		ExtraConfig: &apiserver.ExtraConfig{
-			Client: dynamic.NewForConfigOrDie(clientconfig.GetConfigOrDie()),
+			Mapping:        m,
+			ProxyResources: o.ProxyResources,
 		},
 	}
+	if !m.UsesUpstream() && !o.ProxyResources {
+		// Everything is served locally, no cluster is needed.
+		return config, nil
+	}
+
+	upstreamConfig := clientconfig.GetConfigOrDie()
+	upstreamConfig.QPS = o.UpstreamQPS
+	upstreamConfig.Burst = o.UpstreamBurst
+	upstreamConfig.Timeout = o.UpstreamTimeout
+	clusterName := o.UpstreamName
+	if clusterName == "" {
+		clusterName = upstreamConfig.Host
+	}
+	upstream, err := storage.NewUpstream(clusterName, upstreamConfig)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Recorder, err = upstream.StartEventRecorder(o.ProcessInfo.Name, stopCh); err != nil {
+		return nil, err
+	}
+	config.ExtraConfig.Upstream = upstream
 	return config, nil
 }
 
 // RunServer starts a new Server given ServerOptions
 func (o ServerOptions) Run(stopCh <-chan struct{}) error {
-	config, err := o.Config()
+	config, err := o.Config(stopCh)
 	if err != nil {
 		return err
 	}
@@ -132,5 +237,8 @@ func (o ServerOptions) Run(stopCh <-chan struct{}) error {
 	if err != nil {
 		return err
 	}
+	if o.MappingConfig != "" && o.MappingReloadInterval > 0 {
+		go server.WatchMapping(o.MappingConfig, o.MappingReloadInterval, stopCh)
+	}
 	return server.GenericAPIServer.PrepareRun().Run(stopCh)
 }
@@ -0,0 +1,123 @@
+package apiserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/maisem/proxy-apiserver/pkg/manifests"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+// ManifestOptions contains the options of the generate-manifests command.
+type ManifestOptions struct {
+	// MappingConfig is the path of the mapping to deploy. The built-in
+	// mapping is used if it is empty.
+	MappingConfig string
+	// CAFile is the path of the PEM encoded CA that signed the serving
+	// certificate of the proxy.
+	CAFile string
+	// ProxyResources is passed on to the proxy as --proxy-resources.
+	ProxyResources bool
+
+	Namespace         string
+	Name              string
+	Image             string
+	ServingCertSecret string
+
+	StdOut io.Writer
+}
+
+// NewManifestOptions returns the default ManifestOptions.
+func NewManifestOptions(out io.Writer) *ManifestOptions {
+	return &ManifestOptions{
+		Namespace:         "proxy",
+		Name:              "proxy-apiserver",
+		Image:             "github.com/maisem/proxy-apiserver",
+		ServingCertSecret: "proxy-apiserver-serving-cert",
+		StdOut:            out,
+	}
+}
+
+// NewCommandGenerateManifests provides a CLI handler printing the manifests
+// deploying the proxy for a mapping.
+func NewCommandGenerateManifests(defaults *ManifestOptions) *cobra.Command {
+	o := *defaults
+	cmd := &cobra.Command{
+		Use:   "generate-manifests",
+		Short: "Print the manifests deploying a proxy API server",
+		Long: "Print the manifests deploying a proxy API server serving --mapping-config: an APIService per served group version, " +
+			"the RBAC the proxy needs in the upstream cluster, viewer, editor and admin roles of the facade resources, " +
+			"and the Deployment running the proxy.",
+		RunE: func(c *cobra.Command, args []string) error {
+			if err := o.Validate(args); err != nil {
+				return err
+			}
+			return o.Run()
+		},
+	}
+	o.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func (o *ManifestOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.MappingConfig, "mapping-config", o.MappingConfig, "Path to the mapping served by the proxy. Defaults to the built-in Deployment mapping.")
+	fs.StringVar(&o.CAFile, "ca-file", o.CAFile, "Path to the PEM encoded CA that signed the serving certificate of the proxy, set as the caBundle of the APIServices.")
+	fs.BoolVar(&o.ProxyResources, "proxy-resources", o.ProxyResources, "Also serve the resources configured by ProxyResource objects in the upstream cluster.")
+	fs.StringVar(&o.Namespace, "namespace", o.Namespace, "Namespace the proxy runs in.")
+	fs.StringVar(&o.Name, "name", o.Name, "Name of the Deployment, Service and ServiceAccount of the proxy, and prefix of its roles.")
+	fs.StringVar(&o.Image, "image", o.Image, "Image of the proxy.")
+	fs.StringVar(&o.ServingCertSecret, "serving-cert-secret", o.ServingCertSecret, "Name of the kubernetes.io/tls Secret holding the serving certificate of the proxy.")
+}
+
+// Validate validates ManifestOptions
+func (o ManifestOptions) Validate(args []string) error {
+	var errs []error
+	if len(args) > 0 {
+		errs = append(errs, fmt.Errorf("unexpected arguments %v", args))
+	}
+	if o.CAFile == "" {
+		errs = append(errs, fmt.Errorf("--ca-file is required"))
+	}
+	for flag, v := range map[string]string{"--namespace": o.Namespace, "--name": o.Name, "--image": o.Image, "--serving-cert-secret": o.ServingCertSecret} {
+		if v == "" {
+			errs = append(errs, fmt.Errorf("%s must not be empty", flag))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Run writes the manifests to StdOut.
+func (o ManifestOptions) Run() error {
+	ca, err := ioutil.ReadFile(o.CAFile)
+	if err != nil {
+		return err
+	}
+	opts := manifests.Options{
+		Namespace:         o.Namespace,
+		Name:              o.Name,
+		Image:             o.Image,
+		CABundle:          ca,
+		ServingCertSecret: o.ServingCertSecret,
+		ProxyResources:    o.ProxyResources,
+	}
+	m := mapping.Default()
+	if o.MappingConfig != "" {
+		if m, err = mapping.Load(o.MappingConfig); err != nil {
+			return err
+		}
+		if opts.Mapping, err = ioutil.ReadFile(o.MappingConfig); err != nil {
+			return err
+		}
+	}
+	objs, err := manifests.Generate(m, opts)
+	if err != nil {
+		return err
+	}
+	return manifests.Write(o.StdOut, objs)
+}
@@ -0,0 +1,100 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+
+	"github.com/maisem/proxy-apiserver/pkg/ratelimit"
+)
+
+// RateLimitOptions configures token-bucket limits on facade requests.
+type RateLimitOptions struct {
+	UserQPS   float64
+	UserBurst int
+	// GroupLimits holds limits shared by all members of a group, in the form
+	// <group>=<qps>:<burst>.
+	GroupLimits []string
+}
+
+// NewRateLimitOptions returns RateLimitOptions with rate limiting disabled.
+func NewRateLimitOptions() *RateLimitOptions {
+	return &RateLimitOptions{
+		UserBurst: 20,
+	}
+}
+
+func (o *RateLimitOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.Float64Var(&o.UserQPS, "rate-limit-user-qps", o.UserQPS, "Sustained facade requests per second allowed for each user. 0 disables per-user limits.")
+	fs.IntVar(&o.UserBurst, "rate-limit-user-burst", o.UserBurst, "Burst of facade requests allowed for each user.")
+	fs.StringSliceVar(&o.GroupLimits, "rate-limit-group", o.GroupLimits, "Facade request limit shared by all members of a group, in the form <group>=<qps>:<burst>. May be repeated.")
+}
+
+func (o *RateLimitOptions) Validate() []error {
+	var errs []error
+	if o.UserQPS < 0 {
+		errs = append(errs, fmt.Errorf("--rate-limit-user-qps must not be negative"))
+	}
+	if o.UserQPS > 0 && o.UserBurst <= 0 {
+		errs = append(errs, fmt.Errorf("--rate-limit-user-burst must be positive"))
+	}
+	if _, err := o.groupLimits(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (o *RateLimitOptions) groupLimits() (map[string]ratelimit.Limit, error) {
+	limits := map[string]ratelimit.Limit{}
+	for _, v := range o.GroupLimits {
+		group, limit, ok := parseGroupLimit(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid --rate-limit-group %q: expected <group>=<qps>:<burst> with positive values", v)
+		}
+		limits[group] = limit
+	}
+	return limits, nil
+}
+
+func parseGroupLimit(v string) (string, ratelimit.Limit, bool) {
+	i := strings.LastIndex(v, "=")
+	if i <= 0 {
+		return "", ratelimit.Limit{}, false
+	}
+	parts := strings.Split(v[i+1:], ":")
+	if len(parts) != 2 {
+		return "", ratelimit.Limit{}, false
+	}
+	qps, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || qps <= 0 {
+		return "", ratelimit.Limit{}, false
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst <= 0 {
+		return "", ratelimit.Limit{}, false
+	}
+	return v[:i], ratelimit.Limit{QPS: qps, Burst: burst}, true
+}
+
+// ApplyTo installs the rate limiting filter in the handler chain of cfg, right
+// after authentication and authorization.
+func (o *RateLimitOptions) ApplyTo(cfg *genericapiserver.RecommendedConfig, stopCh <-chan struct{}) error {
+	groups, err := o.groupLimits()
+	if err != nil {
+		return err
+	}
+	if o.UserQPS == 0 && len(groups) == 0 {
+		return nil
+	}
+	limiter := ratelimit.NewLimiter(ratelimit.Limit{QPS: o.UserQPS, Burst: o.UserBurst}, groups, stopCh)
+	buildHandlerChain := cfg.BuildHandlerChainFunc
+	cfg.BuildHandlerChainFunc = func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		return buildHandlerChain(ratelimit.WithRateLimit(apiHandler, limiter, c.Serializer), c)
+	}
+	return nil
+}
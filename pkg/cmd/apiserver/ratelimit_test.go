@@ -0,0 +1,49 @@
+package apiserver
+
+import (
+	"testing"
+
+	"github.com/maisem/proxy-apiserver/pkg/ratelimit"
+)
+
+func TestParseGroupLimit(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		group string
+		limit ratelimit.Limit
+		ok    bool
+	}{
+		{in: "ci=5:10", group: "ci", limit: ratelimit.Limit{QPS: 5, Burst: 10}, ok: true},
+		{in: "system:serviceaccounts=0.5:1", group: "system:serviceaccounts", limit: ratelimit.Limit{QPS: 0.5, Burst: 1}, ok: true},
+		{in: "a=b=1:2", group: "a=b", limit: ratelimit.Limit{QPS: 1, Burst: 2}, ok: true},
+		{in: "ci"},
+		{in: "=1:2"},
+		{in: "ci=1"},
+		{in: "ci=1:2:3"},
+		{in: "ci=0:2"},
+		{in: "ci=-1:2"},
+		{in: "ci=1:0"},
+		{in: "ci=1:1.5"},
+		{in: "ci=x:2"},
+	} {
+		group, limit, ok := parseGroupLimit(tc.in)
+		if ok != tc.ok || group != tc.group || limit != tc.limit {
+			t.Errorf("parseGroupLimit(%q) = %q, %+v, %v, want %q, %+v, %v", tc.in, group, limit, ok, tc.group, tc.limit, tc.ok)
+		}
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	o := &RateLimitOptions{GroupLimits: []string{"ci=1:2", "ops=3:4"}}
+	limits, err := o.groupLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["ci"] != (ratelimit.Limit{QPS: 1, Burst: 2}) || limits["ops"] != (ratelimit.Limit{QPS: 3, Burst: 4}) {
+		t.Errorf("groupLimits() = %v", limits)
+	}
+	o.GroupLimits = append(o.GroupLimits, "bad")
+	if _, err := o.groupLimits(); err == nil {
+		t.Error("groupLimits() with an invalid limit succeeded")
+	}
+}
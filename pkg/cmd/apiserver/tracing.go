@@ -0,0 +1,64 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/pflag"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+
+	"github.com/maisem/proxy-apiserver/pkg/tracing"
+)
+
+// TracingOptions configures where traces of facade requests are exported.
+type TracingOptions struct {
+	// OTLPEndpoint is the URL of an OTLP/HTTP traces endpoint.
+	OTLPEndpoint string
+	// File is a local file spans are appended to.
+	File        string
+	ServiceName string
+}
+
+// NewTracingOptions returns TracingOptions with tracing disabled.
+func NewTracingOptions() *TracingOptions {
+	return &TracingOptions{
+		ServiceName: "proxy-apiserver",
+	}
+}
+
+func (o *TracingOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.OTLPEndpoint, "tracing-otlp-endpoint", o.OTLPEndpoint, "OTLP/HTTP endpoint traces are exported to, e.g. http://otel-collector:4318/v1/traces. Tracing is disabled unless this or --tracing-file is set.")
+	fs.StringVar(&o.File, "tracing-file", o.File, "File spans are appended to as JSON lines, for local debugging and tests.")
+	fs.StringVar(&o.ServiceName, "tracing-service-name", o.ServiceName, "Service name reported with exported spans.")
+}
+
+func (o *TracingOptions) Validate() []error {
+	if o.OTLPEndpoint != "" && o.File != "" {
+		return []error{fmt.Errorf("--tracing-otlp-endpoint and --tracing-file are mutually exclusive")}
+	}
+	return nil
+}
+
+// ApplyTo installs the tracing filter in the handler chain of cfg.
+func (o *TracingOptions) ApplyTo(cfg *genericapiserver.RecommendedConfig, stopCh <-chan struct{}) error {
+	var exporter tracing.Exporter
+	switch {
+	case o.OTLPEndpoint != "":
+		exporter = tracing.NewOTLPExporter(o.OTLPEndpoint, o.ServiceName)
+	case o.File != "":
+		e, err := tracing.NewFileExporter(o.File)
+		if err != nil {
+			return err
+		}
+		exporter = e
+	default:
+		return nil
+	}
+	tracer := tracing.NewTracer(exporter, stopCh)
+	buildHandlerChain := cfg.BuildHandlerChainFunc
+	cfg.BuildHandlerChainFunc = func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		return tracing.WithTracing(buildHandlerChain(apiHandler, c), tracer)
+	}
+	return nil
+}
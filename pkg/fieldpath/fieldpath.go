@@ -0,0 +1,298 @@
+// Package fieldpath addresses fields of unstructured objects with paths like
+// spec.template.spec.containers[*].env[*].value.
+//
+// A path is a dot separated list of field names. Brackets select list
+// elements by index ([0]) or map entries by key (["app.kubernetes.io/name"]),
+// and [*] selects every element of a list or every entry of a map.
+package fieldpath
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Element is one step of a Path.
+type Element struct {
+	// Key selects a map entry.
+	Key string
+	// Index selects a list element if the element is neither a key nor a
+	// wildcard.
+	Index int
+	// Wildcard selects every list element or map entry.
+	Wildcard bool
+	// isKey distinguishes the key "" from an index.
+	isKey bool
+}
+
+func (e Element) String() string {
+	switch {
+	case e.Wildcard:
+		return "[*]"
+	case !e.isKey:
+		return fmt.Sprintf("[%d]", e.Index)
+	case e.Key != "" && !strings.ContainsAny(e.Key, `.[]"`):
+		return e.Key
+	}
+	return strconv.Quote(e.Key)
+}
+
+// IsIndex reports whether e selects a list element by index.
+func (e Element) IsIndex() bool {
+	return !e.isKey && !e.Wildcard
+}
+
+// Path is a parsed field path.
+type Path []Element
+
+func (p Path) String() string {
+	var b strings.Builder
+	for i, e := range p {
+		s := e.String()
+		switch {
+		case e.Wildcard || !e.isKey:
+		case s[0] == '"':
+			s = "[" + s + "]"
+		case i > 0:
+			b.WriteByte('.')
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// HasWildcard reports whether p selects more than one field.
+func (p Path) HasWildcard() bool {
+	for _, e := range p {
+		if e.Wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// Parent returns p without its last element.
+func (p Path) Parent() Path {
+	if len(p) == 0 {
+		return nil
+	}
+	return p[:len(p)-1]
+}
+
+// quotedPrefix returns the double-quoted string at the start of s, like
+// strconv.QuotedPrefix which is not available in Go 1.12.
+func quotedPrefix(s string) (string, error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			if _, err := strconv.Unquote(s[:i+1]); err != nil {
+				return "", err
+			}
+			return s[:i+1], nil
+		}
+	}
+	return "", strconv.ErrSyntax
+}
+
+// Parse parses a field path.
+func Parse(s string) (Path, error) {
+	var p Path
+	rest := s
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if strings.HasPrefix(rest, `["`) {
+				q, err := quotedPrefix(rest[1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid field path %q: unterminated key", s)
+				}
+				key, _ := strconv.Unquote(q)
+				end = 1 + len(q)
+				if end >= len(rest) || rest[end] != ']' {
+					return nil, fmt.Errorf("invalid field path %q: expected ] after key", s)
+				}
+				p = append(p, Element{Key: key, isKey: true})
+			} else if end < 0 {
+				return nil, fmt.Errorf("invalid field path %q: missing ]", s)
+			} else if sel := rest[1:end]; sel == "*" {
+				p = append(p, Element{Wildcard: true})
+			} else if i, err := strconv.Atoi(sel); err == nil && i >= 0 {
+				p = append(p, Element{Index: i})
+			} else {
+				return nil, fmt.Errorf("invalid field path %q: invalid selector [%s]", s, sel)
+			}
+			rest = rest[end+1:]
+		case rest[0] == '.':
+			if len(p) == 0 || len(rest) == 1 || rest[1] == '.' || rest[1] == '[' {
+				return nil, fmt.Errorf("invalid field path %q: empty field name", s)
+			}
+			rest = rest[1:]
+		default:
+			if len(p) > 0 && s[len(s)-len(rest)-1] != '.' {
+				return nil, fmt.Errorf("invalid field path %q: expected . before %s", s, rest)
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			p = append(p, Element{Key: rest[:end], isKey: true})
+			rest = rest[end:]
+		}
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("empty field path")
+	}
+	return p, nil
+}
+
+// MustParse is like Parse but panics on error.
+func MustParse(s string) Path {
+	p, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Expand returns the paths of the fields of obj selected by p, without
+// wildcards, in a stable order.
+func Expand(obj map[string]interface{}, p Path) []Path {
+	var out []Path
+	expand(obj, p, nil, &out)
+	return out
+}
+
+func expand(v interface{}, p, prefix Path, out *[]Path) {
+	if len(p) == 0 {
+		*out = append(*out, append(Path(nil), prefix...))
+		return
+	}
+	e := p[0]
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if e.Wildcard {
+			for _, k := range sortedKeys(v) {
+				expand(v[k], p[1:], append(prefix, Element{Key: k, isKey: true}), out)
+			}
+		} else if e.isKey {
+			if child, ok := v[e.Key]; ok {
+				expand(child, p[1:], append(prefix, e), out)
+			}
+		}
+	case []interface{}:
+		if e.Wildcard {
+			for i := range v {
+				expand(v[i], p[1:], append(prefix, Element{Index: i}), out)
+			}
+		} else if !e.isKey && e.Index < len(v) {
+			expand(v[e.Index], p[1:], append(prefix, e), out)
+		}
+	}
+}
+
+// Get returns the field of obj at p, which must not contain wildcards.
+func Get(obj map[string]interface{}, p Path) (interface{}, bool) {
+	var v interface{} = obj
+	for _, e := range p {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			if !e.isKey {
+				return nil, false
+			}
+			var ok bool
+			if v, ok = c[e.Key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			if e.isKey || e.Wildcard || e.Index >= len(c) {
+				return nil, false
+			}
+			v = c[e.Index]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Set sets the field of obj at p, which must not contain wildcards. Missing
+// maps along p are created; missing list elements are not.
+func Set(obj map[string]interface{}, p Path, value interface{}) error {
+	parent, last, err := container(obj, p, true)
+	if err != nil {
+		return err
+	}
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		if !last.isKey {
+			return fmt.Errorf("%s: not a list", p[:len(p)-1])
+		}
+		c[last.Key] = value
+	case []interface{}:
+		if last.isKey || last.Wildcard || last.Index >= len(c) {
+			return fmt.Errorf("%s: no such list element", p)
+		}
+		c[last.Index] = value
+	default:
+		return fmt.Errorf("%s: not an object", p[:len(p)-1])
+	}
+	return nil
+}
+
+// Remove deletes the map entry of obj at p, which must not contain wildcards.
+// List elements cannot be removed.
+func Remove(obj map[string]interface{}, p Path) {
+	parent, last, err := container(obj, p, false)
+	if err != nil {
+		return
+	}
+	if m, ok := parent.(map[string]interface{}); ok && last.isKey {
+		delete(m, last.Key)
+	}
+}
+
+// container returns the value holding the last element of p.
+func container(obj map[string]interface{}, p Path, create bool) (interface{}, Element, error) {
+	if len(p) == 0 {
+		return nil, Element{}, fmt.Errorf("empty field path")
+	}
+	var v interface{} = obj
+	for i, e := range p[:len(p)-1] {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			if !e.isKey {
+				return nil, Element{}, fmt.Errorf("%s: not a list", p[:i])
+			}
+			child, ok := c[e.Key]
+			if !ok || child == nil {
+				if !create {
+					return nil, Element{}, fmt.Errorf("%s: not found", p[:i+1])
+				}
+				child = map[string]interface{}{}
+				c[e.Key] = child
+			}
+			v = child
+		case []interface{}:
+			if e.isKey || e.Wildcard || e.Index >= len(c) {
+				return nil, Element{}, fmt.Errorf("%s: no such list element", p[:i+1])
+			}
+			v = c[e.Index]
+		default:
+			return nil, Element{}, fmt.Errorf("%s: not an object", p[:i])
+		}
+	}
+	return v, p[len(p)-1], nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
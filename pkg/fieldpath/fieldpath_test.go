@@ -0,0 +1,73 @@
+package fieldpath
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]string{
+		"spec.replicas":                   "spec.replicas",
+		"spec.containers[*].env[0].value": "spec.containers[*].env[0].value",
+		`metadata.annotations["a.b/c"]`:   `metadata.annotations["a.b/c"]`,
+		`metadata.labels["team"]`:         "metadata.labels.team",
+		`metadata.annotations[*]`:         "metadata.annotations[*]",
+		`metadata.annotations["a\"]"]`:    `metadata.annotations["a\"]"]`,
+	} {
+		p, err := Parse(in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", in, err)
+			continue
+		}
+		if got := p.String(); got != want {
+			t.Errorf("Parse(%q).String() = %q, want %q", in, got, want)
+		}
+	}
+	for _, in := range []string{"", ".spec", "spec.", "spec..a", "spec[", "spec[x]", "spec[-1]", `spec["a`, `spec["a\"]`, `spec["\q"]`, "spec[0]a"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	obj := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"env": []interface{}{
+					map[string]interface{}{"name": "A", "value": "1"},
+					map[string]interface{}{"name": "B"},
+				}},
+				map[string]interface{}{"env": []interface{}{
+					map[string]interface{}{"name": "C", "value": "3"},
+				}},
+			},
+		},
+	}
+	var got []string
+	for _, p := range Expand(obj, MustParse("spec.containers[*].env[*].value")) {
+		got = append(got, p.String())
+	}
+	want := []string{"spec.containers[0].env[0].value", "spec.containers[1].env[0].value"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand() = %v, want %v", got, want)
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	obj := map[string]interface{}{}
+	p := MustParse(`metadata.annotations["a.b/c"]`)
+	if err := Set(obj, p, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := Get(obj, p); !ok || v != "x" {
+		t.Errorf("Get() = %v, %v after Set", v, ok)
+	}
+	Remove(obj, p)
+	if _, ok := Get(obj, p); ok {
+		t.Error("field still set after Remove")
+	}
+	if err := Set(obj, MustParse("spec.items[0]"), "x"); err == nil {
+		t.Error("Set of a missing list element succeeded")
+	}
+}
@@ -0,0 +1,149 @@
+// Package health implements health checks of the upstream cluster, so that
+// the proxy reports itself unhealthy when it cannot serve its resources.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Resource is an upstream resource and the verbs the proxy uses on it.
+type Resource struct {
+	schema.GroupVersionResource
+	// Subresource is checked in permissions only.
+	Subresource string
+	Verbs       []string
+}
+
+func (r Resource) String() string {
+	s := r.Resource
+	if r.Subresource != "" {
+		s += "/" + r.Subresource
+	}
+	return schema.GroupResource{Group: r.Group, Resource: s}.String()
+}
+
+// CacheInterval is how long the resources and permissions checks are
+// considered passing after they passed, as they take several upstream
+// requests each. Failures are not cached so that readiness recovers as soon
+// as the upstream does.
+const CacheInterval = time.Minute
+
+// Connectivity returns the "upstream" check, which fails if the upstream API
+// server cannot be reached.
+func Connectivity(client kubernetes.Interface) healthz.HealthzChecker {
+	return healthz.NamedCheck("upstream", func(*http.Request) error {
+		if _, err := client.Discovery().ServerVersion(); err != nil {
+			return fmt.Errorf("upstream API server is unreachable: %v", err)
+		}
+		return nil
+	})
+}
+
+// Resources returns the "upstream-resources" check, which fails if any of
+// the resources returned by resources is missing from upstream discovery.
+func Resources(client kubernetes.Interface, resources func() []Resource) healthz.HealthzChecker {
+	return cached("upstream-resources", func() error {
+		byGV := map[schema.GroupVersion][]Resource{}
+		for _, r := range resources() {
+			byGV[r.GroupVersion()] = append(byGV[r.GroupVersion()], r)
+		}
+		missing := sets.NewString()
+		for gv, rs := range byGV {
+			l, err := client.Discovery().ServerResourcesForGroupVersion(gv.String())
+			if err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("unable to discover %s: %v", gv, err)
+			}
+			served := map[string]bool{}
+			if l != nil {
+				for _, ar := range l.APIResources {
+					served[ar.Name] = true
+				}
+			}
+			for _, r := range rs {
+				if !served[r.Resource] {
+					missing.Insert(r.GroupVersionResource.String())
+				}
+			}
+		}
+		if missing.Len() > 0 {
+			return fmt.Errorf("missing upstream resources: %s", strings.Join(missing.List(), "; "))
+		}
+		return nil
+	})
+}
+
+// Permissions returns the "upstream-permissions" check, which fails if the
+// proxy may not use any of the verbs of the resources returned by resources
+// upstream.
+func Permissions(client kubernetes.Interface, resources func() []Resource) healthz.HealthzChecker {
+	return cached("upstream-permissions", func() error {
+		var denied []string
+		for _, r := range resources() {
+			for _, verb := range r.Verbs {
+				review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+						ResourceAttributes: &authorizationv1.ResourceAttributes{
+							Verb:        verb,
+							Group:       r.Group,
+							Version:     r.Version,
+							Resource:    r.Resource,
+							Subresource: r.Subresource,
+						},
+					},
+				})
+				if err != nil {
+					return fmt.Errorf("unable to review access to %s: %v", r, err)
+				}
+				if !review.Status.Allowed {
+					denied = append(denied, verb+" "+r.String())
+				}
+			}
+		}
+		if len(denied) > 0 {
+			return fmt.Errorf("missing upstream permissions: %s", strings.Join(denied, ", "))
+		}
+		return nil
+	})
+}
+
+// cachedCheck runs check at most once per CacheInterval while it passes.
+type cachedCheck struct {
+	name  string
+	check func() error
+
+	mu sync.Mutex
+	// passed is when check last passed.
+	passed time.Time
+}
+
+func cached(name string, check func() error) healthz.HealthzChecker {
+	return &cachedCheck{name: name, check: check}
+}
+
+func (c *cachedCheck) Name() string {
+	return c.name
+}
+
+func (c *cachedCheck) Check(*http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.passed.IsZero() && time.Since(c.passed) < CacheInterval {
+		return nil
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
+	c.passed = time.Now()
+	return nil
+}
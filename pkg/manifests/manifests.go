@@ -0,0 +1,341 @@
+// Package manifests generates the manifests deploying the proxy for a
+// mapping: its APIServices, the RBAC it needs in the upstream cluster, the
+// roles of the facade resources and the Deployment running it.
+package manifests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+
+	"github.com/maisem/proxy-apiserver/pkg/apiserver"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+const (
+	// mappingDir and servingCertDir are where the mapping and the serving
+	// certificate are mounted in the proxy container.
+	mappingDir     = "/etc/proxy-apiserver"
+	mappingFile    = "mapping.yaml"
+	servingCertDir = "/var/run/proxy-apiserver/serving-cert"
+
+	// groupPriorityMinimum ranks the facade groups after the built-in ones.
+	groupPriorityMinimum = 1000
+)
+
+// Options configures the generated manifests.
+type Options struct {
+	// Namespace the proxy runs in.
+	Namespace string
+	// Name of the Deployment, Service and ServiceAccount of the proxy, and
+	// prefix of the other objects.
+	Name string
+	// Image of the proxy container.
+	Image string
+	// CABundle is the PEM encoded CA the upstream API server verifies the
+	// serving certificate of the proxy with.
+	CABundle []byte
+	// ServingCertSecret is the name of the kubernetes.io/tls Secret holding
+	// the serving certificate of the proxy.
+	ServingCertSecret string
+	// Mapping is the mapping file, stored in a ConfigMap. The built-in
+	// mapping is used if it is empty.
+	Mapping []byte
+	// ProxyResources is whether the proxy serves the resources of
+	// ProxyResources. Their groups are not known in advance, so they get no
+	// APIServices or facade roles.
+	ProxyResources bool
+}
+
+// Generate returns the manifests deploying the proxy serving m.
+func Generate(m *mapping.Config, o Options) ([]runtime.Object, error) {
+	if len(o.CABundle) == 0 {
+		return nil, fmt.Errorf("a CA bundle is required")
+	}
+	objs := []runtime.Object{
+		&corev1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Namespace},
+		},
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: o.meta(o.Name),
+		},
+	}
+	objs = append(objs, o.upstreamRBAC(m)...)
+	objs = append(objs, facadeRoles(m, o.Name)...)
+	if len(o.Mapping) > 0 {
+		objs = append(objs, &corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: o.meta(o.Name + "-mapping"),
+			Data:       map[string]string{mappingFile: string(o.Mapping)},
+		})
+	}
+	objs = append(objs, o.service(), o.deployment())
+	for _, group := range m.Groups() {
+		versions := apiserver.PrioritizedVersions(m, group)
+		for i, gv := range versions {
+			// Earlier versions are preferred.
+			objs = append(objs, o.apiService(gv.Group, gv.Version, 15+10*(len(versions)-1-i)))
+		}
+	}
+	return objs, nil
+}
+
+func (o Options) meta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: o.Namespace, Labels: o.labels()}
+}
+
+func (o Options) labels() map[string]string {
+	return map[string]string{"app": o.Name}
+}
+
+func (o Options) subjects() []rbacv1.Subject {
+	return []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: o.Name, Namespace: o.Namespace}}
+}
+
+func (o Options) clusterRoleBinding(name, role string) *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: role},
+		Subjects:   o.subjects(),
+	}
+}
+
+// upstreamRBAC returns the roles of the proxy in the upstream cluster:
+// delegated authentication and authorization, and exactly the verbs it uses
+// on the upstream resources of m.
+func (o Options) upstreamRBAC(m *mapping.Config) []runtime.Object {
+	var rules []rbacv1.PolicyRule
+	// Events are recorded whenever the upstream cluster is used.
+	for _, r := range apiserver.UpstreamResources(m, true, o.ProxyResources) {
+		resource := r.Resource
+		if r.Subresource != "" {
+			resource += "/" + r.Subresource
+		}
+		rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{r.Group}, Resources: []string{resource}, Verbs: r.Verbs})
+	}
+	upstream := o.Name + ":upstream"
+	return []runtime.Object{
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: upstream, Labels: o.labels()},
+			Rules:      rules,
+		},
+		o.clusterRoleBinding(upstream, upstream),
+		o.clusterRoleBinding(o.Name+":system:auth-delegator", "system:auth-delegator"),
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name + "-auth-reader", Namespace: metav1.NamespaceSystem},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "extension-apiserver-authentication-reader"},
+			Subjects:   o.subjects(),
+		},
+	}
+}
+
+// facadeRoles returns the viewer, editor and admin ClusterRoles of the
+// facade resources of m, aggregated to the view, edit and admin roles of the
+// cluster. Viewers read objects and logs, editors also write objects and run
+// actions, admins also delete collections.
+func facadeRoles(m *mapping.Config, name string) []runtime.Object {
+	type role struct {
+		name, aggregateTo string
+		verbs             map[string]sets.String
+	}
+	roles := []*role{
+		{name: "viewer", aggregateTo: "view"},
+		{name: "editor", aggregateTo: "edit"},
+		{name: "admin", aggregateTo: "admin"},
+	}
+	for _, r := range roles {
+		r.verbs = map[string]sets.String{}
+	}
+	// add grants verbs on the resource of group to the roles from the one at
+	// index from.
+	add := func(from int, group, resource string, verbs ...string) {
+		for _, r := range roles[from:] {
+			k := group + "/" + resource
+			if r.verbs[k] == nil {
+				r.verbs[k] = sets.NewString()
+			}
+			r.verbs[k].Insert(verbs...)
+		}
+	}
+	for _, res := range m.Resources {
+		group, resource := res.External.Group, res.External.Resource
+		add(0, group, resource, "get", "list", "watch")
+		if res.Logs {
+			add(0, group, resource+"/logs", "get")
+		}
+		if res.Backend.Composite != nil {
+			// Composite resources are read-only.
+			continue
+		}
+		add(1, group, resource, "create", "update", "patch", "delete")
+		for _, a := range res.Actions {
+			add(1, group, resource+"/"+a, "create")
+		}
+		add(2, group, resource, "deletecollection")
+	}
+
+	var out []runtime.Object
+	for _, r := range roles {
+		var keys []string
+		for k := range r.verbs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var rules []rbacv1.PolicyRule
+		for _, k := range keys {
+			i := strings.Index(k, "/")
+			rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{k[:i]}, Resources: []string{k[i+1:]}, Verbs: r.verbs[k].List()})
+		}
+		out = append(out, &rbacv1.ClusterRole{
+			TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name + ":" + r.name,
+				Labels: map[string]string{"rbac.authorization.k8s.io/aggregate-to-" + r.aggregateTo: "true"},
+			},
+			Rules: rules,
+		})
+	}
+	return out
+}
+
+func (o Options) service() *corev1.Service {
+	return &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: o.meta(o.Name),
+		Spec: corev1.ServiceSpec{
+			Selector: o.labels(),
+			Ports:    []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt(443)}},
+		},
+	}
+}
+
+func (o Options) deployment() *appsv1.Deployment {
+	replicas := int32(1)
+	args := []string{
+		"--tls-cert-file=" + servingCertDir + "/" + corev1.TLSCertKey,
+		"--tls-private-key-file=" + servingCertDir + "/" + corev1.TLSPrivateKeyKey,
+	}
+	mounts := []corev1.VolumeMount{{Name: "serving-cert", MountPath: servingCertDir, ReadOnly: true}}
+	volumes := []corev1.Volume{{Name: "serving-cert", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: o.ServingCertSecret}}}}
+	if len(o.Mapping) > 0 {
+		args = append(args, "--mapping-config="+mappingDir+"/"+mappingFile)
+		mounts = append(mounts, corev1.VolumeMount{Name: "mapping", MountPath: mappingDir, ReadOnly: true})
+		volumes = append(volumes, corev1.Volume{Name: "mapping", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: o.Name + "-mapping"},
+		}}})
+	}
+	if o.ProxyResources {
+		args = append(args, "--proxy-resources")
+	}
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+		ObjectMeta: o.meta(o.Name),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: o.labels()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: o.labels()},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: o.Name,
+					Containers: []corev1.Container{{
+						Name:         "proxy-apiserver",
+						Image:        o.Image,
+						Args:         args,
+						Ports:        []corev1.ContainerPort{{ContainerPort: 443}},
+						VolumeMounts: mounts,
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// apiService returns the APIService of a facade group version. The
+// apiregistration types are not vendored, so it is unstructured.
+func (o Options) apiService(group, version string, versionPriority int) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiregistration.k8s.io/v1",
+		"kind":       "APIService",
+		"metadata": map[string]interface{}{
+			"name":   version + "." + group,
+			"labels": map[string]interface{}{"app": o.Name},
+		},
+		"spec": map[string]interface{}{
+			"group":                group,
+			"version":              version,
+			"groupPriorityMinimum": int64(groupPriorityMinimum),
+			"versionPriority":      int64(versionPriority),
+			"caBundle":             base64.StdEncoding.EncodeToString(o.CABundle),
+			"service":              map[string]interface{}{"name": o.Name, "namespace": o.Namespace},
+		},
+	}}
+}
+
+// Write writes objs to w as a multi-document YAML stream, leaving out the
+// unset fields of typed objects, like their creation timestamps and statuses.
+func Write(w io.Writer, objs []runtime.Object) error {
+	var buf bytes.Buffer
+	for i, obj := range objs {
+		var content map[string]interface{}
+		if u, ok := obj.(runtime.Unstructured); ok {
+			content = u.UnstructuredContent()
+		} else {
+			var err error
+			if content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+				return err
+			}
+		}
+		b, err := yaml.Marshal(pruned(content))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(b)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// pruned returns v without null values and empty objects.
+func pruned(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range v {
+			e = pruned(e)
+			if m, ok := e.(map[string]interface{}); e == nil || ok && len(m) == 0 {
+				continue
+			}
+			out[k] = e
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = pruned(e)
+		}
+		return out
+	}
+	return v
+}
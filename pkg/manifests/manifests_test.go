@@ -0,0 +1,137 @@
+package manifests
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+var options = Options{
+	Namespace:         "proxy",
+	Name:              "proxy-apiserver",
+	Image:             "proxy-apiserver:latest",
+	CABundle:          []byte("ca"),
+	ServingCertSecret: "serving-cert",
+	Mapping:           []byte("resources: []\n"),
+}
+
+func testMapping() *mapping.Config {
+	m := mapping.Default()
+	m.Resources[0].Actions = []string{"restart", "rollback"}
+	m.Resources[0].Logs = true
+	v2 := m.Resources[0]
+	v2.External.Version = "v2"
+	m.Resources = append(m.Resources, v2, mapping.Resource{
+		External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Note", Resource: "notes"},
+		Backend:  mapping.Backend{File: &mapping.FileBackend{Directory: "/var/lib/notes"}},
+	})
+	m.DeprecatedVersions = []mapping.VersionDeprecation{{Group: "apps.maisem.dev", Version: "v1"}}
+	return m
+}
+
+// rules formats the rules of the ClusterRole name in objs as
+// group/resource=verbs.
+func rules(t *testing.T, objs []runtime.Object, name string) []string {
+	t.Helper()
+	for _, obj := range objs {
+		if r, ok := obj.(*rbacv1.ClusterRole); ok && r.Name == name {
+			var out []string
+			for _, rule := range r.Rules {
+				out = append(out, fmt.Sprintf("%s/%s=%s", strings.Join(rule.APIGroups, ","), strings.Join(rule.Resources, ","), strings.Join(rule.Verbs, ",")))
+			}
+			return out
+		}
+	}
+	t.Fatalf("no ClusterRole %s", name)
+	return nil
+}
+
+func TestGenerate(t *testing.T) {
+	objs, err := Generate(testMapping(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiServices := map[string]int64{}
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok && u.GetKind() == "APIService" {
+			priority, _, _ := unstructured.NestedInt64(u.Object, "spec", "versionPriority")
+			apiServices[u.GetName()] = priority
+			if ca, _, _ := unstructured.NestedString(u.Object, "spec", "caBundle"); ca != "Y2E=" {
+				t.Errorf("caBundle of %s = %q", u.GetName(), ca)
+			}
+		}
+	}
+	if want := "map[v1.apps.maisem.dev:15 v1.notes.maisem.dev:15 v2.apps.maisem.dev:25]"; fmt.Sprint(apiServices) != want {
+		t.Errorf("APIServices = %v, want %s", apiServices, want)
+	}
+
+	for name, want := range map[string][]string{
+		"proxy-apiserver:upstream": {
+			"apps/deployments=create,delete,deletecollection,get,list,patch,update,watch",
+			"/events=create,patch",
+			"/pods=list",
+			"/pods/log=get",
+			"apps/replicasets=list",
+		},
+		"proxy-apiserver:viewer": {
+			"apps.maisem.dev/deployments=get,list,watch",
+			"apps.maisem.dev/deployments/logs=get",
+			"notes.maisem.dev/notes=get,list,watch",
+		},
+		"proxy-apiserver:editor": {
+			"apps.maisem.dev/deployments=create,delete,get,list,patch,update,watch",
+			"apps.maisem.dev/deployments/logs=get",
+			"apps.maisem.dev/deployments/restart=create",
+			"apps.maisem.dev/deployments/rollback=create",
+			"notes.maisem.dev/notes=create,delete,get,list,patch,update,watch",
+		},
+		"proxy-apiserver:admin": {
+			"apps.maisem.dev/deployments=create,delete,deletecollection,get,list,patch,update,watch",
+			"apps.maisem.dev/deployments/logs=get",
+			"apps.maisem.dev/deployments/restart=create",
+			"apps.maisem.dev/deployments/rollback=create",
+			"notes.maisem.dev/notes=create,delete,deletecollection,get,list,patch,update,watch",
+		},
+	} {
+		if got := rules(t, objs, name); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("rules of %s =\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	if _, err := Generate(testMapping(), Options{Namespace: "proxy", Name: "proxy-apiserver"}); err == nil {
+		t.Error("Generate() without a CA bundle succeeded")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	objs, err := Generate(testMapping(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, objs); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if docs := strings.Count(out, "---\n") + 1; docs != len(objs) {
+		t.Errorf("wrote %d documents, want %d", docs, len(objs))
+	}
+	for _, unset := range []string{"null", "{}", "creationTimestamp"} {
+		if strings.Contains(out, unset) {
+			t.Errorf("manifests contain %s:\n%s", unset, out)
+		}
+	}
+	for _, want := range []string{"--mapping-config=/etc/proxy-apiserver/mapping.yaml", "mapping.yaml: |\n    resources: []\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("manifests do not contain %q", want)
+		}
+	}
+}
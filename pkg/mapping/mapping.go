@@ -0,0 +1,567 @@
+// Package mapping describes which facade resources the proxy serves and where
+// each of them is stored.
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+// Config lists the resources served by the proxy.
+type Config struct {
+	Resources []Resource `json:"resources"`
+	// DeprecatedVersions deprecates all resources of external versions.
+	// The deprecation of a resource takes precedence.
+	DeprecatedVersions []VersionDeprecation `json:"deprecatedVersions,omitempty"`
+}
+
+// GroupVersionKindResource identifies a kind and the resource it is served
+// as.
+type GroupVersionKindResource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Kind     string `json:"kind"`
+	Resource string `json:"resource"`
+}
+
+func (r GroupVersionKindResource) GroupVersion() schema.GroupVersion {
+	return schema.GroupVersion{Group: r.Group, Version: r.Version}
+}
+
+func (r GroupVersionKindResource) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+}
+
+func (r GroupVersionKindResource) String() string {
+	return r.GroupVersionResource().String()
+}
+
+// Resource maps one external resource served by the proxy to its backend.
+type Resource struct {
+	// External is the resource as seen by facade clients.
+	External GroupVersionKindResource `json:"external"`
+	// Internal is the upstream resource the external one is proxied to. It is
+	// ignored by backends that do not talk to the upstream cluster.
+	Internal GroupVersionKindResource `json:"internal,omitempty"`
+	// ClusterScoped is set for resources that do not live in a namespace.
+	ClusterScoped bool     `json:"clusterScoped,omitempty"`
+	ShortNames    []string `json:"shortNames,omitempty"`
+	Categories    []string `json:"categories,omitempty"`
+	// Backend selects where objects are stored. The upstream cluster is used
+	// if it is empty.
+	Backend Backend `json:"backend,omitempty"`
+	// Redact hides fields of upstream objects from facade clients. Only
+	// supported for upstream resources.
+	Redact []Redaction `json:"redact,omitempty"`
+	// FieldAccess restricts who may read or change fields of facade
+	// objects. Only supported for upstream resources.
+	FieldAccess []FieldAccess `json:"fieldAccess,omitempty"`
+	// Defaults are set on objects created, and optionally updated, by
+	// facade clients if absent. Only supported for upstream resources.
+	Defaults []FieldDefault `json:"defaults,omitempty"`
+	// Immutable lists field paths that may not change after creation, e.g.
+	// spec.selector or metadata.labels.team. Only supported for upstream
+	// resources.
+	Immutable []string `json:"immutable,omitempty"`
+	// Quota limits the objects per tenant. Only supported for upstream
+	// resources.
+	Quota *Quota `json:"quota,omitempty"`
+	// Actions lists the action subresources to serve, out of restart,
+	// pause, resume and rollback. Only supported for upstream resources
+	// proxied to Deployments.
+	Actions []string `json:"actions,omitempty"`
+	// Logs serves a logs subresource streaming the logs of the upstream pods
+	// selected by spec.selector. Only supported for upstream resources.
+	Logs bool `json:"logs,omitempty"`
+	// Deprecation marks the resource as deprecated. It is still served,
+	// with warnings to its clients.
+	Deprecation *Deprecation `json:"deprecation,omitempty"`
+}
+
+// DateFormat is the format of the dates in the mapping.
+const DateFormat = "2006-01-02"
+
+// Deprecation describes how a resource is phased out, e.g.
+//
+//   replacement: apps.maisem.dev/v2 Deployment
+//   removal: "2020-06-30"
+type Deprecation struct {
+	// Replacement names what clients should use instead.
+	Replacement string `json:"replacement,omitempty"`
+	// Removal is the date, formatted as DateFormat, after which the
+	// resource may no longer be served.
+	Removal string `json:"removal,omitempty"`
+	// Message is added to the warnings, e.g. a link to a migration guide.
+	Message string `json:"message,omitempty"`
+}
+
+// RemovalTime returns the parsed Removal, or the zero time if it is unset.
+func (d Deprecation) RemovalTime() (time.Time, error) {
+	if d.Removal == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(DateFormat, d.Removal)
+}
+
+// VersionDeprecation deprecates the resources of an external version.
+type VersionDeprecation struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Deprecation
+}
+
+// DeprecationOf returns the deprecation of r, or nil if it is not
+// deprecated.
+func (c *Config) DeprecationOf(r Resource) *Deprecation {
+	if r.Deprecation != nil {
+		return r.Deprecation
+	}
+	for i, d := range c.DeprecatedVersions {
+		if d.Group == r.External.Group && d.Version == r.External.Version {
+			return &c.DeprecatedVersions[i].Deprecation
+		}
+	}
+	return nil
+}
+
+// Quota limits the objects of a resource per tenant, e.g. at most 20
+// objects and 50 replicas per namespace:
+//
+//   maxObjects: 20
+//   sums:
+//   - path: spec.replicas
+//     max: 50
+type Quota struct {
+	// TenantLabel groups objects into tenants by the value of this label;
+	// objects without it are not limited. Objects are grouped by namespace
+	// if it is empty.
+	TenantLabel string `json:"tenantLabel,omitempty"`
+	// MaxObjects limits the number of objects per tenant.
+	MaxObjects int64 `json:"maxObjects,omitempty"`
+	// Sums limit the sums of numeric fields over the objects of a tenant.
+	Sums []QuotaSum `json:"sums,omitempty"`
+}
+
+// QuotaSum limits the sum of the numeric fields at Path. Absent fields count
+// as 0 even where upstream defaults them, as it does spec.replicas of a
+// Deployment to 1; a FieldDefault for Path makes them count.
+type QuotaSum struct {
+	Path string `json:"path"`
+	Max  int64  `json:"max"`
+}
+
+// FieldDefault sets the fields at Path to Value if they are absent, e.g.
+//
+//   - path: spec.template.spec.containers[*].resources.requests.cpu
+//     value: 100m
+//   - path: metadata.labels.team
+//     value: unknown
+//     onUpdate: true
+//
+// Maps missing after the last wildcard of Path are created.
+type FieldDefault struct {
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+	// OnUpdate also applies the default on updates.
+	OnUpdate bool `json:"onUpdate,omitempty"`
+}
+
+// DecodedValue returns Value decoded with numbers as int64 or float64, the
+// way they are represented in unstructured objects.
+func (d FieldDefault) DecodedValue() (interface{}, error) {
+	var v []interface{}
+	if err := utiljson.Unmarshal(append(append([]byte("["), d.Value...), ']'), &v); err != nil {
+		return nil, err
+	}
+	if len(v) != 1 || v[0] == nil {
+		return nil, fmt.Errorf("value is required")
+	}
+	return v[0], nil
+}
+
+// Redaction hides the fields at Path, e.g.
+// spec.template.spec.containers[*].env[*].value or
+// metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"].
+// See package fieldpath for the syntax.
+type Redaction struct {
+	Path string `json:"path"`
+	// Action is either "mask", the default, which replaces the value, or
+	// "remove", which removes the field.
+	Action string `json:"action,omitempty"`
+}
+
+// FieldAccess restricts access to the fields at Path to some users and
+// groups, e.g. only sre may set spec.replicas above 10:
+//
+//   - path: spec.replicas
+//     writers: {groups: [sre]}
+//     above: 10
+type FieldAccess struct {
+	Path string `json:"path"`
+	// Readers may see the fields, which are removed for everyone else.
+	// Everyone may see them if unset.
+	Readers *Subjects `json:"readers,omitempty"`
+	// Writers may set or change the fields. Everyone may if unset.
+	Writers *Subjects `json:"writers,omitempty"`
+	// Above, if set, only restricts values above it to Writers.
+	Above *int64 `json:"above,omitempty"`
+}
+
+// Subjects lists users and groups.
+type Subjects struct {
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Backend selects the storage of a resource. At most one field may be set.
+type Backend struct {
+	File      *FileBackend      `json:"file,omitempty"`
+	Git       *GitBackend       `json:"git,omitempty"`
+	Composite *CompositeBackend `json:"composite,omitempty"`
+	Template  *TemplateBackend  `json:"template,omitempty"`
+}
+
+// Upstream reports whether objects are stored upstream as the Internal
+// resource.
+func (b Backend) Upstream() bool {
+	return b.File == nil && b.Git == nil && b.Composite == nil && b.Template == nil
+}
+
+// count returns the number of backends set.
+func (b Backend) count() int {
+	n := 0
+	if b.File != nil {
+		n++
+	}
+	if b.Git != nil {
+		n++
+	}
+	if b.Composite != nil {
+		n++
+	}
+	if b.Template != nil {
+		n++
+	}
+	return n
+}
+
+// FileBackend stores objects as YAML files below Directory, laid out as
+// <group>/<resource>/[<namespace>/]<name>.yaml.
+type FileBackend struct {
+	Directory string `json:"directory"`
+}
+
+// GitBackend stores objects like FileBackend in the git repository at
+// Directory, committing every change. The repository is created if needed.
+type GitBackend struct {
+	Directory string `json:"directory"`
+}
+
+// CompositeBackend serves a read-only resource whose objects are assembled
+// from upstream objects of several resources that share the same value for
+// Label, e.g. an Application made of a Deployment, a Service and a
+// ConfigMap. The label value is the name of the composite object.
+type CompositeBackend struct {
+	Label string          `json:"label"`
+	Parts []CompositePart `json:"parts"`
+}
+
+// CompositePart is one of the upstream resources of a composite resource.
+type CompositePart struct {
+	// Name identifies the part in the composite object.
+	Name     string                   `json:"name"`
+	Resource GroupVersionKindResource `json:"resource"`
+}
+
+// TemplateBackend serves a resource whose objects are expanded into one
+// upstream object per child, e.g. a WebApp made of a Deployment, a Service
+// and a HorizontalPodAutoscaler. The children carry owner labels so that
+// updates reconcile them and deletes remove all of them.
+type TemplateBackend struct {
+	Children []TemplateChild `json:"children"`
+}
+
+// TemplateChild is one upstream object of a template-expanded resource.
+type TemplateChild struct {
+	Resource GroupVersionKindResource `json:"resource"`
+	// Template is a Go text/template producing the child as YAML, executed
+	// with the facade object as data. The value of every action is written
+	// as JSON, so an action must make up a whole YAML scalar. The child is
+	// skipped if the output is empty.
+	Template string `json:"template"`
+}
+
+// Default returns the mapping used when no configuration file is given.
+func Default() *Config {
+	return &Config{
+		Resources: []Resource{{
+			External: GroupVersionKindResource{
+				Group:    "apps.maisem.dev",
+				Version:  "v1",
+				Kind:     "Deployment",
+				Resource: "deployments",
+			},
+			Internal: GroupVersionKindResource{
+				Group:    "apps",
+				Version:  "v1",
+				Kind:     "Deployment",
+				Resource: "deployments",
+			},
+			ShortNames: []string{"mdep"},
+			Categories: []string{"all"},
+		}},
+	}
+}
+
+// Load reads and validates the mapping in the YAML or JSON file at path.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse mapping %s: %v", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks that every resource is fully specified and served once.
+func (c *Config) Validate() error {
+	if len(c.Resources) == 0 {
+		return fmt.Errorf("no resources")
+	}
+	seen := map[schema.GroupVersionResource]bool{}
+	for i, r := range c.Resources {
+		if err := validateGVKR(r.External); err != nil {
+			return fmt.Errorf("resources[%d].external: %v", i, err)
+		}
+		gvr := r.External.GroupVersionResource()
+		if seen[gvr] {
+			return fmt.Errorf("resources[%d]: %s is mapped more than once", i, gvr)
+		}
+		seen[gvr] = true
+		if err := validatePolicy(r); err != nil {
+			return fmt.Errorf("resources[%d].%v", i, err)
+		}
+		if d := r.Deprecation; d != nil {
+			if _, err := d.RemovalTime(); err != nil {
+				return fmt.Errorf("resources[%d].deprecation.removal must be formatted as %s", i, DateFormat)
+			}
+		}
+		switch b := r.Backend; {
+		case b.count() > 1:
+			return fmt.Errorf("resources[%d].backend: only one of file, git, composite and template may be set", i)
+		case b.File != nil && b.File.Directory == "":
+			return fmt.Errorf("resources[%d].backend.file.directory is required", i)
+		case b.Git != nil && b.Git.Directory == "":
+			return fmt.Errorf("resources[%d].backend.git.directory is required", i)
+		case b.Composite != nil:
+			if err := validateComposite(b.Composite); err != nil {
+				return fmt.Errorf("resources[%d].backend.composite: %v", i, err)
+			}
+			continue
+		case b.Template != nil:
+			if err := validateTemplate(b.Template); err != nil {
+				return fmt.Errorf("resources[%d].backend.template: %v", i, err)
+			}
+			continue
+		case !b.Upstream():
+			continue
+		}
+		if err := validateGVKR(r.Internal); err != nil {
+			return fmt.Errorf("resources[%d].internal: %v", i, err)
+		}
+	}
+	versions := map[schema.GroupVersion]bool{}
+	for i, d := range c.DeprecatedVersions {
+		gv := schema.GroupVersion{Group: d.Group, Version: d.Version}
+		if versions[gv] {
+			return fmt.Errorf("deprecatedVersions[%d]: %s is listed more than once", i, gv)
+		}
+		versions[gv] = true
+		served := false
+		for _, r := range c.Resources {
+			served = served || r.External.GroupVersion() == gv
+		}
+		if !served {
+			return fmt.Errorf("deprecatedVersions[%d]: no resource of %s is served", i, gv)
+		}
+		if _, err := d.RemovalTime(); err != nil {
+			return fmt.Errorf("deprecatedVersions[%d].removal must be formatted as %s", i, DateFormat)
+		}
+	}
+	return nil
+}
+
+// validatePolicy checks the rules the proxy enforces on top of upstream.
+func validatePolicy(r Resource) error {
+	if len(r.Redact) > 0 && !r.Backend.Upstream() {
+		return fmt.Errorf("redact is only supported for upstream resources")
+	}
+	if len(r.FieldAccess) > 0 && !r.Backend.Upstream() {
+		return fmt.Errorf("fieldAccess is only supported for upstream resources")
+	}
+	for j, fa := range r.FieldAccess {
+		if _, err := fieldpath.Parse(fa.Path); err != nil {
+			return fmt.Errorf("fieldAccess[%d]: %v", j, err)
+		}
+		if fa.Readers == nil && fa.Writers == nil {
+			return fmt.Errorf("fieldAccess[%d]: one of readers and writers is required", j)
+		}
+		if fa.Above != nil && fa.Writers == nil {
+			return fmt.Errorf("fieldAccess[%d]: above requires writers", j)
+		}
+	}
+	if len(r.Defaults) > 0 && !r.Backend.Upstream() {
+		return fmt.Errorf("defaults are only supported for upstream resources")
+	}
+	for j, d := range r.Defaults {
+		p, err := fieldpath.Parse(d.Path)
+		if err != nil {
+			return fmt.Errorf("defaults[%d]: %v", j, err)
+		}
+		if p[len(p)-1].Wildcard {
+			return fmt.Errorf("defaults[%d]: path must not end with a wildcard", j)
+		}
+		if _, err := d.DecodedValue(); err != nil {
+			return fmt.Errorf("defaults[%d]: %v", j, err)
+		}
+	}
+	if len(r.Immutable) > 0 && !r.Backend.Upstream() {
+		return fmt.Errorf("immutable is only supported for upstream resources")
+	}
+	for j, path := range r.Immutable {
+		if _, err := fieldpath.Parse(path); err != nil {
+			return fmt.Errorf("immutable[%d]: %v", j, err)
+		}
+	}
+	if len(r.Actions) > 0 && !r.Backend.Upstream() {
+		return fmt.Errorf("actions are only supported for upstream resources")
+	}
+	if len(r.Actions) > 0 && (r.Internal.Group != "apps" || r.Internal.Version != "v1" || r.Internal.Kind != "Deployment") {
+		return fmt.Errorf("actions are only supported for resources proxied to apps/v1 Deployments")
+	}
+	if r.Logs && !r.Backend.Upstream() {
+		return fmt.Errorf("logs are only supported for upstream resources")
+	}
+	actions := map[string]bool{}
+	for j, a := range r.Actions {
+		switch a {
+		case "restart", "pause", "resume", "rollback":
+		default:
+			return fmt.Errorf("actions[%d]: unknown action %q", j, a)
+		}
+		if actions[a] {
+			return fmt.Errorf("actions[%d]: %s is listed more than once", j, a)
+		}
+		actions[a] = true
+	}
+	if q := r.Quota; q != nil {
+		if !r.Backend.Upstream() {
+			return fmt.Errorf("quota is only supported for upstream resources")
+		}
+		if q.MaxObjects < 0 {
+			return fmt.Errorf("quota.maxObjects must not be negative")
+		}
+		if q.MaxObjects == 0 && len(q.Sums) == 0 {
+			return fmt.Errorf("quota: one of maxObjects and sums is required")
+		}
+		for j, sum := range q.Sums {
+			if _, err := fieldpath.Parse(sum.Path); err != nil {
+				return fmt.Errorf("quota.sums[%d]: %v", j, err)
+			}
+			if sum.Max < 0 {
+				return fmt.Errorf("quota.sums[%d].max must not be negative", j)
+			}
+		}
+	}
+	for j, rd := range r.Redact {
+		if _, err := fieldpath.Parse(rd.Path); err != nil {
+			return fmt.Errorf("redact[%d]: %v", j, err)
+		}
+		if rd.Action != "" && rd.Action != "mask" && rd.Action != "remove" {
+			return fmt.Errorf("redact[%d]: unknown action %q", j, rd.Action)
+		}
+	}
+	return nil
+}
+
+func validateComposite(c *CompositeBackend) error {
+	if c.Label == "" {
+		return fmt.Errorf("label is required")
+	}
+	if len(c.Parts) == 0 {
+		return fmt.Errorf("at least one part is required")
+	}
+	names := map[string]bool{}
+	for i, p := range c.Parts {
+		if p.Name == "" || names[p.Name] {
+			return fmt.Errorf("parts[%d]: name must be set and unique", i)
+		}
+		names[p.Name] = true
+		if err := validateGVKR(p.Resource); err != nil {
+			return fmt.Errorf("parts[%d].resource: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validateTemplate(t *TemplateBackend) error {
+	if len(t.Children) == 0 {
+		return fmt.Errorf("at least one child is required")
+	}
+	for i, c := range t.Children {
+		if err := validateGVKR(c.Resource); err != nil {
+			return fmt.Errorf("children[%d].resource: %v", i, err)
+		}
+		if c.Template == "" {
+			return fmt.Errorf("children[%d].template is required", i)
+		}
+	}
+	return nil
+}
+
+func validateGVKR(r GroupVersionKindResource) error {
+	// The core group has an empty name, everything else is required.
+	if r.Version == "" || r.Kind == "" || r.Resource == "" {
+		return fmt.Errorf("version, kind and resource are required")
+	}
+	return nil
+}
+
+// Groups returns the names of the external API groups in the mapping, sorted.
+func (c *Config) Groups() []string {
+	seen := map[string]bool{}
+	var groups []string
+	for _, r := range c.Resources {
+		if !seen[r.External.Group] {
+			seen[r.External.Group] = true
+			groups = append(groups, r.External.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// UsesUpstream reports whether any resource is stored in the upstream cluster.
+func (c *Config) UsesUpstream() bool {
+	for _, r := range c.Resources {
+		if r.Backend.Upstream() || r.Backend.Composite != nil || r.Backend.Template != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package mapping
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadConfig loads a mapping file with content.
+func loadConfig(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad(t *testing.T) {
+	c, err := loadConfig(t, `
+resources:
+- external: {group: apps.maisem.dev, version: v1, kind: Deployment, resource: deployments}
+  internal: {group: apps, version: v1, kind: Deployment, resource: deployments}
+  shortNames: [mdep]
+- external: {group: notes.maisem.dev, version: v1, kind: Note, resource: notes}
+  backend:
+    file:
+      directory: /tmp/notes
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Resources) != 2 || c.Resources[1].Backend.File.Directory != "/tmp/notes" {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	if got := c.Groups(); len(got) != 2 || got[0] != "apps.maisem.dev" || got[1] != "notes.maisem.dev" {
+		t.Errorf("Groups() = %v", got)
+	}
+	if !c.UsesUpstream() {
+		t.Error("UsesUpstream() = false, want true")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field":    "resources: []\nextra: true\n",
+		"empty":            "resources: []\n",
+		"missing internal": "resources:\n- external: {version: v1, kind: Pod, resource: pods}\n",
+		"missing directory": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {}}
+`,
+		"template without children": `resources:
+- external: {group: apps.maisem.dev, version: v1, kind: WebApp, resource: webapps}
+  backend: {template: {children: []}}
+`,
+		"invalid redact path": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  internal: {version: v1, kind: Pod, resource: pods}
+  redact: [{path: "spec[x]"}]
+`,
+		"redact on file backend": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {directory: /a}}
+  redact: [{path: spec.secret}]
+`,
+		"logs on file backend": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {directory: /a}}
+  logs: true
+`,
+		"actions on pods": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  internal: {version: v1, kind: Pod, resource: pods}
+  actions: [restart]
+`,
+		"default without value": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  internal: {version: v1, kind: Pod, resource: pods}
+  defaults: [{path: metadata.labels.team}]
+`,
+		"invalid removal date": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {directory: /a}}
+  deprecation: {removal: 30/06/2020}
+`,
+		"deprecated version not served": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {directory: /a}}
+deprecatedVersions:
+- {group: apps, version: v1}
+`,
+		"duplicate": `resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {directory: /a}}
+- external: {version: v1, kind: Pod, resource: pods}
+  backend: {file: {directory: /b}}
+`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(t, content)
+			if err == nil || !strings.Contains(err.Error(), "mapping") {
+				t.Errorf("Load() = %v, want an error", err)
+			}
+		})
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	c, err := loadConfig(t, `
+resources:
+- external: {version: v1, kind: Pod, resource: pods}
+  internal: {version: v1, kind: Pod, resource: pods}
+  defaults:
+  - path: spec.containers[*].resources.limits
+    value: {cpu: 1, memory: 128Mi}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Resources[0].Defaults[0].DecodedValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := v.(map[string]interface{})
+	if limits["cpu"] != int64(1) || limits["memory"] != "128Mi" {
+		t.Errorf("DecodedValue() = %#v", v)
+	}
+}
+
+func TestDeprecationOf(t *testing.T) {
+	c, err := loadConfig(t, `
+resources:
+- external: {group: apps.maisem.dev, version: v1, kind: Deployment, resource: deployments}
+  internal: {group: apps, version: v1, kind: Deployment, resource: deployments}
+- external: {group: apps.maisem.dev, version: v1, kind: StatefulSet, resource: statefulsets}
+  internal: {group: apps, version: v1, kind: StatefulSet, resource: statefulsets}
+  deprecation: {replacement: apps.maisem.dev/v2 StatefulSet}
+- external: {group: apps.maisem.dev, version: v2, kind: Deployment, resource: deployments}
+  internal: {group: apps, version: v1, kind: Deployment, resource: deployments}
+deprecatedVersions:
+- group: apps.maisem.dev
+  version: v1
+  replacement: apps.maisem.dev/v2
+  removal: "2020-06-30"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := c.DeprecationOf(c.Resources[0]); d == nil || d.Replacement != "apps.maisem.dev/v2" || d.Removal != "2020-06-30" {
+		t.Errorf("deprecation of a resource of a deprecated version = %+v", d)
+	}
+	if d := c.DeprecationOf(c.Resources[1]); d == nil || d.Replacement != "apps.maisem.dev/v2 StatefulSet" || d.Removal != "" {
+		t.Errorf("deprecation of a deprecated resource = %+v, want its own", d)
+	}
+	if d := c.DeprecationOf(c.Resources[2]); d != nil {
+		t.Errorf("deprecation of a current resource = %+v, want nil", d)
+	}
+}
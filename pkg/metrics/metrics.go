@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const namespace = "proxy"
+
+var (
+	resourceLabels = []string{"group", "version", "resource", "cluster"}
+	verbLabels     = []string{"group", "version", "resource", "cluster", "verb"}
+	codeLabels     = []string{"group", "version", "resource", "cluster", "verb", "code"}
+	eventLabels    = []string{"group", "version", "resource", "cluster", "type"}
+	callerLabels   = []string{"group", "version", "resource", "verb", "user_agent"}
+
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Number of facade requests served by the proxy, partitioned by external resource, verb, upstream cluster and HTTP status code.",
+		},
+		codeLabels,
+	)
+	requestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "request_errors_total",
+			Help:      "Number of facade requests that failed, partitioned by external resource, verb, upstream cluster and HTTP status code.",
+		},
+		codeLabels,
+	)
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Total latency of facade requests, including all upstream round-trips.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		verbLabels,
+	)
+	upstreamLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Latency of individual round-trips to the upstream API server.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		verbLabels,
+	)
+	activeWatches = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_watches",
+			Help:      "Number of watches currently proxied to the upstream API server.",
+		},
+		resourceLabels,
+	)
+	watchEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "watch_events_total",
+			Help:      "Number of watch events forwarded to facade clients, partitioned by event type.",
+		},
+		eventLabels,
+	)
+	deprecatedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deprecated_requests_total",
+			Help:      "Number of facade requests to deprecated resources, partitioned by external resource, verb and known client.",
+		},
+		callerLabels,
+	)
+
+	registerOnce sync.Once
+)
+
+// Register registers the proxy metrics with the default prometheus registry
+// which is served by the generic API server on /metrics.
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(requests, requestErrors, requestLatency, upstreamLatency, activeWatches, watchEvents, deprecatedRequests)
+	})
+}
+
+// Resource identifies a proxied external resource and the upstream cluster
+// it is served from.
+type Resource struct {
+	Group    string
+	Version  string
+	Resource string
+	Cluster  string
+}
+
+func (r Resource) values(extra ...string) []string {
+	return append([]string{r.Group, r.Version, r.Resource, r.Cluster}, extra...)
+}
+
+// ObserveRequest records the outcome and total latency of a facade request.
+func (r Resource) ObserveRequest(verb string, start time.Time, err error) {
+	code := strconv.Itoa(Code(err))
+	requests.WithLabelValues(r.values(verb, code)...).Inc()
+	if err != nil {
+		requestErrors.WithLabelValues(r.values(verb, code)...).Inc()
+	}
+	requestLatency.WithLabelValues(r.values(verb)...).Observe(time.Since(start).Seconds())
+}
+
+// ObserveUpstream records the latency of a single upstream round-trip.
+func (r Resource) ObserveUpstream(verb string, start time.Time) {
+	upstreamLatency.WithLabelValues(r.values(verb)...).Observe(time.Since(start).Seconds())
+}
+
+// WatchStarted increments the number of active watches.
+func (r Resource) WatchStarted() {
+	activeWatches.WithLabelValues(r.values()...).Inc()
+}
+
+// WatchStopped decrements the number of active watches.
+func (r Resource) WatchStopped() {
+	activeWatches.WithLabelValues(r.values()...).Dec()
+}
+
+// WatchEvent records a watch event forwarded to a facade client.
+func (r Resource) WatchEvent(eventType string) {
+	watchEvents.WithLabelValues(r.values(eventType)...).Inc()
+}
+
+// DeprecatedRequest records a facade request to a deprecated resource by the
+// client userAgent, which must be one of a bounded set of values.
+func DeprecatedRequest(group, version, resource, verb, userAgent string) {
+	deprecatedRequests.WithLabelValues(group, version, resource, verb, userAgent).Inc()
+}
+
+// Code returns the HTTP status code that err would be reported as.
+func Code(err error) int {
+	if err == nil {
+		return 200
+	}
+	if s, ok := err.(errors.APIStatus); ok && s.Status().Code != 0 {
+		return int(s.Status().Code)
+	}
+	return 500
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func histogram(t *testing.T, o prometheus.Observer) *dto.Histogram {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram()
+}
+
+func TestObserveRequest(t *testing.T) {
+	requests.Reset()
+	requestErrors.Reset()
+	requestLatency.Reset()
+	r := Resource{Group: "apps.maisem.dev", Version: "v1", Resource: "deployments", Cluster: "observe-request"}
+	start := time.Now().Add(-time.Second)
+	r.ObserveRequest("get", start, nil)
+	r.ObserveRequest("get", start, errors.NewNotFound(schema.GroupResource{Resource: "deployments"}, "web"))
+	r.ObserveRequest("get", start, fmt.Errorf("connection refused"))
+
+	for _, tc := range []struct {
+		code           string
+		total, errored float64
+	}{
+		{"200", 1, 0},
+		{"404", 1, 1},
+		{"500", 1, 1},
+	} {
+		if got := testutil.ToFloat64(requests.WithLabelValues(r.values("get", tc.code)...)); got != tc.total {
+			t.Errorf("requests with code %s = %v, want %v", tc.code, got, tc.total)
+		}
+		if got := testutil.ToFloat64(requestErrors.WithLabelValues(r.values("get", tc.code)...)); got != tc.errored {
+			t.Errorf("request errors with code %s = %v, want %v", tc.code, got, tc.errored)
+		}
+	}
+	latency := histogram(t, requestLatency.WithLabelValues(r.values("get")...))
+	if latency.GetSampleCount() != 3 || latency.GetSampleSum() < 3 {
+		t.Errorf("observed %d latencies summing to %vs, want 3 of at least 1s each", latency.GetSampleCount(), latency.GetSampleSum())
+	}
+}
+
+func TestWatches(t *testing.T) {
+	activeWatches.Reset()
+	watchEvents.Reset()
+	r := Resource{Group: "apps.maisem.dev", Version: "v1", Resource: "deployments", Cluster: "watches"}
+	r.WatchStarted()
+	r.WatchStarted()
+	r.WatchEvent("ADDED")
+	r.WatchStopped()
+	if got := testutil.ToFloat64(activeWatches.WithLabelValues(r.values()...)); got != 1 {
+		t.Errorf("active watches = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(watchEvents.WithLabelValues(r.values("ADDED")...)); got != 1 {
+		t.Errorf("ADDED events = %v, want 1", got)
+	}
+}
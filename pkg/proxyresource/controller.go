@@ -0,0 +1,182 @@
+package proxyresource
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+// ResyncPeriod is how often all ProxyResources are evaluated again, which
+// picks up upstream resources that were installed in the meantime.
+const ResyncPeriod = time.Minute
+
+// syncKey is the only key of the queue, as ProxyResources are always
+// evaluated together to resolve conflicts.
+const syncKey = "all"
+
+// Controller serves the resources of the ProxyResources in the upstream
+// cluster and reports their conditions.
+type Controller struct {
+	client    dynamic.ResourceInterface
+	discovery discovery.DiscoveryInterface
+	// static returns the mapping the resources are served along with.
+	static func() *mapping.Config
+	// serve replaces the served ProxyResource resources.
+	serve func([]mapping.Resource) error
+
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// NewController returns a controller watching the ProxyResources through
+// client. Resources are checked against the upstream discovery before they
+// are passed to serve.
+func NewController(client dynamic.Interface, disc discovery.DiscoveryInterface, static func() *mapping.Config, serve func([]mapping.Resource) error) *Controller {
+	c := &Controller{
+		client:    client.Resource(GroupVersionResource),
+		discovery: disc,
+		static:    static,
+		serve:     serve,
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "proxyresources"),
+	}
+	c.informer = cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return c.client.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return c.client.Watch(options)
+		},
+	}, &unstructured.Unstructured{}, ResyncPeriod, cache.Indexers{})
+	enqueue := func(interface{}) { c.queue.Add(syncKey) }
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	})
+	return c
+}
+
+// Run evaluates the ProxyResources whenever they change until stopCh is
+// closed.
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+	go c.informer.Run(stopCh)
+	klog.Infof("Waiting for ProxyResources to sync")
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		return
+	}
+	go wait.Until(c.work, time.Second, stopCh)
+	<-stopCh
+}
+
+func (c *Controller) work() {
+	for {
+		key, quit := c.queue.Get()
+		if quit {
+			return
+		}
+		if err := c.sync(); err != nil {
+			klog.Errorf("Unable to sync ProxyResources: %v", err)
+			c.queue.AddRateLimited(key)
+		} else {
+			c.queue.Forget(key)
+		}
+		c.queue.Done(key)
+	}
+}
+
+// sync serves the accepted ProxyResources and updates the status of all of
+// them.
+func (c *Controller) sync() error {
+	var objs []*unstructured.Unstructured
+	for _, obj := range c.informer.GetStore().List() {
+		objs = append(objs, obj.(*unstructured.Unstructured))
+	}
+	e := evaluate(objs, c.static(), c.upstreamServes())
+	if err := c.serve(e.accepted); err != nil {
+		return err
+	}
+	var errs []error
+	for _, u := range objs {
+		if err := c.updateStatus(u, e.conditions[u.GetName()]); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// upstreamServes returns a function reporting whether the upstream cluster
+// serves a resource, discovering each group version once.
+func (c *Controller) upstreamServes() func(schema.GroupVersionResource) (bool, error) {
+	type result struct {
+		resources map[string]bool
+		err       error
+	}
+	discovered := map[schema.GroupVersion]result{}
+	return func(gvr schema.GroupVersionResource) (bool, error) {
+		gv := gvr.GroupVersion()
+		r, ok := discovered[gv]
+		if !ok {
+			r.resources = map[string]bool{}
+			l, err := c.discovery.ServerResourcesForGroupVersion(gv.String())
+			switch {
+			case errors.IsNotFound(err):
+			case err != nil:
+				r.err = err
+			default:
+				for _, ar := range l.APIResources {
+					r.resources[ar.Name] = true
+				}
+			}
+			discovered[gv] = r
+		}
+		return r.resources[gvr.Resource], r.err
+	}
+}
+
+// updateStatus sets the conditions of u if they changed.
+func (c *Controller) updateStatus(u *unstructured.Unstructured, conditions []Condition) error {
+	var old Status
+	if raw, ok := u.Object["status"]; ok {
+		if b, err := json.Marshal(raw); err == nil {
+			json.Unmarshal(b, &old)
+		}
+	}
+	status := Status{
+		ObservedGeneration: u.GetGeneration(),
+		Conditions:         withTransitionTimes(conditions, old.Conditions, metav1.Now()),
+	}
+	if reflect.DeepEqual(status, old) {
+		return nil
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	updated := u.DeepCopy()
+	updated.Object["status"] = raw
+	_, err = c.client.UpdateStatus(updated, metav1.UpdateOptions{})
+	return err
+}
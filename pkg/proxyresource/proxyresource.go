@@ -0,0 +1,175 @@
+// Package proxyresource serves the resources configured by ProxyResource
+// objects in the upstream cluster, so that teams can add facade APIs with
+// kubectl instead of changing the mapping of the proxy.
+package proxyresource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+// GroupVersionResource is the cluster-scoped upstream resource of
+// ProxyResources. Its spec is a mapping.Resource stored upstream.
+var GroupVersionResource = schema.GroupVersionResource{Group: "proxy.maisem.dev", Version: "v1alpha1", Resource: "proxyresources"}
+
+// Kind is the kind of ProxyResources.
+const Kind = "ProxyResource"
+
+// Condition types reported in the status of ProxyResources.
+const (
+	// ConditionAccepted is true if the resource is served by the proxy.
+	ConditionAccepted = "Accepted"
+	// ConditionUpstreamMissing is true if the internal resource is not
+	// served by the upstream cluster.
+	ConditionUpstreamMissing = "UpstreamMissing"
+	// ConditionConflict is true if the external resource is already served
+	// by the mapping of the proxy or an older ProxyResource.
+	ConditionConflict = "Conflict"
+)
+
+// Status is the status of a ProxyResource.
+type Status struct {
+	// ObservedGeneration is the generation of the spec the conditions
+	// describe.
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+// Condition describes one aspect of the state of a ProxyResource.
+type Condition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+// Spec decodes the spec of the ProxyResource u, rejecting unknown fields
+// like mapping.Load does.
+func Spec(u *unstructured.Unstructured) (mapping.Resource, error) {
+	var r mapping.Resource
+	spec, ok := u.Object["spec"]
+	if !ok {
+		return r, fmt.Errorf("spec is required")
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return r, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&r); err != nil {
+		return r, fmt.Errorf("invalid spec: %v", err)
+	}
+	return r, nil
+}
+
+// evaluation is the outcome of evaluating the ProxyResources.
+type evaluation struct {
+	// accepted lists the resources to serve, oldest first.
+	accepted []mapping.Resource
+	// conditions holds the conditions of every ProxyResource by name.
+	conditions map[string][]Condition
+}
+
+// evaluate decides which of objs are served along with the resources of
+// static. Older objects win conflicts. upstream reports whether the upstream
+// cluster serves a resource.
+func evaluate(objs []*unstructured.Unstructured, static *mapping.Config, upstream func(schema.GroupVersionResource) (bool, error)) evaluation {
+	objs = append([]*unstructured.Unstructured(nil), objs...)
+	sort.Slice(objs, func(i, j int) bool {
+		ti, tj := objs[i].GetCreationTimestamp(), objs[j].GetCreationTimestamp()
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return objs[i].GetName() < objs[j].GetName()
+	})
+	claimed := map[schema.GroupVersionResource]string{}
+	for _, r := range static.Resources {
+		claimed[r.External.GroupVersionResource()] = ""
+	}
+
+	e := evaluation{conditions: map[string][]Condition{}}
+	for _, u := range objs {
+		res, err := Spec(u)
+		if err == nil {
+			err = validate(res)
+		}
+		if err != nil {
+			e.conditions[u.GetName()] = []Condition{condition(ConditionAccepted, corev1.ConditionFalse, "Invalid", err.Error())}
+			continue
+		}
+
+		gvr := res.External.GroupVersionResource()
+		conflict := condition(ConditionConflict, corev1.ConditionFalse, "Unique", "")
+		if owner, ok := claimed[gvr]; ok {
+			conflict = condition(ConditionConflict, corev1.ConditionTrue, "ServedByMapping", fmt.Sprintf("%s is served by the mapping of the proxy", gvr))
+			if owner != "" {
+				conflict = condition(ConditionConflict, corev1.ConditionTrue, "ServedByProxyResource", fmt.Sprintf("%s is served by ProxyResource %s", gvr, owner))
+			}
+		}
+		missing := condition(ConditionUpstreamMissing, corev1.ConditionFalse, "Found", "")
+		internal := res.Internal.GroupVersionResource()
+		if found, err := upstream(internal); err != nil {
+			missing = condition(ConditionUpstreamMissing, corev1.ConditionUnknown, "DiscoveryFailed", fmt.Sprintf("unable to discover %s upstream: %v", internal, err))
+		} else if !found {
+			missing = condition(ConditionUpstreamMissing, corev1.ConditionTrue, "NotFound", fmt.Sprintf("%s is not served by the upstream cluster", internal))
+		}
+
+		accepted := condition(ConditionAccepted, corev1.ConditionTrue, "Served", fmt.Sprintf("%s is served", gvr))
+		switch {
+		case conflict.Status != corev1.ConditionFalse:
+			accepted = condition(ConditionAccepted, corev1.ConditionFalse, "Conflict", conflict.Message)
+		case missing.Status != corev1.ConditionFalse:
+			accepted = condition(ConditionAccepted, corev1.ConditionFalse, "UpstreamMissing", missing.Message)
+		default:
+			claimed[gvr] = u.GetName()
+			e.accepted = append(e.accepted, res)
+		}
+		e.conditions[u.GetName()] = []Condition{accepted, missing, conflict}
+	}
+	return e
+}
+
+// validate checks res on its own. ProxyResources may only configure
+// resources proxied to the upstream cluster, the other backends store
+// objects on the host of the proxy.
+func validate(res mapping.Resource) error {
+	if !res.Backend.Upstream() {
+		return fmt.Errorf("spec.backend: only upstream resources may be configured by ProxyResources")
+	}
+	if err := (&mapping.Config{Resources: []mapping.Resource{res}}).Validate(); err != nil {
+		return fmt.Errorf("%s", strings.Replace(err.Error(), "resources[0]", "spec", 1))
+	}
+	return nil
+}
+
+func condition(typ string, status corev1.ConditionStatus, reason, message string) Condition {
+	return Condition{Type: typ, Status: status, Reason: reason, Message: message}
+}
+
+// withTransitionTimes sets the transition times of conditions, keeping those
+// of old conditions whose status did not change and using now for the rest.
+func withTransitionTimes(conditions, old []Condition, now metav1.Time) []Condition {
+	out := make([]Condition, len(conditions))
+	for i, c := range conditions {
+		c.LastTransitionTime = now
+		for _, o := range old {
+			if o.Type == c.Type && o.Status == c.Status {
+				c.LastTransitionTime = o.LastTransitionTime
+			}
+		}
+		out[i] = c
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package proxyresource
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+)
+
+var created = time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+
+// newProxyResource returns a ProxyResource created age after created.
+func newProxyResource(name string, age time.Duration, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetAPIVersion(GroupVersionResource.GroupVersion().String())
+	u.SetKind(Kind)
+	u.SetName(name)
+	u.SetCreationTimestamp(metav1.NewTime(created.Add(age)))
+	return u
+}
+
+func gvkr(group, kind, resource string) map[string]interface{} {
+	return map[string]interface{}{"group": group, "version": "v1", "kind": kind, "resource": resource}
+}
+
+func upstreamSpec(external, internal map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"external": external, "internal": internal}
+}
+
+func TestEvaluate(t *testing.T) {
+	deployments := gvkr("apps", "Deployment", "deployments")
+	objs := []*unstructured.Unstructured{
+		newProxyResource("newer-web", 2*time.Hour, upstreamSpec(gvkr("web.example.com", "WebApp", "webapps"), deployments)),
+		newProxyResource("web", time.Hour, upstreamSpec(gvkr("web.example.com", "WebApp", "webapps"), deployments)),
+		newProxyResource("mapped", time.Hour, upstreamSpec(gvkr("apps.maisem.dev", "Deployment", "deployments"), deployments)),
+		newProxyResource("missing", time.Hour, upstreamSpec(gvkr("db.example.com", "Database", "databases"), gvkr("db.example.com", "Database", "databases"))),
+		newProxyResource("broken", time.Hour, upstreamSpec(gvkr("cache.example.com", "Cache", "caches"), gvkr("cache.example.com", "Cache", "caches"))),
+		newProxyResource("unknown-field", time.Hour, map[string]interface{}{"external": gvkr("a.example.com", "A", "as"), "replicas": int64(1)}),
+		newProxyResource("file", time.Hour, map[string]interface{}{
+			"external": gvkr("notes.example.com", "Note", "notes"),
+			"backend":  map[string]interface{}{"file": map[string]interface{}{"directory": "/etc"}},
+		}),
+		newProxyResource("no-internal", time.Hour, map[string]interface{}{"external": gvkr("b.example.com", "B", "bs")}),
+	}
+	upstream := func(gvr schema.GroupVersionResource) (bool, error) {
+		switch gvr.Group {
+		case "apps":
+			return true, nil
+		case "cache.example.com":
+			return false, fmt.Errorf("connection refused")
+		}
+		return false, nil
+	}
+	e := evaluate(objs, mapping.Default(), upstream)
+
+	if len(e.accepted) != 1 || e.accepted[0].External.Group != "web.example.com" || e.accepted[0].Internal.Resource != "deployments" {
+		t.Errorf("accepted %+v, want the resource of web only", e.accepted)
+	}
+	want := map[string]map[string]string{
+		"web":           {ConditionAccepted: "True/Served", ConditionConflict: "False/Unique", ConditionUpstreamMissing: "False/Found"},
+		"newer-web":     {ConditionAccepted: "False/Conflict", ConditionConflict: "True/ServedByProxyResource", ConditionUpstreamMissing: "False/Found"},
+		"mapped":        {ConditionAccepted: "False/Conflict", ConditionConflict: "True/ServedByMapping", ConditionUpstreamMissing: "False/Found"},
+		"missing":       {ConditionAccepted: "False/UpstreamMissing", ConditionConflict: "False/Unique", ConditionUpstreamMissing: "True/NotFound"},
+		"broken":        {ConditionAccepted: "False/UpstreamMissing", ConditionConflict: "False/Unique", ConditionUpstreamMissing: "Unknown/DiscoveryFailed"},
+		"unknown-field": {ConditionAccepted: "False/Invalid"},
+		"file":          {ConditionAccepted: "False/Invalid"},
+		"no-internal":   {ConditionAccepted: "False/Invalid"},
+	}
+	for name, conditions := range want {
+		got := map[string]string{}
+		for _, c := range e.conditions[name] {
+			got[c.Type] = fmt.Sprintf("%s/%s", c.Status, c.Reason)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(conditions) {
+			t.Errorf("conditions of %s = %v, want %v", name, got, conditions)
+		}
+	}
+	if msg := e.conditions["no-internal"][0].Message; msg != "spec.internal: version, kind and resource are required" {
+		t.Errorf("message of an invalid spec = %q", msg)
+	}
+}
+
+func TestWithTransitionTimes(t *testing.T) {
+	before, now := metav1.NewTime(created), metav1.NewTime(created.Add(time.Hour))
+	old := []Condition{
+		{Type: ConditionAccepted, Status: corev1.ConditionFalse, LastTransitionTime: before},
+		{Type: ConditionConflict, Status: corev1.ConditionFalse, LastTransitionTime: before},
+	}
+	got := withTransitionTimes([]Condition{
+		{Type: ConditionAccepted, Status: corev1.ConditionTrue},
+		{Type: ConditionConflict, Status: corev1.ConditionFalse},
+		{Type: ConditionUpstreamMissing, Status: corev1.ConditionFalse},
+	}, old, now)
+	for i, want := range []metav1.Time{now, before, now} {
+		if !got[i].LastTransitionTime.Equal(&want) {
+			t.Errorf("%s transitioned at %v, want %v", got[i].Type, got[i].LastTransitionTime, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package ratelimit throttles facade requests with token buckets keyed by the
+// requesting user and the groups the user belongs to.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+)
+
+// Limit is the sustained rate and burst of a token bucket.
+type Limit struct {
+	QPS   float64
+	Burst int
+}
+
+// idleTimeout is how long a bucket may go unused before it is dropped.
+const idleTimeout = 10 * time.Minute
+
+// Limiter hands out tokens from per-user and per-group buckets.
+type Limiter struct {
+	user   Limit
+	groups map[string]Limit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// NewLimiter returns a Limiter that gives every user a bucket sized by
+// userLimit, and every group in groupLimits a bucket shared by all of its
+// members. A zero userLimit disables per-user limits. Idle buckets are
+// garbage collected until stopCh is closed.
+func NewLimiter(userLimit Limit, groupLimits map[string]Limit, stopCh <-chan struct{}) *Limiter {
+	l := &Limiter{
+		user:    userLimit,
+		groups:  groupLimits,
+		buckets: map[string]*bucket{},
+	}
+	go l.gc(stopCh)
+	return l
+}
+
+// Reserve takes a token from every bucket that applies to u. If any of them is
+// exhausted, no tokens are taken and the time to wait before retrying is
+// returned.
+func (l *Limiter) Reserve(u user.Info) (time.Duration, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var reservations []*rate.Reservation
+	if l.user.QPS > 0 {
+		reservations = append(reservations, l.bucket("user:"+u.GetName(), l.user, now).ReserveN(now, 1))
+	}
+	for _, g := range u.GetGroups() {
+		if limit, ok := l.groups[g]; ok {
+			reservations = append(reservations, l.bucket("group:"+g, limit, now).ReserveN(now, 1))
+		}
+	}
+
+	var wait time.Duration
+	for _, r := range reservations {
+		if !r.OK() {
+			wait = time.Second
+			continue
+		}
+		if d := r.DelayFrom(now); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return 0, true
+	}
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+	return wait, false
+}
+
+func (l *Limiter) bucket(key string, limit Limit, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Limiter: rate.NewLimiter(rate.Limit(limit.QPS), limit.Burst)}
+		l.buckets[key] = b
+	}
+	b.lastUsed = now
+	return b
+}
+
+func (l *Limiter) gc(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for k, b := range l.buckets {
+				if now.Sub(b.lastUsed) > idleTimeout {
+					delete(l.buckets, k)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// WithRateLimit rejects requests with 429 Too Many Requests and a Retry-After
+// header once the requesting user or one of its groups has exceeded its limit.
+// It must run after authentication. Requests made by the API server itself
+// over loopback are never limited.
+func WithRateLimit(handler http.Handler, l *Limiter, s runtime.NegotiatedSerializer) http.Handler {
+	if l == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, ok := request.UserFrom(req.Context())
+		if !ok || u.GetName() == user.APIServerUser {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		wait, ok := l.Reserve(u)
+		if !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			klog.V(4).Infof("rate limiting %q for %ds", u.GetName(), retryAfter)
+			err := errors.NewTooManyRequests(fmt.Sprintf("rate limit exceeded for user %q, retry after %ds", u.GetName(), retryAfter), retryAfter)
+			responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestReserve(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	l := NewLimiter(Limit{QPS: 1, Burst: 2}, map[string]Limit{"ci": {QPS: 1, Burst: 1}}, stopCh)
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	for i := 0; i < 2; i++ {
+		if _, ok := l.Reserve(alice); !ok {
+			t.Fatalf("request %d of alice was limited within the burst", i)
+		}
+	}
+	wait, ok := l.Reserve(alice)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("Reserve() past the burst = %v, %v, want a wait of at most 1s", wait, ok)
+	}
+
+	// Members of a group share its bucket.
+	bob := &user.DefaultInfo{Name: "bob", Groups: []string{"ci"}}
+	carol := &user.DefaultInfo{Name: "carol", Groups: []string{"ci"}}
+	if _, ok := l.Reserve(bob); !ok {
+		t.Fatal("first request of the ci group was limited")
+	}
+	if _, ok := l.Reserve(carol); ok {
+		t.Error("second request of the ci group was not limited")
+	}
+
+	// The rejected request took no token from carol's own bucket.
+	carol.Groups = nil
+	for i := 0; i < 2; i++ {
+		if _, ok := l.Reserve(carol); !ok {
+			t.Fatalf("request %d of carol outside the ci group was limited", i)
+		}
+	}
+
+	// A zero user limit only applies group limits.
+	l = NewLimiter(Limit{}, map[string]Limit{"ci": {QPS: 1, Burst: 1}}, stopCh)
+	for i := 0; i < 5; i++ {
+		if _, ok := l.Reserve(alice); !ok {
+			t.Fatalf("request %d of alice was limited without a user limit", i)
+		}
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	l := NewLimiter(Limit{QPS: 0.5, Burst: 1}, nil, stopCh)
+	scheme := runtime.NewScheme()
+	metav1.AddToGroupVersion(scheme, schema.GroupVersion{Version: "v1"})
+	handler := WithRateLimit(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), l, serializer.NewCodecFactory(scheme))
+
+	serve := func(u user.Info) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/apis/apps.maisem.dev/v1/deployments", nil)
+		req = req.WithContext(request.WithUser(req.Context(), u))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	if w := serve(alice); w.Code != http.StatusOK {
+		t.Fatalf("first request = %d, want 200", w.Code)
+	}
+	w := serve(alice)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Reason != metav1.StatusReasonTooManyRequests || status.Details == nil || status.Details.RetryAfterSeconds != 2 {
+		t.Errorf("status = %+v", status)
+	}
+
+	// The API server's own loopback requests are never limited.
+	for i := 0; i < 3; i++ {
+		if w := serve(&user.DefaultInfo{Name: user.APIServerUser}); w.Code != http.StatusOK {
+			t.Fatalf("loopback request %d = %d, want 200", i, w.Code)
+		}
+	}
+}
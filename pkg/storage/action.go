@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+// Actions served as subresources of proxied Deployments.
+const (
+	// ActionRestart restarts all pods by stamping the pod template, like
+	// kubectl rollout restart.
+	ActionRestart = "restart"
+	// ActionPause pauses the rollout.
+	ActionPause = "pause"
+	// ActionResume resumes a paused rollout.
+	ActionResume = "resume"
+	// ActionRollback rolls the pod template back to the previous revision,
+	// or to the one in the toRevision query parameter, like kubectl rollout
+	// undo.
+	ActionRollback = "rollback"
+)
+
+const (
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+	revisionAnnotation    = "deployment.kubernetes.io/revision"
+)
+
+var (
+	// deploymentsR is the upstream resource actions apply to.
+	deploymentsR = GroupVersionKindResource{
+		GroupVersion: schema.GroupVersion{Group: "apps", Version: "v1"},
+		Kind:         "Deployment",
+		Resource:     "deployments",
+	}
+	// replicaSetsR is the upstream resource rollback reads the rollout
+	// history from.
+	replicaSetsR = GroupVersionKindResource{
+		GroupVersion: schema.GroupVersion{Group: "apps", Version: "v1"},
+		Kind:         "ReplicaSet",
+		Resource:     "replicasets",
+	}
+)
+
+// NewActionREST returns a connect-style rest.Storage serving action as a
+// subresource of parent, which must be returned by NewREST for a resource
+// proxied to upstream Deployments. A POST to the subresource applies the
+// action upstream and returns the updated object.
+func NewActionREST(parent rest.Storage, action string) (rest.Storage, error) {
+	r, ok := parent.(*restStorage)
+	if !ok {
+		return nil, fmt.Errorf("action %s is only supported for upstream resources", action)
+	}
+	if r.mapper.Internal.GroupVersion != deploymentsR.GroupVersion || r.mapper.Internal.Kind != deploymentsR.Kind {
+		return nil, fmt.Errorf("action %s is only supported for resources proxied to apps/v1 Deployments", action)
+	}
+	switch action {
+	case ActionRestart, ActionPause, ActionResume, ActionRollback:
+	default:
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	return &actionStorage{parent: r, action: action}, nil
+}
+
+type actionStorage struct {
+	parent *restStorage
+	action string
+}
+
+func (a *actionStorage) New() runtime.Object {
+	return a.parent.New()
+}
+
+func (a *actionStorage) NewConnectOptions() (runtime.Object, bool, string) {
+	return nil, false, ""
+}
+
+func (a *actionStorage) ConnectMethods() []string {
+	return []string{http.MethodPost}
+}
+
+func (a *actionStorage) Connect(ctx context.Context, name string, _ runtime.Object, responder rest.Responder) (http.Handler, error) {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		obj, err := a.run(ctx, name, req.URL.Query())
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		responder.Object(http.StatusOK, obj)
+	}), nil
+}
+
+// run applies the action to the object name and returns the result. The
+// action is applied as an update, so it is subject to the same policy and
+// quota checks.
+func (a *actionStorage) run(ctx context.Context, name string, query url.Values) (out runtime.Object, err error) {
+	defer a.parent.observe(a.action, time.Now(), &err)
+	options := &metav1.UpdateOptions{DryRun: query["dryRun"]}
+	defer func() { a.parent.recordEvent(ctx, a.action, name, out, len(options.DryRun) > 0, err) }()
+	for _, d := range options.DryRun {
+		if d != metav1.DryRunAll {
+			return nil, errors.NewBadRequest(fmt.Sprintf("invalid dryRun %q", d))
+		}
+	}
+	var apply func(u *unstructured.Unstructured) error
+	switch a.action {
+	case ActionRestart:
+		restartedAt := time.Now().Format(time.RFC3339)
+		apply = func(u *unstructured.Unstructured) error {
+			return unstructured.SetNestedField(u.Object, restartedAt, "spec", "template", "metadata", "annotations", restartedAtAnnotation)
+		}
+	case ActionPause, ActionResume:
+		apply = func(u *unstructured.Unstructured) error {
+			return unstructured.SetNestedField(u.Object, a.action == ActionPause, "spec", "paused")
+		}
+	case ActionRollback:
+		toRevision := int64(0)
+		if s := query.Get("toRevision"); s != "" {
+			if toRevision, err = strconv.ParseInt(s, 10, 64); err != nil || toRevision < 0 {
+				return nil, errors.NewBadRequest(fmt.Sprintf("invalid toRevision %q", s))
+			}
+		}
+		template, err := a.rollbackTemplate(ctx, name, toRevision)
+		if err != nil {
+			return nil, err
+		}
+		apply = func(u *unstructured.Unstructured) error {
+			return unstructured.SetNestedField(u.Object, template, "spec", "template")
+		}
+	}
+	objInfo := rest.DefaultUpdatedObjectInfo(nil, func(_ context.Context, _, old runtime.Object) (runtime.Object, error) {
+		u := old.(*unstructured.Unstructured)
+		return u, apply(u)
+	})
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := a.parent.get(ctx, name, nil)
+		if err != nil {
+			return err
+		}
+		out, err = a.parent.update(ctx, name, existing.(*unstructured.Unstructured), objInfo, options)
+		return err
+	})
+	return out, err
+}
+
+// rollbackTemplate returns the pod template of revision toRevision of the
+// Deployment name, or of the revision before the current one if toRevision
+// is 0.
+func (a *actionStorage) rollbackTemplate(ctx context.Context, name string, toRevision int64) (map[string]interface{}, error) {
+	o, err := a.parent.get(ctx, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := o.(*unstructured.Unstructured)
+	current, _ := strconv.ParseInt(d.GetAnnotations()[revisionAnnotation], 10, 64)
+
+	ns, _ := request.NamespaceFrom(ctx)
+	l, err := newInstrumentedClient(ctx, a.parent.upstream, replicaSetsR, ns, a.parent.metrics).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	type revision struct {
+		number   int64
+		template map[string]interface{}
+	}
+	var history []revision
+	for _, rs := range l.Items {
+		owned := false
+		for _, ref := range rs.GetOwnerReferences() {
+			owned = owned || ref.UID == d.GetUID()
+		}
+		n, err := strconv.ParseInt(rs.GetAnnotations()[revisionAnnotation], 10, 64)
+		if !owned || err != nil {
+			continue
+		}
+		template, _, _ := unstructured.NestedMap(rs.Object, "spec", "template")
+		history = append(history, revision{n, template})
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].number > history[j].number })
+
+	for _, r := range history {
+		if toRevision == 0 && r.number < current || toRevision != 0 && r.number == toRevision {
+			// The hash label is added by the Deployment controller.
+			unstructured.RemoveNestedField(r.template, "metadata", "labels", "pod-template-hash")
+			return r.template, nil
+		}
+	}
+	if toRevision != 0 {
+		return nil, errors.NewBadRequest(fmt.Sprintf("unable to find revision %d of %s", toRevision, name))
+	}
+	return nil, errors.NewBadRequest(fmt.Sprintf("no previous revision of %s to roll back to", name))
+}
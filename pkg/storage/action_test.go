@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"net/url"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+var replicaSetsGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+
+func newAction(t *testing.T, s *restStorage, action string) *actionStorage {
+	t.Helper()
+	a, err := NewActionREST(s, action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*actionStorage)
+}
+
+func image(u *unstructured.Unstructured) string {
+	containers, _, _ := unstructured.NestedSlice(u.Object, "spec", "template", "spec", "containers")
+	if len(containers) == 0 {
+		return ""
+	}
+	return containers[0].(map[string]interface{})["image"].(string)
+}
+
+func withImage(u *unstructured.Unstructured, img string) *unstructured.Unstructured {
+	unstructured.SetNestedSlice(u.Object, []interface{}{
+		map[string]interface{}{"name": "web", "image": img},
+	}, "spec", "template", "spec", "containers")
+	return u
+}
+
+func TestActions(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	fake.Add(deploymentsGVR, newDeployment(intR.GroupVersion, "foo", nil))
+
+	obj, err := newAction(t, s, ActionRestart).run(ctx, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertExternal(t, obj)
+	upstream := fake.Object(deploymentsGVR, "default", "foo")
+	if _, ok, _ := unstructured.NestedString(upstream.Object, "spec", "template", "metadata", "annotations", restartedAtAnnotation); !ok {
+		t.Error("restart did not stamp the pod template")
+	}
+
+	for action, want := range map[string]bool{ActionPause: true, ActionResume: false} {
+		if _, err := newAction(t, s, action).run(ctx, "foo", nil); err != nil {
+			t.Fatal(err)
+		}
+		if paused, _, _ := unstructured.NestedBool(fake.Object(deploymentsGVR, "default", "foo").Object, "spec", "paused"); paused != want {
+			t.Errorf("after %s spec.paused = %v, want %v", action, paused, want)
+		}
+	}
+
+	if _, err := NewActionREST(s, "explode"); err == nil {
+		t.Error("NewActionREST accepted an unknown action")
+	}
+	pods := GroupVersionKindResource{GroupVersion: schema.GroupVersion{Version: "v1"}, Kind: "Pod", Resource: "pods"}
+	if _, err := NewActionREST(NewREST(extR, pods, true, false, s.upstream, nil, nil, Policy{}), ActionRestart); err == nil {
+		t.Error("NewActionREST accepted a resource proxied to pods")
+	}
+}
+
+func TestActionPolicy(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	fake.Add(deploymentsGVR, newDeployment(intR.GroupVersion, "foo", nil))
+	restartedAt := func() string {
+		v, _, _ := unstructured.NestedString(fake.Object(deploymentsGVR, "default", "foo").Object, "spec", "template", "metadata", "annotations", restartedAtAnnotation)
+		return v
+	}
+
+	// Dry runs return the result without changing the upstream object.
+	obj, err := newAction(t, s, ActionRestart).run(ctx, "foo", url.Values{"dryRun": {metav1.DryRunAll}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := unstructured.NestedString(obj.(*unstructured.Unstructured).Object, "spec", "template", "metadata", "annotations", restartedAtAnnotation); v == "" {
+		t.Error("dry run did not return the restarted object")
+	}
+	if v := restartedAt(); v != "" {
+		t.Errorf("dry run stamped the pod template with %s", v)
+	}
+	if _, err := newAction(t, s, ActionRestart).run(ctx, "foo", url.Values{"dryRun": {"Some"}}); !errors.IsBadRequest(err) {
+		t.Errorf("run with an invalid dryRun returned %v, want BadRequest", err)
+	}
+
+	// Actions are subject to the policy like updates.
+	s.policy = Policy{Immutable: []fieldpath.Path{fieldpath.MustParse("spec.template")}}
+	if _, err := newAction(t, s, ActionRestart).run(ctx, "foo", nil); !errors.IsInvalid(err) {
+		t.Errorf("restart of an immutable pod template returned %v, want Invalid", err)
+	}
+	if v := restartedAt(); v != "" {
+		t.Errorf("restart stamped an immutable pod template with %s", v)
+	}
+	if _, err := newAction(t, s, ActionPause).run(ctx, "foo", nil); err != nil {
+		t.Errorf("pause with an immutable pod template: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	d := withImage(newDeployment(intR.GroupVersion, "foo", nil), "web:v3")
+	d.SetAnnotations(map[string]string{revisionAnnotation: "3"})
+	d = fake.Add(deploymentsGVR, d)
+	for rev, img := range map[string]string{"1": "web:v1", "2": "web:v2", "3": "web:v3"} {
+		rs := withImage(newPart("apps/v1", "ReplicaSet", "foo-"+rev, "foo"), img)
+		rs.SetAnnotations(map[string]string{revisionAnnotation: rev})
+		unstructured.SetNestedField(rs.Object, "hash"+rev, "spec", "template", "metadata", "labels", "pod-template-hash")
+		rs.Object["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{
+			map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment", "name": "foo", "uid": string(d.GetUID())},
+		}
+		fake.Add(replicaSetsGVR, rs)
+	}
+	// ReplicaSets of other Deployments are ignored.
+	other := withImage(newPart("apps/v1", "ReplicaSet", "bar-1", "bar"), "bar:v9")
+	other.SetAnnotations(map[string]string{revisionAnnotation: "2"})
+	fake.Add(replicaSetsGVR, other)
+
+	rollback := newAction(t, s, ActionRollback)
+	if _, err := rollback.run(ctx, "foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	upstream := fake.Object(deploymentsGVR, "default", "foo")
+	if img := image(upstream); img != "web:v2" {
+		t.Errorf("rolled back to %s, want web:v2", img)
+	}
+	if _, ok, _ := unstructured.NestedString(upstream.Object, "spec", "template", "metadata", "labels", "pod-template-hash"); ok {
+		t.Error("pod-template-hash label was copied from the ReplicaSet")
+	}
+
+	if _, err := rollback.run(ctx, "foo", url.Values{"toRevision": {"1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if img := image(fake.Object(deploymentsGVR, "default", "foo")); img != "web:v1" {
+		t.Errorf("rolled back to %s, want web:v1", img)
+	}
+	if _, err := rollback.run(ctx, "foo", url.Values{"toRevision": {"7"}}); err == nil {
+		t.Error("rollback to a missing revision succeeded")
+	}
+}
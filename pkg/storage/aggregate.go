@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+)
+
+// aggregateBatchSize bounds the number of upstream events whose facade objects
+// are computed together.
+const aggregateBatchSize = 100
+
+// aggregateFuncs tie the upstream objects a facade object is made of back to
+// that object.
+type aggregateFuncs struct {
+	// owner returns the name of the facade object an upstream object belongs
+	// to, or "" if it belongs to none.
+	owner func(*unstructured.Unstructured) string
+	// get returns the current facade object.
+	get func(ctx context.Context, namespace, name string) (*unstructured.Unstructured, error)
+	// tombstone returns the object sent when a facade object is deleted.
+	tombstone func(namespace, name string) *unstructured.Unstructured
+	// matches filters the facade objects sent to the client.
+	matches func(*unstructured.Unstructured) bool
+}
+
+// watchAggregate watches the upstream resources in rs and sends the
+// recomputed facade object whenever one of its upstream objects changes.
+func watchAggregate(ctx context.Context, upstream Upstream, m metrics.Resource, rs []GroupVersionKindResource, namespace string, lo metav1.ListOptions, fns aggregateFuncs) (watch.Interface, error) {
+	w := &aggregateWatcher{
+		ctx:     ctx,
+		metrics: m,
+		fns:     fns,
+		known:   map[string]bool{},
+		resumed: lo.ResourceVersion != "" && lo.ResourceVersion != "0",
+		events:  make(chan watch.Event, aggregateBatchSize),
+		result:  make(chan watch.Event),
+		done:    make(chan struct{}),
+	}
+	seen := map[schema.GroupVersionResource]bool{}
+	var clients []*instrumentedClient
+	for _, r := range rs {
+		c := newInstrumentedClient(ctx, upstream, r, namespace, m)
+		if !seen[c.gvr] {
+			seen[c.gvr] = true
+			clients = append(clients, c)
+		}
+	}
+	if w.resumed {
+		// The client already holds the facade objects of the list it resumes
+		// from. Seed them from the current upstream state, which is at least
+		// as recent as the list, so that their changes are sent as MODIFIED
+		// and their deletions are not dropped.
+		for _, c := range clients {
+			l, err := c.List(metav1.ListOptions{LabelSelector: lo.LabelSelector})
+			if err != nil {
+				return nil, err
+			}
+			for i := range l.Items {
+				if name := fns.owner(&l.Items[i]); name != "" {
+					w.known[l.Items[i].GetNamespace()+"/"+name] = true
+				}
+			}
+		}
+	}
+	for _, c := range clients {
+		wi, err := c.Watch(lo)
+		if err != nil {
+			w.Stop()
+			return nil, err
+		}
+		w.upstream = append(w.upstream, wi)
+	}
+	m.WatchStarted()
+	for _, wi := range w.upstream {
+		go w.forward(wi)
+	}
+	go w.run()
+	return w, nil
+}
+
+type aggregateWatcher struct {
+	ctx      context.Context
+	metrics  metrics.Resource
+	fns      aggregateFuncs
+	upstream []watch.Interface
+	// known holds the facade objects sent to the client, mapped to false
+	// once their deletion has been sent.
+	known map[string]bool
+	// resumed is set if the watch started from a resourceVersion.
+	resumed  bool
+	events   chan watch.Event
+	result   chan watch.Event
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// forward passes the events of one upstream watch to run.
+func (w *aggregateWatcher) forward(wi watch.Interface) {
+	for e := range wi.ResultChan() {
+		select {
+		case w.events <- e:
+		case <-w.done:
+			return
+		}
+	}
+	// Upstream watches end on timeout; end the facade watch with them so
+	// that the client starts a new one.
+	w.Stop()
+}
+
+func (w *aggregateWatcher) run() {
+	defer w.metrics.WatchStopped()
+	defer close(w.result)
+	for {
+		var e watch.Event
+		select {
+		case e = <-w.events:
+		case <-w.done:
+			return
+		}
+		// Handle the events that queued up meanwhile together, so that a
+		// facade object whose parts changed at once is computed only once.
+		events := []watch.Event{e}
+	drain:
+		for len(events) < aggregateBatchSize {
+			select {
+			case e = <-w.events:
+				events = append(events, e)
+			default:
+				break drain
+			}
+		}
+		if !w.handle(events) {
+			return
+		}
+	}
+}
+
+// handle sends the facade objects the upstream events belong to, each
+// computed once after its last event. It returns false once the watch is
+// over.
+func (w *aggregateWatcher) handle(events []watch.Event) bool {
+	type change struct {
+		namespace, name, rv string
+		t                   watch.EventType
+	}
+	var changes []*change
+	byKey := map[string]*change{}
+	flush := func() bool {
+		for _, c := range changes {
+			out, ok := w.compute(c.namespace, c.name, c.rv, c.t)
+			if ok && !w.send(out) {
+				return false
+			}
+		}
+		changes, byKey = nil, map[string]*change{}
+		return true
+	}
+	for _, e := range events {
+		if e.Type == watch.Error {
+			if flush() {
+				w.send(e)
+			}
+			w.Stop()
+			return false
+		}
+		u, ok := e.Object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		name := w.fns.owner(u)
+		if name == "" {
+			continue
+		}
+		key := u.GetNamespace() + "/" + name
+		c := byKey[key]
+		if c == nil {
+			c = &change{namespace: u.GetNamespace(), name: name}
+			byKey[key] = c
+			changes = append(changes, c)
+		}
+		c.rv = u.GetResourceVersion()
+		// A deletion among the changes is what lets a resumed watch send
+		// the tombstone of an object it never saw.
+		if c.t != watch.Deleted {
+			c.t = e.Type
+		}
+	}
+	return flush()
+}
+
+// compute returns the event for the facade object name after one of its
+// upstream objects had an event of type t at resourceVersion rv.
+func (w *aggregateWatcher) compute(namespace, name, rv string, t watch.EventType) (watch.Event, bool) {
+	key := namespace + "/" + name
+	u, err := w.fns.get(w.ctx, namespace, name)
+	if errors.IsNotFound(err) {
+		sent, ok := w.known[key]
+		// A resumed watch replays the deletions since its resourceVersion,
+		// including those of objects the seed no longer saw.
+		if !sent && (ok || !w.resumed || t != watch.Deleted) {
+			return watch.Event{}, false
+		}
+		w.known[key] = false
+		u = w.fns.tombstone(namespace, name)
+		u.SetResourceVersion(rv)
+		return watch.Event{Type: watch.Deleted, Object: u}, true
+	}
+	if err != nil {
+		return watch.Event{Type: watch.Error, Object: &errors.NewInternalError(err).ErrStatus}, true
+	}
+	if !w.fns.matches(u) {
+		return watch.Event{}, false
+	}
+	// Resuming from the version of the change that triggered this event
+	// replays any later change already reflected in u, which is harmless.
+	u.SetResourceVersion(rv)
+	if w.known[key] {
+		return watch.Event{Type: watch.Modified, Object: u}, true
+	}
+	w.known[key] = true
+	return watch.Event{Type: watch.Added, Object: u}, true
+}
+
+func (w *aggregateWatcher) send(e watch.Event) bool {
+	select {
+	case w.result <- e:
+		w.metrics.WatchEvent(string(e.Type))
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *aggregateWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+func (w *aggregateWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		for _, wi := range w.upstream {
+			wi.Stop()
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+)
+
+// CompositePart is one of the upstream resources a composite resource is
+// made of.
+type CompositePart struct {
+	// Name identifies the part in the composite object.
+	Name     string
+	Resource GroupVersionKindResource
+}
+
+// NewCompositeREST returns a read-only rest.Storage serving res. Its objects
+// are assembled from the upstream objects of parts that have the same value
+// for label; the value is the name of the composite object.
+//
+// The part objects are listed in spec.components and their readiness is
+// rolled up into status.
+func NewCompositeREST(res GroupVersionKindResource, nsScoped bool, label string, parts []CompositePart, upstream Upstream, shortNames, categories []string) rest.Storage {
+	return &compositeStorage{
+		kind:            res,
+		gr:              schema.GroupResource{Group: res.GroupVersion.Group, Resource: res.Resource},
+		namespaceScoped: nsScoped,
+		label:           label,
+		parts:           parts,
+		upstream:        upstream,
+		shortNames:      shortNames,
+		categories:      categories,
+		metrics: metrics.Resource{
+			Group:    res.GroupVersion.Group,
+			Version:  res.GroupVersion.Version,
+			Resource: res.Resource,
+			Cluster:  upstream.Name,
+		},
+	}
+}
+
+type compositeStorage struct {
+	kind            GroupVersionKindResource
+	gr              schema.GroupResource
+	namespaceScoped bool
+	label           string
+	parts           []CompositePart
+	upstream        Upstream
+	shortNames      []string
+	categories      []string
+	metrics         metrics.Resource
+}
+
+func (s *compositeStorage) Categories() []string {
+	return s.categories
+}
+
+func (s *compositeStorage) ShortNames() []string {
+	return s.shortNames
+}
+
+func (s *compositeStorage) NamespaceScoped() bool {
+	return s.namespaceScoped
+}
+
+func (s *compositeStorage) New() runtime.Object {
+	u := &unstructured.Unstructured{}
+	s.kind.Assign(u)
+	return u
+}
+
+func (s *compositeStorage) NewList() runtime.Object {
+	ul := &unstructured.UnstructuredList{}
+	s.kind.AssignList(ul)
+	return ul
+}
+
+func (s *compositeStorage) observe(verb string, start time.Time, err *error) {
+	s.metrics.ObserveRequest(verb, start, *err)
+}
+
+func (s *compositeStorage) client(ctx context.Context, part CompositePart, namespace string) *instrumentedClient {
+	return newInstrumentedClient(ctx, s.upstream, part.Resource, namespace, s.metrics)
+}
+
+// selector returns the label selector matching the parts of the composite
+// object name, or of all composite objects if name is empty.
+func (s *compositeStorage) selector(name string) string {
+	if name == "" {
+		return s.label
+	}
+	return labels.SelectorFromSet(labels.Set{s.label: name}).String()
+}
+
+// partLists holds the objects of every part, in the order of s.parts.
+type partLists [][]unstructured.Unstructured
+
+// listParts lists the objects of all parts matching the selector for name.
+// The returned resourceVersion is the oldest of the part lists, so that a
+// watch started from it misses no change to any part.
+func (s *compositeStorage) listParts(ctx context.Context, namespace, name string) (partLists, string, error) {
+	lists := make(partLists, len(s.parts))
+	var rv string
+	for i, part := range s.parts {
+		l, err := s.client(ctx, part, namespace).List(metav1.ListOptions{LabelSelector: s.selector(name)})
+		if err != nil {
+			return nil, "", err
+		}
+		lists[i] = l.Items
+		if rv == "" || compareResourceVersions(l.GetResourceVersion(), rv) < 0 {
+			rv = l.GetResourceVersion()
+		}
+	}
+	return lists, rv, nil
+}
+
+// compareResourceVersions orders resourceVersions numerically if possible.
+func compareResourceVersions(a, b string) int {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// assemble groups the part objects by namespace and label value into
+// composite objects, sorted by namespace and name.
+func (s *compositeStorage) assemble(lists partLists) []*unstructured.Unstructured {
+	byKey := map[string]partLists{}
+	var keys []string
+	for i, items := range lists {
+		for _, item := range items {
+			name := item.GetLabels()[s.label]
+			if name == "" {
+				continue
+			}
+			key := item.GetNamespace() + "/" + name
+			if _, ok := byKey[key]; !ok {
+				byKey[key] = make(partLists, len(s.parts))
+				keys = append(keys, key)
+			}
+			byKey[key][i] = append(byKey[key][i], item)
+		}
+	}
+	sort.Strings(keys)
+	var out []*unstructured.Unstructured
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 2)
+		out = append(out, s.compose(parts[0], parts[1], byKey[key]))
+	}
+	return out
+}
+
+// compose builds the composite object name from the objects of its parts.
+func (s *compositeStorage) compose(namespace, name string, lists partLists) *unstructured.Unstructured {
+	u := s.New().(*unstructured.Unstructured)
+	u.SetName(name)
+	u.SetNamespace(namespace)
+	u.SetLabels(map[string]string{s.label: name})
+
+	var rv string
+	var created metav1.Time
+	var components, statuses []interface{}
+	var notReady []string
+	allReady := true
+	for i, part := range s.parts {
+		items := lists[i]
+		sort.Slice(items, func(a, b int) bool { return items[a].GetName() < items[b].GetName() })
+		objects := []interface{}{}
+		var ready int64
+		for _, item := range items {
+			if r := item.GetResourceVersion(); rv == "" || compareResourceVersions(r, rv) > 0 {
+				rv = r
+			}
+			if c := item.GetCreationTimestamp(); created.IsZero() || c.Before(&created) {
+				created = c
+			}
+			if partReady(&item) {
+				ready++
+			}
+			obj := item.DeepCopy()
+			unstructured.RemoveNestedField(obj.Object, "status")
+			objects = append(objects, obj.Object)
+		}
+		components = append(components, map[string]interface{}{
+			"name":       part.Name,
+			"apiVersion": part.Resource.GroupVersion.String(),
+			"kind":       part.Resource.Kind,
+			"objects":    objects,
+		})
+		statuses = append(statuses, map[string]interface{}{
+			"name":  part.Name,
+			"total": int64(len(items)),
+			"ready": ready,
+		})
+		if ready < int64(len(items)) {
+			allReady = false
+			notReady = append(notReady, fmt.Sprintf("%s: %d/%d ready", part.Name, ready, len(items)))
+		}
+	}
+	u.SetResourceVersion(rv)
+	u.SetCreationTimestamp(created)
+
+	condition := map[string]interface{}{
+		"type":   "Ready",
+		"status": string(metav1.ConditionTrue),
+		"reason": "ComponentsReady",
+	}
+	if !allReady {
+		condition["status"] = string(metav1.ConditionFalse)
+		condition["reason"] = "ComponentsNotReady"
+		condition["message"] = strings.Join(notReady, ", ")
+	}
+	u.Object["spec"] = map[string]interface{}{"components": components}
+	u.Object["status"] = map[string]interface{}{
+		"ready":      allReady,
+		"components": statuses,
+		"conditions": []interface{}{condition},
+	}
+	return u
+}
+
+// partReady guesses whether an upstream object is ready from its status: an
+// Available or Ready condition wins, then ready replicas; objects without
+// either, like Services and ConfigMaps, are always ready.
+func partReady(u *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	for _, t := range []string{"Available", "Ready"} {
+		for _, c := range conditions {
+			c, ok := c.(map[string]interface{})
+			if ok && c["type"] == t {
+				return c["status"] == string(metav1.ConditionTrue)
+			}
+		}
+	}
+	if replicas, ok, _ := unstructured.NestedInt64(u.Object, "spec", "replicas"); ok {
+		ready, _, _ := unstructured.NestedInt64(u.Object, "status", "readyReplicas")
+		return ready >= replicas
+	}
+	return true
+}
+
+// matchesSelectors reports whether u is selected by label and field.
+func matchesSelectors(u *unstructured.Unstructured, label labels.Selector, field fields.Selector) bool {
+	if label != nil && !label.Matches(labels.Set(u.GetLabels())) {
+		return false
+	}
+	if field != nil && !field.Matches(fields.Set{
+		"metadata.name":      u.GetName(),
+		"metadata.namespace": u.GetNamespace(),
+	}) {
+		return false
+	}
+	return true
+}
+
+func (s *compositeStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (_ runtime.Object, err error) {
+	defer s.observe("get", time.Now(), &err)
+	ns, _ := request.NamespaceFrom(ctx)
+	return s.get(ctx, ns, name)
+}
+
+func (s *compositeStorage) get(ctx context.Context, namespace, name string) (*unstructured.Unstructured, error) {
+	lists, _, err := s.listParts(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, items := range lists {
+		if len(items) > 0 {
+			return s.compose(namespace, name, lists), nil
+		}
+	}
+	return nil, errors.NewNotFound(s.gr, name)
+}
+
+func (s *compositeStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (_ runtime.Object, err error) {
+	defer s.observe("list", time.Now(), &err)
+	if options == nil {
+		options = &metainternalversion.ListOptions{}
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	lists, rv, err := s.listParts(ctx, ns, "")
+	if err != nil {
+		return nil, err
+	}
+	out := s.NewList().(*unstructured.UnstructuredList)
+	out.SetResourceVersion(rv)
+	for _, u := range s.assemble(lists) {
+		if matchesSelectors(u, options.LabelSelector, options.FieldSelector) {
+			out.Items = append(out.Items, *u)
+		}
+	}
+	return out, nil
+}
+
+// Watch watches all parts and sends the recomputed composite object whenever
+// one of its parts changes.
+func (s *compositeStorage) Watch(ctx context.Context, options *metainternalversion.ListOptions) (_ watch.Interface, err error) {
+	defer s.observe("watch", time.Now(), &err)
+	if options == nil {
+		options = &metainternalversion.ListOptions{}
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	var gvrs []GroupVersionKindResource
+	for _, part := range s.parts {
+		gvrs = append(gvrs, part.Resource)
+	}
+	return watchAggregate(ctx, s.upstream, s.metrics, gvrs, ns, metav1.ListOptions{LabelSelector: s.label, ResourceVersion: options.ResourceVersion}, aggregateFuncs{
+		owner: func(u *unstructured.Unstructured) string { return u.GetLabels()[s.label] },
+		get:   s.get,
+		tombstone: func(namespace, name string) *unstructured.Unstructured {
+			u := s.New().(*unstructured.Unstructured)
+			u.SetName(name)
+			u.SetNamespace(namespace)
+			u.SetLabels(map[string]string{s.label: name})
+			return u
+		},
+		matches: func(u *unstructured.Unstructured) bool {
+			return matchesSelectors(u, options.LabelSelector, options.FieldSelector)
+		},
+	})
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+)
+
+var (
+	applicationR = GroupVersionKindResource{
+		GroupVersion: schema.GroupVersion{Group: "apps.maisem.dev", Version: "v1"},
+		Kind:         "Application",
+		Resource:     "applications",
+	}
+	servicesGVR   = schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	configMapsGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+)
+
+func newTestCompositeStorage(t *testing.T) (*compositeStorage, *fakeupstream.Server) {
+	t.Helper()
+	fake := fakeupstream.New()
+	upstream, err := NewUpstream("fake", fake.Config())
+	if err != nil {
+		fake.Close()
+		t.Fatal(err)
+	}
+	parts := []CompositePart{
+		{Name: "deployment", Resource: intR},
+		{Name: "service", Resource: GroupVersionKindResource{GroupVersion: schema.GroupVersion{Version: "v1"}, Kind: "Service", Resource: "services"}},
+		{Name: "config", Resource: GroupVersionKindResource{GroupVersion: schema.GroupVersion{Version: "v1"}, Kind: "ConfigMap", Resource: "configmaps"}},
+	}
+	return NewCompositeREST(applicationR, true, "app", parts, upstream, nil, nil).(*compositeStorage), fake
+}
+
+func newPart(apiVersion, kind, name, app string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetNamespace("default")
+	u.SetName(name)
+	u.SetLabels(map[string]string{"app": app})
+	return u
+}
+
+func componentStatus(t *testing.T, u *unstructured.Unstructured, part string) (total, ready int64) {
+	t.Helper()
+	statuses, _, _ := unstructured.NestedSlice(u.Object, "status", "components")
+	for _, s := range statuses {
+		s := s.(map[string]interface{})
+		if s["name"] == part {
+			return s["total"].(int64), s["ready"].(int64)
+		}
+	}
+	t.Fatalf("no status for component %s", part)
+	return 0, 0
+}
+
+func TestCompositeGet(t *testing.T) {
+	s, fake := newTestCompositeStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	deployment := newDeployment(intR.GroupVersion, "web", map[string]string{"app": "web"})
+	unstructured.SetNestedField(deployment.Object, int64(0), "status", "readyReplicas")
+	fake.Add(deploymentsGVR, deployment)
+	fake.Add(servicesGVR, newPart("v1", "Service", "web", "web"))
+	fake.Add(configMapsGVR, newPart("v1", "ConfigMap", "api-config", "api"))
+
+	obj, err := s.Get(ctx, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := obj.(*unstructured.Unstructured)
+	if u.GetAPIVersion() != "apps.maisem.dev/v1" || u.GetKind() != "Application" || u.GetName() != "web" {
+		t.Fatalf("got %s %s %s", u.GetAPIVersion(), u.GetKind(), u.GetName())
+	}
+	components, _, _ := unstructured.NestedSlice(u.Object, "spec", "components")
+	if len(components) != 3 {
+		t.Fatalf("got %d components, want 3", len(components))
+	}
+	if objects := components[0].(map[string]interface{})["objects"].([]interface{}); len(objects) != 1 {
+		t.Errorf("deployment component has %d objects, want 1", len(objects))
+	}
+	if total, ready := componentStatus(t, u, "deployment"); total != 1 || ready != 0 {
+		t.Errorf("deployment status = %d/%d, want 0/1", ready, total)
+	}
+	if total, ready := componentStatus(t, u, "service"); total != 1 || ready != 1 {
+		t.Errorf("service status = %d/%d, want 1/1", ready, total)
+	}
+	if ready, _, _ := unstructured.NestedBool(u.Object, "status", "ready"); ready {
+		t.Error("application is ready although its deployment is not")
+	}
+
+	if _, err := s.Get(ctx, "missing", nil); !errors.IsNotFound(err) {
+		t.Errorf("get of a missing application returned %v, want NotFound", err)
+	}
+}
+
+func TestCompositeList(t *testing.T) {
+	s, fake := newTestCompositeStorage(t)
+	defer fake.Close()
+	fake.Add(servicesGVR, newPart("v1", "Service", "web", "web"))
+	fake.Add(configMapsGVR, newPart("v1", "ConfigMap", "api-config", "api"))
+	fake.Add(configMapsGVR, newPart("v1", "ConfigMap", "unlabelled", ""))
+
+	obj, err := s.List(ctxWithNamespace(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := obj.(*unstructured.UnstructuredList)
+	var got []string
+	for _, u := range l.Items {
+		got = append(got, u.GetName())
+	}
+	if len(got) != 2 || got[0] != "api" || got[1] != "web" {
+		t.Errorf("list returned %v, want [api web]", got)
+	}
+	if l.GetResourceVersion() == "" {
+		t.Error("list has no resourceVersion")
+	}
+}
+
+func TestCompositeWatch(t *testing.T) {
+	s, fake := newTestCompositeStorage(t)
+	defer fake.Close()
+	w, err := s.Watch(ctxWithNamespace(), &metainternalversion.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	fake.Add(servicesGVR, newPart("v1", "Service", "web", "web"))
+	e := nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Added || u.GetName() != "web" || u.GetKind() != "Application" {
+		t.Fatalf("got %s event for %s %s, want ADDED Application web", e.Type, u.GetKind(), u.GetName())
+	}
+	fake.Add(configMapsGVR, newPart("v1", "ConfigMap", "web-config", "web"))
+	e = nextEvent(t, w)
+	if e.Type != watch.Modified {
+		t.Fatalf("got %s event, want MODIFIED", e.Type)
+	}
+	if total, _ := componentStatus(t, e.Object.(*unstructured.Unstructured), "config"); total != 1 {
+		t.Errorf("config component has %d objects, want 1", total)
+	}
+}
+
+func TestCompositeWatchFromList(t *testing.T) {
+	s, fake := newTestCompositeStorage(t)
+	defer fake.Close()
+	fake.Add(servicesGVR, newPart("v1", "Service", "web", "web"))
+	fake.Add(configMapsGVR, newPart("v1", "ConfigMap", "web-config", "web"))
+	fake.Add(servicesGVR, newPart("v1", "Service", "api", "api"))
+	fake.Add(servicesGVR, newPart("v1", "Service", "gone", "gone"))
+
+	obj, err := s.List(ctxWithNamespace(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := obj.(*unstructured.UnstructuredList).GetResourceVersion()
+	services := s.upstream.Client.Resource(servicesGVR).Namespace("default")
+	configMaps := s.upstream.Client.Resource(configMapsGVR).Namespace("default")
+	// Deleted between the list and the watch.
+	if err := services.Delete("gone", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := s.Watch(ctxWithNamespace(), &metainternalversion.ListOptions{ResourceVersion: rv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	e := nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Deleted || u.GetName() != "gone" {
+		t.Fatalf("got %s event for %s, want DELETED gone", e.Type, u.GetName())
+	}
+
+	if err := services.Delete("api", nil); err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Deleted || u.GetName() != "api" {
+		t.Fatalf("got %s event for %s, want DELETED api", e.Type, u.GetName())
+	}
+
+	if err := configMaps.Delete("web-config", nil); err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Modified || u.GetName() != "web" {
+		t.Fatalf("got %s event for %s, want MODIFIED web", e.Type, u.GetName())
+	}
+	if err := services.Delete("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Deleted || u.GetName() != "web" {
+		t.Fatalf("got %s event for %s, want DELETED web", e.Type, u.GetName())
+	}
+}
+
+func TestAggregateCoalescesEvents(t *testing.T) {
+	var gets []string
+	w := &aggregateWatcher{
+		ctx:     context.Background(),
+		metrics: metrics.Resource{Resource: "applications"},
+		fns: aggregateFuncs{
+			owner: func(u *unstructured.Unstructured) string { return u.GetLabels()["app"] },
+			get: func(_ context.Context, namespace, name string) (*unstructured.Unstructured, error) {
+				gets = append(gets, name)
+				return newPart("apps.maisem.dev/v1", "Application", name, name), nil
+			},
+			matches: func(*unstructured.Unstructured) bool { return true },
+		},
+		known:  map[string]bool{},
+		events: make(chan watch.Event, aggregateBatchSize),
+		result: make(chan watch.Event),
+		done:   make(chan struct{}),
+	}
+	defer w.Stop()
+	for i, part := range []*unstructured.Unstructured{
+		newPart("v1", "Service", "web", "web"),
+		newPart("v1", "ConfigMap", "web-config", "web"),
+		newPart("v1", "Service", "api", "api"),
+		newPart("apps/v1", "Deployment", "web", "web"),
+	} {
+		part.SetResourceVersion(strconv.Itoa(i + 1))
+		w.events <- watch.Event{Type: watch.Added, Object: part}
+	}
+	go w.run()
+
+	for _, want := range []string{"web 4", "api 3"} {
+		e := nextEvent(t, w)
+		u := e.Object.(*unstructured.Unstructured)
+		if got := u.GetName() + " " + u.GetResourceVersion(); e.Type != watch.Added || got != want {
+			t.Errorf("got %s event for %s, want ADDED %s", e.Type, got, want)
+		}
+	}
+	if len(gets) != 2 {
+		t.Errorf("computed %v, want each object once", gets)
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// deleteCollectionWorkers bounds the number of concurrent upstream deletes
+// issued by a single DeleteCollection call.
+const deleteCollectionWorkers = 16
+
+// causeTypeDeleteFailed is the cause reported for each item DeleteCollection
+// failed to delete.
+const causeTypeDeleteFailed metav1.CauseType = "DeleteFailed"
+
+// DeleteCollection selects all resources in the storage matching given 'listOptions'
+// and deletes them. The delete attempt is validated by the deleteValidation first.
+// If 'options' are provided, the resource will attempt to honor them or return an
+// invalid request error.
+// DeleteCollection may not be atomic - i.e. it may delete some objects and still
+// return an error after it. On success, returns a list of deleted objects.
+//
+// Without admission control there is nothing to validate per item, so the
+// whole collection is deleted upstream in a single call. Otherwise items are
+// validated and deleted concurrently, and failures are reported together once
+// every item has been attempted.
+func (r *restStorage) DeleteCollection(ctx context.Context, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions, listOptions *metainternalversion.ListOptions) (_ runtime.Object, err error) {
+	defer r.observe("deletecollection", time.Now(), &err)
+	if listOptions == nil {
+		listOptions = &metainternalversion.ListOptions{}
+	} else {
+		listOptions = listOptions.DeepCopy()
+	}
+	// Deletion applies to the whole collection.
+	listOptions.Limit = 0
+	listOptions.Continue = ""
+
+	l, err := r.list(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*unstructured.UnstructuredList)
+	if !r.admission {
+		return r.deleteCollectionUpstream(ctx, ul, options, listOptions)
+	}
+	return r.deleteCollectionItems(ctx, ul, deleteValidation, options)
+}
+
+func (r *restStorage) deleteCollectionUpstream(ctx context.Context, ul *unstructured.UnstructuredList, options *metav1.DeleteOptions, listOptions *metainternalversion.ListOptions) (runtime.Object, error) {
+	lo, err := toMetaListOptions(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = r.getClient(ctx).DeleteCollection(options, lo)
+	for i := range ul.Items {
+		r.recordEvent(ctx, "delete", ul.Items[i].GetName(), &ul.Items[i], options != nil && len(options.DryRun) > 0, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ul, nil
+}
+
+func (r *restStorage) deleteCollectionItems(ctx context.Context, ul *unstructured.UnstructuredList, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (runtime.Object, error) {
+	var (
+		mu      sync.Mutex
+		deleted = make([]*unstructured.Unstructured, len(ul.Items))
+		failed  = map[string]error{}
+	)
+	workqueue.ParallelizeUntil(ctx, deleteCollectionWorkers, len(ul.Items), func(i int) {
+		name := ul.Items[i].GetName()
+		obj, _, err := r.delete(ctx, name, deleteValidation, options)
+		if errors.IsNotFound(err) {
+			// Someone else got there first.
+			return
+		}
+		if err != nil {
+			klog.Errorf("failed to delete %s %q: %v", r.mapper.External.Resource, name, err)
+			mu.Lock()
+			failed[name] = err
+			mu.Unlock()
+			return
+		}
+		deleted[i] = obj.(*unstructured.Unstructured)
+	})
+
+	out := r.NewList().(*unstructured.UnstructuredList)
+	out.SetResourceVersion(ul.GetResourceVersion())
+	for _, u := range deleted {
+		if u != nil {
+			out.Items = append(out.Items, *u)
+		}
+	}
+	if err := ctx.Err(); err != nil && len(failed)+len(out.Items) < len(ul.Items) {
+		return out, errors.NewTimeoutError(fmt.Sprintf("deleted %d of %d %s before the request was cancelled", len(out.Items), len(ul.Items), r.mapper.External.Resource), 0)
+	}
+	if len(failed) > 0 {
+		return out, r.deleteCollectionError(failed, len(ul.Items))
+	}
+	klog.V(4).Infof("deleted %d %s", len(out.Items), r.mapper.External.Resource)
+	return out, nil
+}
+
+// deleteCollectionError aggregates the per-item failures of DeleteCollection
+// into a single status with one cause per item. The status code is the one
+// shared by all failures, or 500 if they differ.
+func (r *restStorage) deleteCollectionError(failed map[string]error, total int) error {
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	status := metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: fmt.Sprintf("failed to delete %d of %d %s", len(failed), total, r.mapper.External.Resource),
+		Details: &metav1.StatusDetails{
+			Group: r.mapper.External.Group,
+			Kind:  r.mapper.External.Resource,
+		},
+	}
+	for i, name := range names {
+		s := toStatus(failed[name])
+		if i == 0 {
+			status.Code, status.Reason = s.Code, s.Reason
+		} else if s.Code != status.Code {
+			status.Code, status.Reason = http.StatusInternalServerError, metav1.StatusReasonInternalError
+		}
+		status.Details.Causes = append(status.Details.Causes, metav1.StatusCause{
+			Type:    causeTypeDeleteFailed,
+			Field:   name,
+			Message: s.Message,
+		})
+	}
+	return &errors.StatusError{ErrStatus: status}
+}
+
+func toStatus(err error) metav1.Status {
+	if s, ok := err.(errors.APIStatus); ok {
+		return s.Status()
+	}
+	return errors.NewInternalError(err).Status()
+}
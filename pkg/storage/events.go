@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded for facade requests that did not succeed.
+const (
+	// EventReasonDenied is recorded for requests rejected by the proxy's
+	// policy, admission or the upstream cluster.
+	EventReasonDenied = "Denied"
+	// EventReasonForwardFailed is recorded for requests that could not be
+	// forwarded upstream.
+	EventReasonForwardFailed = "ForwardFailed"
+)
+
+// eventVerbs holds the reason and past tense of the verbs recorded as events.
+var eventVerbs = map[string]struct{ reason, past string }{
+	"create":       {"Created", "created"},
+	"update":       {"Updated", "updated"},
+	"delete":       {"Deleted", "deleted"},
+	ActionRestart:  {"Restarted", "restarted"},
+	ActionPause:    {"Paused", "paused"},
+	ActionResume:   {"Resumed", "resumed"},
+	ActionRollback: {"RolledBack", "rolled back"},
+}
+
+// StartEventRecorder returns a recorder that records events as component in
+// the upstream cluster until stopCh is closed.
+func (u Upstream) StartEventRecorder(component string, stopCh <-chan struct{}) (record.EventRecorder, error) {
+	if u.core == nil {
+		return nil, fmt.Errorf("upstream %s does not support recording events", u.Name)
+	}
+	b := record.NewBroadcaster()
+	w := b.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: u.core.Events("")})
+	go func() {
+		<-stopCh
+		w.Stop()
+	}()
+	return b.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component}), nil
+}
+
+// recordEvent records the outcome err of the facade request verb on the
+// object name, or the returned obj, as an event on the upstream object.
+// Dry runs and failures clients are expected to handle, like conflicts, are
+// not recorded.
+func (r *restStorage) recordEvent(ctx context.Context, verb, name string, obj runtime.Object, dryRun bool, err error) {
+	rec := r.upstream.Recorder
+	if rec == nil || dryRun {
+		return
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	ref := &corev1.ObjectReference{
+		APIVersion: r.mapper.Internal.GroupVersion.String(),
+		Kind:       r.mapper.Internal.Kind,
+		Namespace:  ns,
+		Name:       name,
+	}
+	if obj != nil {
+		if m, err := meta.Accessor(obj); err == nil {
+			ref.Name, ref.UID = m.GetName(), m.GetUID()
+		}
+	}
+	if ref.Name == "" {
+		return
+	}
+	facade := r.groupResource().String() + " " + ref.Name
+	if ns != "" {
+		facade = r.groupResource().String() + " " + ns + "/" + ref.Name
+	}
+	u, _ := request.UserFrom(ctx)
+	switch {
+	case err == nil:
+		v := eventVerbs[verb]
+		rec.Eventf(ref, corev1.EventTypeNormal, v.reason, "%s %s %s", userName(u), v.past, facade)
+	case errors.IsForbidden(err) || errors.IsInvalid(err):
+		rec.Eventf(ref, corev1.EventTypeWarning, EventReasonDenied, "%s of %s by %s denied: %v", verb, facade, userName(u), err)
+	case errors.IsNotFound(err) || errors.IsConflict(err) || errors.IsAlreadyExists(err) || errors.IsBadRequest(err):
+	default:
+		rec.Eventf(ref, corev1.EventTypeWarning, EventReasonForwardFailed, "%s of %s by %s could not be forwarded: %v", verb, facade, userName(u), err)
+	}
+}
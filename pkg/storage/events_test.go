@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+// events returns the events recorded so far.
+func events(rec *record.FakeRecorder) []string {
+	var out []string
+	for {
+		select {
+		case e := <-rec.Events:
+			out = append(out, e)
+		default:
+			return out
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	rec := record.NewFakeRecorder(10)
+	s.upstream.Recorder = rec
+	s.policy = Policy{Immutable: []fieldpath.Path{fieldpath.MustParse("metadata.labels.team")}}
+	ctx := ctxWithUser("alice")
+
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", map[string]string{"team": "a"}), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	dryRun := &metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "bar", nil), rest.ValidateAllObjectFunc, dryRun); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Object(deploymentsGVR, "default", "bar") != nil {
+		t.Fatal("dry-run create stored the object upstream")
+	}
+	baz := rest.DefaultUpdatedObjectInfo(newDeployment(extR.GroupVersion, "baz", nil))
+	if _, _, err := s.Update(ctx, "baz", baz, rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, true, &metav1.UpdateOptions{DryRun: dryRun.DryRun}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Object(deploymentsGVR, "default", "baz") != nil {
+		t.Fatal("dry-run update of a missing object created it upstream")
+	}
+	update := func(team string) error {
+		obj, err := s.Get(ctx, "foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := obj.(*unstructured.Unstructured)
+		u.SetLabels(map[string]string{"team": team})
+		_, _, err = s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+		return err
+	}
+	if err := update("b"); !errors.IsInvalid(err) {
+		t.Fatalf("update of an immutable field returned %v, want Invalid", err)
+	}
+	fake.FailNext(http.MethodPut, "/apis/apps/v1/namespaces/default/deployments/foo", errors.NewServiceUnavailable("upstream is down"))
+	if err := update("a"); err == nil {
+		t.Fatal("update did not fail")
+	}
+	// Conflicts and missing objects are left to clients.
+	if _, _, err := s.Delete(ctx, "missing", rest.ValidateAllObjectFunc, nil); !errors.IsNotFound(err) {
+		t.Fatalf("delete of a missing object returned %v, want NotFound", err)
+	}
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, &metav1.DeleteOptions{DryRun: []string{metav1.DryRunAll}}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Object(deploymentsGVR, "default", "foo") == nil {
+		t.Fatal("dry-run delete removed the object upstream")
+	}
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := events(rec)
+	want := []string{
+		`Normal Created user "alice" created deployments.apps.maisem.dev default/foo`,
+		`Warning Denied update of deployments.apps.maisem.dev default/foo by user "alice" denied:`,
+		`Warning ForwardFailed update of deployments.apps.maisem.dev default/foo by user "alice" could not be forwarded: upstream is down`,
+		`Normal Deleted user "alice" deleted deployments.apps.maisem.dev default/foo`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("recorded events %q, want %d events", got, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("event %d = %q, want prefix %q", i, got[i], want[i])
+		}
+	}
+}
+
+// refRecorder records the objects events are recorded on.
+type refRecorder struct {
+	record.FakeRecorder
+	objects []runtime.Object
+}
+
+func (r *refRecorder) Eventf(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.objects = append(r.objects, obj)
+}
+
+func TestEventObject(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	rec := &refRecorder{}
+	s.upstream.Recorder = rec
+	created, err := s.Create(ctxWithNamespace(), newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.objects) != 1 {
+		t.Fatalf("recorded %d events, want 1", len(rec.objects))
+	}
+	// Events are recorded on the upstream object so that they show up next
+	// to the ones of its controllers.
+	got := rec.objects[0].(*corev1.ObjectReference)
+	want := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "foo", UID: created.(*unstructured.Unstructured).GetUID()}
+	if *got != *want {
+		t.Errorf("event recorded on %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,732 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/validation/path"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	storagenames "k8s.io/apiserver/pkg/storage/names"
+	"sigs.k8s.io/yaml"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+)
+
+// resourceVersionFile holds the last resourceVersion handed out for a
+// resource so that versions keep increasing across restarts.
+const resourceVersionFile = ".resourceversion"
+
+// NewFileREST returns a rest.Storage that keeps the objects of res as YAML
+// files in dir, laid out as <group>/<resource>/[<namespace>/]<name>.yaml. The
+// core group is stored as "core".
+func NewFileREST(res GroupVersionKindResource, nsScoped bool, dir string, shortNames, categories []string) rest.Storage {
+	group := res.GroupVersion.Group
+	if group == "" {
+		group = "core"
+	}
+	s := &fileStorage{
+		kind:            res,
+		gr:              schema.GroupResource{Group: res.GroupVersion.Group, Resource: res.Resource},
+		dir:             filepath.Join(dir, group, res.Resource),
+		namespaceScoped: nsScoped,
+		shortNames:      shortNames,
+		categories:      categories,
+		metrics: metrics.Resource{
+			Group:    res.GroupVersion.Group,
+			Version:  res.GroupVersion.Version,
+			Resource: res.Resource,
+			Cluster:  "file",
+		},
+		mu: &sync.Mutex{},
+	}
+	s.history = newCounterHistory(s)
+	return s
+}
+
+// fileStorage serves a resource from YAML files. Writes through the API are
+// serialized; changes made to the files by other means are picked up by
+// watches but are not subject to conflict detection.
+type fileStorage struct {
+	kind            GroupVersionKindResource
+	gr              schema.GroupResource
+	dir             string
+	namespaceScoped bool
+	shortNames      []string
+	categories      []string
+	metrics         metrics.Resource
+	history         fileHistory
+	// mu serializes writes. Storages sharing a history share it as well.
+	mu *sync.Mutex
+}
+
+// fileHistory versions the changes made to the files of a fileStorage and
+// feeds its watches.
+type fileHistory interface {
+	// next returns the resourceVersion of the next change. It is called with
+	// the storage's mu held.
+	next() (string, error)
+	// current returns the resourceVersion of the last change.
+	current() (string, error)
+	// record persists the creation, update or deletion (as given by verb) of
+	// u, stored at path, on behalf of the user in ctx. It is called with the
+	// storage's mu held, after the file has been written or removed.
+	record(ctx context.Context, verb, path string, u *unstructured.Unstructured) error
+	// watch starts a watch of the objects accepted by filter. If initial is
+	// set the current objects are sent as ADDED events first, otherwise
+	// changes after resourceVersion since are.
+	watch(filter func(*unstructured.Unstructured) bool, initial bool, since uint64) (watch.Interface, error)
+}
+
+func (s *fileStorage) Categories() []string {
+	return s.categories
+}
+
+func (s *fileStorage) ShortNames() []string {
+	return s.shortNames
+}
+
+func (s *fileStorage) NamespaceScoped() bool {
+	return s.namespaceScoped
+}
+
+func (s *fileStorage) New() runtime.Object {
+	u := &unstructured.Unstructured{}
+	s.kind.Assign(u)
+	return u
+}
+
+func (s *fileStorage) NewList() runtime.Object {
+	ul := &unstructured.UnstructuredList{}
+	s.kind.AssignList(ul)
+	return ul
+}
+
+func (s *fileStorage) observe(verb string, start time.Time, err *error) {
+	s.metrics.ObserveRequest(verb, start, *err)
+}
+
+// validateName returns the reasons name cannot be used as the file name of an
+// object, if any. Names starting with a dot are reserved for the storage's own
+// files.
+func validateName(name string) []string {
+	msgs := path.IsValidPathSegmentName(name)
+	if strings.HasPrefix(name, ".") {
+		msgs = append(msgs, "may not start with '.'")
+	}
+	return msgs
+}
+
+// path returns the file an object is stored in. It fails if namespace or name
+// would address a file outside of the resource's directory.
+func (s *fileStorage) path(namespace, name string) (string, error) {
+	for _, segment := range []string{namespace, name} {
+		if msgs := validateName(segment); segment != "" && len(msgs) > 0 {
+			return "", errors.NewBadRequest(fmt.Sprintf("invalid name %q: %s", segment, strings.Join(msgs, "; ")))
+		}
+	}
+	if name == "" {
+		return "", errors.NewBadRequest("name is required")
+	}
+	p := filepath.Join(s.dir, name+".yaml")
+	if s.namespaceScoped {
+		p = filepath.Join(s.dir, namespace, name+".yaml")
+	}
+	if rel, err := filepath.Rel(s.dir, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.NewBadRequest(fmt.Sprintf("invalid name %q", name))
+	}
+	return p, nil
+}
+
+// namespace returns the namespace of the request, failing if a namespaced
+// object is addressed without one.
+func (s *fileStorage) namespace(ctx context.Context) (string, error) {
+	if !s.namespaceScoped {
+		return "", nil
+	}
+	ns, ok := request.NamespaceFrom(ctx)
+	if !ok || ns == "" {
+		return "", errors.NewBadRequest("namespace is required")
+	}
+	return ns, nil
+}
+
+func readObject(path string) (*unstructured.Unstructured, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(j); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// writeFile atomically replaces the file at path with data.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *fileStorage) get(ns, name string) (*unstructured.Unstructured, error) {
+	p, err := s.path(ns, name)
+	if err != nil {
+		return nil, err
+	}
+	u, err := readObject(p)
+	if os.IsNotExist(err) {
+		return nil, errors.NewNotFound(s.gr, name)
+	}
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	return s.kind.Assign(u), nil
+}
+
+// maxFileChanges is how many changes made through the proxy a counterHistory
+// keeps for watches resuming from an older resourceVersion.
+const maxFileChanges = 1000
+
+// counterHistory numbers changes with a counter kept next to the files and
+// watches the directory tree for changes.
+type counterHistory struct {
+	path     string
+	notifier *fileNotifier
+
+	mu              sync.Mutex
+	resourceVersion uint64
+	// log holds the last changes made through the proxy, oldest first. The
+	// changes up to resourceVersion oldest are forgotten.
+	log    []fileChange
+	oldest uint64
+}
+
+// fileChange is a change of the object stored at path.
+type fileChange struct {
+	path  string
+	event watch.Event
+}
+
+func newCounterHistory(s *fileStorage) *counterHistory {
+	h := &counterHistory{path: filepath.Join(s.dir, resourceVersionFile)}
+	h.notifier = newFileNotifier(s.metrics, &dirSource{storage: s, history: h})
+	return h
+}
+
+// load reads the counter if it has not been yet. It must be called with h.mu
+// held.
+func (h *counterHistory) load() error {
+	if h.resourceVersion != 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(h.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if h.resourceVersion, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return err
+		}
+	}
+	// Changes made before the proxy started are not known.
+	h.oldest = h.resourceVersion
+	return nil
+}
+
+func (h *counterHistory) next() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		return "", err
+	}
+	h.resourceVersion++
+	rv := strconv.FormatUint(h.resourceVersion, 10)
+	if err := writeFile(h.path, []byte(rv+"\n")); err != nil {
+		return "", err
+	}
+	return rv, nil
+}
+
+func (h *counterHistory) current() (string, error) {
+	rv, err := h.version()
+	return strconv.FormatUint(rv, 10), err
+}
+
+// version returns the resourceVersion of the last change.
+func (h *counterHistory) version() (uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		return 0, err
+	}
+	return h.resourceVersion, nil
+}
+
+func (h *counterHistory) record(_ context.Context, verb, path string, u *unstructured.Unstructured) error {
+	e := watch.Event{Type: watch.Modified, Object: u.DeepCopy()}
+	switch verb {
+	case "create":
+		e.Type = watch.Added
+	case "delete":
+		e.Type = watch.Deleted
+	}
+	h.mu.Lock()
+	h.log = append(h.log, fileChange{path: path, event: e})
+	if len(h.log) > maxFileChanges {
+		h.oldest = objectResourceVersion(h.log[0].event.Object)
+		h.log = h.log[1:]
+	}
+	h.mu.Unlock()
+	h.notifier.kick()
+	return nil
+}
+
+// changes returns the changes made through the proxy after resourceVersion
+// since up to resourceVersion until, or an Expired error if they are no longer
+// all known.
+func (h *counterHistory) changes(since, until uint64) ([]fileChange, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	if since < h.oldest {
+		return nil, errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", since, h.oldest))
+	}
+	var out []fileChange
+	for _, c := range h.log {
+		if rv := objectResourceVersion(c.event.Object); rv > since && rv <= until {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (h *counterHistory) watch(filter func(*unstructured.Unstructured) bool, initial bool, since uint64) (watch.Interface, error) {
+	return h.notifier.watch(filter, initial, since)
+}
+
+// put stores u with a new resourceVersion. It must be called with s.mu held.
+func (s *fileStorage) put(ctx context.Context, verb string, u *unstructured.Unstructured) error {
+	rv, err := s.history.next()
+	if err != nil {
+		return errors.NewInternalError(err)
+	}
+	u.SetResourceVersion(rv)
+	s.kind.Assign(u)
+	b, err := yaml.Marshal(u.Object)
+	if err != nil {
+		return errors.NewInternalError(err)
+	}
+	path, err := s.path(u.GetNamespace(), u.GetName())
+	if err != nil {
+		return err
+	}
+	if err := writeFile(path, b); err != nil {
+		return errors.NewInternalError(err)
+	}
+	if err := s.history.record(ctx, verb, path, u); err != nil {
+		return errors.NewInternalError(err)
+	}
+	return nil
+}
+
+func (s *fileStorage) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (_ runtime.Object, err error) {
+	defer s.observe("create", time.Now(), &err)
+	return s.create(ctx, obj, createValidation, options)
+}
+
+func (s *fileStorage) create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.NewBadRequest("unexpected object type")
+	}
+	u = u.DeepCopy()
+	if u.GetName() == "" && u.GetGenerateName() != "" {
+		u.SetName(storagenames.SimpleNameGenerator.GenerateName(u.GetGenerateName()))
+	}
+	if u.GetName() == "" {
+		return nil, errors.NewBadRequest("name or generateName is required")
+	}
+	if msgs := validateName(u.GetName()); len(msgs) > 0 {
+		return nil, errors.NewInvalid(schema.GroupKind{Group: s.gr.Group, Kind: s.kind.Kind}, u.GetName(), field.ErrorList{
+			field.Invalid(field.NewPath("metadata", "name"), u.GetName(), strings.Join(msgs, "; ")),
+		})
+	}
+	u.SetNamespace(ns)
+	u.SetUID(uuid.NewUUID())
+	u.SetCreationTimestamp(metav1.Now())
+	u.SetGeneration(1)
+	u.SetResourceVersion("")
+	if createValidation != nil {
+		if err := createValidation(u); err != nil {
+			return nil, err
+		}
+	}
+
+	path, err := s.path(ns, u.GetName())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return nil, errors.NewAlreadyExists(s.gr, u.GetName())
+	}
+	if options != nil && len(options.DryRun) > 0 {
+		return u, nil
+	}
+	if err := s.put(ctx, "create", u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *fileStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (_ runtime.Object, err error) {
+	defer s.observe("get", time.Now(), &err)
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(ns, name)
+}
+
+func (s *fileStorage) Update(ctx context.Context, name string, objInfo rest.UpdatedObjectInfo, createValidation rest.ValidateObjectFunc, updateValidation rest.ValidateObjectUpdateFunc, forceAllowCreate bool, options *metav1.UpdateOptions) (_ runtime.Object, _ bool, err error) {
+	defer s.observe("update", time.Now(), &err)
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.mu.Lock()
+	existing, err := s.get(ns, name)
+	if errors.IsNotFound(err) && forceAllowCreate {
+		s.mu.Unlock()
+		newObj, err := objInfo.UpdatedObject(ctx, s.New())
+		if err != nil {
+			return nil, false, err
+		}
+		created, err := s.create(ctx, newObj, createValidation, createOptions(options))
+		if err != nil {
+			return nil, false, err
+		}
+		return created, true, nil
+	}
+	defer s.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+
+	obj, err := objInfo.UpdatedObject(ctx, existing)
+	if err != nil {
+		return nil, false, err
+	}
+	updated, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, false, errors.NewBadRequest("unexpected object type")
+	}
+	updated = updated.DeepCopy()
+	if rv := updated.GetResourceVersion(); rv != "" && rv != existing.GetResourceVersion() {
+		return nil, false, errors.NewConflict(s.gr, name, fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	if err := checkPreconditions(s.gr, name, objInfo.Preconditions(), existing); err != nil {
+		return nil, false, err
+	}
+	if updated.GetName() != name {
+		return nil, false, errors.NewBadRequest("the name of the object does not match the name in the URL")
+	}
+	updated.SetNamespace(ns)
+	updated.SetUID(existing.GetUID())
+	updated.SetCreationTimestamp(existing.GetCreationTimestamp())
+	updated.SetGeneration(existing.GetGeneration())
+	if !equality.Semantic.DeepEqual(updated.Object["spec"], existing.Object["spec"]) {
+		updated.SetGeneration(existing.GetGeneration() + 1)
+	}
+	if updateValidation != nil {
+		if err := updateValidation(updated, existing); err != nil {
+			return nil, false, err
+		}
+	}
+	if options != nil && len(options.DryRun) > 0 {
+		return updated, false, nil
+	}
+	if err := s.put(ctx, "update", updated); err != nil {
+		return nil, false, err
+	}
+	return updated, false, nil
+}
+
+// checkPreconditions returns a Conflict error if obj does not satisfy pc.
+func checkPreconditions(gr schema.GroupResource, name string, pc *metav1.Preconditions, obj metav1.Object) error {
+	if pc == nil {
+		return nil
+	}
+	if pc.UID != nil && *pc.UID != obj.GetUID() {
+		return errors.NewConflict(gr, name, fmt.Errorf("precondition failed: UID in precondition: %v, UID in object meta: %v", *pc.UID, obj.GetUID()))
+	}
+	if pc.ResourceVersion != nil && *pc.ResourceVersion != obj.GetResourceVersion() {
+		return errors.NewConflict(gr, name, fmt.Errorf("precondition failed: ResourceVersion in precondition: %v, ResourceVersion in object meta: %v", *pc.ResourceVersion, obj.GetResourceVersion()))
+	}
+	return nil
+}
+
+func (s *fileStorage) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (_ runtime.Object, _ bool, err error) {
+	defer s.observe("delete", time.Now(), &err)
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return s.delete(ctx, ns, name, deleteValidation, options)
+}
+
+func (s *fileStorage) delete(ctx context.Context, ns, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (runtime.Object, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, err := s.get(ns, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if options != nil {
+		if err := checkPreconditions(s.gr, name, options.Preconditions, obj); err != nil {
+			return nil, false, err
+		}
+	}
+	if deleteValidation != nil {
+		if err := deleteValidation(obj); err != nil {
+			return nil, false, err
+		}
+	}
+	if options != nil && len(options.DryRun) > 0 {
+		return obj, true, nil
+	}
+	path, err := s.path(ns, name)
+	if err != nil {
+		return nil, false, err
+	}
+	// Deletions get a resourceVersion of their own, so that watches resuming
+	// from before it see them.
+	rv, err := s.history.next()
+	if err != nil {
+		return nil, false, errors.NewInternalError(err)
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, errors.NewNotFound(s.gr, name)
+		}
+		return nil, false, errors.NewInternalError(err)
+	}
+	obj.SetResourceVersion(rv)
+	if err := s.history.record(ctx, "delete", path, obj); err != nil {
+		return nil, false, errors.NewInternalError(err)
+	}
+	return obj, true, nil
+}
+
+func (s *fileStorage) DeleteCollection(ctx context.Context, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions, listOptions *metainternalversion.ListOptions) (_ runtime.Object, err error) {
+	defer s.observe("deletecollection", time.Now(), &err)
+	lo := &metainternalversion.ListOptions{}
+	if listOptions != nil {
+		lo = listOptions.DeepCopy()
+	}
+	lo.Limit, lo.Continue = 0, ""
+	objs, err := s.list(ctx, lo)
+	if err != nil {
+		return nil, err
+	}
+	list := objs.(*unstructured.UnstructuredList)
+	deleted := s.NewList().(*unstructured.UnstructuredList)
+	for i := range list.Items {
+		item := &list.Items[i]
+		if _, _, err := s.delete(ctx, item.GetNamespace(), item.GetName(), deleteValidation, options); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		deleted.Items = append(deleted.Items, *item)
+	}
+	return deleted, nil
+}
+
+func (s *fileStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (_ runtime.Object, err error) {
+	defer s.observe("list", time.Now(), &err)
+	return s.list(ctx, options)
+}
+
+// key identifies an object in list order.
+func fileKey(u *unstructured.Unstructured) string {
+	return u.GetNamespace() + "/" + u.GetName()
+}
+
+func (s *fileStorage) list(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	if options == nil {
+		options = &metainternalversion.ListOptions{}
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	var after string
+	if options.Continue != "" {
+		b, err := base64.RawURLEncoding.DecodeString(options.Continue)
+		if err != nil {
+			return nil, errors.NewBadRequest("invalid continue token")
+		}
+		after = string(b)
+	}
+
+	rv, err := s.history.current()
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	out := s.NewList().(*unstructured.UnstructuredList)
+	out.SetResourceVersion(rv)
+	objs, err := s.readAll()
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	for _, u := range objs {
+		if after != "" && fileKey(u) <= after {
+			continue
+		}
+		if !s.matches(u, ns, options.LabelSelector, options.FieldSelector) {
+			continue
+		}
+		if options.Limit > 0 && int64(len(out.Items)) == options.Limit {
+			out.SetContinue(base64.RawURLEncoding.EncodeToString([]byte(fileKey(&out.Items[len(out.Items)-1]))))
+			break
+		}
+		out.Items = append(out.Items, *u)
+	}
+	return out, nil
+}
+
+// readAll returns all stored objects sorted by namespace and name.
+func (s *fileStorage) readAll() ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	err := s.walk(func(path string, _ os.FileInfo) error {
+		u, err := readObject(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		objs = append(objs, s.kind.Assign(u))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objs, func(i, j int) bool { return fileKey(objs[i]) < fileKey(objs[j]) })
+	return objs, nil
+}
+
+// walk calls fn for every object file of the resource.
+func (s *fileStorage) walk(fn func(path string, info os.FileInfo) error) error {
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || filepath.Ext(path) != ".yaml" {
+			return nil
+		}
+		return fn(path, info)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// matches reports whether u is in namespace ns (all namespaces if empty) and
+// matches the selectors.
+func (s *fileStorage) matches(u *unstructured.Unstructured, ns string, label labels.Selector, field fields.Selector) bool {
+	if ns != "" && u.GetNamespace() != ns {
+		return false
+	}
+	if label != nil && !label.Matches(labels.Set(u.GetLabels())) {
+		return false
+	}
+	if field != nil && !field.Matches(fields.Set{
+		"metadata.name":      u.GetName(),
+		"metadata.namespace": u.GetNamespace(),
+	}) {
+		return false
+	}
+	return true
+}
+
+func (s *fileStorage) Watch(ctx context.Context, options *metainternalversion.ListOptions) (_ watch.Interface, err error) {
+	defer s.observe("watch", time.Now(), &err)
+	if options == nil {
+		options = &metainternalversion.ListOptions{}
+	}
+	var since uint64
+	if rv := options.ResourceVersion; rv != "" && rv != "0" {
+		if since, err = strconv.ParseUint(rv, 10, 64); err != nil {
+			return nil, errors.NewBadRequest("invalid resourceVersion " + rv)
+		}
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	filter := func(u *unstructured.Unstructured) bool {
+		return s.matches(u, ns, options.LabelSelector, options.FieldSelector)
+	}
+	return s.history.watch(filter, options.ResourceVersion == "" || options.ResourceVersion == "0", since)
+}
+
+// objectResourceVersion returns the resourceVersion of obj as a number, or 0
+// if it is not one.
+func objectResourceVersion(obj runtime.Object) uint64 {
+	a, err := meta.Accessor(obj)
+	if err != nil {
+		return 0
+	}
+	rv, _ := strconv.ParseUint(a.GetResourceVersion(), 10, 64)
+	return rv
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+)
+
+func newTestFileStorage(t *testing.T) (*fileStorage, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "proxy-apiserver-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileREST(extR, true, dir, []string{"mdep"}, []string{"all"}).(*fileStorage), dir
+}
+
+func TestFileCRUD(t *testing.T) {
+	s, dir := newTestFileStorage(t)
+	defer os.RemoveAll(dir)
+	ctx := ctxWithNamespace()
+
+	obj, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", map[string]string{"app": "foo"}), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := assertExternal(t, obj)
+	if created.GetResourceVersion() != "1" || created.GetUID() == "" {
+		t.Errorf("created object has resourceVersion %q and uid %q", created.GetResourceVersion(), created.GetUID())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "apps.maisem.dev", "deployments", "default", "foo.yaml")); err != nil {
+		t.Errorf("object file not written: %v", err)
+	}
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil); !errors.IsAlreadyExists(err) {
+		t.Errorf("creating a duplicate returned %v, want AlreadyExists", err)
+	}
+	dryRun := []string{metav1.DryRunAll}
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, &metav1.CreateOptions{DryRun: dryRun}); !errors.IsAlreadyExists(err) {
+		t.Errorf("dry-run create of a duplicate returned %v, want AlreadyExists", err)
+	}
+	if _, _, err := s.Update(ctx, "dry", rest.DefaultUpdatedObjectInfo(newDeployment(extR.GroupVersion, "dry", nil)), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, true, &metav1.UpdateOptions{DryRun: dryRun}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "dry", nil); !errors.IsNotFound(err) {
+		t.Errorf("get after a dry-run update of a missing object returned %v, want NotFound", err)
+	}
+
+	got, err := s.Get(ctx, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := assertExternal(t, got)
+	if u.GetUID() != created.GetUID() {
+		t.Errorf("got uid %s, want %s", u.GetUID(), created.GetUID())
+	}
+
+	stale := u.DeepCopy()
+	unstructured.SetNestedField(u.Object, int64(3), "spec", "replicas")
+	obj, _, err = s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated := assertExternal(t, obj); updated.GetResourceVersion() != "2" || updated.GetGeneration() != 2 {
+		t.Errorf("updated object has resourceVersion %q and generation %d, want 2 and 2", updated.GetResourceVersion(), updated.GetGeneration())
+	}
+	if _, _, err := s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(stale), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); !errors.IsConflict(err) {
+		t.Errorf("update with a stale resourceVersion returned %v, want Conflict", err)
+	}
+
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "bar", map[string]string{"app": "bar"}), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List(ctx, &metainternalversion.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "bar"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, list); len(got) != 1 || got[0] != "bar" {
+		t.Errorf("list app=bar returned %v", got)
+	}
+	list, err = s.List(ctx, &metainternalversion.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul := list.(*unstructured.UnstructuredList)
+	if got := names(t, ul); len(got) != 1 || got[0] != "bar" || ul.GetContinue() == "" {
+		t.Fatalf("first page = %v (continue %q)", got, ul.GetContinue())
+	}
+	list, err = s.List(ctx, &metainternalversion.ListOptions{Limit: 1, Continue: ul.GetContinue()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, list); len(got) != 1 || got[0] != "foo" {
+		t.Errorf("second page = %v, want [foo]", got)
+	}
+
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "foo", nil); !errors.IsNotFound(err) {
+		t.Errorf("get after delete returned %v, want NotFound", err)
+	}
+	if _, err := s.DeleteCollection(ctx, rest.ValidateAllObjectFunc, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.List(ctx, nil); err != nil || len(list.(*unstructured.UnstructuredList).Items) != 0 {
+		t.Errorf("list after DeleteCollection = %v, %v", list, err)
+	}
+
+	// resourceVersions keep increasing across restarts. Both deletions got
+	// one of their own.
+	s = NewFileREST(extR, true, dir, nil, nil).(*fileStorage)
+	obj, err = s.Create(ctx, newDeployment(extR.GroupVersion, "baz", nil), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv := assertExternal(t, obj).GetResourceVersion(); rv != "6" {
+		t.Errorf("resourceVersion after restart = %q, want 6", rv)
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	s, dir := newTestFileStorage(t)
+	defer os.RemoveAll(dir)
+	ctx := ctxWithNamespace()
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "existing", nil), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := s.Watch(ctx, &metainternalversion.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if e := nextEvent(t, w); e.Type != watch.Added || assertExternal(t, e.Object).GetName() != "existing" {
+		t.Errorf("got initial %s event for %v", e.Type, e.Object)
+	}
+
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, w); e.Type != watch.Added || assertExternal(t, e.Object).GetName() != "foo" {
+		t.Errorf("got %s event for %v, want ADDED foo", e.Type, e.Object)
+	}
+
+	// Files edited outside of the proxy are picked up as well.
+	path := filepath.Join(dir, "apps.maisem.dev", "deployments", "default", "foo.yaml")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, append(b, []byte("status:\n  replicas: 1\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, w); e.Type != watch.Modified {
+		t.Errorf("got %s event for external edit, want MODIFIED", e.Type)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, w); e.Type != watch.Deleted || assertExternal(t, e.Object).GetName() != "foo" {
+		t.Errorf("got %s event for %v, want DELETED foo", e.Type, e.Object)
+	}
+
+	w.Stop()
+
+	// A watch resuming from a list sees the changes made in between with
+	// their types, including deletions.
+	list, err := s.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := list.(*unstructured.UnstructuredList).GetResourceVersion()
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "bar", nil), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := s.Get(ctx, "existing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertExternal(t, existing).SetLabels(map[string]string{"app": "existing"})
+	if _, _, err := s.Update(ctx, "existing", rest.DefaultUpdatedObjectInfo(existing), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Delete(ctx, "existing", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := s.Watch(ctx, &metainternalversion.ListOptions{ResourceVersion: rv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Stop()
+	last := objectResourceVersion(list)
+	for _, want := range []string{"ADDED bar", "MODIFIED existing", "DELETED existing"} {
+		e := nextEvent(t, resumed)
+		if got := fmt.Sprintf("%s %s", e.Type, assertExternal(t, e.Object).GetName()); got != want {
+			t.Errorf("watch from resourceVersion %s got %s, want %s", rv, got, want)
+		}
+		if v := objectResourceVersion(e.Object); v <= last {
+			t.Errorf("%s event has resourceVersion %d, not after %d", e.Type, v, last)
+		} else {
+			last = v
+		}
+	}
+
+	// Changes made before a restart are not known.
+	s = NewFileREST(extR, true, dir, nil, nil).(*fileStorage)
+	if _, err := s.Watch(ctx, &metainternalversion.ListOptions{ResourceVersion: rv}); !errors.IsResourceExpired(err) {
+		t.Errorf("watch from before a restart returned %v, want Expired", err)
+	}
+}
+
+func TestFileWatchSlowWatcher(t *testing.T) {
+	s, dir := newTestFileStorage(t)
+	defer os.RemoveAll(dir)
+	ctx := ctxWithNamespace()
+
+	// A watcher that reads nothing fills its queue and holds up delivery.
+	slow, err := s.Watch(ctx, &metainternalversion.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Stop()
+	for i := 0; i < 150; i++ {
+		if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, fmt.Sprintf("foo-%d", i), nil), rest.ValidateAllObjectFunc, nil); err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 49 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// Other watches still start and stop, and see later changes once the
+	// slow one is gone.
+	started := make(chan watch.Interface)
+	go func() {
+		w, err := s.Watch(ctx, &metainternalversion.ListOptions{ResourceVersion: "0"})
+		if err != nil {
+			t.Error(err)
+		}
+		started <- w
+	}()
+	var w watch.Interface
+	select {
+	case w = <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not start while another watcher was stuck")
+	}
+	if w == nil {
+		return
+	}
+	defer w.Stop()
+	stopped := make(chan struct{})
+	go func() {
+		slow.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck watcher did not stop")
+	}
+	for i := 0; i < 150; i++ {
+		nextEvent(t, w)
+	}
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "bar", nil), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, w); e.Type != watch.Added || assertExternal(t, e.Object).GetName() != "bar" {
+		t.Errorf("got %s event for %v, want ADDED bar", e.Type, e.Object)
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	s, dir := newTestFileStorage(t)
+	defer os.RemoveAll(dir)
+	ctx := ctxWithNamespace()
+	other := NewFileREST(GroupVersionKindResource{GroupVersion: extR.GroupVersion, Kind: "Note", Resource: "notes"}, true, dir, nil, nil).(*fileStorage)
+	if _, err := other.Create(ctx, newDeployment(extR.GroupVersion, "note", nil), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../../../../escaped", "../../notes/default/note", "a/b", "..", ".", ".resourceversion", "a%2fb"} {
+		if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, name, nil), rest.ValidateAllObjectFunc, nil); !errors.IsInvalid(err) {
+			t.Errorf("creating %q returned %v, want Invalid", name, err)
+		}
+		if _, err := s.Get(ctx, name, nil); !errors.IsBadRequest(err) {
+			t.Errorf("getting %q returned %v, want BadRequest", name, err)
+		}
+		if _, _, err := s.Delete(ctx, name, rest.ValidateAllObjectFunc, nil); !errors.IsBadRequest(err) {
+			t.Errorf("deleting %q returned %v, want BadRequest", name, err)
+		}
+	}
+	u := newDeployment(extR.GroupVersion, "../../notes/default/note", nil)
+	if _, _, err := s.Update(ctx, u.GetName(), rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, true, nil); err == nil {
+		t.Error("updating a name outside of the resource's directory succeeded")
+	}
+	if _, err := s.Get(request.WithNamespace(ctx, ".."), "note", nil); !errors.IsBadRequest(err) {
+		t.Errorf("getting from namespace .. returned %v, want BadRequest", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped.yaml")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the storage directory: %v", err)
+	}
+	if got, err := other.Get(ctx, "note", nil); err != nil || got.(*unstructured.Unstructured).GetKind() != "Note" {
+		t.Errorf("object of another resource = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+)
+
+// filePollInterval is how often the source of a watched resource is checked
+// for changes made outside of the proxy. Writes through the proxy are noticed
+// immediately. Polling is used rather than inotify because the directories are
+// often volumes that deliver no inotify events, such as NFS shares or
+// ConfigMap volumes whose files the kubelet swaps in through symlinks.
+var filePollInterval = time.Second
+
+// eventSource produces the watch events of a fileNotifier. Its methods are
+// called with the notifier's lock held.
+type eventSource interface {
+	// reset records the current state as the starting point for poll.
+	reset() error
+	// backlog returns the events a new watcher starts with: ADDED events for
+	// the current objects if initial is set, otherwise the changes after
+	// resourceVersion since up to the last call to reset or poll. It fails
+	// with an Expired error if those changes are no longer known.
+	backlog(initial bool, since uint64) ([]watch.Event, error)
+	// poll returns the changes since the last call to reset or poll.
+	poll() ([]watch.Event, error)
+}
+
+// fileNotifier fans the events of an eventSource out to watchers. The source
+// is only polled while there are watchers.
+type fileNotifier struct {
+	metrics metrics.Resource
+	source  eventSource
+	wake    chan struct{}
+
+	mu       sync.Mutex
+	watchers map[*fileWatcher]bool
+	stop     chan struct{}
+	// pending holds the polled events that are yet to be delivered, oldest
+	// first. A single goroutine delivers them, without mu held, while sending
+	// is set. A watcher whose queue is full holds up delivery to the others,
+	// but not watchers from starting or stopping, nor polling.
+	pending []fileBatch
+	sending bool
+}
+
+// fileBatch is the events of a poll and the watchers they go to.
+type fileBatch struct {
+	watchers []*fileWatcher
+	events   []watch.Event
+}
+
+func newFileNotifier(m metrics.Resource, source eventSource) *fileNotifier {
+	return &fileNotifier{
+		metrics:  m,
+		source:   source,
+		wake:     make(chan struct{}, 1),
+		watchers: map[*fileWatcher]bool{},
+	}
+}
+
+// kick asks for a poll as soon as possible.
+func (n *fileNotifier) kick() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *fileNotifier) watch(filter func(*unstructured.Unstructured) bool, initial bool, since uint64) (watch.Interface, error) {
+	n.mu.Lock()
+	var events []watch.Event
+	if n.stop == nil {
+		if err := n.source.reset(); err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		n.stop = make(chan struct{})
+		go n.run(n.stop)
+	} else {
+		// Catch up first, so that the backlog of the new watcher ends where
+		// the events of the existing ones continue.
+		var err error
+		if events, err = n.source.poll(); err != nil {
+			klog.Errorf("Failed to poll for changes: %v", err)
+		}
+	}
+	watchers := n.snapshot()
+	backlog, err := n.source.backlog(initial, since)
+	if err != nil {
+		n.dispatch(watchers, events)
+		return nil, err
+	}
+	var filtered []watch.Event
+	for _, e := range backlog {
+		if filter(e.Object.(*unstructured.Unstructured)) {
+			filtered = append(filtered, watch.Event{Type: e.Type, Object: e.Object.DeepCopyObject()})
+		}
+	}
+	w := &fileWatcher{
+		notifier: n,
+		filter:   filter,
+		incoming: make(chan watch.Event, 100),
+		result:   make(chan watch.Event),
+		done:     make(chan struct{}),
+	}
+	n.watchers[w] = true
+	n.metrics.WatchStarted()
+	go w.run(filtered)
+	n.dispatch(watchers, events)
+	return w, nil
+}
+
+// snapshot returns the current watchers. It must be called with n.mu held.
+func (n *fileNotifier) snapshot() []*fileWatcher {
+	watchers := make([]*fileWatcher, 0, len(n.watchers))
+	for w := range n.watchers {
+		watchers = append(watchers, w)
+	}
+	return watchers
+}
+
+// dispatch queues events for delivery to watchers and releases n.mu. It must
+// be called with n.mu held.
+func (n *fileNotifier) dispatch(watchers []*fileWatcher, events []watch.Event) {
+	defer n.mu.Unlock()
+	if len(events) == 0 || len(watchers) == 0 {
+		return
+	}
+	n.pending = append(n.pending, fileBatch{watchers: watchers, events: events})
+	if !n.sending {
+		n.sending = true
+		go n.send()
+	}
+}
+
+// send delivers the pending events in order until there are none left.
+func (n *fileNotifier) send() {
+	for {
+		n.mu.Lock()
+		if len(n.pending) == 0 {
+			n.sending = false
+			n.mu.Unlock()
+			return
+		}
+		b := n.pending[0]
+		n.pending[0] = fileBatch{}
+		n.pending = n.pending[1:]
+		n.mu.Unlock()
+		for _, e := range b.events {
+			for _, w := range b.watchers {
+				w.send(e)
+			}
+		}
+	}
+}
+
+func (n *fileNotifier) remove(w *fileWatcher) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.watchers[w] {
+		return
+	}
+	delete(n.watchers, w)
+	n.metrics.WatchStopped()
+	if len(n.watchers) == 0 {
+		close(n.stop)
+		n.stop = nil
+	}
+}
+
+func (n *fileNotifier) run(stop chan struct{}) {
+	t := time.NewTicker(filePollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-n.wake:
+		}
+		n.mu.Lock()
+		if n.stop != stop {
+			n.mu.Unlock()
+			continue
+		}
+		events, err := n.source.poll()
+		if err != nil {
+			klog.Errorf("Failed to poll for changes: %v", err)
+		}
+		n.dispatch(n.snapshot(), events)
+	}
+}
+
+// sortByResourceVersion orders events oldest first.
+func sortByResourceVersion(events []watch.Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return objectResourceVersion(events[i].Object) < objectResourceVersion(events[j].Object)
+	})
+}
+
+// dirSource finds changes by comparing the modification times and sizes of
+// the files of a fileStorage between scans. Watches resuming from a
+// resourceVersion are fed from the changes its history kept.
+type dirSource struct {
+	storage *fileStorage
+	history *counterHistory
+	// files is the state of the directory tree as of the last scan.
+	files map[string]fileState
+	// resourceVersion is the resourceVersion of the last scan.
+	resourceVersion uint64
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	obj     *unstructured.Unstructured
+}
+
+func (d *dirSource) reset() error {
+	files, rv, err := d.scan(nil)
+	if err != nil {
+		return err
+	}
+	d.files, d.resourceVersion = files, rv
+	return nil
+}
+
+func (d *dirSource) backlog(initial bool, since uint64) ([]watch.Event, error) {
+	if !initial {
+		changes, err := d.history.changes(since, d.resourceVersion)
+		if err != nil {
+			return nil, err
+		}
+		var events []watch.Event
+		for _, c := range changes {
+			events = append(events, c.event)
+		}
+		return events, nil
+	}
+	var events []watch.Event
+	for _, f := range d.files {
+		events = append(events, watch.Event{Type: watch.Added, Object: f.obj})
+	}
+	sortByResourceVersion(events)
+	return events, nil
+}
+
+func (d *dirSource) poll() ([]watch.Event, error) {
+	files, rv, err := d.scan(d.files)
+	if err != nil {
+		return nil, err
+	}
+	// Objects deleted through the proxy are reported with the
+	// resourceVersion of their deletion.
+	deleted := map[string]runtime.Object{}
+	if changes, err := d.history.changes(d.resourceVersion, rv); err == nil {
+		for _, c := range changes {
+			if c.event.Type == watch.Deleted {
+				deleted[c.path] = c.event.Object
+			}
+		}
+	}
+	var events []watch.Event
+	for path, f := range files {
+		p, ok := d.files[path]
+		switch {
+		case !ok:
+			events = append(events, watch.Event{Type: watch.Added, Object: f.obj})
+		case p.obj != f.obj:
+			events = append(events, watch.Event{Type: watch.Modified, Object: f.obj})
+		}
+	}
+	for path, p := range d.files {
+		if _, ok := files[path]; !ok {
+			var obj runtime.Object = p.obj
+			if o, ok := deleted[path]; ok {
+				obj = o
+			}
+			events = append(events, watch.Event{Type: watch.Deleted, Object: obj})
+		}
+	}
+	d.files, d.resourceVersion = files, rv
+	sortByResourceVersion(events)
+	return events, nil
+}
+
+// scan stats all files, reading only those that changed since prev, and
+// returns them with the resourceVersion they are at. Writes through the proxy
+// are held off meanwhile so that the two agree.
+func (d *dirSource) scan(prev map[string]fileState) (map[string]fileState, uint64, error) {
+	d.storage.mu.Lock()
+	defer d.storage.mu.Unlock()
+	rv, err := d.history.version()
+	if err != nil {
+		return nil, 0, err
+	}
+	files := map[string]fileState{}
+	err = d.storage.walk(func(path string, info os.FileInfo) error {
+		if p, ok := prev[path]; ok && p.modTime.Equal(info.ModTime()) && p.size == info.Size() {
+			files[path] = p
+			return nil
+		}
+		u, err := readObject(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			// A file may be read while it is still being written by
+			// someone else; it is retried on the next scan.
+			klog.V(2).Infof("Skipping %s: %v", path, err)
+			return nil
+		}
+		files[path] = fileState{modTime: info.ModTime(), size: info.Size(), obj: d.storage.kind.Assign(u)}
+		return nil
+	})
+	return files, rv, err
+}
+
+// fileWatcher is a watch.Interface fed by a fileNotifier.
+type fileWatcher struct {
+	notifier *fileNotifier
+	filter   func(*unstructured.Unstructured) bool
+	incoming chan watch.Event
+	result   chan watch.Event
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// send queues e if it passes the filter. It blocks while the queue is full so
+// that no events are dropped.
+func (w *fileWatcher) send(e watch.Event) {
+	if !w.filter(e.Object.(*unstructured.Unstructured)) {
+		return
+	}
+	e.Object = e.Object.DeepCopyObject()
+	select {
+	case w.incoming <- e:
+	case <-w.done:
+	}
+}
+
+func (w *fileWatcher) run(backlog []watch.Event) {
+	defer close(w.result)
+	for _, e := range backlog {
+		if !w.deliver(e) {
+			return
+		}
+	}
+	for {
+		select {
+		case e := <-w.incoming:
+			if !w.deliver(e) {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *fileWatcher) deliver(e watch.Event) bool {
+	select {
+	case w.result <- e:
+		w.notifier.metrics.WatchEvent(string(e.Type))
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *fileWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+func (w *fileWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.notifier.remove(w)
+	})
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// NewGitREST returns a rest.Storage like NewFileREST that also commits every
+// change to the git repository at dir, creating the repository if needed.
+// Commits are authored by the requesting user and the resourceVersion of an
+// object is the number of commits in the history up to its last change.
+// Resources stored in the same repository share the version sequence.
+func NewGitREST(res GroupVersionKindResource, nsScoped bool, dir string, shortNames, categories []string) (rest.Storage, error) {
+	repo, err := openGitRepo(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := NewFileREST(res, nsScoped, repo.dir, shortNames, categories).(*fileStorage)
+	s.metrics.Cluster = "git"
+	s.mu = &repo.mu
+	h := &gitHistory{
+		storage: s,
+		repo:    repo,
+	}
+	h.notifier = newFileNotifier(s.metrics, &gitSource{history: h})
+	s.history = h
+	return s, nil
+}
+
+// gitRepos holds the repositories in use so that storages sharing one also
+// share its lock.
+var gitRepos = struct {
+	sync.Mutex
+	m map[string]*gitRepo
+}{m: map[string]*gitRepo{}}
+
+type gitRepo struct {
+	dir string
+	// mu serializes changes to the repository.
+	mu sync.Mutex
+}
+
+func openGitRepo(dir string) (*gitRepo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	gitRepos.Lock()
+	defer gitRepos.Unlock()
+	if r, ok := gitRepos.m[dir]; ok {
+		return r, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &gitRepo{dir: dir}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := r.git("init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+	gitRepos.m[dir] = r
+	return r, nil
+}
+
+func (r *gitRepo) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-c", "commit.gpgsign=false"}, args...)...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_COMMITTER_NAME=proxy-apiserver",
+		"GIT_COMMITTER_EMAIL=proxy-apiserver",
+	)
+	return cmd
+}
+
+// git runs git in the repository and returns its standard output.
+func (r *gitRepo) git(args ...string) (string, error) {
+	cmd := r.command(args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// head returns the current commit, or "" if there is none yet.
+func (r *gitRepo) head() (string, error) {
+	out, err := r.command("rev-parse", "-q", "--verify", "HEAD").Output()
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse HEAD: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// count returns the number of commits reachable from rev.
+func (r *gitRepo) count(rev string) (uint64, error) {
+	if rev == "" {
+		return 0, nil
+	}
+	out, err := r.git("rev-list", "--count", rev)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+}
+
+// commitAt returns the commit of resourceVersion rv in the history of head.
+func (r *gitRepo) commitAt(head string, rv uint64) (string, error) {
+	n, err := r.count(head)
+	if err != nil || rv >= n {
+		return head, err
+	}
+	out, err := r.git("rev-list", "-n", "1", "--skip", strconv.FormatUint(n-rv, 10), head)
+	return strings.TrimSpace(out), err
+}
+
+// gitAuthor returns the commit author for the user making the request.
+func gitAuthor(ctx context.Context) string {
+	name := "proxy-apiserver"
+	if u, ok := request.UserFrom(ctx); ok && u.GetName() != "" {
+		name = strings.NewReplacer("<", "", ">", "", "\n", "").Replace(u.GetName())
+	}
+	return fmt.Sprintf("%s <%s>", name, name)
+}
+
+// gitHistory numbers changes by commit and feeds watches from new commits.
+type gitHistory struct {
+	storage  *fileStorage
+	repo     *gitRepo
+	notifier *fileNotifier
+}
+
+func (h *gitHistory) next() (string, error) {
+	head, err := h.repo.head()
+	if err != nil {
+		return "", err
+	}
+	n, err := h.repo.count(head)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(n+1, 10), nil
+}
+
+func (h *gitHistory) current() (string, error) {
+	head, err := h.repo.head()
+	if err != nil {
+		return "", err
+	}
+	n, err := h.repo.count(head)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(n, 10), nil
+}
+
+func (h *gitHistory) record(ctx context.Context, verb, path string, u *unstructured.Unstructured) error {
+	rel, err := filepath.Rel(h.repo.dir, path)
+	if err != nil {
+		return err
+	}
+	key := u.GetName()
+	if ns := u.GetNamespace(); ns != "" {
+		key = ns + "/" + key
+	}
+	message := fmt.Sprintf("%s %s %s", strings.Title(verb), h.storage.gr, key)
+	_, err = h.repo.git("add", "-A", "--", rel)
+	if err == nil {
+		_, err = h.repo.git("commit", "-q", "--author", gitAuthor(ctx), "-m", message, "--", rel)
+	}
+	if err == nil {
+		h.notifier.kick()
+		return nil
+	}
+	// Put the file back the way it was so that it does not show up as a
+	// change that never happened.
+	h.repo.git("reset", "-q", "--", rel)
+	if _, cerr := h.repo.git("checkout", "-q", "HEAD", "--", rel); cerr != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (h *gitHistory) watch(filter func(*unstructured.Unstructured) bool, initial bool, since uint64) (watch.Interface, error) {
+	return h.notifier.watch(filter, initial, since)
+}
+
+// gitSource turns the commits touching a resource into watch events.
+type gitSource struct {
+	history *gitHistory
+	// head is the last commit events were produced for.
+	head string
+}
+
+func (g *gitSource) reset() error {
+	head, err := g.history.repo.head()
+	g.head = head
+	return err
+}
+
+func (g *gitSource) backlog(initial bool, since uint64) ([]watch.Event, error) {
+	if initial {
+		objs, err := g.history.storage.readAll()
+		if err != nil {
+			return nil, err
+		}
+		var events []watch.Event
+		for _, u := range objs {
+			events = append(events, watch.Event{Type: watch.Added, Object: u})
+		}
+		sortByResourceVersion(events)
+		return events, nil
+	}
+	from, err := g.history.repo.commitAt(g.head, since)
+	if err != nil {
+		return nil, err
+	}
+	return g.log(from, g.head)
+}
+
+func (g *gitSource) poll() ([]watch.Event, error) {
+	head, err := g.history.repo.head()
+	if err != nil || head == g.head {
+		return nil, err
+	}
+	events, err := g.log(g.head, head)
+	if err != nil {
+		return nil, err
+	}
+	g.head = head
+	return events, nil
+}
+
+// log returns the changes to the resource made by the commits after from up
+// to and including to.
+func (g *gitSource) log(from, to string) ([]watch.Event, error) {
+	if to == "" || from == to {
+		return nil, nil
+	}
+	repo := g.history.repo
+	dir, err := filepath.Rel(repo.dir, g.history.storage.dir)
+	if err != nil {
+		return nil, err
+	}
+	rev := to
+	if from != "" {
+		rev = from + ".." + to
+	}
+	out, err := repo.git("log", "--reverse", "--no-renames", "--name-status", "--format=commit %H", rev, "--", filepath.ToSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var events []watch.Event
+	var commit string
+	var rv uint64
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "commit ") {
+			commit = strings.TrimPrefix(line, "commit ")
+			if rv, err = repo.count(commit); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || commit == "" {
+			continue
+		}
+		path := fields[1]
+		if filepath.Ext(path) != ".yaml" || strings.HasPrefix(filepath.Base(path), ".") {
+			continue
+		}
+		e := watch.Event{Type: watch.Modified}
+		rev := commit
+		switch fields[0] {
+		case "A":
+			e.Type = watch.Added
+		case "D":
+			e.Type = watch.Deleted
+			rev = commit + "^"
+		}
+		u, err := g.show(rev, path)
+		if err != nil {
+			return nil, err
+		}
+		u.SetResourceVersion(strconv.FormatUint(rv, 10))
+		e.Object = u
+		events = append(events, e)
+	}
+	return events, sc.Err()
+}
+
+// show reads the object stored at path as of rev.
+func (g *gitSource) show(rev, path string) (*unstructured.Unstructured, error) {
+	out, err := g.history.repo.git("show", rev+":"+path)
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON([]byte(out))
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(j); err != nil {
+		return nil, err
+	}
+	return g.history.storage.kind.Assign(u), nil
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+)
+
+func newTestGitStorage(t *testing.T) (*fileStorage, *gitRepo) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "proxy-apiserver-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewGitREST(extR, true, dir, nil, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s.(*fileStorage), s.(*fileStorage).history.(*gitHistory).repo
+}
+
+func gitLog(t *testing.T, repo *gitRepo) []string {
+	t.Helper()
+	out, err := repo.git("log", "--reverse", "--format=%an: %s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(out), "\n")
+}
+
+func TestGitCommits(t *testing.T) {
+	s, repo := newTestGitStorage(t)
+	defer os.RemoveAll(repo.dir)
+	ctx := request.WithUser(ctxWithNamespace(), &user.DefaultInfo{Name: "alice"})
+
+	obj, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := assertExternal(t, obj)
+	if u.GetResourceVersion() != "1" {
+		t.Errorf("resourceVersion after first commit = %q, want 1", u.GetResourceVersion())
+	}
+	stale := u.DeepCopy()
+	unstructured.SetNestedField(u.Object, int64(2), "spec", "replicas")
+	obj, _, err = s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv := assertExternal(t, obj).GetResourceVersion(); rv != "2" {
+		t.Errorf("resourceVersion after second commit = %q, want 2", rv)
+	}
+	if _, _, err := s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(stale), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); !errors.IsConflict(err) {
+		t.Errorf("update with a stale resourceVersion returned %v, want Conflict", err)
+	}
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"alice: Create deployments.apps.maisem.dev default/foo",
+		"alice: Update deployments.apps.maisem.dev default/foo",
+		"alice: Delete deployments.apps.maisem.dev default/foo",
+	}
+	if got := gitLog(t, repo); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("git log = %q, want %q", got, want)
+	}
+	if out, _ := repo.git("status", "--porcelain"); out != "" {
+		t.Errorf("working tree not clean:\n%s", out)
+	}
+	list, err := s.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv := list.(*unstructured.UnstructuredList).GetResourceVersion(); rv != "3" {
+		t.Errorf("list resourceVersion = %q, want 3", rv)
+	}
+}
+
+func TestGitWatch(t *testing.T) {
+	s, repo := newTestGitStorage(t)
+	defer os.RemoveAll(repo.dir)
+	ctx := ctxWithNamespace()
+	for _, name := range []string{"a", "b"} {
+		if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, name, nil), rest.ValidateAllObjectFunc, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := s.Watch(ctx, &metainternalversion.ListOptions{ResourceVersion: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if e := nextEvent(t, w); e.Type != watch.Added || assertExternal(t, e.Object).GetName() != "b" {
+		t.Errorf("replayed %s event for %v, want ADDED b", e.Type, e.Object)
+	}
+
+	// Commits made outside of the proxy are picked up as well.
+	path := filepath.Join(repo.dir, "apps.maisem.dev", "deployments", "default", "a.yaml")
+	if _, err := repo.git("rm", "-q", path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.git("commit", "-q", "--author", "bob <bob>", "-m", "remove a"); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEvent(t, w)
+	if u := assertExternal(t, e.Object); e.Type != watch.Deleted || u.GetName() != "a" || u.GetResourceVersion() != "3" {
+		t.Errorf("got %s event for %s at %s, want DELETED a at 3", e.Type, u.GetName(), u.GetResourceVersion())
+	}
+}
+
+func TestGitNames(t *testing.T) {
+	s, repo := newTestGitStorage(t)
+	defer os.RemoveAll(repo.dir)
+	ctx := ctxWithNamespace()
+
+	for _, name := range []string{"a/b", "..", "../../../.git/config", "../../../../escaped", "..foo/../..", ".git"} {
+		if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, name, nil), rest.ValidateAllObjectFunc, nil); !errors.IsInvalid(err) {
+			t.Errorf("creating %q returned %v, want Invalid", name, err)
+		}
+		u := newDeployment(extR.GroupVersion, name, nil)
+		if _, _, err := s.Update(ctx, name, rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, true, nil); !errors.IsBadRequest(err) {
+			t.Errorf("updating %q returned %v, want BadRequest", name, err)
+		}
+	}
+	if head, err := repo.head(); err != nil || head != "" {
+		t.Errorf("HEAD = %q, %v, want no commits", head, err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(repo.dir), "escaped.yaml")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the repository: %v", err)
+	}
+	if _, err := repo.git("status"); err != nil {
+		t.Errorf("repository damaged: %v", err)
+	}
+}
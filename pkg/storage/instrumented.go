@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+	"github.com/maisem/proxy-apiserver/pkg/tracing"
+)
+
+// instrumentedClient records the latency of every round-trip to the upstream
+// API server and traces it as a child span of the facade request.
+type instrumentedClient struct {
+	ctx       context.Context
+	upstream  Upstream
+	gvr       schema.GroupVersionResource
+	namespace string
+	metrics   metrics.Resource
+}
+
+// newInstrumentedClient returns a client for the upstream resource r,
+// accounting requests to the facade resource of m.
+func newInstrumentedClient(ctx context.Context, upstream Upstream, r GroupVersionKindResource, namespace string, m metrics.Resource) *instrumentedClient {
+	return &instrumentedClient{
+		ctx:      ctx,
+		upstream: upstream,
+		gvr: schema.GroupVersionResource{
+			Group:    r.GroupVersion.Group,
+			Version:  r.GroupVersion.Version,
+			Resource: r.Resource,
+		},
+		namespace: namespace,
+		metrics:   m,
+	}
+}
+
+// start begins an upstream call for verb. The returned function must be
+// called with the outcome of the call.
+func (c *instrumentedClient) start(verb, name string) (dynamic.ResourceInterface, func(error)) {
+	ctx, span := tracing.Start(c.ctx, "upstream "+verb+" "+c.gvr.Resource, tracing.KindClient)
+	span.SetAttribute("k8s.verb", verb)
+	span.SetAttribute("k8s.resource", c.gvr.String())
+	span.SetAttribute("k8s.cluster", c.upstream.Name)
+	if c.namespace != "" {
+		span.SetAttribute("k8s.namespace", c.namespace)
+	}
+	if name != "" {
+		span.SetAttribute("k8s.name", name)
+	}
+	resource := c.upstream.ClientFor(ctx).Resource(c.gvr)
+	var client dynamic.ResourceInterface = resource
+	if c.namespace != "" {
+		client = resource.Namespace(c.namespace)
+	}
+	start := time.Now()
+	return client, func(err error) {
+		c.metrics.ObserveUpstream(verb, start)
+		span.Finish(err)
+	}
+}
+
+func (c *instrumentedClient) Create(obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (_ *unstructured.Unstructured, err error) {
+	client, done := c.start("create", obj.GetName())
+	defer func() { done(err) }()
+	return client.Create(obj, options, subresources...)
+}
+
+func (c *instrumentedClient) Update(obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (_ *unstructured.Unstructured, err error) {
+	client, done := c.start("update", obj.GetName())
+	defer func() { done(err) }()
+	return client.Update(obj, options, subresources...)
+}
+
+func (c *instrumentedClient) UpdateStatus(obj *unstructured.Unstructured, options metav1.UpdateOptions) (_ *unstructured.Unstructured, err error) {
+	client, done := c.start("update", obj.GetName())
+	defer func() { done(err) }()
+	return client.UpdateStatus(obj, options)
+}
+
+func (c *instrumentedClient) Delete(name string, options *metav1.DeleteOptions, subresources ...string) (err error) {
+	client, done := c.start("delete", name)
+	defer func() { done(err) }()
+	return client.Delete(name, options, subresources...)
+}
+
+func (c *instrumentedClient) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) (err error) {
+	client, done := c.start("deletecollection", "")
+	defer func() { done(err) }()
+	return client.DeleteCollection(options, listOptions)
+}
+
+func (c *instrumentedClient) Get(name string, options metav1.GetOptions, subresources ...string) (_ *unstructured.Unstructured, err error) {
+	client, done := c.start("get", name)
+	defer func() { done(err) }()
+	return client.Get(name, options, subresources...)
+}
+
+func (c *instrumentedClient) List(opts metav1.ListOptions) (_ *unstructured.UnstructuredList, err error) {
+	client, done := c.start("list", "")
+	defer func() { done(err) }()
+	return client.List(opts)
+}
+
+// Watch only records the time taken to establish the watch.
+func (c *instrumentedClient) Watch(opts metav1.ListOptions) (_ watch.Interface, err error) {
+	client, done := c.start("watch", "")
+	defer func() { done(err) }()
+	return client.Watch(opts)
+}
+
+func (c *instrumentedClient) Patch(name string, pt types.PatchType, data []byte, options metav1.PatchOptions, subresources ...string) (_ *unstructured.Unstructured, err error) {
+	client, done := c.start("patch", name)
+	defer func() { done(err) }()
+	return client.Patch(name, pt, data, options, subresources...)
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+)
+
+// sample returns the value of the counter, or the number of observations of
+// the histogram, of family name with exactly labels.
+func sample(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range f.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue next
+				}
+			}
+			if h := m.GetHistogram(); h != nil {
+				return float64(h.GetSampleCount())
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestInstrumentation(t *testing.T) {
+	metrics.Register()
+	fake := fakeupstream.New()
+	defer fake.Close()
+	upstream, err := NewUpstream("fake", fake.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewREST(extR, intR, true, false, upstream, nil, nil, Policy{}).(*restStorage)
+	seed(fake, "foo")
+
+	labels := func(extra ...string) map[string]string {
+		l := map[string]string{"group": "apps.maisem.dev", "version": "v1", "resource": "deployments", "cluster": "fake", "verb": "get"}
+		for i := 0; i < len(extra); i += 2 {
+			l[extra[i]] = extra[i+1]
+		}
+		return l
+	}
+	samples := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"proxy_requests_total", labels("code", "200"), 1},
+		{"proxy_requests_total", labels("code", "404"), 1},
+		{"proxy_request_errors_total", labels("code", "200"), 0},
+		{"proxy_request_errors_total", labels("code", "404"), 1},
+		{"proxy_request_duration_seconds", labels(), 2},
+		{"proxy_upstream_request_duration_seconds", labels(), 2},
+	}
+	before := make([]float64, len(samples))
+	for i, s := range samples {
+		before[i] = sample(t, s.name, s.labels)
+	}
+
+	ctx := ctxWithNamespace()
+	if _, err := s.Get(ctx, "foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "missing", nil); !errors.IsNotFound(err) {
+		t.Fatalf("get of a missing object returned %v, want NotFound", err)
+	}
+
+	for i, s := range samples {
+		if got := sample(t, s.name, s.labels) - before[i]; got != s.want {
+			t.Errorf("%s%v increased by %v, want %v", s.name, s.labels, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/registry/rest"
+)
+
+// podsR is the upstream resource the pods of a workload are found in.
+var podsR = GroupVersionKindResource{
+	GroupVersion: schema.GroupVersion{Version: "v1"},
+	Kind:         "Pod",
+	Resource:     "pods",
+}
+
+// maxLogStreams limits the containers whose logs one request may stream.
+const maxLogStreams = 50
+
+// NewLogsREST returns a connect-style rest.Storage serving the logs of the
+// pods selected by spec.selector of the objects of parent, which must be
+// returned by NewREST. Logs are read upstream with the credentials of the
+// proxy, so facade clients only need access to the subresource.
+//
+// A GET to the subresource accepts the container, follow, tailLines and
+// sinceSeconds query parameters of pod logs, and prefix, which prefixes each
+// line with the pod and container it came from. Lines are prefixed by
+// default if they come from more than one container.
+func NewLogsREST(parent rest.Storage) (rest.Storage, error) {
+	r, ok := parent.(*restStorage)
+	if !ok {
+		return nil, fmt.Errorf("logs are only supported for upstream resources")
+	}
+	return &logsStorage{parent: r}, nil
+}
+
+type logsStorage struct {
+	parent *restStorage
+}
+
+func (l *logsStorage) New() runtime.Object {
+	return l.parent.New()
+}
+
+func (l *logsStorage) NewConnectOptions() (runtime.Object, bool, string) {
+	return nil, false, ""
+}
+
+func (l *logsStorage) ConnectMethods() []string {
+	return []string{http.MethodGet}
+}
+
+func (l *logsStorage) Connect(ctx context.Context, name string, _ runtime.Object, responder rest.Responder) (http.Handler, error) {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		opts, err := parseLogOptions(req.URL.Query())
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Open every stream before answering so that upstream errors can
+		// still be returned as a Status.
+		streams, err := l.open(ctx, name, opts)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		prefix := len(streams) > 1
+		if opts.prefix != nil {
+			prefix = *opts.prefix
+		}
+		copyLogs(w, streams, opts.logs.Follow, prefix)
+	}), nil
+}
+
+// logOptions are the query parameters of a logs request.
+type logOptions struct {
+	logs corev1.PodLogOptions
+	// prefix is nil if the caller did not choose.
+	prefix *bool
+}
+
+func parseLogOptions(query url.Values) (logOptions, error) {
+	var opts logOptions
+	opts.logs.Container = query.Get("container")
+	parseBool := func(key string) (bool, error) {
+		v, err := strconv.ParseBool(query.Get(key))
+		if err != nil {
+			return false, errors.NewBadRequest(fmt.Sprintf("invalid %s %q", key, query.Get(key)))
+		}
+		return v, nil
+	}
+	parseInt := func(key string) (*int64, error) {
+		n, err := strconv.ParseInt(query.Get(key), 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.NewBadRequest(fmt.Sprintf("invalid %s %q", key, query.Get(key)))
+		}
+		return &n, nil
+	}
+	var err error
+	if query.Get("follow") != "" {
+		if opts.logs.Follow, err = parseBool("follow"); err != nil {
+			return opts, err
+		}
+	}
+	if query.Get("prefix") != "" {
+		prefix, err := parseBool("prefix")
+		if err != nil {
+			return opts, err
+		}
+		opts.prefix = &prefix
+	}
+	if query.Get("tailLines") != "" {
+		if opts.logs.TailLines, err = parseInt("tailLines"); err != nil {
+			return opts, err
+		}
+	}
+	if query.Get("sinceSeconds") != "" {
+		if opts.logs.SinceSeconds, err = parseInt("sinceSeconds"); err != nil {
+			return opts, err
+		}
+		if *opts.logs.SinceSeconds == 0 {
+			return opts, errors.NewBadRequest("sinceSeconds must be positive")
+		}
+	}
+	return opts, nil
+}
+
+// logStream is the log of one container.
+type logStream struct {
+	pod, container string
+	io.ReadCloser
+}
+
+// open starts streaming the logs of the containers of the pods of the object
+// name. The streams end when ctx is done.
+func (l *logsStorage) open(ctx context.Context, name string, opts logOptions) (_ []logStream, err error) {
+	defer l.parent.observe("logs", time.Now(), &err)
+	o, err := l.parent.get(ctx, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	u := o.(*unstructured.Unstructured)
+	m, ok, _ := unstructured.NestedMap(u.Object, "spec", "selector")
+	if !ok {
+		return nil, errors.NewBadRequest(fmt.Sprintf("%s has no selector", name))
+	}
+	ls := &metav1.LabelSelector{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, ls); err != nil {
+		return nil, errors.NewBadRequest(fmt.Sprintf("invalid selector of %s: %v", name, err))
+	}
+	sel, err := metav1.LabelSelectorAsSelector(ls)
+	if err != nil {
+		return nil, errors.NewBadRequest(fmt.Sprintf("invalid selector of %s: %v", name, err))
+	}
+	if sel.Empty() {
+		return nil, errors.NewBadRequest(fmt.Sprintf("%s has an empty selector", name))
+	}
+
+	ns := u.GetNamespace()
+	pods, err := newInstrumentedClient(ctx, l.parent.upstream, podsR, ns, l.parent.metrics).List(metav1.ListOptions{LabelSelector: sel.String()})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].GetName() < pods.Items[j].GetName() })
+	type target struct{ pod, container string }
+	var targets []target
+	for _, pod := range pods.Items {
+		containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+		for _, c := range containers {
+			cname, _, _ := unstructured.NestedString(c.(map[string]interface{}), "name")
+			if opts.logs.Container == "" || opts.logs.Container == cname {
+				targets = append(targets, target{pod.GetName(), cname})
+			}
+		}
+	}
+	switch {
+	case len(pods.Items) == 0:
+		return nil, errors.NewBadRequest(fmt.Sprintf("%s has no pods", name))
+	case len(targets) == 0:
+		return nil, errors.NewBadRequest(fmt.Sprintf("no pod of %s has a container %q", name, opts.logs.Container))
+	case len(targets) > maxLogStreams:
+		return nil, errors.NewBadRequest(fmt.Sprintf("%s has %d containers, at most %d may be streamed at once; choose a container", name, len(targets), maxLogStreams))
+	}
+
+	var streams []logStream
+	defer func() {
+		if err != nil {
+			for _, s := range streams {
+				s.Close()
+			}
+		}
+	}()
+	for _, t := range targets {
+		podOpts := opts.logs
+		podOpts.Container = t.container
+		var rc io.ReadCloser
+		if rc, err = l.parent.upstream.PodLogs(ctx, ns, t.pod, &podOpts); err != nil {
+			return nil, err
+		}
+		streams = append(streams, logStream{t.pod, t.container, rc})
+	}
+	return streams, nil
+}
+
+// copyLogs writes the lines of streams to w, which is flushed after every
+// line. Followed streams are interleaved as lines arrive; otherwise the
+// streams are written one after another.
+func copyLogs(w io.Writer, streams []logStream, follow, prefix bool) {
+	var mu sync.Mutex
+	copyStream := func(s logStream) {
+		defer s.Close()
+		p := ""
+		if prefix {
+			p = fmt.Sprintf("[pod/%s/%s] ", s.pod, s.container)
+		}
+		br := bufio.NewReader(s)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				if line[len(line)-1] != '\n' {
+					line += "\n"
+				}
+				mu.Lock()
+				_, werr := io.WriteString(w, p+line)
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				mu.Unlock()
+				if werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	if !follow {
+		for _, s := range streams {
+			copyStream(s)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s logStream) {
+			defer wg.Done()
+			copyStream(s)
+		}(s)
+	}
+	wg.Wait()
+}
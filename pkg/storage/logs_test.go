@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var podsGVR = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// errorResponder records the error a connect handler responds with.
+type errorResponder struct {
+	err error
+}
+
+func (r *errorResponder) Object(int, runtime.Object) {}
+func (r *errorResponder) Error(err error)            { r.err = err }
+
+func newPod(name, app string, containers ...string) *unstructured.Unstructured {
+	u := newPart("v1", "Pod", name, app)
+	var cs []interface{}
+	for _, c := range containers {
+		cs = append(cs, map[string]interface{}{"name": c, "image": c})
+	}
+	unstructured.SetNestedSlice(u.Object, cs, "spec", "containers")
+	return u
+}
+
+// getLogs serves a logs request for name with query and returns the body, or
+// the error the handler responded with.
+func getLogs(t *testing.T, ctx context.Context, s *restStorage, name, query string) (string, error) {
+	t.Helper()
+	l, err := NewLogsREST(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := &errorResponder{}
+	h, err := l.(*logsStorage).Connect(ctx, name, nil, responder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/logs?"+query, nil).WithContext(ctx))
+	return w.Body.String(), responder.err
+}
+
+func TestLogs(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	d := newDeployment(intR.GroupVersion, "foo", nil)
+	unstructured.SetNestedStringMap(d.Object, map[string]string{"app": "foo"}, "spec", "selector", "matchLabels")
+	fake.Add(deploymentsGVR, d)
+	fake.Add(podsGVR, newPod("foo-a", "foo", "web"))
+	fake.Add(podsGVR, newPod("foo-b", "foo", "web", "sidecar"))
+	fake.Add(podsGVR, newPod("bar-a", "bar", "web"))
+	fake.SetLogs("default", "foo-a", "web", "a1\na2\na3\n")
+	fake.SetLogs("default", "foo-b", "web", "b1\nb2\n")
+	fake.SetLogs("default", "foo-b", "sidecar", "s1\n")
+	fake.SetLogs("default", "bar-a", "web", "other\n")
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "[pod/foo-a/web] a1\n[pod/foo-a/web] a2\n[pod/foo-a/web] a3\n[pod/foo-b/web] b1\n[pod/foo-b/web] b2\n[pod/foo-b/sidecar] s1\n"},
+		{"container=web&tailLines=1", "[pod/foo-a/web] a3\n[pod/foo-b/web] b2\n"},
+		{"container=sidecar", "s1\n"},
+		{"container=sidecar&prefix=true", "[pod/foo-b/sidecar] s1\n"},
+		{"container=web&prefix=false&tailLines=1", "a3\nb2\n"},
+	} {
+		got, err := getLogs(t, ctx, s, "foo", tc.query)
+		if err != nil {
+			t.Errorf("logs?%s: %v", tc.query, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("logs?%s = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"container=db", "tailLines=-1", "follow=maybe", "sinceSeconds=0"} {
+		if _, err := getLogs(t, ctx, s, "foo", query); !errors.IsBadRequest(err) {
+			t.Errorf("logs?%s returned %v, want BadRequest", query, err)
+		}
+	}
+	if _, err := getLogs(t, ctx, s, "missing", ""); !errors.IsNotFound(err) {
+		t.Errorf("logs of a missing object returned %v, want NotFound", err)
+	}
+}
+
+func TestLogsFollow(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	d := newDeployment(intR.GroupVersion, "foo", nil)
+	unstructured.SetNestedStringMap(d.Object, map[string]string{"app": "foo"}, "spec", "selector", "matchLabels")
+	fake.Add(deploymentsGVR, d)
+	fake.Add(podsGVR, newPod("foo-a", "foo", "web"))
+	fake.Add(podsGVR, newPod("foo-b", "foo", "web"))
+	fake.SetLogs("default", "foo-a", "web", "a1\n")
+	fake.SetLogs("default", "foo-b", "web", "b1\n")
+
+	// Followed streams stay open until the client goes away.
+	ctx, cancel := context.WithTimeout(ctxWithNamespace(), 500*time.Millisecond)
+	defer cancel()
+	got, err := getLogs(t, ctx, s, "foo", "follow=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(got, "[pod/foo-a/web] a1\n") || !strings.Contains(got, "[pod/foo-b/web] b1\n") {
+		t.Errorf("followed logs = %q, want the lines of both pods", got)
+	}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// continueTokenTTL is how long a continue token handed out by the proxy stays
+// valid. It matches the default compaction interval of the upstream API
+// server, after which upstream continue tokens expire as well.
+const continueTokenTTL = 5 * time.Minute
+
+// continueTokenKey signs continue tokens so that clients cannot forge upstream
+// tokens or positions. It is random unless set with SetContinueTokenKey.
+var continueTokenKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	return key
+}()
+
+// SetContinueTokenKey sets the key continue tokens are signed with. Replicas
+// serving the same API must share it, for a client may continue a List on
+// another replica. It must be called before any List is served.
+func SetContinueTokenKey(key []byte) {
+	continueTokenKey = key
+}
+
+// continueToken is the state needed to resume a paginated List. It is handed
+// to clients as an opaque, signed string so that upstream tokens never leak
+// into the facade API and cannot be tampered with.
+type continueToken struct {
+	// Upstream is the upstream continue token of the page the next item is
+	// on, or empty for the first page.
+	Upstream string `json:"u,omitempty"`
+	// Skip is the number of items of that page already returned.
+	Skip int `json:"s,omitempty"`
+	// ResourceVersion is the version the list is served at.
+	ResourceVersion string `json:"rv"`
+	// Issued is the unix time the first page of the list was served.
+	Issued int64 `json:"t"`
+}
+
+func signContinueToken(payload string) string {
+	mac := hmac.New(sha256.New, continueTokenKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (t *continueToken) encode() (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + signContinueToken(payload), nil
+}
+
+func decodeContinueToken(s string) (*continueToken, error) {
+	i := strings.LastIndex(s, ".")
+	if i < 0 || !hmac.Equal([]byte(s[i+1:]), []byte(signContinueToken(s[:i]))) {
+		return nil, errors.NewBadRequest("invalid continue token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return nil, errors.NewBadRequest("invalid continue token")
+	}
+	t := &continueToken{}
+	if err := json.Unmarshal(b, t); err != nil || t.Skip < 0 || t.Issued == 0 {
+		return nil, errors.NewBadRequest("invalid continue token")
+	}
+	if time.Since(time.Unix(t.Issued, 0)) > continueTokenTTL {
+		return nil, errors.NewResourceExpired("The provided continue parameter is too old to display a consistent list result. You can start a new list without the continue parameter.")
+	}
+	return t, nil
+}
+
+// list serves List by paging through the upstream collection until the
+// requested number of objects has been collected.
+func (r *restStorage) list(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	lo, err := toMetaListOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	token := &continueToken{Issued: time.Now().Unix()}
+	if lo.Continue != "" {
+		if token, err = decodeContinueToken(lo.Continue); err != nil {
+			return nil, err
+		}
+	}
+
+	out := r.NewList().(*unstructured.UnstructuredList)
+	client := r.getClient(ctx)
+	for {
+		req := lo
+		req.Continue = token.Upstream
+		if token.Upstream != "" {
+			// Upstream continue tokens carry their own resourceVersion.
+			req.ResourceVersion = ""
+		} else if token.ResourceVersion != "" {
+			// Re-reading the first page must see the same snapshot.
+			req.ResourceVersion = token.ResourceVersion
+		}
+		if lo.Limit > 0 {
+			req.Limit = int64(token.Skip) + lo.Limit - int64(len(out.Items))
+		}
+		page, err := client.List(req)
+		if err != nil {
+			return nil, err
+		}
+		if token.ResourceVersion == "" {
+			token.ResourceVersion = page.GetResourceVersion()
+		}
+
+		for i := token.Skip; i < len(page.Items); i++ {
+			out.Items = append(out.Items, *r.toExternal(ctx, &page.Items[i]))
+			if lo.Limit <= 0 || int64(len(out.Items)) < lo.Limit {
+				continue
+			}
+			// The page is full, remember where the next one starts.
+			switch {
+			case i+1 < len(page.Items):
+				token.Skip = i + 1
+			case page.GetContinue() != "":
+				token.Upstream, token.Skip = page.GetContinue(), 0
+			default:
+				return r.finishList(out, token.ResourceVersion, nil)
+			}
+			return r.finishList(out, token.ResourceVersion, token)
+		}
+
+		if page.GetContinue() == "" {
+			return r.finishList(out, token.ResourceVersion, nil)
+		}
+		token.Upstream, token.Skip = page.GetContinue(), 0
+	}
+}
+
+// finishList sets the list metadata of out. next is nil on the last page.
+func (r *restStorage) finishList(out *unstructured.UnstructuredList, resourceVersion string, next *continueToken) (runtime.Object, error) {
+	out.SetResourceVersion(resourceVersion)
+	if next == nil {
+		return out, nil
+	}
+	c, err := next.encode()
+	if err != nil {
+		return nil, err
+	}
+	out.SetContinue(c)
+	return out, nil
+}
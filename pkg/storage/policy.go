@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+// Policy holds the rules the proxy enforces for a resource on top of what
+// upstream enforces. The zero Policy enforces nothing.
+type Policy struct {
+	// Redactions hide fields of upstream objects from facade clients.
+	Redactions []Redaction
+	// FieldAccess restricts who may read or change fields.
+	FieldAccess []FieldAccess
+	// Defaults are set on objects written by facade clients.
+	Defaults []FieldDefault
+	// Immutable fields may not change after creation.
+	Immutable []fieldpath.Path
+	// Quota limits the objects per tenant, if set.
+	Quota *Quota
+}
+
+// RedactAction is how a redacted field is hidden.
+type RedactAction string
+
+const (
+	// RedactMask replaces the value of the field with redactedValue.
+	RedactMask RedactAction = "Mask"
+	// RedactRemove removes the field.
+	RedactRemove RedactAction = "Remove"
+)
+
+// redactedValue replaces the value of masked fields.
+const redactedValue = "<redacted>"
+
+// Redaction hides the fields at Path in every object returned to facade
+// clients. Writes keep the upstream value of a hidden field unless the
+// client sets a new one.
+type Redaction struct {
+	Path   fieldpath.Path
+	Action RedactAction
+}
+
+// Subjects lists users and groups.
+type Subjects struct {
+	Users  []string
+	Groups []string
+}
+
+// includes reports whether u is one of s.
+func (s *Subjects) includes(u user.Info) bool {
+	if u == nil {
+		return false
+	}
+	for _, name := range s.Users {
+		if name == u.GetName() {
+			return true
+		}
+	}
+	for _, g := range u.GetGroups() {
+		for _, name := range s.Groups {
+			if name == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FieldAccess restricts access to the fields at Path based on the identity
+// of the caller.
+type FieldAccess struct {
+	Path fieldpath.Path
+	// Readers may see the fields, which are removed for everyone else. Nil
+	// allows everyone.
+	Readers *Subjects
+	// Writers may set or change the fields. Nil allows everyone.
+	Writers *Subjects
+	// Above, if set, only restricts values above it to Writers.
+	Above *int64
+}
+
+// hidden returns the fields hidden from the caller in ctx: the redactions
+// and the fields the caller may not read.
+func (p *Policy) hidden(ctx context.Context) []Redaction {
+	if len(p.FieldAccess) == 0 {
+		return p.Redactions
+	}
+	u, _ := request.UserFrom(ctx)
+	out := append([]Redaction(nil), p.Redactions...)
+	for _, fa := range p.FieldAccess {
+		if fa.Readers != nil && !fa.Readers.includes(u) {
+			out = append(out, Redaction{Path: fa.Path, Action: RedactRemove})
+		}
+	}
+	return out
+}
+
+// redact hides the fields of u hidden from the caller in ctx, in place.
+func (p *Policy) redact(ctx context.Context, u *unstructured.Unstructured) {
+	for _, r := range p.hidden(ctx) {
+		for _, fp := range fieldpath.Expand(u.Object, r.Path) {
+			if r.Action == RedactRemove {
+				fieldpath.Remove(u.Object, fp)
+			} else {
+				fieldpath.Set(u.Object, fp, redactedValue)
+			}
+		}
+	}
+}
+
+// restore puts the upstream values of the redacted fields of upstream back
+// into updated, which was derived from the redacted view of upstream. A
+// masked field is restored if it still holds redactedValue, a removed one if
+// it is still absent. List elements are matched by index.
+func (p *Policy) restore(ctx context.Context, updated, upstream *unstructured.Unstructured) {
+	for _, r := range p.hidden(ctx) {
+		for _, fp := range fieldpath.Expand(upstream.Object, r.Path) {
+			v, ok := fieldpath.Get(updated.Object, fp)
+			if r.Action == RedactRemove && ok || r.Action != RedactRemove && (!ok || v != redactedValue) {
+				continue
+			}
+			orig, _ := fieldpath.Get(upstream.Object, fp)
+			// Fails if the enclosing list element was removed, in which
+			// case there is nothing to restore.
+			fieldpath.Set(updated.Object, fp, runtime.DeepCopyJSONValue(orig))
+		}
+	}
+}
+
+// FieldDefault sets the fields at Path to Value if they are absent. Path may
+// contain wildcards before its last element, e.g.
+// spec.template.spec.containers[*].resources.limits.memory; maps missing
+// after the last wildcard are created.
+type FieldDefault struct {
+	Path fieldpath.Path
+	// Value is a JSON value as found in unstructured objects.
+	Value interface{}
+	// OnUpdate also applies the default on updates, not only on creates.
+	OnUpdate bool
+}
+
+// applyDefaults sets the absent defaulted fields of u. update is true if u
+// is being updated rather than created.
+func (p *Policy) applyDefaults(u *unstructured.Unstructured, update bool) {
+	for _, d := range p.Defaults {
+		if update && !d.OnUpdate {
+			continue
+		}
+		// Expand the path up to its last wildcard, the rest is created.
+		last := -1
+		for i, e := range d.Path {
+			if e.Wildcard {
+				last = i
+			}
+		}
+		targets := []fieldpath.Path{nil}
+		if last >= 0 {
+			targets = fieldpath.Expand(u.Object, d.Path[:last+1])
+		}
+		for _, t := range targets {
+			fp := append(append(fieldpath.Path(nil), t...), d.Path[last+1:]...)
+			if _, ok := fieldpath.Get(u.Object, fp); !ok {
+				fieldpath.Set(u.Object, fp, runtime.DeepCopyJSONValue(d.Value))
+			}
+		}
+	}
+}
+
+// checkWrites returns a Forbidden error if the caller in ctx changes a field
+// of existing it may not change. existing is nil on create.
+func (p *Policy) checkWrites(ctx context.Context, gr schema.GroupResource, name string, updated, existing *unstructured.Unstructured) error {
+	if len(p.FieldAccess) == 0 {
+		return nil
+	}
+	u, _ := request.UserFrom(ctx)
+	var old map[string]interface{}
+	if existing != nil {
+		old = existing.Object
+	}
+	for _, fa := range p.FieldAccess {
+		if fa.Writers == nil || fa.Writers.includes(u) {
+			continue
+		}
+		for _, fp := range expandBoth(updated.Object, old, fa.Path) {
+			v, ok := fieldpath.Get(updated.Object, fp)
+			ov, ook := fieldpath.Get(old, fp)
+			if ok == ook && equality.Semantic.DeepEqual(v, ov) {
+				continue
+			}
+			if fa.Above == nil {
+				return errors.NewForbidden(gr, name, fmt.Errorf("%s may not be changed by %s", fp, userName(u)))
+			}
+			if ok && !numberAtMost(v, *fa.Above) {
+				return errors.NewForbidden(gr, name, fmt.Errorf("%s may not be set above %d by %s", fp, *fa.Above, userName(u)))
+			}
+		}
+	}
+	return nil
+}
+
+// checkImmutable returns an Invalid error naming every immutable field that
+// differs between updated and existing.
+func (p *Policy) checkImmutable(gk schema.GroupKind, name string, updated, existing *unstructured.Unstructured) error {
+	var errs field.ErrorList
+	for _, path := range p.Immutable {
+		for _, fp := range expandBoth(updated.Object, existing.Object, path) {
+			v, ok := fieldpath.Get(updated.Object, fp)
+			ov, ook := fieldpath.Get(existing.Object, fp)
+			if ok != ook || !equality.Semantic.DeepEqual(v, ov) {
+				errs = append(errs, field.Invalid(toFieldPath(fp), v, "field is immutable"))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(gk, name, errs)
+}
+
+// toFieldPath converts fp, which must not contain wildcards, for use in
+// validation errors.
+func toFieldPath(fp fieldpath.Path) *field.Path {
+	var out *field.Path
+	for _, e := range fp {
+		switch {
+		case e.IsIndex() && out == nil:
+			out = field.NewPath("").Index(e.Index)
+		case e.IsIndex():
+			out = out.Index(e.Index)
+		case out == nil:
+			out = field.NewPath(e.Key)
+		case strings.ContainsAny(e.Key, ".[]"):
+			out = out.Key(e.Key)
+		default:
+			out = out.Child(e.Key)
+		}
+	}
+	return out
+}
+
+// expandBoth returns the paths selected by p in either a or b.
+func expandBoth(a, b map[string]interface{}, p fieldpath.Path) []fieldpath.Path {
+	seen := map[string]bool{}
+	var out []fieldpath.Path
+	for _, obj := range []map[string]interface{}{a, b} {
+		for _, fp := range fieldpath.Expand(obj, p) {
+			if !seen[fp.String()] {
+				seen[fp.String()] = true
+				out = append(out, fp)
+			}
+		}
+	}
+	return out
+}
+
+// numberAtMost reports whether v is a number no greater than limit.
+func numberAtMost(v interface{}, limit int64) bool {
+	switch n := v.(type) {
+	case int64:
+		return n <= limit
+	case float64:
+		return n <= float64(limit)
+	}
+	return false
+}
+
+func userName(u user.Info) string {
+	if u == nil {
+		return "anonymous user"
+	}
+	return fmt.Sprintf("user %q", u.GetName())
+}
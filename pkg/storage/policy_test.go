@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+const lastApplied = "kubectl.kubernetes.io/last-applied-configuration"
+
+func newSecretDeployment(name string) *unstructured.Unstructured {
+	u := newDeployment(intR.GroupVersion, name, nil)
+	u.SetAnnotations(map[string]string{lastApplied: "{}", "team": "a"})
+	unstructured.SetNestedSlice(u.Object, []interface{}{
+		map[string]interface{}{
+			"name":  "web",
+			"image": "nginx",
+			"env": []interface{}{
+				map[string]interface{}{"name": "PASSWORD", "value": "hunter2"},
+			},
+		},
+	}, "spec", "template", "spec", "containers")
+	return u
+}
+
+func envValue(t *testing.T, u *unstructured.Unstructured) interface{} {
+	t.Helper()
+	v, ok := fieldpath.Get(u.Object, fieldpath.MustParse("spec.template.spec.containers[0].env[0].value"))
+	if !ok {
+		t.Fatal("env value not set")
+	}
+	return v
+}
+
+func assertRedacted(t *testing.T, u *unstructured.Unstructured) {
+	t.Helper()
+	if v := envValue(t, u); v != redactedValue {
+		t.Errorf("env value = %v, want it masked", v)
+	}
+	if _, ok := u.GetAnnotations()[lastApplied]; ok {
+		t.Errorf("%s annotation not removed", lastApplied)
+	}
+	if u.GetAnnotations()["team"] != "a" {
+		t.Error("unredacted annotation was removed")
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	s.policy = Policy{Redactions: []Redaction{
+		{Path: fieldpath.MustParse("spec.template.spec.containers[*].env[*].value"), Action: RedactMask},
+		{Path: fieldpath.MustParse(`metadata.annotations["` + lastApplied + `"]`), Action: RedactRemove},
+	}}
+	ctx := ctxWithNamespace()
+	fake.Add(deploymentsGVR, newSecretDeployment("foo"))
+
+	obj, err := s.Get(ctx, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedacted(t, assertExternal(t, obj))
+	l, err := s.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedacted(t, &l.(*unstructured.UnstructuredList).Items[0])
+
+	w, err := s.Watch(ctx, &metainternalversion.ListOptions{ResourceVersion: l.(*unstructured.UnstructuredList).GetResourceVersion()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// Updating the redacted view keeps the hidden upstream values.
+	u := obj.(*unstructured.Unstructured)
+	unstructured.SetNestedField(u.Object, int64(3), "spec", "replicas")
+	obj, _, err = s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedacted(t, assertExternal(t, obj))
+	upstream := fake.Object(deploymentsGVR, "default", "foo")
+	if v := envValue(t, upstream); v != "hunter2" {
+		t.Errorf("upstream env value = %v after update, want hunter2", v)
+	}
+	if upstream.GetAnnotations()[lastApplied] != "{}" {
+		t.Errorf("upstream %s annotation was not preserved", lastApplied)
+	}
+	assertRedacted(t, assertExternal(t, nextEvent(t, w).Object))
+
+	// A new value replaces the hidden one.
+	u = obj.(*unstructured.Unstructured)
+	fieldpath.Set(u.Object, fieldpath.MustParse("spec.template.spec.containers[0].env[0].value"), "correct-horse")
+	if _, _, err := s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := envValue(t, fake.Object(deploymentsGVR, "default", "foo")); v != "correct-horse" {
+		t.Errorf("upstream env value = %v, want correct-horse", v)
+	}
+}
+
+func ctxWithUser(name string, groups ...string) context.Context {
+	return request.WithUser(ctxWithNamespace(), &user.DefaultInfo{Name: name, Groups: groups})
+}
+
+func TestFieldAccess(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ten := int64(10)
+	s.policy = Policy{FieldAccess: []FieldAccess{
+		{Path: fieldpath.MustParse("spec.replicas"), Writers: &Subjects{Groups: []string{"sre"}}, Above: &ten},
+		{Path: fieldpath.MustParse("spec.template.spec.serviceAccountName"), Readers: &Subjects{Groups: []string{"platform"}}, Writers: &Subjects{Groups: []string{"platform"}}},
+	}}
+	d := newDeployment(intR.GroupVersion, "foo", nil)
+	unstructured.SetNestedField(d.Object, "deployer", "spec", "template", "spec", "serviceAccountName")
+	fake.Add(deploymentsGVR, d)
+	dev, sre, platform := ctxWithUser("dev"), ctxWithUser("bob", "sre"), ctxWithUser("carol", "platform")
+
+	obj, err := s.Get(dev, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := obj.(*unstructured.Unstructured)
+	if _, ok, _ := unstructured.NestedString(u.Object, "spec", "template", "spec", "serviceAccountName"); ok {
+		t.Error("serviceAccountName visible to a user outside platform")
+	}
+	if obj, err := s.Get(platform, "foo", nil); err != nil {
+		t.Fatal(err)
+	} else if sa, _, _ := unstructured.NestedString(obj.(*unstructured.Unstructured).Object, "spec", "template", "spec", "serviceAccountName"); sa != "deployer" {
+		t.Errorf("platform sees serviceAccountName %q, want deployer", sa)
+	}
+
+	// Updating the view without the hidden field keeps it upstream.
+	unstructured.SetNestedField(u.Object, int64(5), "spec", "replicas")
+	obj, _, err = s.Update(dev, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa, _, _ := unstructured.NestedString(fake.Object(deploymentsGVR, "default", "foo").Object, "spec", "template", "spec", "serviceAccountName"); sa != "deployer" {
+		t.Errorf("upstream serviceAccountName = %q after update, want deployer", sa)
+	}
+
+	u = obj.(*unstructured.Unstructured)
+	unstructured.SetNestedField(u.Object, int64(20), "spec", "replicas")
+	_, _, err = s.Update(dev, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if !errors.IsForbidden(err) || !strings.Contains(err.Error(), "spec.replicas") {
+		t.Errorf("scaling above 10 as dev returned %v, want Forbidden naming spec.replicas", err)
+	}
+	if _, _, err := s.Update(sre, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); err != nil {
+		t.Errorf("scaling above 10 as sre: %v", err)
+	}
+
+	d = newDeployment(extR.GroupVersion, "bar", nil)
+	unstructured.SetNestedField(d.Object, "admin", "spec", "template", "spec", "serviceAccountName")
+	if _, err := s.Create(dev, d, rest.ValidateAllObjectFunc, nil); !errors.IsForbidden(err) || !strings.Contains(err.Error(), "serviceAccountName") {
+		t.Errorf("create with serviceAccountName as dev returned %v, want Forbidden", err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	s.policy = Policy{Defaults: []FieldDefault{
+		{Path: fieldpath.MustParse("metadata.labels.team"), Value: "unknown", OnUpdate: true},
+		{Path: fieldpath.MustParse("spec.template.spec.containers[*].resources.requests.cpu"), Value: "100m"},
+		{Path: fieldpath.MustParse("spec.template.spec.tolerations"), Value: []interface{}{
+			map[string]interface{}{"key": "dedicated", "operator": "Exists"},
+		}},
+	}}
+	ctx := ctxWithNamespace()
+	d := newDeployment(extR.GroupVersion, "foo", map[string]string{"app": "foo"})
+	unstructured.SetNestedSlice(d.Object, []interface{}{
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": "b", "resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "2"}}},
+	}, "spec", "template", "spec", "containers")
+	if _, err := s.Create(ctx, d, rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := fake.Object(deploymentsGVR, "default", "foo")
+	if upstream.GetLabels()["team"] != "unknown" || upstream.GetLabels()["app"] != "foo" {
+		t.Errorf("labels = %v, want team defaulted", upstream.GetLabels())
+	}
+	for i, want := range []string{"100m", "2"} {
+		got, _ := fieldpath.Get(upstream.Object, fieldpath.MustParse(fmt.Sprintf("spec.template.spec.containers[%d].resources.requests.cpu", i)))
+		if got != want {
+			t.Errorf("container %d requests %v cpu, want %s", i, got, want)
+		}
+	}
+	if tolerations, _, _ := unstructured.NestedSlice(upstream.Object, "spec", "template", "spec", "tolerations"); len(tolerations) != 1 {
+		t.Errorf("got %d tolerations, want 1", len(tolerations))
+	}
+
+	// Only defaults marked OnUpdate apply to updates.
+	obj, err := s.Get(ctx, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := obj.(*unstructured.Unstructured)
+	u.SetLabels(nil)
+	unstructured.RemoveNestedField(u.Object, "spec", "template", "spec", "tolerations")
+	if _, _, err := s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	upstream = fake.Object(deploymentsGVR, "default", "foo")
+	if upstream.GetLabels()["team"] != "unknown" {
+		t.Errorf("labels = %v after update, want team defaulted", upstream.GetLabels())
+	}
+	if _, ok, _ := unstructured.NestedSlice(upstream.Object, "spec", "template", "spec", "tolerations"); ok {
+		t.Error("tolerations defaulted on update")
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	s.policy = Policy{Immutable: []fieldpath.Path{
+		fieldpath.MustParse("spec.selector"),
+		fieldpath.MustParse("metadata.labels.team"),
+	}}
+	ctx := ctxWithNamespace()
+	d := newDeployment(extR.GroupVersion, "foo", map[string]string{"team": "a"})
+	unstructured.SetNestedStringMap(d.Object, map[string]string{"app": "foo"}, "spec", "selector", "matchLabels")
+	obj, err := s.Create(ctx, d, rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := obj.(*unstructured.Unstructured).DeepCopy()
+	unstructured.SetNestedField(u.Object, int64(2), "spec", "replicas")
+	obj, _, err = s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatalf("update of a mutable field: %v", err)
+	}
+
+	u = obj.(*unstructured.Unstructured).DeepCopy()
+	u.SetLabels(map[string]string{"team": "b"})
+	unstructured.SetNestedField(u.Object, "bar", "spec", "selector", "matchLabels", "app")
+	_, _, err = s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if !errors.IsInvalid(err) {
+		t.Fatalf("update of immutable fields returned %v, want Invalid", err)
+	}
+	causes := err.(*errors.StatusError).ErrStatus.Details.Causes
+	var fields []string
+	for _, c := range causes {
+		fields = append(fields, c.Field)
+	}
+	if strings.Join(fields, ",") != "spec.selector,metadata.labels.team" {
+		t.Errorf("invalid fields = %v, want spec.selector and metadata.labels.team", fields)
+	}
+}
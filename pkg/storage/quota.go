@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+// Quota limits the objects of a resource per tenant. Usage is counted from
+// a cache of the upstream objects, so limits are only enforced on writes
+// made through the proxy.
+type Quota struct {
+	// TenantLabel groups objects into tenants by the value of this label;
+	// objects without it are not limited. Objects are grouped by namespace
+	// if it is empty.
+	TenantLabel string
+	// MaxObjects, if positive, limits the number of objects per tenant.
+	MaxObjects int64
+	// Sums limit the sums of numeric fields over the objects of a tenant.
+	Sums []QuotaSum
+}
+
+// QuotaSum limits the sum of the numeric fields at Path, e.g. spec.replicas.
+// Absent fields count as 0 even where upstream defaults them, as it does
+// spec.replicas of a Deployment to 1; a FieldDefault makes them count.
+type QuotaSum struct {
+	Path fieldpath.Path
+	Max  int64
+}
+
+const tenantIndex = "tenant"
+
+// quotaTracker enforces a Quota for one upstream resource.
+type quotaTracker struct {
+	quota    Quota
+	informer cache.SharedIndexInformer
+	start    sync.Once
+	// stopCh stops the informer once the storage is destroyed.
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// mu guards reserved. Admitted writes reserve their object until they
+	// are done, so that concurrent writes cannot both use the last of the
+	// quota without holding mu across the upstream request.
+	mu       sync.Mutex
+	reserved map[*unstructured.Unstructured]bool
+}
+
+func newQuotaTracker(q Quota, upstream Upstream, gvr schema.GroupVersionResource) *quotaTracker {
+	client := upstream.Client.Resource(gvr)
+	t := &quotaTracker{quota: q, stopCh: make(chan struct{}), reserved: map[*unstructured.Unstructured]bool{}}
+	t.informer = cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.Watch(options)
+		},
+	}, &unstructured.Unstructured{}, 0, cache.Indexers{
+		tenantIndex: func(obj interface{}) ([]string, error) {
+			if tenant := t.tenant(obj.(*unstructured.Unstructured)); tenant != "" {
+				return []string{tenant}, nil
+			}
+			return nil, nil
+		},
+	})
+	return t
+}
+
+// stop stops the informer.
+func (t *quotaTracker) stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stopCh) })
+}
+
+// tenant returns the tenant u belongs to, or "" if it is not limited.
+func (t *quotaTracker) tenant(u *unstructured.Unstructured) string {
+	if t.quota.TenantLabel != "" {
+		return u.GetLabels()[t.quota.TenantLabel]
+	}
+	return u.GetNamespace()
+}
+
+// admit checks that writing obj, which replaces old unless old is nil, keeps
+// its tenant within the quota. On success the caller must call release once
+// the write is done, with the written object or nil if nothing was written.
+func (t *quotaTracker) admit(ctx context.Context, gr schema.GroupResource, obj, old *unstructured.Unstructured) (release func(*unstructured.Unstructured), err error) {
+	if t == nil {
+		return func(*unstructured.Unstructured) {}, nil
+	}
+	t.start.Do(func() { go t.informer.Run(t.stopCh) })
+	if !cache.WaitForCacheSync(ctx.Done(), t.informer.HasSynced) {
+		return nil, errors.NewServiceUnavailable(fmt.Sprintf("quota usage of %s is not known yet", gr))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.check(gr, obj, old); err != nil {
+		return nil, err
+	}
+	reservation := obj.DeepCopy()
+	t.reserved[reservation] = true
+	return func(written *unstructured.Unstructured) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.reserved, reservation)
+		if written != nil {
+			// Count the write before the watch delivers it.
+			t.informer.GetIndexer().Update(written.DeepCopy())
+		}
+	}, nil
+}
+
+func (t *quotaTracker) check(gr schema.GroupResource, obj, old *unstructured.Unstructured) error {
+	tenant := t.tenant(obj)
+	if tenant == "" {
+		return nil
+	}
+	items, err := t.informer.GetIndexer().ByIndex(tenantIndex, tenant)
+	if err != nil {
+		return errors.NewInternalError(err)
+	}
+	// Objects of the tenant other than obj, with writes in progress counted
+	// as done. Creates with generateName have no name yet, so each of them
+	// counts as a new object.
+	key := obj.GetNamespace() + "/" + obj.GetName()
+	objs := map[string]*unstructured.Unstructured{}
+	for _, item := range items {
+		u := item.(*unstructured.Unstructured)
+		objs[u.GetNamespace()+"/"+u.GetName()] = u
+	}
+	var nameless []*unstructured.Unstructured
+	for u := range t.reserved {
+		switch {
+		case t.tenant(u) != tenant:
+		case u.GetName() == "":
+			nameless = append(nameless, u)
+		default:
+			objs[u.GetNamespace()+"/"+u.GetName()] = u
+		}
+	}
+	if obj.GetName() != "" {
+		delete(objs, key)
+	}
+	count := int64(len(objs) + len(nameless))
+	sums := make([]int64, len(t.quota.Sums))
+	for _, u := range objs {
+		for i, s := range t.quota.Sums {
+			sums[i] += sumFields(u, s.Path)
+		}
+	}
+	for _, u := range nameless {
+		for i, s := range t.quota.Sums {
+			sums[i] += sumFields(u, s.Path)
+		}
+	}
+
+	moved := old == nil || t.tenant(old) != tenant
+	if max := t.quota.MaxObjects; max > 0 && moved && count+1 > max {
+		return errors.NewForbidden(gr, obj.GetName(), fmt.Errorf("exceeded quota: tenant %q may have at most %d objects", tenant, max))
+	}
+	for i, s := range t.quota.Sums {
+		total := sums[i] + sumFields(obj, s.Path)
+		// Writes that do not increase the usage are allowed even if the
+		// tenant is already over the limit.
+		previous := int64(0)
+		if !moved {
+			previous = sums[i] + sumFields(old, s.Path)
+		}
+		if total > s.Max && total > previous {
+			return errors.NewForbidden(gr, obj.GetName(), fmt.Errorf("exceeded quota: %s of tenant %q would total %d, limited to %d", s.Path, tenant, total, s.Max))
+		}
+	}
+	return nil
+}
+
+// sumFields returns the sum of the integer fields of u at p.
+func sumFields(u *unstructured.Unstructured, p fieldpath.Path) int64 {
+	var sum int64
+	for _, fp := range fieldpath.Expand(u.Object, p) {
+		switch v, _ := fieldpath.Get(u.Object, fp); n := v.(type) {
+		case int64:
+			sum += n
+		case float64:
+			sum += int64(n)
+		}
+	}
+	return sum
+}
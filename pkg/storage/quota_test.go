@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/fieldpath"
+)
+
+func TestQuota(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	s.quota = newQuotaTracker(Quota{
+		MaxObjects: 2,
+		Sums:       []QuotaSum{{Path: fieldpath.MustParse("spec.replicas"), Max: 5}},
+	}, s.upstream, s.gvr)
+	defer s.Destroy()
+	ctx := ctxWithNamespace()
+	// Objects in other namespaces belong to other tenants.
+	other := newDeployment(intR.GroupVersion, "other", nil)
+	other.SetNamespace("other")
+	unstructured.SetNestedField(other.Object, int64(2), "spec", "replicas")
+	fake.Add(deploymentsGVR, other)
+
+	create := func(name string, replicas int64) error {
+		d := newDeployment(extR.GroupVersion, name, nil)
+		unstructured.SetNestedField(d.Object, replicas, "spec", "replicas")
+		_, err := s.Create(ctx, d, rest.ValidateAllObjectFunc, nil)
+		return err
+	}
+	if err := create("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("bar", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("baz", 1); !errors.IsForbidden(err) || !strings.Contains(err.Error(), "at most 2") {
+		t.Errorf("third create returned %v, want Forbidden", err)
+	}
+
+	scale := func(name string, replicas int64) error {
+		obj, err := s.Get(ctx, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := obj.(*unstructured.Unstructured)
+		unstructured.SetNestedField(u.Object, replicas, "spec", "replicas")
+		_, _, err = s.Update(ctx, name, rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+		return err
+	}
+	if err := scale("bar", 5); !errors.IsForbidden(err) || !strings.Contains(err.Error(), "spec.replicas") {
+		t.Errorf("scaling over the quota returned %v, want Forbidden", err)
+	}
+	if err := scale("bar", 4); err != nil {
+		t.Errorf("scaling up to the quota: %v", err)
+	}
+
+	d := newDeployment(extR.GroupVersion, "second", nil)
+	d.SetNamespace("other")
+	if _, err := s.Create(request.WithNamespace(ctx, "other"), d, rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Errorf("create in another namespace: %v", err)
+	}
+
+	// Deletes free up quota once the cache sees them.
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return create("baz", 1) == nil, nil
+	})
+	if err != nil {
+		t.Error("create after a delete was not admitted")
+	}
+}
+
+func TestQuotaReservations(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	tracker := newQuotaTracker(Quota{MaxObjects: 1}, s.upstream, s.gvr)
+	defer tracker.stop()
+	ctx := ctxWithNamespace()
+	gr := s.groupResource()
+	newObj := func(namespace, name string) *unstructured.Unstructured {
+		d := newDeployment(intR.GroupVersion, name, nil)
+		d.SetNamespace(namespace)
+		return d
+	}
+
+	// Admitting a write does not block writes of other tenants while it is
+	// in progress, but its object counts towards its own tenant's usage.
+	release, err := tracker.admit(ctx, gr, newObj("default", "foo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRelease, err := tracker.admit(ctx, gr, newObj("other", "foo"), nil)
+	if err != nil {
+		t.Fatalf("write of another tenant was not admitted: %v", err)
+	}
+	otherRelease(nil)
+	if _, err := tracker.admit(ctx, gr, newObj("default", "bar"), nil); !errors.IsForbidden(err) {
+		t.Errorf("write during a reserved write returned %v, want Forbidden", err)
+	}
+	// A failed write frees its reservation.
+	release(nil)
+	release, err = tracker.admit(ctx, gr, newObj("default", "bar"), nil)
+	if err != nil {
+		t.Fatalf("write after a failed write was not admitted: %v", err)
+	}
+	release(newObj("default", "bar"))
+	if _, err := tracker.admit(ctx, gr, newObj("default", "foo"), nil); !errors.IsForbidden(err) {
+		t.Errorf("write after a done write returned %v, want Forbidden", err)
+	}
+}
+
+func TestQuotaReservationsGenerateName(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	tracker := newQuotaTracker(Quota{MaxObjects: 2}, s.upstream, s.gvr)
+	defer tracker.stop()
+	ctx := ctxWithNamespace()
+	gr := s.groupResource()
+	newObj := func() *unstructured.Unstructured {
+		d := newDeployment(intR.GroupVersion, "", nil)
+		d.SetNamespace("default")
+		d.SetGenerateName("web-")
+		return d
+	}
+
+	// Creates with generateName in progress each count, even though they
+	// share the same empty name.
+	var releases []func(*unstructured.Unstructured)
+	for i := 0; i < 2; i++ {
+		release, err := tracker.admit(ctx, gr, newObj(), nil)
+		if err != nil {
+			t.Fatalf("create %d was not admitted: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := tracker.admit(ctx, gr, newObj(), nil); !errors.IsForbidden(err) {
+		t.Errorf("third create returned %v, want Forbidden", err)
+	}
+	releases[0](nil)
+	release, err := tracker.admit(ctx, gr, newObj(), nil)
+	if err != nil {
+		t.Fatalf("create after a failed create was not admitted: %v", err)
+	}
+	release(nil)
+	releases[1](nil)
+}
+
+func TestQuotaDestroy(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	s.quota = newQuotaTracker(Quota{MaxObjects: 1}, s.upstream, s.gvr)
+	if _, err := s.Create(ctxWithNamespace(), newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Destroy()
+	select {
+	case <-s.quota.stopCh:
+	default:
+		t.Error("Destroy() did not stop the quota cache")
+	}
+	// Destroying twice, or a storage without quota, is harmless.
+	s.Destroy()
+	s.quota = nil
+	s.Destroy()
+}
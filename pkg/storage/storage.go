@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
@@ -14,12 +15,18 @@ import (
 	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/registry/rest"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/klog"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
 )
 
 //func NewREST() rest.StandardStorage {
-func NewREST(extR, intR GroupVersionKindResource, nsScoped bool, client dynamic.Interface, shortNames, categories []string) rest.Storage {
-	return &restStorage{
+
+// NewREST returns a rest.Storage serving extR by proxying to intR upstream.
+// admission must be true if requests are subject to admission control, in
+// which case every item removed by DeleteCollection is validated individually.
+// policy is enforced on every request.
+func NewREST(extR, intR GroupVersionKindResource, nsScoped, admission bool, upstream Upstream, shortNames, categories []string, policy Policy) rest.Storage {
+	r := &restStorage{
 		mapper: &mapper{
 			External: extR,
 			Internal: intR,
@@ -27,12 +34,38 @@ func NewREST(extR, intR GroupVersionKindResource, nsScoped bool, client dynamic.
 		categories:      categories,
 		shortNames:      shortNames,
 		namespaceScoped: nsScoped,
-		client: client.Resource(schema.GroupVersionResource{
+		admission:       admission,
+		upstream:        upstream,
+		policy:          policy,
+		gvr: schema.GroupVersionResource{
 			Group:    intR.GroupVersion.Group,
 			Version:  intR.GroupVersion.Version,
 			Resource: intR.Resource,
-		}),
+		},
+		metrics: metrics.Resource{
+			Group:    extR.GroupVersion.Group,
+			Version:  extR.GroupVersion.Version,
+			Resource: extR.Resource,
+			Cluster:  upstream.Name,
+		},
+	}
+	if policy.Quota != nil {
+		r.quota = newQuotaTracker(*policy.Quota, upstream, r.gvr)
 	}
+	return r
+}
+
+// Destroyer is implemented by storages holding resources, such as caches of
+// upstream objects, that must be released once they are no longer served.
+type Destroyer interface {
+	// Destroy releases the resources. The storage must not be used
+	// afterwards.
+	Destroy()
+}
+
+// Destroy stops the quota cache.
+func (r *restStorage) Destroy() {
+	r.quota.stop()
 }
 
 func (r *restStorage) Categories() []string {
@@ -76,26 +109,55 @@ type restStorage struct {
 	shortNames      []string
 	mapper          *mapper
 	namespaceScoped bool
-	client          dynamic.NamespaceableResourceInterface
+	admission       bool
+	upstream        Upstream
+	policy          Policy
+	// quota enforces policy.Quota; it is nil if there is none.
+	quota   *quotaTracker
+	gvr     schema.GroupVersionResource
+	metrics metrics.Resource
+}
+
+// observe records the outcome of a facade request started at start. It is
+// meant to be deferred with a pointer to the named error result.
+func (r *restStorage) observe(verb string, start time.Time, err *error) {
+	r.metrics.ObserveRequest(verb, start, *err)
+}
+
+// toExternal turns the upstream object o into the object returned to the
+// facade client in ctx.
+func (r *restStorage) toExternal(ctx context.Context, o runtime.Object) *unstructured.Unstructured {
+	u := r.mapper.External.Assign(o)
+	r.policy.redact(ctx, u)
+	return u
+}
+
+// groupResource returns the external resource.
+func (r *restStorage) groupResource() schema.GroupResource {
+	return schema.GroupResource{Group: r.mapper.External.GroupVersion.Group, Resource: r.mapper.External.Resource}
 }
 
 type watcher struct {
 	wi      watch.Interface
 	mapper  func(runtime.Object) *unstructured.Unstructured
 	wrapper *watch.RaceFreeFakeWatcher
+	metrics metrics.Resource
 }
 
-func newWrappedWatcher(mapper func(o runtime.Object) *unstructured.Unstructured, wi watch.Interface) *watcher {
+func newWrappedWatcher(mapper func(o runtime.Object) *unstructured.Unstructured, wi watch.Interface, m metrics.Resource) *watcher {
 	w := &watcher{
 		mapper:  mapper,
 		wi:      wi,
 		wrapper: watch.NewRaceFreeFake(),
+		metrics: m,
 	}
+	m.WatchStarted()
 	go w.run()
 	return w
 }
 
 func (w *watcher) run() {
+	defer w.metrics.WatchStopped()
 	defer w.wrapper.Stop()
 	for e := range w.wi.ResultChan() {
 		if e.Type != watch.Error {
@@ -103,6 +165,7 @@ func (w *watcher) run() {
 		} else {
 			w.wrapper.Action(e.Type, e.Object)
 		}
+		w.metrics.WatchEvent(string(e.Type))
 	}
 }
 
@@ -115,31 +178,62 @@ func (w *watcher) Stop() {
 	w.wrapper.Stop()
 }
 
-func (r *restStorage) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+func (r *restStorage) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (out runtime.Object, err error) {
+	defer r.observe("create", time.Now(), &err)
+	defer func() {
+		r.recordEvent(ctx, "create", obj.(*unstructured.Unstructured).GetName(), out, options != nil && len(options.DryRun) > 0, err)
+	}()
+	return r.create(ctx, obj, createValidation, options)
+}
+
+func (r *restStorage) create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+	u := obj.(*unstructured.Unstructured)
+	if err := r.policy.checkWrites(ctx, r.groupResource(), u.GetName(), u, nil); err != nil {
+		return nil, err
+	}
+	r.policy.applyDefaults(u, false)
 	if err := createValidation(obj); err != nil {
 		return nil, err
 	}
 	orig := r.mapper.Internal.Assign(obj)
-	if options != nil {
+	if ns, _ := request.NamespaceFrom(ctx); orig.GetNamespace() == "" {
+		orig.SetNamespace(ns)
+	}
+	if options == nil {
 		options = &metav1.CreateOptions{}
 	}
+	release, err := r.quota.admit(ctx, r.groupResource(), orig, nil)
+	if err != nil {
+		return nil, err
+	}
 	created, err := r.getClient(ctx).Create(orig, *options)
+	if err != nil || len(options.DryRun) > 0 {
+		release(nil)
+	} else {
+		release(created)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return r.mapper.External.Assign(created), nil
+	return r.toExternal(ctx, created), nil
 }
 
-func (r *restStorage) Update(ctx context.Context, name string, objInfo rest.UpdatedObjectInfo, createValidation rest.ValidateObjectFunc, updateValidation rest.ValidateObjectUpdateFunc, forceAllowCreate bool, options *metav1.UpdateOptions) (runtime.Object, bool, error) {
-	o, err := r.Get(ctx, name, nil)
+func (r *restStorage) Update(ctx context.Context, name string, objInfo rest.UpdatedObjectInfo, createValidation rest.ValidateObjectFunc, updateValidation rest.ValidateObjectUpdateFunc, forceAllowCreate bool, options *metav1.UpdateOptions) (out runtime.Object, _ bool, err error) {
+	defer r.observe("update", time.Now(), &err)
+	verb := "update"
+	defer func() {
+		r.recordEvent(ctx, verb, name, out, options != nil && len(options.DryRun) > 0, err)
+	}()
+	existing, err := r.get(ctx, name, nil)
 	if err != nil {
 		if errors.IsNotFound(err) && forceAllowCreate {
+			verb = "create"
 			// We have the external version which is what we want to run validations on.
 			newObj, err := objInfo.UpdatedObject(ctx, r.New())
 			if err != nil {
 				return nil, false, err
 			}
-			c, err := r.Create(ctx, newObj, createValidation, nil)
+			c, err := r.create(ctx, newObj, createValidation, createOptions(options))
 			if err != nil {
 				return nil, false, err
 			}
@@ -147,35 +241,68 @@ func (r *restStorage) Update(ctx context.Context, name string, objInfo rest.Upda
 		}
 		return nil, false, err
 	}
+	out, err = r.update(ctx, name, existing.(*unstructured.Unstructured), objInfo, options)
+	return out, false, err
+}
+
+// createOptions returns the options of the create an update with options
+// turns into when the object does not exist.
+func createOptions(options *metav1.UpdateOptions) *metav1.CreateOptions {
+	if options == nil {
+		return nil
+	}
+	return &metav1.CreateOptions{DryRun: options.DryRun}
+}
+
+// update replaces the existing object name with the one objInfo derives from
+// it, enforcing the policy and quota.
+func (r *restStorage) update(ctx context.Context, name string, existing *unstructured.Unstructured, objInfo rest.UpdatedObjectInfo, options *metav1.UpdateOptions) (runtime.Object, error) {
 	// We have the external version which is what we want to run validations on.
+	o := existing.DeepCopy()
+	r.policy.redact(ctx, o)
 	updated, err := objInfo.UpdatedObject(ctx, o)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	orig := r.mapper.Internal.Assign(updated)
+	r.policy.restore(ctx, orig, existing)
+	if err := r.policy.checkWrites(ctx, r.groupResource(), name, orig, existing); err != nil {
+		return nil, err
+	}
+	r.policy.applyDefaults(orig, true)
+	gk := schema.GroupKind{Group: r.mapper.External.GroupVersion.Group, Kind: r.mapper.External.Kind}
+	if err := r.policy.checkImmutable(gk, name, orig, existing); err != nil {
+		return nil, err
+	}
 
 	// Run precondition checks.
-	if objInfo.Preconditions != nil {
-		if pc := objInfo.Preconditions(); pc != nil {
-			if pc.UID != nil && *pc.UID != orig.GetUID() {
-				return nil, false, fmt.Errorf("failed uid precondition")
-			}
-			if pc.ResourceVersion != nil && *pc.ResourceVersion != orig.GetResourceVersion() {
-				return nil, false, fmt.Errorf("failed resourceVersion precondition")
-			}
+	if pc := objInfo.Preconditions(); pc != nil {
+		if pc.UID != nil && *pc.UID != orig.GetUID() {
+			return nil, fmt.Errorf("failed uid precondition")
+		}
+		if pc.ResourceVersion != nil && *pc.ResourceVersion != orig.GetResourceVersion() {
+			return nil, fmt.Errorf("failed resourceVersion precondition")
 		}
 	}
 
-	if options != nil {
+	if options == nil {
 		options = &metav1.UpdateOptions{}
 	}
+	release, err := r.quota.admit(ctx, r.groupResource(), orig, existing)
+	if err != nil {
+		return nil, err
+	}
 	returned, err := r.getClient(ctx).Update(orig, *options)
+	if err != nil || len(options.DryRun) > 0 {
+		release(nil)
+	} else {
+		release(returned)
+	}
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
-	r.mapper.External.Assign(returned)
-	return returned, false, nil
+	return r.toExternal(ctx, returned), nil
 }
 
 // NewList returns an empty object that can be used with the List call.
@@ -194,7 +321,8 @@ func (r *restStorage) New() runtime.Object {
 	return u
 }
 
-func (r *restStorage) Watch(ctx context.Context, options *metainternalversion.ListOptions) (watch.Interface, error) {
+func (r *restStorage) Watch(ctx context.Context, options *metainternalversion.ListOptions) (_ watch.Interface, err error) {
+	defer r.observe("watch", time.Now(), &err)
 	lo, err := toMetaListOptions(options)
 	if err != nil {
 		return nil, err
@@ -203,7 +331,8 @@ func (r *restStorage) Watch(ctx context.Context, options *metainternalversion.Li
 	if err != nil {
 		return nil, err
 	}
-	return newWrappedWatcher(r.mapper.External.Assign, wi), nil
+	toExternal := func(o runtime.Object) *unstructured.Unstructured { return r.toExternal(ctx, o) }
+	return newWrappedWatcher(toExternal, wi, r.metrics), nil
 }
 
 func toMetaListOptions(options *metainternalversion.ListOptions) (metav1.ListOptions, error) {
@@ -218,24 +347,20 @@ func toMetaListOptions(options *metainternalversion.ListOptions) (metav1.ListOpt
 }
 
 func (r *restStorage) getClient(ctx context.Context) dynamic.ResourceInterface {
-	if ns, ok := request.NamespaceFrom(ctx); ok {
-		return r.client.Namespace(ns)
+	ns, _ := request.NamespaceFrom(ctx)
+	return &instrumentedClient{
+		ctx:       ctx,
+		upstream:  r.upstream,
+		gvr:       r.gvr,
+		namespace: ns,
+		metrics:   r.metrics,
 	}
-	return r.client
 }
 
 // List selects resources in the storage which match to the selector. 'options' can be nil.
-func (r *restStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
-	lo, err := toMetaListOptions(options)
-	if err != nil {
-		return nil, err
-	}
-	ul, err := r.getClient(ctx).List(lo)
-	if err != nil {
-		return nil, err
-	}
-	r.mapper.External.AssignList(ul)
-	return ul, nil
+func (r *restStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (_ runtime.Object, err error) {
+	defer r.observe("list", time.Now(), &err)
+	return r.list(ctx, options)
 }
 
 func (r *restStorage) NamespaceScoped() bool {
@@ -245,7 +370,17 @@ func (r *restStorage) NamespaceScoped() bool {
 // Get finds a resource in the storage by name and returns it.
 // Although it can return an arbitrary error value, IsNotFound(err) is true for the
 // returned error value err when the specified resource is not found.
-func (r *restStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+func (r *restStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (_ runtime.Object, err error) {
+	defer r.observe("get", time.Now(), &err)
+	o, err := r.get(ctx, name, options)
+	if err != nil {
+		return nil, err
+	}
+	return r.toExternal(ctx, o), nil
+}
+
+// get returns the upstream object name with the external kind, unredacted.
+func (r *restStorage) get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
 	if options == nil {
 		options = &metav1.GetOptions{}
 	}
@@ -267,11 +402,20 @@ func (r *restStorage) Get(ctx context.Context, name string, options *metav1.GetO
 // information about deletion.
 // It also returns a boolean which is set to true if the resource was instantly
 // deleted or false if it will be deleted asynchronously.
-func (r *restStorage) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (runtime.Object, bool, error) {
-	obj, err := r.Get(ctx, name, &metav1.GetOptions{})
+func (r *restStorage) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (_ runtime.Object, _ bool, err error) {
+	defer r.observe("delete", time.Now(), &err)
+	return r.delete(ctx, name, deleteValidation, options)
+}
+
+func (r *restStorage) delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (out runtime.Object, _ bool, err error) {
+	defer func() {
+		r.recordEvent(ctx, "delete", name, out, options != nil && len(options.DryRun) > 0, err)
+	}()
+	obj, err := r.get(ctx, name, &metav1.GetOptions{})
 	if err != nil {
 		return nil, false, err
 	}
+	obj = r.toExternal(ctx, obj)
 	if err := deleteValidation(obj); err != nil {
 		return nil, false, err
 	}
@@ -281,29 +425,3 @@ func (r *restStorage) Delete(ctx context.Context, name string, deleteValidation
 	}
 	return r.mapper.External.Assign(orig), false, nil
 }
-
-// DeleteCollection selects all resources in the storage matching given 'listOptions'
-// and deletes them. The delete attempt is validated by the deleteValidation first.
-// If 'options' are provided, the resource will attempt to honor them or return an
-// invalid request error.
-// DeleteCollection may not be atomic - i.e. it may delete some objects and still
-// return an error after it. On success, returns a list of deleted objects.
-func (r *restStorage) DeleteCollection(ctx context.Context, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions, listOptions *metainternalversion.ListOptions) (runtime.Object, error) {
-	l, err := r.List(ctx, listOptions)
-	if err != nil {
-		klog.Error(err)
-		return nil, err
-	}
-	deleted := r.NewList().(*unstructured.UnstructuredList)
-	ul := l.(*unstructured.UnstructuredList)
-	for _, i := range ul.Items {
-		r, _, err := r.Delete(ctx, i.GetName(), deleteValidation, options)
-		if err != nil {
-			klog.Error(err)
-			return deleted, err
-		}
-		deleted.Items = append(deleted.Items, (*r.(*unstructured.Unstructured)))
-	}
-	klog.Info("done deleting")
-	return deleted, nil
-}
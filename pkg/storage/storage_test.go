@@ -0,0 +1,511 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+)
+
+var (
+	extR = GroupVersionKindResource{
+		GroupVersion: schema.GroupVersion{Group: "apps.maisem.dev", Version: "v1"},
+		Kind:         "Deployment",
+		Resource:     "deployments",
+	}
+	intR = GroupVersionKindResource{
+		GroupVersion: schema.GroupVersion{Group: "apps", Version: "v1"},
+		Kind:         "Deployment",
+		Resource:     "deployments",
+	}
+	deploymentsGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+func newTestStorage(t *testing.T, admission bool) (*restStorage, *fakeupstream.Server) {
+	t.Helper()
+	fake := fakeupstream.New()
+	upstream, err := NewUpstream("fake", fake.Config())
+	if err != nil {
+		fake.Close()
+		t.Fatal(err)
+	}
+	return NewREST(extR, intR, true, admission, upstream, []string{"mdep"}, []string{"all"}, Policy{}).(*restStorage), fake
+}
+
+func newDeployment(gv schema.GroupVersion, name string, lbls map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(gv.String())
+	u.SetKind("Deployment")
+	u.SetNamespace("default")
+	u.SetName(name)
+	u.SetLabels(lbls)
+	unstructured.SetNestedField(u.Object, int64(1), "spec", "replicas")
+	return u
+}
+
+func ctxWithNamespace() context.Context {
+	return request.WithNamespace(context.Background(), "default")
+}
+
+func seed(fake *fakeupstream.Server, names ...string) {
+	for _, n := range names {
+		fake.Add(deploymentsGVR, newDeployment(intR.GroupVersion, n, map[string]string{"app": n}))
+	}
+}
+
+func names(t *testing.T, obj runtime.Object) []string {
+	t.Helper()
+	var out []string
+	for _, u := range obj.(*unstructured.UnstructuredList).Items {
+		if u.GetAPIVersion() != extR.GroupVersion.String() || u.GetKind() != extR.Kind {
+			t.Errorf("item %s has type %s %s, want external type", u.GetName(), u.GetAPIVersion(), u.GetKind())
+		}
+		out = append(out, u.GetName())
+	}
+	return out
+}
+
+func assertExternal(t *testing.T, obj runtime.Object) *unstructured.Unstructured {
+	t.Helper()
+	u := obj.(*unstructured.Unstructured)
+	if u.GetAPIVersion() != extR.GroupVersion.String() || u.GetKind() != extR.Kind {
+		t.Fatalf("got type %s %s, want %s %s", u.GetAPIVersion(), u.GetKind(), extR.GroupVersion, extR.Kind)
+	}
+	return u
+}
+
+func TestMetadata(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	if !s.NamespaceScoped() {
+		t.Error("NamespaceScoped() = false, want true")
+	}
+	if got := s.ShortNames(); len(got) != 1 || got[0] != "mdep" {
+		t.Errorf("ShortNames() = %v, want [mdep]", got)
+	}
+	if got := s.Categories(); len(got) != 1 || got[0] != "all" {
+		t.Errorf("Categories() = %v, want [all]", got)
+	}
+	assertExternal(t, s.New())
+	if l := s.NewList().(*unstructured.UnstructuredList); l.GetKind() != "DeploymentList" || l.GetAPIVersion() != extR.GroupVersion.String() {
+		t.Errorf("NewList() has type %s %s", l.GetAPIVersion(), l.GetKind())
+	}
+}
+
+func TestCreate(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+
+	obj, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := assertExternal(t, obj); u.GetResourceVersion() == "" {
+		t.Error("created object has no resourceVersion")
+	}
+	upstream := fake.Object(deploymentsGVR, "default", "foo")
+	if upstream == nil || upstream.GetAPIVersion() != "apps/v1" {
+		t.Fatalf("upstream object = %v, want apps/v1 Deployment", upstream)
+	}
+
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "foo", nil), rest.ValidateAllObjectFunc, nil); !errors.IsAlreadyExists(err) {
+		t.Errorf("creating a duplicate returned %v, want AlreadyExists", err)
+	}
+
+	denied := func(runtime.Object) error { return errors.NewForbidden(schema.GroupResource{}, "bar", fmt.Errorf("denied")) }
+	if _, err := s.Create(ctx, newDeployment(extR.GroupVersion, "bar", nil), denied, nil); !errors.IsForbidden(err) {
+		t.Errorf("create with failing validation returned %v, want Forbidden", err)
+	}
+	if fake.Object(deploymentsGVR, "default", "bar") != nil {
+		t.Error("object was created upstream despite failing validation")
+	}
+}
+
+func TestGet(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	seed(fake, "foo")
+
+	obj, err := s.Get(ctxWithNamespace(), "foo", &metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := assertExternal(t, obj); u.GetName() != "foo" {
+		t.Errorf("got %q, want foo", u.GetName())
+	}
+	if _, err := s.Get(ctxWithNamespace(), "missing", nil); !errors.IsNotFound(err) {
+		t.Errorf("getting a missing object returned %v, want NotFound", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	seed(fake, "foo")
+
+	obj, err := s.Get(ctx, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := obj.DeepCopyObject().(*unstructured.Unstructured)
+	u := obj.(*unstructured.Unstructured)
+	unstructured.SetNestedField(u.Object, int64(3), "spec", "replicas")
+	updated, created, err := s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("Update reported creating an existing object")
+	}
+	assertExternal(t, updated)
+	if r, _, _ := unstructured.NestedInt64(fake.Object(deploymentsGVR, "default", "foo").Object, "spec", "replicas"); r != 3 {
+		t.Errorf("upstream replicas = %d, want 3", r)
+	}
+
+	unstructured.SetNestedField(stale.Object, int64(5), "spec", "replicas")
+	if _, _, err := s.Update(ctx, "foo", rest.DefaultUpdatedObjectInfo(stale), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); !errors.IsConflict(err) {
+		t.Errorf("update with a stale resourceVersion returned %v, want Conflict", err)
+	}
+
+	if _, _, err := s.Update(ctx, "bar", rest.DefaultUpdatedObjectInfo(newDeployment(extR.GroupVersion, "bar", nil)), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); !errors.IsNotFound(err) {
+		t.Errorf("update of a missing object returned %v, want NotFound", err)
+	}
+	_, created, err = s.Update(ctx, "bar", rest.DefaultUpdatedObjectInfo(newDeployment(extR.GroupVersion, "bar", nil)), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || fake.Object(deploymentsGVR, "default", "bar") == nil {
+		t.Error("update with forceAllowCreate did not create the object")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	seed(fake, "foo", "bar")
+
+	denied := func(runtime.Object) error { return errors.NewForbidden(schema.GroupResource{}, "foo", fmt.Errorf("denied")) }
+	if _, _, err := s.Delete(ctx, "foo", denied, nil); !errors.IsForbidden(err) {
+		t.Errorf("delete with failing validation returned %v, want Forbidden", err)
+	}
+	if fake.Object(deploymentsGVR, "default", "foo") == nil {
+		t.Fatal("object was deleted despite failing validation")
+	}
+
+	obj, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertExternal(t, obj)
+	if fake.Object(deploymentsGVR, "default", "foo") != nil {
+		t.Error("object still exists upstream")
+	}
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil); !errors.IsNotFound(err) {
+		t.Errorf("deleting a missing object returned %v, want NotFound", err)
+	}
+}
+
+func TestDeleteCollectionUpstream(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	seed(fake, "a", "b", "c")
+	fake.Add(deploymentsGVR, newDeployment(intR.GroupVersion, "keep", map[string]string{"keep": "true"}))
+
+	obj, err := s.DeleteCollection(ctxWithNamespace(), rest.ValidateAllObjectFunc, nil, &metainternalversion.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{"app": "b"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, obj); len(got) != 1 || got[0] != "b" {
+		t.Errorf("deleted %v, want [b]", got)
+	}
+	var collectionDeletes int
+	for _, r := range fake.Requests() {
+		if r == "DELETE /apis/apps/v1/namespaces/default/deployments" {
+			collectionDeletes++
+		}
+	}
+	if collectionDeletes != 1 {
+		t.Errorf("got %d upstream collection deletes, want 1", collectionDeletes)
+	}
+	for _, n := range []string{"a", "c", "keep"} {
+		if fake.Object(deploymentsGVR, "default", n) == nil {
+			t.Errorf("%s was deleted", n)
+		}
+	}
+}
+
+func TestDeleteCollectionPartialFailure(t *testing.T) {
+	s, fake := newTestStorage(t, true)
+	defer fake.Close()
+	seed(fake, "a", "b", "c", "d")
+	fake.FailNext("DELETE", "/apis/apps/v1/namespaces/default/deployments/b", errors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "b", fmt.Errorf("busy")))
+	denied := func(obj runtime.Object) error {
+		if obj.(*unstructured.Unstructured).GetName() == "d" {
+			return errors.NewForbidden(schema.GroupResource{}, "d", fmt.Errorf("denied"))
+		}
+		return nil
+	}
+
+	obj, err := s.DeleteCollection(ctxWithNamespace(), denied, nil, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	status := err.(errors.APIStatus).Status()
+	if status.Code != 500 {
+		t.Errorf("got code %d, want 500 for mixed failures", status.Code)
+	}
+	var causes []string
+	for _, c := range status.Details.Causes {
+		causes = append(causes, c.Field)
+	}
+	if strings.Join(causes, ",") != "b,d" {
+		t.Errorf("got causes for %v, want [b d]", causes)
+	}
+	if got := names(t, obj); strings.Join(got, ",") != "a,c" {
+		t.Errorf("deleted %v, want [a c]", got)
+	}
+	for n, exists := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		if got := fake.Object(deploymentsGVR, "default", n) != nil; got != exists {
+			t.Errorf("%s exists = %v, want %v", n, got, exists)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	seed(fake, "a", "b", "c")
+	fake.Add(deploymentsGVR, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "other", "namespace": "other"},
+	}})
+
+	obj, err := s.List(ctxWithNamespace(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, obj); strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("List() = %v, want [a b c]", got)
+	}
+	if rv := obj.(*unstructured.UnstructuredList).GetResourceVersion(); rv == "" {
+		t.Error("list has no resourceVersion")
+	}
+
+	obj, err = s.List(ctxWithNamespace(), &metainternalversion.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "c"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, obj); strings.Join(got, ",") != "c" {
+		t.Errorf("List(app=c) = %v, want [c]", got)
+	}
+
+	obj, err = s.List(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, obj); len(got) != 4 {
+		t.Errorf("List() across namespaces = %v, want 4 items", got)
+	}
+}
+
+// listAll pages through the collection and returns the names of all items.
+func listAll(t *testing.T, s *restStorage, limit int64) []string {
+	t.Helper()
+	var all []string
+	opts := &metainternalversion.ListOptions{Limit: limit}
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("pagination did not terminate")
+		}
+		obj, err := s.List(ctxWithNamespace(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := names(t, obj)
+		if int64(len(page)) > limit {
+			t.Fatalf("page has %d items, limit is %d", len(page), limit)
+		}
+		all = append(all, page...)
+		c := obj.(*unstructured.UnstructuredList).GetContinue()
+		if c == "" {
+			return all
+		}
+		if int64(len(page)) != limit {
+			t.Errorf("short page %v with more to come", page)
+		}
+		opts.Continue = c
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	seed(fake, "a", "b", "c", "d", "e", "f", "g")
+
+	for _, limit := range []int64{1, 3, 7, 10} {
+		if got := strings.Join(listAll(t, s, limit), ","); got != "a,b,c,d,e,f,g" {
+			t.Errorf("list paged by %d = %s", limit, got)
+		}
+	}
+}
+
+func TestListContinueTokens(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	seed(fake, "a", "b", "c", "d", "e", "f")
+
+	obj, err := s.List(ctxWithNamespace(), &metainternalversion.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := obj.(*unstructured.UnstructuredList).GetContinue()
+	parts := strings.Split(c, ".")
+	if len(parts) != 2 {
+		t.Fatalf("continue token %q is not the proxy's own signed token", c)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatalf("continue token %q is not the proxy's own token: %v", c, err)
+	}
+	if strings.Contains(string(b), "apps/v1") {
+		t.Errorf("continue token leaks upstream details: %s", b)
+	}
+
+	// Tokens must be signed by the proxy.
+	forged := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"u":"forged","rv":"1","t":%d}`, time.Now().Unix())))
+	for _, invalid := range []string{"garbage!", forged, forged + "." + parts[1], parts[0] + ".", parts[0] + "." + parts[1] + "x"} {
+		if _, err := s.List(ctxWithNamespace(), &metainternalversion.ListOptions{Limit: 1, Continue: invalid}); !errors.IsBadRequest(err) {
+			t.Errorf("continue token %q returned %v, want BadRequest", invalid, err)
+		}
+	}
+
+	old, _ := (&continueToken{ResourceVersion: "1", Issued: time.Now().Add(-time.Hour).Unix()}).encode()
+	if _, err := s.List(ctxWithNamespace(), &metainternalversion.ListOptions{Limit: 1, Continue: old}); !errors.IsResourceExpired(err) {
+		t.Errorf("old continue token returned %v, want Expired", err)
+	}
+
+	// Get a token pointing into the upstream pagination, then compact.
+	obj, err = s.List(ctxWithNamespace(), &metainternalversion.ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = s.List(ctxWithNamespace(), &metainternalversion.ListOptions{Limit: 2, Continue: obj.(*unstructured.UnstructuredList).GetContinue()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed(fake, "g", "h")
+	fake.Compact()
+	if c := obj.(*unstructured.UnstructuredList).GetContinue(); c != "" {
+		if _, err := s.List(ctxWithNamespace(), &metainternalversion.ListOptions{Limit: 2, Continue: c}); !errors.IsResourceExpired(err) {
+			t.Errorf("continue token after upstream compaction returned %v, want Expired", err)
+		}
+	} else {
+		t.Error("expected more pages")
+	}
+}
+
+func nextEvent(t *testing.T, w watch.Interface) watch.Event {
+	t.Helper()
+	select {
+	case e, ok := <-w.ResultChan():
+		if !ok {
+			t.Fatal("watch closed unexpectedly")
+		}
+		return e
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+	return watch.Event{}
+}
+
+func TestWatch(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+
+	w, err := s.Watch(ctx, &metainternalversion.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "foo"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed(fake, "bar", "foo")
+	e := nextEvent(t, w)
+	if e.Type != watch.Added {
+		t.Errorf("got %s event, want ADDED", e.Type)
+	}
+	if u := assertExternal(t, e.Object); u.GetName() != "foo" {
+		t.Errorf("got event for %q, want foo", u.GetName())
+	}
+
+	if _, _, err := s.Delete(ctx, "foo", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, w); e.Type != watch.Deleted {
+		t.Errorf("got %s event, want DELETED", e.Type)
+	}
+
+	w.Stop()
+	select {
+	case _, ok := <-w.ResultChan():
+		if ok {
+			t.Error("got event after Stop")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("result channel not closed after Stop")
+	}
+}
+
+func TestWatchResourceVersion(t *testing.T) {
+	s, fake := newTestStorage(t, false)
+	defer fake.Close()
+	seed(fake, "a")
+	obj, err := s.List(ctxWithNamespace(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := obj.(*unstructured.UnstructuredList).GetResourceVersion()
+	seed(fake, "b")
+
+	w, err := s.Watch(ctxWithNamespace(), &metainternalversion.ListOptions{ResourceVersion: rv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if u := assertExternal(t, nextEvent(t, w).Object); u.GetName() != "b" {
+		t.Errorf("got event for %q, want b", u.GetName())
+	}
+
+	fake.Compact()
+	w, err = s.Watch(ctxWithNamespace(), &metainternalversion.ListOptions{ResourceVersion: rv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	e := nextEvent(t, w)
+	if e.Type != watch.Error {
+		t.Fatalf("got %s event, want ERROR for a compacted resourceVersion", e.Type)
+	}
+	if err := errors.FromObject(e.Object); !errors.IsResourceExpired(err) {
+		t.Errorf("got error %v, want Expired", err)
+	}
+}
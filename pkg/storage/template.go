@@ -0,0 +1,627 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	storagenames "k8s.io/apiserver/pkg/storage/names"
+	"sigs.k8s.io/yaml"
+
+	"github.com/maisem/proxy-apiserver/pkg/metrics"
+)
+
+const (
+	// ownerResourceLabel and ownerNameHashLabel are set on the upstream
+	// objects a template-expanded facade object is made of. Object names do
+	// not fit in a label value, so the label holds a hash of the name and
+	// ownerNameAnnotation the name itself.
+	ownerResourceLabel  = "proxy.maisem.dev/owner-resource"
+	ownerNameHashLabel  = "proxy.maisem.dev/owner-name-hash"
+	ownerNameAnnotation = "proxy.maisem.dev/owner-name"
+	// parentAnnotation holds the facade object on each of its upstream
+	// objects, as JSON.
+	parentAnnotation = "proxy.maisem.dev/parent"
+)
+
+// TemplateChild is one upstream object a template-expanded facade object
+// expands to.
+type TemplateChild struct {
+	Resource GroupVersionKindResource
+	// Template is a text/template producing the child as YAML. It is executed
+	// with the facade object as data. The value of every action is written
+	// as JSON, so that a string stays one YAML scalar whatever it holds; an
+	// action must therefore make up a whole scalar, e.g.
+	// {{ printf "%s-db" .metadata.name }} rather than {{ .metadata.name }}-db.
+	// The child is skipped if the output is empty. Its name defaults to the
+	// facade object's.
+	Template string
+}
+
+// NewTemplateREST returns a rest.Storage serving res whose objects are
+// expanded into one upstream object per child. Updates reconcile the
+// children with the new expansion and deletes remove all of them.
+func NewTemplateREST(res GroupVersionKindResource, nsScoped bool, children []TemplateChild, upstream Upstream, shortNames, categories []string) (rest.Storage, error) {
+	s := &templateStorage{
+		kind:            res,
+		gr:              schema.GroupResource{Group: res.GroupVersion.Group, Resource: res.Resource},
+		namespaceScoped: nsScoped,
+		upstream:        upstream,
+		shortNames:      shortNames,
+		categories:      categories,
+		metrics: metrics.Resource{
+			Group:    res.GroupVersion.Group,
+			Version:  res.GroupVersion.Version,
+			Resource: res.Resource,
+			Cluster:  upstream.Name,
+		},
+	}
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"default": func(def, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return def
+			}
+			return v
+		},
+	}
+	for i, c := range children {
+		t, err := template.New(fmt.Sprintf("%s[%d]", res.Resource, i)).Funcs(funcs).Option("missingkey=zero").Parse(c.Template)
+		if err != nil {
+			return nil, err
+		}
+		for _, tmpl := range t.Templates() {
+			if tmpl.Tree != nil {
+				quoteActions(tmpl.Tree, tmpl.Tree.Root)
+			}
+		}
+		s.children = append(s.children, templateChild{resource: c.Resource, template: t})
+	}
+	return s, nil
+}
+
+// quoteActions pipes the value of every action under node into the json
+// function, unless it already ends there, so that values from the facade
+// object cannot inject YAML into the child. Conditions of if, range and with
+// are left alone.
+func quoteActions(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			quoteActions(tree, c)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			// Declarations print nothing.
+			return
+		}
+		last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+		if id, ok := last.Args[0].(*parse.IdentifierNode); ok && id.Ident == "json" {
+			return
+		}
+		quote := parse.NewIdentifier("json").SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{quote}})
+	case *parse.IfNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.RangeNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.WithNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	}
+}
+
+type templateChild struct {
+	resource GroupVersionKindResource
+	template *template.Template
+}
+
+type templateStorage struct {
+	kind            GroupVersionKindResource
+	gr              schema.GroupResource
+	namespaceScoped bool
+	children        []templateChild
+	upstream        Upstream
+	shortNames      []string
+	categories      []string
+	metrics         metrics.Resource
+}
+
+func (s *templateStorage) Categories() []string {
+	return s.categories
+}
+
+func (s *templateStorage) ShortNames() []string {
+	return s.shortNames
+}
+
+func (s *templateStorage) NamespaceScoped() bool {
+	return s.namespaceScoped
+}
+
+func (s *templateStorage) New() runtime.Object {
+	u := &unstructured.Unstructured{}
+	s.kind.Assign(u)
+	return u
+}
+
+func (s *templateStorage) NewList() runtime.Object {
+	ul := &unstructured.UnstructuredList{}
+	s.kind.AssignList(ul)
+	return ul
+}
+
+func (s *templateStorage) observe(verb string, start time.Time, err *error) {
+	s.metrics.ObserveRequest(verb, start, *err)
+}
+
+func (s *templateStorage) client(ctx context.Context, r GroupVersionKindResource, namespace string) *instrumentedClient {
+	return newInstrumentedClient(ctx, s.upstream, r, namespace, s.metrics)
+}
+
+// resources returns the distinct upstream resources of the children.
+func (s *templateStorage) resources() []GroupVersionKindResource {
+	seen := map[GroupVersionKindResource]bool{}
+	var out []GroupVersionKindResource
+	for _, c := range s.children {
+		if !seen[c.resource] {
+			seen[c.resource] = true
+			out = append(out, c.resource)
+		}
+	}
+	return out
+}
+
+// selector returns the label selector matching the children of name, or of
+// all objects if name is empty.
+func (s *templateStorage) selector(name string) string {
+	set := labels.Set{ownerResourceLabel: s.gr.String()}
+	if name != "" {
+		set[ownerNameHashLabel] = ownerNameHash(name)
+	}
+	return labels.SelectorFromSet(set).String()
+}
+
+// ownerNameHash returns the value of ownerNameHashLabel for name.
+func ownerNameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// owner returns the name of the facade object the child u belongs to.
+func owner(u *unstructured.Unstructured) string {
+	return u.GetAnnotations()[ownerNameAnnotation]
+}
+
+// childKey identifies an upstream object among the children.
+type childKey struct {
+	resource GroupVersionKindResource
+	name     string
+}
+
+// listChildren lists the upstream objects matching the selector for name.
+// The returned resourceVersion is the oldest of the lists.
+func (s *templateStorage) listChildren(ctx context.Context, namespace, name string) (map[childKey]*unstructured.Unstructured, string, error) {
+	out := map[childKey]*unstructured.Unstructured{}
+	var rv string
+	for _, r := range s.resources() {
+		l, err := s.client(ctx, r, namespace).List(metav1.ListOptions{LabelSelector: s.selector(name)})
+		if err != nil {
+			return nil, "", err
+		}
+		for i := range l.Items {
+			item := &l.Items[i]
+			// Skip the children of other objects whose name hash collides.
+			if o := owner(item); o == "" || (name != "" && o != name) {
+				continue
+			}
+			out[childKey{r, item.GetNamespace() + "/" + item.GetName()}] = item
+		}
+		if rv == "" || compareResourceVersions(l.GetResourceVersion(), rv) < 0 {
+			rv = l.GetResourceVersion()
+		}
+	}
+	return out, rv, nil
+}
+
+// parent rebuilds the facade object from its children. The object stored on
+// the most recently changed child wins.
+func (s *templateStorage) parent(children []*unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	sort.Slice(children, func(i, j int) bool {
+		return compareResourceVersions(children[i].GetResourceVersion(), children[j].GetResourceVersion()) > 0
+	})
+	u := s.New().(*unstructured.Unstructured)
+	if err := u.UnmarshalJSON([]byte(children[0].GetAnnotations()[parentAnnotation])); err != nil {
+		return nil, errors.NewInternalError(fmt.Errorf("invalid %s annotation on %s: %v", parentAnnotation, children[0].GetName(), err))
+	}
+	s.kind.Assign(u)
+	u.SetResourceVersion(children[0].GetResourceVersion())
+
+	var statuses []interface{}
+	allReady := true
+	for i := len(children) - 1; i >= 0; i-- {
+		c := children[i]
+		ready := partReady(c)
+		allReady = allReady && ready
+		statuses = append(statuses, map[string]interface{}{
+			"apiVersion": c.GetAPIVersion(),
+			"kind":       c.GetKind(),
+			"name":       c.GetName(),
+			"ready":      ready,
+		})
+	}
+	u.Object["status"] = map[string]interface{}{
+		"ready":    allReady,
+		"children": statuses,
+	}
+	return u, nil
+}
+
+func (s *templateStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (_ runtime.Object, err error) {
+	defer s.observe("get", time.Now(), &err)
+	ns, _ := request.NamespaceFrom(ctx)
+	u, _, err := s.get(ctx, ns, name)
+	return u, err
+}
+
+// get returns the facade object name along with its children.
+func (s *templateStorage) get(ctx context.Context, namespace, name string) (*unstructured.Unstructured, map[childKey]*unstructured.Unstructured, error) {
+	children, _, err := s.listChildren(ctx, namespace, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(children) == 0 {
+		return nil, nil, errors.NewNotFound(s.gr, name)
+	}
+	var objs []*unstructured.Unstructured
+	for _, c := range children {
+		objs = append(objs, c)
+	}
+	u, err := s.parent(objs)
+	return u, children, err
+}
+
+func (s *templateStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (_ runtime.Object, err error) {
+	defer s.observe("list", time.Now(), &err)
+	if options == nil {
+		options = &metainternalversion.ListOptions{}
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	children, rv, err := s.listChildren(ctx, ns, "")
+	if err != nil {
+		return nil, err
+	}
+	byOwner := map[string][]*unstructured.Unstructured{}
+	var keys []string
+	for _, c := range children {
+		key := c.GetNamespace() + "/" + owner(c)
+		if _, ok := byOwner[key]; !ok {
+			keys = append(keys, key)
+		}
+		byOwner[key] = append(byOwner[key], c)
+	}
+	sort.Strings(keys)
+
+	out := s.NewList().(*unstructured.UnstructuredList)
+	out.SetResourceVersion(rv)
+	for _, key := range keys {
+		u, err := s.parent(byOwner[key])
+		if err != nil {
+			return nil, err
+		}
+		if matchesSelectors(u, options.LabelSelector, options.FieldSelector) {
+			out.Items = append(out.Items, *u)
+		}
+	}
+	return out, nil
+}
+
+// expand renders the children of the facade object u.
+func (s *templateStorage) expand(u *unstructured.Unstructured) (map[childKey]*unstructured.Unstructured, error) {
+	stored := u.DeepCopy()
+	unstructured.RemoveNestedField(stored.Object, "status")
+	unstructured.RemoveNestedField(stored.Object, "metadata", "resourceVersion")
+	parent, err := stored.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[childKey]*unstructured.Unstructured{}
+	for _, c := range s.children {
+		var buf bytes.Buffer
+		if err := c.template.Execute(&buf, u.Object); err != nil {
+			return nil, errors.NewBadRequest(fmt.Sprintf("failed to expand %s: %v", c.resource.Kind, err))
+		}
+		if strings.TrimSpace(buf.String()) == "" {
+			continue
+		}
+		j, err := yaml.YAMLToJSON(buf.Bytes())
+		if err != nil {
+			return nil, errors.NewBadRequest(fmt.Sprintf("failed to expand %s: %v", c.resource.Kind, err))
+		}
+		// The kind may be left out, so do not use Unstructured.UnmarshalJSON.
+		child := &unstructured.Unstructured{}
+		if err := json.Unmarshal(j, &child.Object); err != nil || child.Object == nil {
+			return nil, errors.NewBadRequest(fmt.Sprintf("failed to expand %s: not an object: %v", c.resource.Kind, err))
+		}
+		c.resource.Assign(child)
+		if child.GetName() == "" {
+			child.SetName(u.GetName())
+		}
+		child.SetNamespace(u.GetNamespace())
+		lbls := child.GetLabels()
+		if lbls == nil {
+			lbls = map[string]string{}
+		}
+		lbls[ownerResourceLabel] = s.gr.String()
+		lbls[ownerNameHashLabel] = ownerNameHash(u.GetName())
+		child.SetLabels(lbls)
+		annotations := child.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[ownerNameAnnotation] = u.GetName()
+		annotations[parentAnnotation] = string(parent)
+		child.SetAnnotations(annotations)
+
+		key := childKey{c.resource, child.GetNamespace() + "/" + child.GetName()}
+		if _, ok := out[key]; ok {
+			return nil, errors.NewBadRequest(fmt.Sprintf("%s %s is expanded more than once", c.resource.Kind, child.GetName()))
+		}
+		out[key] = child
+	}
+	if len(out) == 0 {
+		return nil, errors.NewBadRequest(fmt.Sprintf("%s %s expands to no objects", s.kind.Kind, u.GetName()))
+	}
+	return out, nil
+}
+
+// sortedKeys returns the keys of children in a stable order.
+func sortedKeys(children map[childKey]*unstructured.Unstructured) []childKey {
+	var keys []childKey
+	for k := range children {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].resource.Resource != keys[j].resource.Resource {
+			return keys[i].resource.Resource < keys[j].resource.Resource
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+func (s *templateStorage) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (_ runtime.Object, err error) {
+	defer s.observe("create", time.Now(), &err)
+	return s.create(ctx, obj, createValidation, options)
+}
+
+func (s *templateStorage) create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+	ns, _ := request.NamespaceFrom(ctx)
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.NewBadRequest("unexpected object type")
+	}
+	u = u.DeepCopy()
+	if u.GetName() == "" && u.GetGenerateName() != "" {
+		u.SetName(storagenames.SimpleNameGenerator.GenerateName(u.GetGenerateName()))
+	}
+	if u.GetName() == "" {
+		return nil, errors.NewBadRequest("name or generateName is required")
+	}
+	u.SetNamespace(ns)
+	u.SetUID(uuid.NewUUID())
+	u.SetCreationTimestamp(metav1.Now())
+	u.SetGeneration(1)
+	u.SetResourceVersion("")
+	if createValidation != nil {
+		if err := createValidation(u); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := s.get(ctx, ns, u.GetName()); err == nil {
+		return nil, errors.NewAlreadyExists(s.gr, u.GetName())
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	children, err := s.expand(u)
+	if err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = &metav1.CreateOptions{}
+	}
+
+	var created []*unstructured.Unstructured
+	keys := sortedKeys(children)
+	for _, key := range keys {
+		c, err := s.client(ctx, key.resource, ns).Create(children[key], *options)
+		if err != nil {
+			// Do not leave a partial expansion behind.
+			if len(options.DryRun) == 0 {
+				for j, c := range created {
+					s.deleteChild(ctx, keys[j].resource, c)
+				}
+			}
+			return nil, err
+		}
+		created = append(created, c)
+	}
+	return s.parent(created)
+}
+
+func (s *templateStorage) deleteChild(ctx context.Context, r GroupVersionKindResource, c *unstructured.Unstructured) error {
+	err := s.client(ctx, r, c.GetNamespace()).Delete(c.GetName(), &metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *templateStorage) Update(ctx context.Context, name string, objInfo rest.UpdatedObjectInfo, createValidation rest.ValidateObjectFunc, updateValidation rest.ValidateObjectUpdateFunc, forceAllowCreate bool, options *metav1.UpdateOptions) (_ runtime.Object, _ bool, err error) {
+	defer s.observe("update", time.Now(), &err)
+	ns, _ := request.NamespaceFrom(ctx)
+	existing, current, err := s.get(ctx, ns, name)
+	if errors.IsNotFound(err) && forceAllowCreate {
+		newObj, err := objInfo.UpdatedObject(ctx, s.New())
+		if err != nil {
+			return nil, false, err
+		}
+		created, err := s.create(ctx, newObj, createValidation, createOptions(options))
+		if err != nil {
+			return nil, false, err
+		}
+		return created, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	obj, err := objInfo.UpdatedObject(ctx, existing)
+	if err != nil {
+		return nil, false, err
+	}
+	updated, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, false, errors.NewBadRequest("unexpected object type")
+	}
+	updated = updated.DeepCopy()
+	if rv := updated.GetResourceVersion(); rv != "" && rv != existing.GetResourceVersion() {
+		return nil, false, errors.NewConflict(s.gr, name, fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	if err := checkPreconditions(s.gr, name, objInfo.Preconditions(), existing); err != nil {
+		return nil, false, err
+	}
+	updated.SetNamespace(ns)
+	updated.SetName(name)
+	updated.SetUID(existing.GetUID())
+	updated.SetCreationTimestamp(existing.GetCreationTimestamp())
+	updated.SetGeneration(existing.GetGeneration())
+	if !equality.Semantic.DeepEqual(updated.Object["spec"], existing.Object["spec"]) {
+		updated.SetGeneration(existing.GetGeneration() + 1)
+	}
+	if updateValidation != nil {
+		if err := updateValidation(updated, existing); err != nil {
+			return nil, false, err
+		}
+	}
+	children, err := s.expand(updated)
+	if err != nil {
+		return nil, false, err
+	}
+	if options == nil {
+		options = &metav1.UpdateOptions{}
+	}
+
+	// Reconcile the upstream objects with the new expansion.
+	var result []*unstructured.Unstructured
+	for _, key := range sortedKeys(children) {
+		child := children[key]
+		client := s.client(ctx, key.resource, ns)
+		var out *unstructured.Unstructured
+		if old, ok := current[key]; ok {
+			child.SetResourceVersion(old.GetResourceVersion())
+			out, err = client.Update(child, *options)
+		} else {
+			out, err = client.Create(child, metav1.CreateOptions{DryRun: options.DryRun})
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		result = append(result, out)
+	}
+	if len(options.DryRun) == 0 {
+		for _, key := range sortedKeys(current) {
+			if _, ok := children[key]; ok {
+				continue
+			}
+			if err := s.deleteChild(ctx, key.resource, current[key]); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	u, err := s.parent(result)
+	return u, false, err
+}
+
+func (s *templateStorage) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (_ runtime.Object, _ bool, err error) {
+	defer s.observe("delete", time.Now(), &err)
+	ns, _ := request.NamespaceFrom(ctx)
+	existing, children, err := s.get(ctx, ns, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if options != nil {
+		if err := checkPreconditions(s.gr, name, options.Preconditions, existing); err != nil {
+			return nil, false, err
+		}
+	}
+	if deleteValidation != nil {
+		if err := deleteValidation(existing); err != nil {
+			return nil, false, err
+		}
+	}
+	if options != nil && len(options.DryRun) > 0 {
+		return existing, true, nil
+	}
+	for _, key := range sortedKeys(children) {
+		if err := s.deleteChild(ctx, key.resource, children[key]); err != nil {
+			return nil, false, err
+		}
+	}
+	return existing, true, nil
+}
+
+// Watch sends the recomputed facade object whenever one of its children
+// changes.
+func (s *templateStorage) Watch(ctx context.Context, options *metainternalversion.ListOptions) (_ watch.Interface, err error) {
+	defer s.observe("watch", time.Now(), &err)
+	if options == nil {
+		options = &metainternalversion.ListOptions{}
+	}
+	ns, _ := request.NamespaceFrom(ctx)
+	return watchAggregate(ctx, s.upstream, s.metrics, s.resources(), ns, metav1.ListOptions{LabelSelector: s.selector(""), ResourceVersion: options.ResourceVersion}, aggregateFuncs{
+		owner: owner,
+		get: func(ctx context.Context, namespace, name string) (*unstructured.Unstructured, error) {
+			u, _, err := s.get(ctx, namespace, name)
+			return u, err
+		},
+		tombstone: func(namespace, name string) *unstructured.Unstructured {
+			u := s.New().(*unstructured.Unstructured)
+			u.SetName(name)
+			u.SetNamespace(namespace)
+			return u
+		},
+		matches: func(u *unstructured.Unstructured) bool {
+			return matchesSelectors(u, options.LabelSelector, options.FieldSelector)
+		},
+	})
+}
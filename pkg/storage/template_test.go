@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/registry/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+)
+
+var webAppR = GroupVersionKindResource{
+	GroupVersion: schema.GroupVersion{Group: "apps.maisem.dev", Version: "v1"},
+	Kind:         "WebApp",
+	Resource:     "webapps",
+}
+
+const (
+	webAppDeployment = `
+spec:
+  replicas: {{ .spec.replicas }}
+  template:
+    spec:
+      containers:
+      - name: web
+        image: {{ .spec.image }}
+`
+	webAppService = `
+{{ if .spec.port }}
+spec:
+  ports:
+  - port: {{ .spec.port }}
+{{ end }}
+`
+)
+
+func newTestTemplateStorage(t *testing.T) (*templateStorage, *fakeupstream.Server) {
+	t.Helper()
+	fake := fakeupstream.New()
+	upstream, err := NewUpstream("fake", fake.Config())
+	if err != nil {
+		fake.Close()
+		t.Fatal(err)
+	}
+	s, err := NewTemplateREST(webAppR, true, []TemplateChild{
+		{Resource: intR, Template: webAppDeployment},
+		{Resource: GroupVersionKindResource{GroupVersion: schema.GroupVersion{Version: "v1"}, Kind: "Service", Resource: "services"}, Template: webAppService},
+	}, upstream, nil, nil)
+	if err != nil {
+		fake.Close()
+		t.Fatal(err)
+	}
+	return s.(*templateStorage), fake
+}
+
+func newWebApp(name string, port int64) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": int64(2),
+			"image":    "nginx",
+		},
+	}}
+	webAppR.Assign(u)
+	u.SetName(name)
+	if port != 0 {
+		unstructured.SetNestedField(u.Object, port, "spec", "port")
+	}
+	return u
+}
+
+func TestTemplateCreate(t *testing.T) {
+	s, fake := newTestTemplateStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+
+	obj, err := s.Create(ctx, newWebApp("web", 80), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := obj.(*unstructured.Unstructured)
+	if u.GetKind() != "WebApp" || u.GetName() != "web" || u.GetUID() == "" {
+		t.Fatalf("got %s %s with uid %q", u.GetKind(), u.GetName(), u.GetUID())
+	}
+	deployment := fake.Object(deploymentsGVR, "default", "web")
+	if deployment == nil {
+		t.Fatal("deployment was not created")
+	}
+	if r, _, _ := unstructured.NestedInt64(deployment.Object, "spec", "replicas"); r != 2 {
+		t.Errorf("deployment has %d replicas, want 2", r)
+	}
+	if got := deployment.GetAnnotations()[ownerNameAnnotation]; got != "web" {
+		t.Errorf("deployment owner annotation = %q, want web", got)
+	}
+	if got := deployment.GetLabels()[ownerNameHashLabel]; got != ownerNameHash("web") {
+		t.Errorf("deployment owner label = %q, want the hash of web", got)
+	}
+	if fake.Object(servicesGVR, "default", "web") == nil {
+		t.Error("service was not created")
+	}
+
+	obj, err = s.Get(ctx, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := obj.(*unstructured.Unstructured)
+	if image, _, _ := unstructured.NestedString(got.Object, "spec", "image"); image != "nginx" || got.GetUID() != u.GetUID() {
+		t.Errorf("get returned image %q and uid %q, want nginx and %q", image, got.GetUID(), u.GetUID())
+	}
+	if children, _, _ := unstructured.NestedSlice(got.Object, "status", "children"); len(children) != 2 {
+		t.Errorf("status lists %d children, want 2", len(children))
+	}
+	if _, err := s.Create(ctx, newWebApp("web", 80), rest.ValidateAllObjectFunc, nil); !errors.IsAlreadyExists(err) {
+		t.Errorf("second create returned %v, want AlreadyExists", err)
+	}
+}
+
+func TestTemplateInjection(t *testing.T) {
+	s, fake := newTestTemplateStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+
+	web := newWebApp("web", 0)
+	image := "nginx\n        securityContext: {privileged: true}"
+	unstructured.SetNestedField(web.Object, image, "spec", "image")
+	if _, err := s.Create(ctx, web, rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	deployment := fake.Object(deploymentsGVR, "default", "web")
+	if deployment == nil {
+		t.Fatal("deployment was not created")
+	}
+	containers, _, _ := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+	if len(containers) != 1 {
+		t.Fatalf("deployment has %d containers, want 1", len(containers))
+	}
+	container := containers[0].(map[string]interface{})
+	if container["image"] != image || container["securityContext"] != nil {
+		t.Errorf("spec.image was not kept as a string: got container %v", container)
+	}
+}
+
+func TestTemplateUpdate(t *testing.T) {
+	s, fake := newTestTemplateStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	obj, err := s.Create(ctx, newWebApp("web", 80), rest.ValidateAllObjectFunc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping the port removes the service.
+	u := obj.(*unstructured.Unstructured)
+	unstructured.SetNestedField(u.Object, int64(5), "spec", "replicas")
+	unstructured.RemoveNestedField(u.Object, "spec", "port")
+	obj, _, err = s.Update(ctx, "web", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := obj.(*unstructured.Unstructured).GetGeneration(); g != 2 {
+		t.Errorf("generation = %d, want 2", g)
+	}
+	if r, _, _ := unstructured.NestedInt64(fake.Object(deploymentsGVR, "default", "web").Object, "spec", "replicas"); r != 5 {
+		t.Errorf("deployment has %d replicas, want 5", r)
+	}
+	if fake.Object(servicesGVR, "default", "web") != nil {
+		t.Error("service was not deleted")
+	}
+	if _, _, err := s.Update(ctx, "web", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); !errors.IsConflict(err) {
+		t.Errorf("update with a stale resourceVersion returned %v, want Conflict", err)
+	}
+
+	// A dry-run update of a missing object creates nothing.
+	dryRun := &metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}}
+	if _, _, err := s.Update(ctx, "dry", rest.DefaultUpdatedObjectInfo(newWebApp("dry", 80)), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, true, dryRun); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Object(deploymentsGVR, "default", "dry") != nil || fake.Object(servicesGVR, "default", "dry") != nil {
+		t.Error("dry-run update of a missing object created its children")
+	}
+}
+
+func TestTemplateDelete(t *testing.T) {
+	s, fake := newTestTemplateStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	for _, name := range []string{"web", "api"} {
+		if _, err := s.Create(ctx, newWebApp(name, 80), rest.ValidateAllObjectFunc, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := s.Delete(ctx, "web", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Object(deploymentsGVR, "default", "web") != nil || fake.Object(servicesGVR, "default", "web") != nil {
+		t.Error("children were not deleted")
+	}
+
+	obj, err := s.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := obj.(*unstructured.UnstructuredList).Items; len(items) != 1 || items[0].GetName() != "api" {
+		t.Errorf("list returned %v, want only api", items)
+	}
+	if _, err := s.Get(ctx, "web", nil); !errors.IsNotFound(err) {
+		t.Errorf("get after delete returned %v, want NotFound", err)
+	}
+}
+
+func TestTemplateLongName(t *testing.T) {
+	s, fake := newTestTemplateStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	name := strings.Repeat("a", validation.DNS1123SubdomainMaxLength)
+	if _, err := s.Create(ctx, newWebApp(name, 80), rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, gvr := range []schema.GroupVersionResource{deploymentsGVR, servicesGVR} {
+		child := fake.Object(gvr, "default", name)
+		if child == nil {
+			t.Fatalf("%s was not created", gvr.Resource)
+		}
+		for k, v := range child.GetLabels() {
+			if errs := validation.IsValidLabelValue(v); len(errs) != 0 {
+				t.Errorf("label %s of %s is invalid: %v", k, gvr.Resource, errs)
+			}
+		}
+	}
+	obj, err := s.Get(ctx, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.(*unstructured.Unstructured).GetName(); got != name {
+		t.Errorf("get returned %s", got)
+	}
+	if _, _, err := s.Delete(ctx, name, rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Object(deploymentsGVR, "default", name) != nil {
+		t.Error("deployment was not deleted")
+	}
+}
+
+func TestTemplateWatchFromList(t *testing.T) {
+	s, fake := newTestTemplateStorage(t)
+	defer fake.Close()
+	ctx := ctxWithNamespace()
+	for _, name := range []string{"web", "api", "gone"} {
+		if _, err := s.Create(ctx, newWebApp(name, 80), rest.ValidateAllObjectFunc, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err := s.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := obj.(*unstructured.UnstructuredList).GetResourceVersion()
+	if _, _, err := s.Delete(ctx, "gone", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := s.Watch(ctx, &metainternalversion.ListOptions{ResourceVersion: rv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	e := nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Deleted || u.GetName() != "gone" {
+		t.Fatalf("got %s event for %s, want DELETED gone", e.Type, u.GetName())
+	}
+
+	obj, err = s.Get(ctx, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := obj.(*unstructured.Unstructured)
+	unstructured.SetNestedField(u.Object, int64(3), "spec", "replicas")
+	if _, _, err := s.Update(ctx, "web", rest.DefaultUpdatedObjectInfo(u), rest.ValidateAllObjectFunc, rest.ValidateAllObjectUpdateFunc, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(t, w)
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Modified || u.GetName() != "web" {
+		t.Fatalf("got %s event for %s, want MODIFIED web", e.Type, u.GetName())
+	}
+
+	if _, _, err := s.Delete(ctx, "api", rest.ValidateAllObjectFunc, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Each child of web sends a MODIFIED event of its own.
+	for e = nextEvent(t, w); e.Object.(*unstructured.Unstructured).GetName() == "web"; e = nextEvent(t, w) {
+		if e.Type != watch.Modified {
+			t.Fatalf("got %s event for web, want MODIFIED", e.Type)
+		}
+	}
+	if u := e.Object.(*unstructured.Unstructured); e.Type != watch.Deleted || u.GetName() != "api" {
+		t.Fatalf("got %s event for %s, want DELETED api", e.Type, u.GetName())
+	}
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	jsonserializer "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/tracing"
+)
+
+var (
+	versionV1       = schema.GroupVersion{Version: "v1"}
+	parameterScheme = runtime.NewScheme()
+	parameterCodec  = runtime.NewParameterCodec(parameterScheme)
+	watchSerializer = jsonserializer.NewSerializer(jsonserializer.DefaultMetaFactory, parameterScheme, parameterScheme, false)
+)
+
+func init() {
+	metav1.AddToGroupVersion(parameterScheme, versionV1)
+}
+
+// newTracedRESTClient returns the REST client shared by all tracedClients of
+// an upstream.
+func newTracedRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	config = dynamic.ConfigFor(config)
+	config.GroupVersion = &schema.GroupVersion{}
+	config.APIPath = "/"
+	return rest.RESTClientFor(config)
+}
+
+// tracedClient is a dynamic client whose requests carry a traceparent header.
+// The dynamic client of this client-go version accepts neither a context nor
+// headers per request, so it sends the requests itself on a REST client that
+// is built once per upstream.
+type tracedClient struct {
+	client      *rest.RESTClient
+	traceparent string
+}
+
+func (c *tracedClient) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &tracedResourceClient{tracedClient: c, gvr: gvr}
+}
+
+type tracedResourceClient struct {
+	*tracedClient
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+func (c *tracedResourceClient) Namespace(namespace string) dynamic.ResourceInterface {
+	out := *c
+	out.namespace = namespace
+	return &out
+}
+
+// request starts a request for verb on the object name, or on the collection
+// if name is empty.
+func (c *tracedResourceClient) request(verb, name string, subresources ...string) *rest.Request {
+	path := []string{"apis", c.gvr.Group, c.gvr.Version}
+	if c.gvr.Group == "" {
+		path = []string{"api", c.gvr.Version}
+	}
+	if c.namespace != "" {
+		path = append(path, "namespaces", c.namespace)
+	}
+	path = append(path, c.gvr.Resource)
+	if name != "" {
+		path = append(path, name)
+	}
+	return c.client.Verb(verb).
+		AbsPath(append(path, subresources...)...).
+		SetHeader(tracing.TraceparentHeader, c.traceparent)
+}
+
+func decodeObject(result rest.Result) (*unstructured.Unstructured, error) {
+	b, err := result.Raw()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := runtime.Decode(unstructured.UnstructuredJSONScheme, b)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %T in response", obj)
+	}
+	return u, nil
+}
+
+func (c *tracedResourceClient) Create(obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	name := ""
+	if len(subresources) > 0 {
+		if name = obj.GetName(); name == "" {
+			return nil, fmt.Errorf("name is required")
+		}
+	}
+	body, err := runtime.Encode(unstructured.UnstructuredJSONScheme, obj)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObject(c.request("POST", name, subresources...).
+		Body(body).
+		SpecificallyVersionedParams(&options, parameterCodec, versionV1).
+		Do())
+}
+
+func (c *tracedResourceClient) Update(obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if obj.GetName() == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	body, err := runtime.Encode(unstructured.UnstructuredJSONScheme, obj)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObject(c.request("PUT", obj.GetName(), subresources...).
+		Body(body).
+		SpecificallyVersionedParams(&options, parameterCodec, versionV1).
+		Do())
+}
+
+func (c *tracedResourceClient) UpdateStatus(obj *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+	return c.Update(obj, options, "status")
+}
+
+func (c *tracedResourceClient) Delete(name string, options *metav1.DeleteOptions, subresources ...string) error {
+	if name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if options == nil {
+		options = &metav1.DeleteOptions{}
+	}
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	return c.request("DELETE", name, subresources...).Body(body).Do().Error()
+}
+
+func (c *tracedResourceClient) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	if options == nil {
+		options = &metav1.DeleteOptions{}
+	}
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	return c.request("DELETE", "").
+		Body(body).
+		SpecificallyVersionedParams(&listOptions, parameterCodec, versionV1).
+		Do().
+		Error()
+}
+
+func (c *tracedResourceClient) Get(name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	return decodeObject(c.request("GET", name, subresources...).
+		SpecificallyVersionedParams(&options, parameterCodec, versionV1).
+		Do())
+}
+
+func (c *tracedResourceClient) List(options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	b, err := c.request("GET", "").
+		SpecificallyVersionedParams(&options, parameterCodec, versionV1).
+		Do().
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := runtime.Decode(unstructured.UnstructuredJSONScheme, b)
+	if err != nil {
+		return nil, err
+	}
+	switch obj := obj.(type) {
+	case *unstructured.UnstructuredList:
+		return obj, nil
+	case *unstructured.Unstructured:
+		return obj.ToList()
+	}
+	return nil, fmt.Errorf("unexpected %T in response", obj)
+}
+
+func (c *tracedResourceClient) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	options.Watch = true
+	return c.request("GET", "").
+		SpecificallyVersionedParams(&options, parameterCodec, versionV1).
+		WatchWithSpecificDecoders(func(body io.ReadCloser) streaming.Decoder {
+			return streaming.NewDecoder(jsonserializer.Framer.NewFrameReader(body), watchSerializer)
+		}, unstructured.UnstructuredJSONScheme)
+}
+
+func (c *tracedResourceClient) Patch(name string, pt types.PatchType, data []byte, options metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	return decodeObject(c.request("PATCH", name, subresources...).
+		SetHeader("Content-Type", string(pt)).
+		Body(data).
+		SpecificallyVersionedParams(&options, parameterCodec, versionV1).
+		Do())
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+	"github.com/maisem/proxy-apiserver/pkg/tracing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+type nopExporter struct{}
+
+func (nopExporter) Export([]*tracing.Span) error { return nil }
+
+func TestTracedClient(t *testing.T) {
+	fake := fakeupstream.New()
+	defer fake.Close()
+	var mu sync.Mutex
+	var traceparents []string
+	config := fake.Config()
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			traceparents = append(traceparents, req.Method+" "+req.Header.Get(tracing.TraceparentHeader))
+			mu.Unlock()
+			return rt.RoundTrip(req)
+		})
+	}
+	upstream, err := NewUpstream("fake", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ctx, span := tracing.NewTracer(nopExporter{}, stopCh).StartRoot(context.Background(), "test", "")
+	defer span.Finish(nil)
+	want := tracing.Traceparent(ctx)
+
+	client := upstream.ClientFor(ctx).Resource(deploymentsGVR).Namespace("default")
+	w, err := client.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	created, err := client.Create(newDeployment(intR.GroupVersion, "foo", nil), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.ResultChan():
+		if e.Type != watch.Added {
+			t.Errorf("watch event = %v, want ADDED", e.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watch event")
+	}
+	if _, err := client.Update(created, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	patched, err := client.Patch("foo", types.MergePatchType, []byte(`{"metadata":{"labels":{"a":"b"}}}`), metav1.PatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.GetLabels()["a"] != "b" {
+		t.Errorf("patched labels = %v", patched.GetLabels())
+	}
+	if _, err := client.Get("foo", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := client.List(metav1.ListOptions{}); err != nil || len(list.Items) != 1 {
+		t.Fatalf("List() = %v, %v", list, err)
+	}
+	if err := client.Delete("foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("foo", metav1.GetOptions{}); err == nil {
+		t.Error("Get() after Delete() succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traceparents) != 8 {
+		t.Errorf("sent %d requests, want 8: %v", len(traceparents), traceparents)
+	}
+	for _, got := range traceparents {
+		if !strings.HasSuffix(got, " "+want) {
+			t.Errorf("request %q does not carry traceparent %s", got, want)
+		}
+	}
+
+	// Untraced requests use the plain client.
+	if upstream.ClientFor(context.Background()) != upstream.Client {
+		t.Error("ClientFor() without a span did not return the plain client")
+	}
+}
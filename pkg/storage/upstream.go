@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/transport"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/maisem/proxy-apiserver/pkg/tracing"
+)
+
+// Upstream describes the cluster that proxied requests are forwarded to.
+type Upstream struct {
+	// Name identifies the upstream cluster in metrics and logs.
+	Name   string
+	Client dynamic.Interface
+	// Recorder records events about the outcome of facade requests on
+	// upstream objects. No events are recorded if it is nil.
+	Recorder record.EventRecorder
+
+	// clientFor returns a client whose requests carry the trace context of
+	// ctx. It is nil when the Upstream was not built from a rest.Config.
+	clientFor func(ctx context.Context) dynamic.Interface
+	// core streams pod logs, which the dynamic client cannot. It is nil when
+	// the Upstream was not built from a rest.Config.
+	core corev1client.CoreV1Interface
+	// config is the config the Upstream was built from, or nil.
+	config *rest.Config
+}
+
+// NewUpstream returns an Upstream talking to the cluster described by config.
+func NewUpstream(name string, config *rest.Config) (Upstream, error) {
+	config = rest.CopyConfig(config)
+	if config.RateLimiter == nil && config.QPS >= 0 {
+		qps, burst := config.QPS, config.Burst
+		if qps == 0 {
+			qps = rest.DefaultQPS
+		}
+		if burst == 0 {
+			burst = rest.DefaultBurst
+		}
+		// Share a single rate limiter between the plain and the traced client
+		// so they draw from the same budget.
+		config.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	}
+	// The client timeout would also cut off watches and followed log streams,
+	// so it only applies to requests that are not watches, and not at all to
+	// logs.
+	timeout := config.Timeout
+	config.Timeout = 0
+	core, err := corev1client.NewForConfig(config)
+	if err != nil {
+		return Upstream{}, err
+	}
+	if timeout > 0 {
+		config.WrapTransport = transport.Wrappers(config.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+			return &timeoutRoundTripper{rt: rt, timeout: timeout}
+		})
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return Upstream{}, err
+	}
+	traced, err := newTracedRESTClient(config)
+	if err != nil {
+		return Upstream{}, err
+	}
+	return Upstream{
+		Name:   name,
+		Client: client,
+		core:   core,
+		config: config,
+		clientFor: func(ctx context.Context) dynamic.Interface {
+			traceparent := tracing.Traceparent(ctx)
+			if traceparent == "" {
+				return client
+			}
+			return &tracedClient{client: traced, traceparent: traceparent}
+		},
+	}, nil
+}
+
+// ClientFor returns a client to use for requests made on behalf of ctx.
+func (u Upstream) ClientFor(ctx context.Context) dynamic.Interface {
+	if u.clientFor == nil {
+		return u.Client
+	}
+	return u.clientFor(ctx)
+}
+
+// Config returns a copy of the config the Upstream was built from, or nil if
+// it was not built from one.
+func (u Upstream) Config() *rest.Config {
+	if u.config == nil {
+		return nil
+	}
+	return rest.CopyConfig(u.config)
+}
+
+// PodLogs streams the logs of a container of the pod namespace/name. The
+// stream ends when ctx is done or, unless opts.Follow is set, when all logs
+// have been read. Callers must close it.
+func (u Upstream) PodLogs(ctx context.Context, namespace, name string, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
+	if u.core == nil {
+		return nil, fmt.Errorf("upstream %s does not support streaming logs", u.Name)
+	}
+	return u.core.Pods(namespace).GetLogs(name, opts).Context(ctx).Stream()
+}
+
+// timeoutRoundTripper bounds every request that is not a watch by timeout,
+// including the time spent reading its response body.
+type timeoutRoundTripper struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("watch") == "true" {
+		return t.rt.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request when its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+	"github.com/maisem/proxy-apiserver/pkg/tracing"
+)
+
+func TestUpstreamTimeout(t *testing.T) {
+	fake := fakeupstream.New()
+	defer fake.Close()
+	config := fake.Config()
+	config.Timeout = 100 * time.Millisecond
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Path, "/slow") {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			}
+			return rt.RoundTrip(req)
+		})
+	}
+	upstream, err := NewUpstream("fake", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ctx, span := tracing.NewTracer(nopExporter{}, stopCh).StartRoot(context.Background(), "test", "")
+	defer span.Finish(nil)
+
+	plain := upstream.Client.Resource(deploymentsGVR).Namespace("default")
+	traced := upstream.ClientFor(ctx).Resource(deploymentsGVR).Namespace("default")
+	done := make(chan error, 1)
+	go func() {
+		_, err := plain.Get("slow", metav1.GetOptions{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("get of a slow object succeeded, want a timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get of a slow object was not cut off by the timeout")
+	}
+
+	var watchers []watch.Interface
+	for _, client := range []interface {
+		Watch(metav1.ListOptions) (watch.Interface, error)
+	}{plain, traced} {
+		w, err := client.Watch(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		watchers = append(watchers, w)
+	}
+	// Outlive the timeout before anything happens on the watches.
+	time.Sleep(3 * config.Timeout)
+	if _, err := plain.Create(newDeployment(intR.GroupVersion, "foo", nil), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range watchers {
+		select {
+		case e, ok := <-w.ResultChan():
+			if !ok || e.Type != watch.Added {
+				t.Errorf("watch %d: got %v (open %v), want ADDED", i, e.Type, ok)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch %d: no event", i)
+		}
+	}
+}
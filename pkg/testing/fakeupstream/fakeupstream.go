@@ -0,0 +1,885 @@
+// Package fakeupstream implements an in-memory Kubernetes API server that
+// speaks enough of the REST and watch protocol to exercise the proxy without a
+// cluster. It supports every resource under /api and /apis, resourceVersions
+// and conflicts, label and field selectors, pagination and watches, status
+// subresources, the logs of pods, discovery of common built-in resources and
+// access reviews.
+package fakeupstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+// Server is a fake upstream API server.
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// rv is the resourceVersion of the last write.
+	rv int64
+	// compacted is the oldest resourceVersion lists and watches may start at.
+	compacted int64
+	objects   map[schema.GroupVersionResource]map[string]*unstructured.Unstructured
+	events    []event
+	watchers  map[*watcher]bool
+	requests  []string
+	// failures holds errors to return for the next matching requests.
+	failures map[string]error
+	// logs holds the logs of containers by namespace/pod/container.
+	logs map[string]string
+	// closed is closed by Close to end followed logs.
+	closed chan struct{}
+	// discovery lists the resources served in discovery by group version.
+	discovery map[schema.GroupVersion][]metav1.APIResource
+	// denied holds the "<verb> <resource>" pairs access reviews deny.
+	denied map[string]bool
+}
+
+type event struct {
+	gvr schema.GroupVersionResource
+	watch.Event
+	rv int64
+}
+
+type watcher struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+	selector  selector
+	ch        chan event
+}
+
+// New starts a fake upstream. Callers must Close it.
+func New() *Server {
+	s := &Server{
+		objects:  map[schema.GroupVersionResource]map[string]*unstructured.Unstructured{},
+		watchers: map[*watcher]bool{},
+		failures: map[string]error{},
+		logs:     map[string]string{},
+		closed:   make(chan struct{}),
+		denied:   map[string]bool{},
+	}
+	s.discovery = map[schema.GroupVersion][]metav1.APIResource{}
+	for _, r := range builtinResources {
+		gv := schema.GroupVersion{Group: r.Group, Version: r.Version}
+		s.discovery[gv] = append(s.discovery[gv], r)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Config returns a client config for the fake upstream.
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{Host: s.URL}
+}
+
+// Close stops all watches and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for w := range s.watchers {
+		close(w.ch)
+		delete(s.watchers, w)
+	}
+	close(s.closed)
+	s.mu.Unlock()
+	s.Server.Close()
+}
+
+// Add stores obj in gvr as if it had been created through the API.
+func (s *Server) Add(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) *unstructured.Unstructured {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.create(gvr, obj.GetNamespace(), obj.DeepCopy(), false)
+	if err != nil {
+		panic(err)
+	}
+	return u.DeepCopy()
+}
+
+// Object returns a copy of the stored object, or nil.
+func (s *Server) Object(gvr schema.GroupVersionResource, namespace, name string) *unstructured.Unstructured {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.objects[gvr][key(namespace, name)]; ok {
+		return u.DeepCopy()
+	}
+	return nil
+}
+
+// Compact discards the history before the current resourceVersion, expiring
+// continue tokens and watches that start at an older version.
+func (s *Server) Compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compacted = s.rv
+	s.events = nil
+}
+
+// SetLogs sets the logs of container in the pod namespace/name. The pod
+// must be added separately.
+func (s *Server) SetLogs(namespace, name, container, logs string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs[key(namespace, name)+"/"+container] = logs
+}
+
+// Requests returns the "<METHOD> <path>" of every request served so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// FailNext makes the next request with the given method and path fail with
+// err. path is the URL path without query, e.g.
+// /apis/apps/v1/namespaces/default/deployments/foo.
+func (s *Server) FailNext(method, path string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method+" "+path] = err
+}
+
+// builtinResources are served in discovery until removed.
+var builtinResources = []metav1.APIResource{
+	{Version: "v1", Name: "pods", Kind: "Pod", Namespaced: true},
+	{Version: "v1", Name: "pods/log", Kind: "Pod", Namespaced: true},
+	{Version: "v1", Name: "services", Kind: "Service", Namespaced: true},
+	{Version: "v1", Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+	{Version: "v1", Name: "secrets", Kind: "Secret", Namespaced: true},
+	{Version: "v1", Name: "events", Kind: "Event", Namespaced: true},
+	{Version: "v1", Name: "namespaces", Kind: "Namespace"},
+	{Group: "apps", Version: "v1", Name: "deployments", Kind: "Deployment", Namespaced: true},
+	{Group: "apps", Version: "v1", Name: "replicasets", Kind: "ReplicaSet", Namespaced: true},
+	{Group: "apps", Version: "v1", Name: "statefulsets", Kind: "StatefulSet", Namespaced: true},
+	{Group: "apps", Version: "v1", Name: "daemonsets", Kind: "DaemonSet", Namespaced: true},
+}
+
+// AddResource serves r in discovery. r.Group and r.Version must be set.
+func (s *Server) AddResource(r metav1.APIResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gv := schema.GroupVersion{Group: r.Group, Version: r.Version}
+	s.discovery[gv] = append(s.discovery[gv], r)
+}
+
+// RemoveResource removes the resource gvr from discovery. Requests for it
+// are still served.
+func (s *Server) RemoveResource(gvr schema.GroupVersionResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gv := gvr.GroupVersion()
+	var kept []metav1.APIResource
+	for _, r := range s.discovery[gv] {
+		if r.Name != gvr.Resource {
+			kept = append(kept, r)
+		}
+	}
+	s.discovery[gv] = kept
+}
+
+// Deny makes self subject access reviews of verb on gvr fail. subresource
+// may be empty.
+func (s *Server) Deny(verb string, gvr schema.GroupVersionResource, subresource string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[accessKey(verb, gvr, subresource)] = true
+}
+
+func accessKey(verb string, gvr schema.GroupVersionResource, subresource string) string {
+	k := verb + " " + gvr.String()
+	if subresource != "" {
+		k += "/" + subresource
+	}
+	return k
+}
+
+// request is a parsed resource request.
+type request struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+	name      string
+	// subresource is either status or, for pods, log.
+	subresource string
+}
+
+func parsePath(path string) (request, bool) {
+	var r request
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		r.gvr.Version = parts[1]
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		r.gvr.Group, r.gvr.Version = parts[1], parts[2]
+		parts = parts[3:]
+	default:
+		return r, false
+	}
+	if len(parts) >= 2 && parts[0] == "namespaces" && len(parts) != 2 {
+		r.namespace = parts[1]
+		parts = parts[2:]
+	}
+	switch len(parts) {
+	case 1:
+		r.gvr.Resource = parts[0]
+	case 2:
+		r.gvr.Resource, r.name = parts[0], parts[1]
+	case 3:
+		if parts[2] != "status" && (r.gvr.Group != "" || parts[0] != "pods" || parts[2] != "log") {
+			return r, false
+		}
+		r.gvr.Resource, r.name, r.subresource = parts[0], parts[1], parts[2]
+	default:
+		return r, false
+	}
+	return r, true
+}
+
+func key(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+	failure, ok := s.failures[req.Method+" "+req.URL.Path]
+	delete(s.failures, req.Method+" "+req.URL.Path)
+	s.mu.Unlock()
+	if ok {
+		writeError(w, failure)
+		return
+	}
+
+	if req.Method == http.MethodGet && req.URL.Path == "/version" {
+		writeJSON(w, http.StatusOK, map[string]string{"major": "1", "minor": "15", "gitVersion": "v1.15.0-fake"})
+		return
+	}
+	if gv, ok := parseGroupVersionPath(req.URL.Path); ok && req.Method == http.MethodGet {
+		s.handle(w, func() (interface{}, error) { return s.resources(gv) })
+		return
+	}
+	r, ok := parsePath(req.URL.Path)
+	if !ok {
+		writeError(w, errors.NewNotFound(schema.GroupResource{}, req.URL.Path))
+		return
+	}
+	q := req.URL.Query()
+	switch {
+	case r.subresource == "log" && req.Method == http.MethodGet:
+		s.podLogs(w, req, r)
+	case r.subresource == "status" && req.Method == http.MethodGet:
+		s.handle(w, func() (interface{}, error) { return s.get(r) })
+	case r.subresource == "status" && req.Method == http.MethodPut:
+		s.handleBody(w, req, http.StatusOK, func(u *unstructured.Unstructured) (interface{}, error) {
+			return s.updateStatus(r, u)
+		})
+	case r.subresource != "":
+		writeError(w, errors.NewMethodNotSupported(r.gvr.GroupResource(), req.Method))
+	case req.Method == http.MethodGet && q.Get("watch") == "true":
+		s.watch(w, req, r)
+	case req.Method == http.MethodGet && r.name == "":
+		s.handle(w, func() (interface{}, error) { return s.list(r, q) })
+	case req.Method == http.MethodGet:
+		s.handle(w, func() (interface{}, error) { return s.get(r) })
+	case req.Method == http.MethodPost && r.gvr.Group == "authorization.k8s.io" && r.gvr.Resource == "selfsubjectaccessreviews":
+		s.handleBody(w, req, http.StatusCreated, s.review)
+	case req.Method == http.MethodPost && r.name == "":
+		s.handleBody(w, req, http.StatusCreated, func(u *unstructured.Unstructured) (interface{}, error) {
+			return s.create(r.gvr, r.namespace, u, len(q["dryRun"]) > 0)
+		})
+	case req.Method == http.MethodPut && r.name != "":
+		s.handleBody(w, req, http.StatusOK, func(u *unstructured.Unstructured) (interface{}, error) {
+			return s.update(r, u, len(q["dryRun"]) > 0)
+		})
+	case req.Method == http.MethodPatch && r.name != "":
+		s.handle(w, func() (interface{}, error) { return s.patch(r, req) })
+	case req.Method == http.MethodDelete && r.name != "":
+		s.handle(w, func() (interface{}, error) {
+			dryRun, err := deleteDryRun(req, q)
+			if err != nil {
+				return nil, err
+			}
+			return s.delete(r, dryRun)
+		})
+	case req.Method == http.MethodDelete:
+		s.handle(w, func() (interface{}, error) {
+			dryRun, err := deleteDryRun(req, q)
+			if err != nil {
+				return nil, err
+			}
+			return s.deleteCollection(r, q, dryRun)
+		})
+	default:
+		writeError(w, errors.NewMethodNotSupported(r.gvr.GroupResource(), req.Method))
+	}
+}
+
+// parseGroupVersionPath parses the discovery path of a group version, e.g.
+// /api/v1 or /apis/apps/v1.
+func parseGroupVersionPath(path string) (schema.GroupVersion, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "api":
+		return schema.GroupVersion{Version: parts[1]}, true
+	case len(parts) == 3 && parts[0] == "apis":
+		return schema.GroupVersion{Group: parts[1], Version: parts[2]}, true
+	}
+	return schema.GroupVersion{}, false
+}
+
+func (s *Server) handle(w http.ResponseWriter, fn func() (interface{}, error)) {
+	s.mu.Lock()
+	obj, err := fn()
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *Server) handleBody(w http.ResponseWriter, req *http.Request, code int, fn func(*unstructured.Unstructured) (interface{}, error)) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, errors.NewBadRequest(err.Error()))
+		return
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(body); err != nil {
+		writeError(w, errors.NewBadRequest(err.Error()))
+		return
+	}
+	s.mu.Lock()
+	obj, err := fn(u)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, code, obj)
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := errors.NewInternalError(err).ErrStatus
+	if s, ok := err.(errors.APIStatus); ok {
+		status = s.Status()
+	}
+	status.Kind, status.APIVersion = "Status", "v1"
+	writeJSON(w, int(status.Code), status)
+}
+
+// The methods below must be called with s.mu held.
+
+func (s *Server) resources(gv schema.GroupVersion) (*metav1.APIResourceList, error) {
+	resources, ok := s.discovery[gv]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{}, gv.String())
+	}
+	l := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: gv.String(),
+	}
+	for _, r := range resources {
+		r.Group, r.Version = "", ""
+		r.Verbs = metav1.Verbs{"create", "delete", "deletecollection", "get", "list", "patch", "update", "watch"}
+		l.APIResources = append(l.APIResources, r)
+	}
+	return l, nil
+}
+
+// review answers a self subject access review, allowing everything that was
+// not denied.
+func (s *Server) review(u *unstructured.Unstructured) (interface{}, error) {
+	attrs, _, _ := unstructured.NestedStringMap(u.Object, "spec", "resourceAttributes")
+	gvr := schema.GroupVersionResource{Group: attrs["group"], Version: attrs["version"], Resource: attrs["resource"]}
+	allowed := !s.denied[accessKey(attrs["verb"], gvr, attrs["subresource"])]
+	unstructured.SetNestedField(u.Object, allowed, "status", "allowed")
+	return u, nil
+}
+
+func (s *Server) nextRV() int64 {
+	s.rv++
+	return s.rv
+}
+
+func (s *Server) record(gvr schema.GroupVersionResource, t watch.EventType, u *unstructured.Unstructured) {
+	e := event{gvr: gvr, Event: watch.Event{Type: t, Object: u.DeepCopy()}, rv: s.rv}
+	s.events = append(s.events, e)
+	for w := range s.watchers {
+		if w.matches(e) {
+			select {
+			case w.ch <- e:
+			default:
+				// The watcher is too slow, drop it like the real thing would.
+				close(w.ch)
+				delete(s.watchers, w)
+			}
+		}
+	}
+}
+
+func (s *Server) get(r request) (*unstructured.Unstructured, error) {
+	u, ok := s.objects[r.gvr][key(r.namespace, r.name)]
+	if !ok {
+		return nil, errors.NewNotFound(r.gvr.GroupResource(), r.name)
+	}
+	return u, nil
+}
+
+func (s *Server) create(gvr schema.GroupVersionResource, namespace string, u *unstructured.Unstructured, dryRun bool) (*unstructured.Unstructured, error) {
+	if u.GetName() == "" && u.GetGenerateName() != "" {
+		u.SetName(u.GetGenerateName() + string(uuid.NewUUID())[:5])
+	}
+	if u.GetName() == "" {
+		return nil, errors.NewBadRequest("name or generateName is required")
+	}
+	if namespace != "" {
+		if u.GetNamespace() != "" && u.GetNamespace() != namespace {
+			return nil, errors.NewBadRequest("the namespace of the object does not match the namespace of the request")
+		}
+		u.SetNamespace(namespace)
+	}
+	k := key(u.GetNamespace(), u.GetName())
+	if _, ok := s.objects[gvr][k]; ok {
+		return nil, errors.NewAlreadyExists(gvr.GroupResource(), u.GetName())
+	}
+	if s.objects[gvr] == nil {
+		s.objects[gvr] = map[string]*unstructured.Unstructured{}
+	}
+	u.SetUID(uuid.NewUUID())
+	u.SetCreationTimestamp(metav1.Now())
+	u.SetGeneration(1)
+	if dryRun {
+		return u, nil
+	}
+	u.SetResourceVersion(strconv.FormatInt(s.nextRV(), 10))
+	s.objects[gvr][k] = u
+	s.record(gvr, watch.Added, u)
+	return u, nil
+}
+
+func (s *Server) update(r request, u *unstructured.Unstructured, dryRun bool) (*unstructured.Unstructured, error) {
+	old, err := s.get(r)
+	if err != nil {
+		return nil, err
+	}
+	if u.GetName() != r.name {
+		return nil, errors.NewBadRequest("the name of the object does not match the name of the request")
+	}
+	if rv := u.GetResourceVersion(); rv != "" && rv != old.GetResourceVersion() {
+		return nil, errors.NewConflict(r.gvr.GroupResource(), r.name, fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	if dryRun {
+		return u, nil
+	}
+	return s.replace(r, old, u), nil
+}
+
+// updateStatus replaces the status of the stored object with the one of u,
+// ignoring the rest of u.
+func (s *Server) updateStatus(r request, u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	old, err := s.get(r)
+	if err != nil {
+		return nil, err
+	}
+	if rv := u.GetResourceVersion(); rv != "" && rv != old.GetResourceVersion() {
+		return nil, errors.NewConflict(r.gvr.GroupResource(), r.name, fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	updated := old.DeepCopy()
+	if status, ok := u.Object["status"]; ok {
+		updated.Object["status"] = status
+	} else {
+		delete(updated.Object, "status")
+	}
+	updated.SetResourceVersion(strconv.FormatInt(s.nextRV(), 10))
+	s.objects[r.gvr][key(r.namespace, r.name)] = updated
+	s.record(r.gvr, watch.Modified, updated)
+	return updated, nil
+}
+
+func (s *Server) replace(r request, old, u *unstructured.Unstructured) *unstructured.Unstructured {
+	u.SetNamespace(old.GetNamespace())
+	u.SetUID(old.GetUID())
+	u.SetCreationTimestamp(old.GetCreationTimestamp())
+	u.SetGeneration(old.GetGeneration())
+	if !equalIgnoringMeta(old, u) {
+		u.SetGeneration(old.GetGeneration() + 1)
+	}
+	u.SetResourceVersion(strconv.FormatInt(s.nextRV(), 10))
+	s.objects[r.gvr][key(r.namespace, r.name)] = u
+	s.record(r.gvr, watch.Modified, u)
+	return u
+}
+
+func equalIgnoringMeta(a, b *unstructured.Unstructured) bool {
+	ac, bc := a.DeepCopy().Object, b.DeepCopy().Object
+	delete(ac, "metadata")
+	delete(bc, "metadata")
+	aj, _ := json.Marshal(ac)
+	bj, _ := json.Marshal(bc)
+	return string(aj) == string(bj)
+}
+
+func (s *Server) patch(r request, req *http.Request) (*unstructured.Unstructured, error) {
+	old, err := s.get(r)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, errors.NewBadRequest(err.Error())
+	}
+	doc, err := old.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	switch types.PatchType(req.Header.Get("Content-Type")) {
+	case types.JSONPatchType:
+		p, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return nil, errors.NewBadRequest(err.Error())
+		}
+		patched, err = p.Apply(doc)
+		if err != nil {
+			return nil, errors.NewBadRequest(err.Error())
+		}
+	case types.MergePatchType, types.StrategicMergePatchType:
+		// Strategic merge patches are applied as merge patches, which is
+		// equivalent as long as no lists are patched.
+		patched, err = jsonpatch.MergePatch(doc, body)
+		if err != nil {
+			return nil, errors.NewBadRequest(err.Error())
+		}
+	default:
+		return nil, &errors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusUnsupportedMediaType,
+			Reason:  metav1.StatusReasonUnsupportedMediaType,
+			Message: fmt.Sprintf("unsupported patch type %q", req.Header.Get("Content-Type")),
+		}}
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(patched); err != nil {
+		return nil, errors.NewBadRequest(err.Error())
+	}
+	return s.replace(r, old, u), nil
+}
+
+func (s *Server) delete(r request, dryRun bool) (*metav1.Status, error) {
+	u, err := s.get(r)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		delete(s.objects[r.gvr], key(r.namespace, r.name))
+		s.nextRV()
+		s.record(r.gvr, watch.Deleted, u)
+	}
+	return &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+		Details:  &metav1.StatusDetails{Name: r.name, Group: r.gvr.Group, Kind: r.gvr.Resource, UID: u.GetUID()},
+	}, nil
+}
+
+func (s *Server) deleteCollection(r request, q map[string][]string, dryRun bool) (*metav1.Status, error) {
+	sel, err := parseSelector(q)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range s.sorted(r.gvr, r.namespace) {
+		if sel.matches(u) {
+			if _, err := s.delete(request{gvr: r.gvr, namespace: u.GetNamespace(), name: u.GetName()}, dryRun); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess}, nil
+}
+
+// deleteDryRun reports whether a delete request is a dry run, which clients
+// signal in the DeleteOptions of the body or in the query.
+func deleteDryRun(req *http.Request, q map[string][]string) (bool, error) {
+	if len(q["dryRun"]) > 0 {
+		return true, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return false, errors.NewBadRequest(err.Error())
+	}
+	if len(body) == 0 {
+		return false, nil
+	}
+	var opts metav1.DeleteOptions
+	if err := json.Unmarshal(body, &opts); err != nil {
+		return false, errors.NewBadRequest(err.Error())
+	}
+	return len(opts.DryRun) > 0, nil
+}
+
+// sorted returns the objects of gvr in namespace, or all namespaces if
+// namespace is empty, ordered by key.
+func (s *Server) sorted(gvr schema.GroupVersionResource, namespace string) []*unstructured.Unstructured {
+	var keys []string
+	for k, u := range s.objects[gvr] {
+		if namespace == "" || u.GetNamespace() == namespace {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := make([]*unstructured.Unstructured, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, s.objects[gvr][k])
+	}
+	return out
+}
+
+// continueToken mirrors the upstream token: the key to resume after and the
+// resourceVersion of the first page.
+type continueToken struct {
+	RV    int64  `json:"rv"`
+	Start string `json:"start"`
+}
+
+func (s *Server) list(r request, q map[string][]string) (*unstructured.UnstructuredList, error) {
+	sel, err := parseSelector(q)
+	if err != nil {
+		return nil, err
+	}
+	var start string
+	rv := s.rv
+	if c := get(q, "continue"); c != "" {
+		t := continueToken{}
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil || json.Unmarshal(b, &t) != nil {
+			return nil, errors.NewBadRequest("invalid continue token")
+		}
+		if t.RV < s.compacted {
+			return nil, errors.NewResourceExpired("The provided continue parameter is too old to display a consistent list result.")
+		}
+		start, rv = t.Start, t.RV
+	}
+	limit, _ := strconv.Atoi(get(q, "limit"))
+
+	ul := &unstructured.UnstructuredList{}
+	ul.SetAPIVersion(schema.GroupVersion{Group: r.gvr.Group, Version: r.gvr.Version}.String())
+	ul.SetKind("List")
+	ul.SetResourceVersion(strconv.FormatInt(rv, 10))
+	for _, u := range s.sorted(r.gvr, r.namespace) {
+		k := key(u.GetNamespace(), u.GetName())
+		if k <= start || !sel.matches(u) {
+			continue
+		}
+		if limit > 0 && len(ul.Items) == limit {
+			b, _ := json.Marshal(continueToken{RV: rv, Start: key(ul.Items[limit-1].GetNamespace(), ul.Items[limit-1].GetName())})
+			ul.SetContinue(base64.RawURLEncoding.EncodeToString(b))
+			break
+		}
+		ul.Items = append(ul.Items, *u.DeepCopy())
+	}
+	return ul, nil
+}
+
+func (s *Server) watch(w http.ResponseWriter, req *http.Request, r request) {
+	q := req.URL.Query()
+	sel, err := parseSelector(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.mu.Lock()
+	wt := &watcher{gvr: r.gvr, namespace: r.namespace, selector: sel, ch: make(chan event, len(s.events)+100)}
+	if v := get(q, "resourceVersion"); v != "" && v != "0" {
+		rv, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.mu.Unlock()
+			writeError(w, errors.NewBadRequest("invalid resourceVersion"))
+			return
+		}
+		if rv < s.compacted {
+			s.mu.Unlock()
+			// Like the real thing, report expiry as an event on the stream.
+			status := errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", rv, s.compacted)).ErrStatus
+			status.Kind, status.APIVersion = "Status", "v1"
+			b, _ := json.Marshal(status)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(metav1.WatchEvent{Type: string(watch.Error), Object: runtime.RawExtension{Raw: b}})
+			return
+		}
+		for _, e := range s.events {
+			if e.rv > rv && wt.matches(e) {
+				wt.ch <- e
+			}
+		}
+	}
+	s.watchers[wt] = true
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	timeout := time.Hour
+	if t, err := strconv.Atoi(get(q, "timeoutSeconds")); err == nil && t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+	defer s.stopWatch(wt)
+	for {
+		select {
+		case e, ok := <-wt.ch:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(metav1.WatchEvent{Type: string(e.Type), Object: rawObject(e.Object.(*unstructured.Unstructured))}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-time.After(timeout):
+			return
+		}
+	}
+}
+
+// podLogs serves the logs set by SetLogs, honoring the container, tailLines
+// and follow parameters. Followed logs are held open until the client or the
+// server goes away.
+func (s *Server) podLogs(w http.ResponseWriter, req *http.Request, r request) {
+	q := req.URL.Query()
+	s.mu.Lock()
+	pod, err := s.get(r)
+	if err != nil {
+		s.mu.Unlock()
+		writeError(w, err)
+		return
+	}
+	container := get(q, "container")
+	if container == "" {
+		containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+		if len(containers) != 1 {
+			s.mu.Unlock()
+			writeError(w, errors.NewBadRequest(fmt.Sprintf("a container name must be specified for pod %s", r.name)))
+			return
+		}
+		container, _, _ = unstructured.NestedString(containers[0].(map[string]interface{}), "name")
+	}
+	logs := s.logs[key(r.namespace, r.name)+"/"+container]
+	s.mu.Unlock()
+
+	if v := get(q, "tailLines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, errors.NewBadRequest("invalid tailLines"))
+			return
+		}
+		lines := strings.SplitAfter(strings.TrimSuffix(logs, "\n"), "\n")
+		if logs == "" {
+			lines = nil
+		}
+		if n < len(lines) {
+			lines = lines[len(lines)-n:]
+		}
+		logs = strings.Join(lines, "")
+		if logs != "" && !strings.HasSuffix(logs, "\n") {
+			logs += "\n"
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, logs)
+	w.(http.Flusher).Flush()
+	if get(q, "follow") == "true" {
+		select {
+		case <-req.Context().Done():
+		case <-s.closed:
+		}
+	}
+}
+
+func (s *Server) stopWatch(w *watcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers[w] {
+		delete(s.watchers, w)
+		close(w.ch)
+	}
+}
+
+func (w *watcher) matches(e event) bool {
+	u := e.Object.(*unstructured.Unstructured)
+	return e.gvr == w.gvr && (w.namespace == "" || w.namespace == u.GetNamespace()) && w.selector.matches(u)
+}
+
+func rawObject(u *unstructured.Unstructured) runtime.RawExtension {
+	b, _ := u.MarshalJSON()
+	return runtime.RawExtension{Raw: b}
+}
+
+// selector combines the label and field selectors of a request.
+type selector struct {
+	labels labels.Selector
+	fields fields.Selector
+}
+
+func parseSelector(q map[string][]string) (selector, error) {
+	ls, err := labels.Parse(get(q, "labelSelector"))
+	if err != nil {
+		return selector{}, errors.NewBadRequest(err.Error())
+	}
+	fs, err := fields.ParseSelector(get(q, "fieldSelector"))
+	if err != nil {
+		return selector{}, errors.NewBadRequest(err.Error())
+	}
+	return selector{labels: ls, fields: fs}, nil
+}
+
+func (s selector) matches(u *unstructured.Unstructured) bool {
+	return s.labels.Matches(labels.Set(u.GetLabels())) && s.fields.Matches(fields.Set{
+		"metadata.name":      u.GetName(),
+		"metadata.namespace": u.GetNamespace(),
+	})
+}
+
+func get(q map[string][]string, k string) string {
+	if v := q[k]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
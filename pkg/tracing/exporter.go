@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter ships finished spans to a tracing backend.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// NewOTLPExporter returns an exporter that posts spans to an OTLP/HTTP
+// collector endpoint, e.g. http://otel-collector:4318/v1/traces, using the
+// JSON encoding of the OTLP protocol.
+func NewOTLPExporter(endpoint, serviceName string) Exporter {
+	return &otlpExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+func (e *otlpExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(newExportRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("OTLP endpoint %s returned %s: %s", e.endpoint, resp.Status, msg)
+	}
+	return nil
+}
+
+// NewFileExporter returns an exporter that appends spans to the file at path,
+// one JSON encoded OTLP span per line. It is meant for tests and local
+// debugging.
+func NewFileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{f: f}, nil
+}
+
+type fileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (e *fileExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.f)
+	for _, s := range spans {
+		if err := enc.Encode(toOTLPSpan(s)); err != nil {
+			return err
+		}
+	}
+	return e.f.Sync()
+}
+
+// The types below mirror the JSON mapping of the OTLP trace protobufs.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+func newExportRequest(serviceName string, spans []*Span) *exportRequest {
+	ss := scopeSpans{Scope: scope{Name: "github.com/maisem/proxy-apiserver"}}
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, toOTLPSpan(s))
+	}
+	return &exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{
+				Attributes: []keyValue{{Key: "service.name", Value: anyValue{StringValue: serviceName}}},
+			},
+			ScopeSpans: []scopeSpans{ss},
+		}},
+	}
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	o := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            status{Code: statusOK},
+	}
+	if s.ParentID != (SpanID{}) {
+		o.ParentSpanID = s.ParentID.String()
+	}
+	for k, v := range s.Attributes {
+		o.Attributes = append(o.Attributes, keyValue{Key: k, Value: anyValue{StringValue: v}})
+	}
+	if s.Err != nil {
+		o.Status = status{Code: statusError, Message: s.Err.Error()}
+	}
+	return o
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// TraceparentHeader is the W3C Trace Context header carrying the trace.
+const TraceparentHeader = "traceparent"
+
+// WithTracing starts a server span for every request handled by handler,
+// continuing the caller's trace if the request carries a traceparent header.
+func WithTracing(handler http.Handler, t *Tracer) http.Handler {
+	if t == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, span := t.StartRoot(req.Context(), req.Method+" "+req.URL.Path, req.Header.Get(TraceparentHeader))
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.RequestURI())
+		rw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		defer func() {
+			span.SetAttribute("http.status_code", strconv.Itoa(rw.code))
+			span.Finish(nil)
+		}()
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// statusRecorder captures the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush is needed for watch responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify is needed for watch responses. The returned channel never fires
+// if the wrapped writer cannot notify.
+func (r *statusRecorder) CloseNotify() <-chan bool {
+	if n, ok := r.ResponseWriter.(http.CloseNotifier); ok {
+		return n.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Hijack is needed for connections upgraded to SPDY or websockets.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", r.ResponseWriter)
+	}
+	r.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithTracing(t *testing.T) {
+	tracer, path, stop, cleanup := newFileTracer(t)
+	defer cleanup()
+
+	var outgoing string
+	handler := WithTracing(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outgoing = Traceparent(req.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}), tracer)
+
+	for _, flags := range []string{"00", "01"} {
+		req := httptest.NewRequest("GET", "/apis/foo?watch=1", nil)
+		req.Header.Set(TraceparentHeader, "00-"+traceID+"-"+parentID+"-"+flags)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if !strings.HasPrefix(outgoing, "00-"+traceID+"-") || !strings.HasSuffix(outgoing, "-"+flags) {
+			t.Errorf("outgoing traceparent for incoming flags %s = %s", flags, outgoing)
+		}
+	}
+
+	stop()
+	spans := exported(t, path, 1)
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want only the sampled one: %v", len(spans), spans)
+	}
+	s := spans[0]
+	if s.Name != "GET /apis/foo" || s.Kind != KindServer || s.ParentSpanID != parentID {
+		t.Errorf("span = %+v", s)
+	}
+	attrs := map[string]string{}
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value.StringValue
+	}
+	if attrs["http.status_code"] != "418" || attrs["http.target"] != "/apis/foo?watch=1" {
+		t.Errorf("attributes = %v", attrs)
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	tracer, _, _, cleanup := newFileTracer(t)
+	defer cleanup()
+
+	// Writers that cannot notify or hijack must not make the handler panic.
+	handler := WithTracing(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.(http.CloseNotifier).CloseNotify()
+		if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			t.Error("Hijack() of a recorder succeeded")
+		}
+		w.(http.Flusher).Flush()
+	}), tracer)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	server := httptest.NewServer(WithTracing(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	}), tracer))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Errorf("status = %q, want 101 from the hijacked connection", status)
+	}
+}
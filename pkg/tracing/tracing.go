@@ -0,0 +1,257 @@
+// Package tracing implements a minimal tracer that follows the W3C Trace
+// Context propagation format and exports spans using the OTLP/HTTP JSON
+// encoding, so that facade requests and the upstream calls they cause can be
+// followed in any OpenTelemetry compatible backend.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Kind describes the relationship of a span to its remote peer.
+type Kind int
+
+// Span kinds, numbered as in the OTLP specification.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is a single timed operation within a trace.
+type Span struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	Kind       Kind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	// Err is the error the operation failed with, if any.
+	Err error
+	// Sampled reports whether the trace is recorded. Spans of unsampled
+	// traces are propagated to the upstream but not exported.
+	Sampled bool
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute records a key/value pair on the span. It is safe to call on a
+// nil span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, recording err as its status, and hands it to the
+// exporter. It is safe to call on a nil span and only the first call has an
+// effect.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.Err = err
+	s.mu.Unlock()
+	if s.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// traceparent returns the W3C traceparent header value for the span.
+func (s *Span) traceparent() string {
+	var flags byte
+	if s.Sampled {
+		flags = sampledFlag
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", s.TraceID, s.SpanID, flags)
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the span stored in ctx, or nil.
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Traceparent returns the W3C traceparent header value propagating the span
+// stored in ctx, or "" if ctx carries no span.
+func Traceparent(ctx context.Context) string {
+	s := SpanFrom(ctx)
+	if s == nil {
+		return ""
+	}
+	return s.traceparent()
+}
+
+// Start starts a child of the span stored in ctx. If ctx carries no span,
+// tracing is disabled for the request and a nil span is returned, whose
+// methods are no-ops.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := SpanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.TraceID, parent.SpanID, parent.Sampled)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Tracer creates root spans and batches finished spans to an Exporter.
+type Tracer struct {
+	exporter Exporter
+	spans    chan *Span
+}
+
+const (
+	batchSize     = 512
+	queueSize     = 2048
+	flushInterval = 5 * time.Second
+)
+
+// NewTracer returns a tracer that exports finished spans to exporter until
+// stopCh is closed.
+func NewTracer(exporter Exporter, stopCh <-chan struct{}) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		spans:    make(chan *Span, queueSize),
+	}
+	go t.run(stopCh)
+	return t
+}
+
+// StartRoot starts a new span that continues the trace described by
+// traceparent, or a new sampled trace if traceparent is empty or malformed.
+func (t *Tracer) StartRoot(ctx context.Context, name, traceparent string) (context.Context, *Span) {
+	traceID, parentID, flags, ok := parseTraceparent(traceparent)
+	if !ok {
+		traceID, parentID, flags = newTraceID(), SpanID{}, sampledFlag
+	}
+	s := t.newSpan(name, KindServer, traceID, parentID, flags&sampledFlag != 0)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) newSpan(name string, kind Kind, traceID TraceID, parentID SpanID, sampled bool) *Span {
+	return &Span{
+		TraceID:    traceID,
+		SpanID:     newSpanID(),
+		ParentID:   parentID,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		Sampled:    sampled,
+		tracer:     t,
+	}
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		klog.V(4).Infof("dropping span %q: export queue is full", s.Name)
+	}
+}
+
+func (t *Tracer) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			klog.Errorf("failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stopCh:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// sampledFlag is the trace flag marking a trace as recorded by the caller.
+const sampledFlag = 0x01
+
+// parseTraceparent parses a W3C traceparent header of the form
+// "00-<trace-id>-<parent-id>-<flags>".
+func parseTraceparent(v string) (TraceID, SpanID, byte, bool) {
+	var traceID TraceID
+	var spanID SpanID
+	var flags [1]byte
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 2*len(traceID) || len(parts[2]) != 2*len(spanID) || len(parts[3]) != 2 {
+		return traceID, spanID, 0, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == (TraceID{}) {
+		return traceID, spanID, 0, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == (SpanID{}) {
+		return traceID, spanID, 0, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return traceID, spanID, 0, false
+	}
+	return traceID, spanID, flags[0], true
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID = "00f067aa0ba902b7"
+)
+
+// newFileTracer returns a tracer exporting to a file, the path of the file, a
+// function that stops the tracer and one that also removes the file.
+func newFileTracer(t *testing.T) (*Tracer, string, func(), func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "spans.json")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	stopped := false
+	stop := func() {
+		if !stopped {
+			close(stopCh)
+			stopped = true
+		}
+	}
+	return NewTracer(exporter, stopCh), path, stop, func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// exported waits for n spans to be exported to path and returns them.
+func exported(t *testing.T, path string, n int) []otlpSpan {
+	t.Helper()
+	var spans []otlpSpan
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		spans = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var s otlpSpan
+			if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+				return false, err
+			}
+			spans = append(spans, s)
+		}
+		return len(spans) >= n, scanner.Err()
+	})
+	if err != nil {
+		t.Fatalf("waiting for %d spans, got %v: %v", n, spans, err)
+	}
+	return spans
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		ok    bool
+		flags byte
+	}{
+		{in: "00-" + traceID + "-" + parentID + "-01", ok: true, flags: 0x01},
+		{in: "00-" + traceID + "-" + parentID + "-00", ok: true, flags: 0x00},
+		{in: " 00-" + traceID + "-" + parentID + "-03 ", ok: true, flags: 0x03},
+		{in: ""},
+		{in: "ff-" + traceID + "-" + parentID + "-01"},
+		{in: "00-00000000000000000000000000000000-" + parentID + "-01"},
+		{in: "00-" + traceID + "-0000000000000000-01"},
+		{in: "00-" + traceID + "-" + parentID + "-1"},
+		{in: "00-" + traceID + "-" + parentID + "-zz"},
+		{in: "00-" + traceID + "-" + parentID},
+	} {
+		gotTrace, gotParent, flags, ok := parseTraceparent(tc.in)
+		if ok != tc.ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", tc.in, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if gotTrace.String() != traceID || gotParent.String() != parentID || flags != tc.flags {
+			t.Errorf("parseTraceparent(%q) = %s, %s, %02x", tc.in, gotTrace, gotParent, flags)
+		}
+	}
+}
+
+func TestStartRoot(t *testing.T) {
+	tracer, path, stop, cleanup := newFileTracer(t)
+	defer cleanup()
+
+	ctx, root := tracer.StartRoot(context.Background(), "root", "00-"+traceID+"-"+parentID+"-01")
+	_, child := Start(ctx, "child", KindClient)
+	if got, want := Traceparent(ctx), "00-"+traceID+"-"+root.SpanID.String()+"-01"; got != want {
+		t.Errorf("Traceparent() = %s, want %s", got, want)
+	}
+	child.SetAttribute("k", "v")
+	child.Finish(errors.New("boom"))
+	child.Finish(nil)
+	root.Finish(nil)
+
+	// Spans of unsampled traces are propagated but not exported.
+	ctx, unsampled := tracer.StartRoot(context.Background(), "unsampled", "00-"+traceID+"-"+parentID+"-00")
+	ctx, unsampledChild := Start(ctx, "unsampled child", KindClient)
+	if got, want := Traceparent(ctx), "00-"+traceID+"-"+unsampledChild.SpanID.String()+"-00"; got != want {
+		t.Errorf("Traceparent() of an unsampled trace = %s, want %s", got, want)
+	}
+	unsampledChild.Finish(nil)
+	unsampled.Finish(nil)
+
+	ctx, fresh := tracer.StartRoot(context.Background(), "fresh", "malformed")
+	if fresh.TraceID.String() == traceID || fresh.ParentID != (SpanID{}) || !fresh.Sampled {
+		t.Errorf("StartRoot() with a malformed traceparent = %+v, want a new sampled trace", fresh)
+	}
+	fresh.Finish(nil)
+
+	if ctx, span := Start(context.Background(), "untraced", KindInternal); span != nil || Traceparent(ctx) != "" {
+		t.Errorf("Start() without a span in ctx = %v", span)
+	}
+
+	stop()
+	spans := exported(t, path, 3)
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans, want 3: %v", len(spans), spans)
+	}
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	c, r := byName["child"], byName["root"]
+	if c.TraceID != traceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != parentID {
+		t.Errorf("child = %+v, root = %+v, want them linked to the incoming trace", c, r)
+	}
+	if c.Status.Code != statusError || c.Status.Message != "boom" || c.Kind != KindClient {
+		t.Errorf("child = %+v, want a failed client span", c)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "k" || c.Attributes[0].Value.StringValue != "v" {
+		t.Errorf("child attributes = %v", c.Attributes)
+	}
+	if f := byName["fresh"]; f.TraceID == traceID || f.ParentSpanID != "" {
+		t.Errorf("fresh = %+v", f)
+	}
+}
@@ -0,0 +1,4 @@
+// Package e2e runs the proxy API server in-process against a fake upstream
+// and exercises it with real client-go clients, covering discovery, the
+// facade REST API and watches end to end.
+package e2e
@@ -0,0 +1,688 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/apiserver"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/proxyresource"
+)
+
+func newFacadeDeployment(name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("apps.maisem.dev/v1")
+	u.SetKind("Deployment")
+	u.SetName(name)
+	u.SetLabels(map[string]string{"app": name})
+	unstructured.SetNestedField(u.Object, int64(1), "spec", "replicas")
+	return u
+}
+
+func TestDiscovery(t *testing.T) {
+	s := startServer(t)
+	defer s.Stop()
+	client, err := discovery.NewDiscoveryClientForConfig(s.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := client.ServerGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, g := range groups.Groups {
+		if g.Name == "apps.maisem.dev" {
+			found = true
+			if g.PreferredVersion.Version != "v1" {
+				t.Errorf("preferred version = %q, want v1", g.PreferredVersion.Version)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("apps.maisem.dev missing from discovery: %v", groups.Groups)
+	}
+
+	resources, err := client.ServerResourcesForGroupVersion("apps.maisem.dev/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range resources.APIResources {
+		if r.Name != "deployments" {
+			continue
+		}
+		if r.Kind != "Deployment" || !r.Namespaced {
+			t.Errorf("deployments discovered as kind %q namespaced=%v", r.Kind, r.Namespaced)
+		}
+		if len(r.ShortNames) != 1 || r.ShortNames[0] != "mdep" {
+			t.Errorf("short names = %v, want [mdep]", r.ShortNames)
+		}
+		verbs := map[string]bool{}
+		for _, v := range r.Verbs {
+			verbs[v] = true
+		}
+		for _, v := range []string{"create", "get", "list", "watch", "update", "patch", "delete", "deletecollection"} {
+			if !verbs[v] {
+				t.Errorf("verb %q missing from %v", v, r.Verbs)
+			}
+		}
+		return
+	}
+	t.Errorf("deployments missing from %v", resources.APIResources)
+}
+
+func TestCRUD(t *testing.T) {
+	s := startServer(t)
+	defer s.Stop()
+	client := s.Dynamic(t).Resource(facadeGVR).Namespace("default")
+
+	created, err := client.Create(newFacadeDeployment("web"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.GetAPIVersion() != "apps.maisem.dev/v1" || created.GetKind() != "Deployment" {
+		t.Errorf("created object has type %s %s", created.GetAPIVersion(), created.GetKind())
+	}
+	upstream := s.Upstream.Object(upstreamGVR, "default", "web")
+	if upstream == nil || upstream.GetAPIVersion() != "apps/v1" {
+		t.Fatalf("upstream object = %v, want an apps/v1 Deployment", upstream)
+	}
+
+	got, err := client.Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetUID() != upstream.GetUID() {
+		t.Errorf("got uid %s, want %s", got.GetUID(), upstream.GetUID())
+	}
+
+	unstructured.SetNestedField(got.Object, int64(4), "spec", "replicas")
+	updated, err := client.Update(got, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas"); r != 4 {
+		t.Errorf("updated replicas = %d, want 4", r)
+	}
+	if r, _, _ := unstructured.NestedInt64(s.Upstream.Object(upstreamGVR, "default", "web").Object, "spec", "replicas"); r != 4 {
+		t.Errorf("upstream replicas = %d, want 4", r)
+	}
+
+	if _, err := client.Create(newFacadeDeployment("api"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := client.List(metav1.ListOptions{LabelSelector: "app=api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].GetName() != "api" {
+		t.Errorf("list app=api returned %d items", len(list.Items))
+	}
+	list, err = s.Dynamic(t).Resource(facadeGVR).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 {
+		t.Errorf("list across namespaces returned %d items, want 2", len(list.Items))
+	}
+
+	if err := client.Delete("web", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Upstream.Object(upstreamGVR, "default", "web") != nil {
+		t.Error("web still exists upstream")
+	}
+	if err := client.DeleteCollection(&metav1.DeleteOptions{}, metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Upstream.Object(upstreamGVR, "default", "api") != nil {
+		t.Error("api still exists upstream")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := startServer(t)
+	defer s.Stop()
+	client := s.Dynamic(t).Resource(facadeGVR).Namespace("default")
+
+	if _, err := client.Get("missing", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("get of a missing object returned %v, want NotFound", err)
+	}
+	created, err := client.Create(newFacadeDeployment("web"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Create(newFacadeDeployment("web"), metav1.CreateOptions{}); !errors.IsAlreadyExists(err) {
+		t.Errorf("duplicate create returned %v, want AlreadyExists", err)
+	}
+	if _, err := client.Update(created, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(created, metav1.UpdateOptions{}); !errors.IsConflict(err) {
+		t.Errorf("update with a stale resourceVersion returned %v, want Conflict", err)
+	}
+
+	anonymous := rest.AnonymousClientConfig(s.Config)
+	anonClient, err := dynamic.NewForConfig(anonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonClient.Resource(facadeGVR).Namespace("default").Get("web", metav1.GetOptions{}); !errors.IsUnauthorized(err) {
+		t.Errorf("unauthenticated get returned %v, want Unauthorized", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := startServer(t)
+	defer s.Stop()
+	client := s.Dynamic(t).Resource(facadeGVR).Namespace("default")
+
+	w, err := client.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if _, err := client.Create(newFacadeDeployment("web"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e, ok := <-w.ResultChan():
+		if !ok {
+			t.Fatal("watch closed")
+		}
+		u := e.Object.(*unstructured.Unstructured)
+		if e.Type != watch.Added || u.GetName() != "web" || u.GetAPIVersion() != "apps.maisem.dev/v1" {
+			t.Errorf("got %s event for %s %s", e.Type, u.GetAPIVersion(), u.GetName())
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-apiserver-e2e-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := mapping.Default()
+	m.Resources = append(m.Resources, mapping.Resource{
+		External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Note", Resource: "notes"},
+		Backend:  mapping.Backend{File: &mapping.FileBackend{Directory: dir}},
+	})
+	s := startServerWithMapping(t, m)
+	defer s.Stop()
+	// Health checks reach the upstream while the server starts.
+	started := len(s.Upstream.Requests())
+	notes := schema.GroupVersionResource{Group: "notes.maisem.dev", Version: "v1", Resource: "notes"}
+	client := s.Dynamic(t).Resource(notes).Namespace("default")
+
+	note := &unstructured.Unstructured{}
+	note.SetAPIVersion("notes.maisem.dev/v1")
+	note.SetKind("Note")
+	note.SetName("hello")
+	unstructured.SetNestedField(note.Object, "world", "spec", "text")
+	created, err := client.Create(note, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(created, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(created, metav1.UpdateOptions{}); !errors.IsConflict(err) {
+		t.Errorf("update with a stale resourceVersion returned %v, want Conflict", err)
+	}
+	got, err := client.Get("hello", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _, _ := unstructured.NestedString(got.Object, "spec", "text"); text != "world" {
+		t.Errorf("spec.text = %q, want world", text)
+	}
+	if reqs := s.Upstream.Requests()[started:]; len(reqs) != 0 {
+		t.Errorf("file backed requests reached the upstream: %v", reqs)
+	}
+}
+
+func TestActions(t *testing.T) {
+	m := mapping.Default()
+	m.Resources[0].Actions = []string{"restart", "pause"}
+	s := startServerWithMapping(t, m)
+	defer s.Stop()
+	client := s.Dynamic(t).Resource(facadeGVR).Namespace("default")
+	if _, err := client.Create(newFacadeDeployment("web"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restClient := kubernetes.NewForConfigOrDie(s.Config).Discovery().RESTClient()
+	body, err := restClient.Post().AbsPath("/apis/apps.maisem.dev/v1/namespaces/default/deployments/web/restart").Do().Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &unstructured.Unstructured{}
+	if err := got.UnmarshalJSON(body); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetKind() != "Deployment" || got.GetAPIVersion() != "apps.maisem.dev/v1" {
+		t.Errorf("restart returned %s %s, want the facade Deployment", got.GetAPIVersion(), got.GetKind())
+	}
+	upstream := s.Upstream.Object(upstreamGVR, "default", "web")
+	if _, ok, _ := unstructured.NestedString(upstream.Object, "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt"); !ok {
+		t.Error("restart did not reach the upstream Deployment")
+	}
+
+	// Only the configured actions are served.
+	err = restClient.Post().AbsPath("/apis/apps.maisem.dev/v1/namespaces/default/deployments/web/rollback").Do().Error()
+	if !errors.IsNotFound(err) {
+		t.Errorf("POST to an unconfigured action returned %v, want NotFound", err)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	m := mapping.Default()
+	m.Resources[0].Logs = true
+	s := startServerWithMapping(t, m)
+	defer s.Stop()
+	d := newFacadeDeployment("web")
+	unstructured.SetNestedStringMap(d.Object, map[string]string{"app": "web"}, "spec", "selector", "matchLabels")
+	if _, err := s.Dynamic(t).Resource(facadeGVR).Namespace("default").Create(d, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("web-1")
+	pod.SetLabels(map[string]string{"app": "web"})
+	unstructured.SetNestedSlice(pod.Object, []interface{}{map[string]interface{}{"name": "web", "image": "web"}}, "spec", "containers")
+	s.Upstream.Add(schema.GroupVersionResource{Version: "v1", Resource: "pods"}, pod)
+	s.Upstream.SetLogs("default", "web-1", "web", "started\nserving\n")
+
+	restClient := kubernetes.NewForConfigOrDie(s.Config).Discovery().RESTClient()
+	body, err := restClient.Get().AbsPath("/apis/apps.maisem.dev/v1/namespaces/default/deployments/web/logs").Param("tailLines", "1").Do().Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "serving\n" {
+		t.Errorf("logs = %q, want %q", body, "serving\n")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := startServer(t)
+	defer s.Stop()
+	if _, err := s.Dynamic(t).Resource(facadeGVR).Namespace("default").Create(newFacadeDeployment("web"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are recorded asynchronously.
+	events := dynamic.NewForConfigOrDie(s.Upstream.Config()).Resource(schema.GroupVersionResource{Version: "v1", Resource: "events"}).Namespace("default")
+	err := wait.PollImmediate(50*time.Millisecond, 10*time.Second, func() (bool, error) {
+		l, err := events.List(metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, e := range l.Items {
+			reason, _, _ := unstructured.NestedString(e.Object, "reason")
+			name, _, _ := unstructured.NestedString(e.Object, "involvedObject", "name")
+			component, _, _ := unstructured.NestedString(e.Object, "source", "component")
+			if reason == "Created" && name == "web" && component == "proxy-apiserver" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Errorf("no Created event was recorded upstream: %v", err)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	readyz := func(s *testServer) (string, error) {
+		body, err := kubernetes.NewForConfigOrDie(s.Config).Discovery().RESTClient().Get().AbsPath("/readyz").Param("verbose", "true").Do().Raw()
+		return string(body), err
+	}
+
+	s := startServer(t)
+	defer s.Stop()
+	body, err := readyz(s)
+	if err != nil {
+		t.Fatalf("readyz failed: %v: %s", err, body)
+	}
+	for _, check := range []string{"upstream", "upstream-resources", "upstream-permissions"} {
+		if !strings.Contains(body, "[+]"+check+" ok") {
+			t.Errorf("readyz does not report check %s passing: %s", check, body)
+		}
+	}
+
+	s = startServer(t)
+	defer s.Stop()
+	s.Upstream.Deny("delete", upstreamGVR, "")
+	s.Upstream.RemoveResource(upstreamGVR)
+	body, err = readyz(s)
+	if err == nil {
+		t.Fatal("readyz passed without permissions to delete upstream deployments")
+	}
+	for _, check := range []string{"upstream-resources", "upstream-permissions"} {
+		if !strings.Contains(body, "[-]"+check+" failed") {
+			t.Errorf("readyz does not report check %s failing: %s", check, body)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	s := startServer(t)
+	defer s.Stop()
+	deployments := s.Dynamic(t).Resource(facadeGVR).Namespace("default")
+	w, err := deployments.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	dir, err := ioutil.TempDir("", "proxy-apiserver-e2e-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notes := mapping.Resource{
+		External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Note", Resource: "notes"},
+		Backend:  mapping.Backend{File: &mapping.FileBackend{Directory: dir}},
+	}
+	m := mapping.Default()
+	m.Resources[0].ShortNames = []string{"fd"}
+	m.Resources = append(m.Resources, notes)
+	if err := s.Server.Reload(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Watches of modified resources end so that clients start over.
+	select {
+	case _, ok := <-w.ResultChan():
+		if ok {
+			t.Error("watch of a modified resource received an event, want it closed")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("watch of a modified resource was not ended")
+	}
+	resources, err := discovery.NewDiscoveryClientForConfigOrDie(s.Config).ServerResourcesForGroupVersion("notes.maisem.dev/v1")
+	if err != nil || len(resources.APIResources) != 1 {
+		t.Fatalf("discovery of an added group returned %v, %v", resources, err)
+	}
+	note := &unstructured.Unstructured{}
+	note.SetAPIVersion("notes.maisem.dev/v1")
+	note.SetKind("Note")
+	note.SetName("hello")
+	if _, err := s.Dynamic(t).Resource(notes.External.GroupVersionResource()).Namespace("default").Create(note, metav1.CreateOptions{}); err != nil {
+		t.Errorf("create of an added resource: %v", err)
+	}
+	if _, err := deployments.List(metav1.ListOptions{}); err != nil {
+		t.Errorf("list of a modified resource: %v", err)
+	}
+
+	// Invalid mappings are rejected and the current one is still served.
+	if err := s.Server.Reload(&mapping.Config{}); err == nil {
+		t.Error("reload of an empty mapping succeeded")
+	}
+	if _, err := deployments.List(metav1.ListOptions{}); err != nil {
+		t.Errorf("list after a failed reload: %v", err)
+	}
+
+	if err := s.Server.Reload(&mapping.Config{Resources: []mapping.Resource{notes}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deployments.List(metav1.ListOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("list of a removed resource returned %v, want NotFound", err)
+	}
+	groups, err := discovery.NewDiscoveryClientForConfigOrDie(s.Config).ServerGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range groups.Groups {
+		if g.Name == facadeGVR.Group {
+			t.Errorf("discovery still lists removed group %s", g.Name)
+		}
+	}
+}
+
+func newProxyResource(name string, external, internal mapping.GroupVersionKindResource) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"external": map[string]interface{}{"group": external.Group, "version": external.Version, "kind": external.Kind, "resource": external.Resource},
+			"internal": map[string]interface{}{"group": internal.Group, "version": internal.Version, "kind": internal.Kind, "resource": internal.Resource},
+		},
+	}}
+	u.SetAPIVersion(proxyresource.GroupVersionResource.GroupVersion().String())
+	u.SetKind(proxyresource.Kind)
+	u.SetName(name)
+	return u
+}
+
+// waitForCondition waits until the ProxyResource name reports the condition
+// typ with status and returns its reason.
+func waitForCondition(t *testing.T, s *testServer, name, typ, status string) string {
+	t.Helper()
+	var reason string
+	err := wait.PollImmediate(100*time.Millisecond, 30*time.Second, func() (bool, error) {
+		u := s.Upstream.Object(proxyresource.GroupVersionResource, "", name)
+		if u == nil {
+			return false, nil
+		}
+		conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+		for _, c := range conditions {
+			c := c.(map[string]interface{})
+			if c["type"] == typ && c["status"] == status {
+				reason, _ = c["reason"].(string)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("ProxyResource %s did not report %s=%s: %v", name, typ, status, err)
+	}
+	return reason
+}
+
+func TestProxyResources(t *testing.T) {
+	s := startServerWithConfig(t, func(c *apiserver.ExtraConfig) { c.ProxyResources = true })
+	defer s.Stop()
+	deployments := mapping.GroupVersionKindResource{Group: "apps", Version: "v1", Kind: "Deployment", Resource: "deployments"}
+	webapps := mapping.GroupVersionKindResource{Group: "web.example.com", Version: "v1", Kind: "WebApp", Resource: "webapps"}
+	s.Upstream.Add(proxyresource.GroupVersionResource, newProxyResource("webapps", webapps, deployments))
+	if reason := waitForCondition(t, s, "webapps", proxyresource.ConditionAccepted, "True"); reason != "Served" {
+		t.Errorf("Accepted reason = %q, want Served", reason)
+	}
+
+	client := s.Dynamic(t).Resource(webapps.GroupVersionResource()).Namespace("default")
+	app := &unstructured.Unstructured{}
+	app.SetAPIVersion("web.example.com/v1")
+	app.SetKind("WebApp")
+	app.SetName("shop")
+	if _, err := client.Create(app, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Upstream.Object(upstreamGVR, "default", "shop") == nil {
+		t.Error("WebApp was not created as an upstream Deployment")
+	}
+	if l, err := client.List(metav1.ListOptions{}); err != nil || len(l.Items) != 1 {
+		t.Errorf("list of WebApps returned %v, %v", l, err)
+	}
+
+	s.Upstream.Add(proxyresource.GroupVersionResource, newProxyResource("mapped", mapping.Default().Resources[0].External, deployments))
+	waitForCondition(t, s, "mapped", proxyresource.ConditionConflict, "True")
+	databases := mapping.GroupVersionKindResource{Group: "db.example.com", Version: "v1", Kind: "Database", Resource: "databases"}
+	s.Upstream.Add(proxyresource.GroupVersionResource, newProxyResource("databases", databases, databases))
+	waitForCondition(t, s, "databases", proxyresource.ConditionUpstreamMissing, "True")
+	if _, err := s.Dynamic(t).Resource(databases.GroupVersionResource()).Namespace("default").List(metav1.ListOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("list of a resource missing upstream returned %v, want NotFound", err)
+	}
+
+	upstream, err := dynamic.NewForConfig(s.Upstream.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Resource(proxyresource.GroupVersionResource).Delete("webapps", nil); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(100*time.Millisecond, 30*time.Second, func() (bool, error) {
+		_, err := client.List(metav1.ListOptions{})
+		return errors.IsNotFound(err), nil
+	})
+	if err != nil {
+		t.Errorf("WebApps are still served after their ProxyResource was deleted: %v", err)
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	m := mapping.Default()
+	v2 := m.Resources[0]
+	v2.External.Version = "v2"
+	m.Resources = append(m.Resources, v2)
+	m.DeprecatedVersions = []mapping.VersionDeprecation{{
+		Group:       "apps.maisem.dev",
+		Version:     "v1",
+		Deprecation: mapping.Deprecation{Replacement: "apps.maisem.dev/v2", Removal: "2020-06-30"},
+	}}
+	s := startServerWithMapping(t, m)
+	defer s.Stop()
+	transport, err := rest.TransportFor(s.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	get := func(path, userAgent string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, s.Config.Host+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s returned %s", path, resp.Status)
+		}
+		return resp
+	}
+
+	resp := get("/apis/apps.maisem.dev/v1/namespaces/default/deployments", "legacy-deployer/v0.1 (linux/amd64)")
+	want := `299 - "apps.maisem.dev/v1 deployments is deprecated and will be removed after 2020-06-30; use apps.maisem.dev/v2"`
+	if got := resp.Header.Get("Warning"); got != want {
+		t.Errorf("Warning = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Sunset"); got != "Tue, 30 Jun 2020 00:00:00 GMT" {
+		t.Errorf("Sunset = %q", got)
+	}
+	get("/apis/apps.maisem.dev/v1/namespaces/default/deployments", "kubectl/v1.15.0 (linux/amd64) kubernetes/e8462b5")
+	resp = get("/apis/apps.maisem.dev/v2/namespaces/default/deployments", "kubectl/v1.15.0 (linux/amd64) kubernetes/e8462b5")
+	if got := resp.Header.Get("Warning"); got != "" {
+		t.Errorf("Warning of a current version = %q, want none", got)
+	}
+
+	disc := discovery.NewDiscoveryClientForConfigOrDie(s.Config)
+	groups, err := disc.ServerGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range groups.Groups {
+		if g.Name == "apps.maisem.dev" && g.PreferredVersion.Version != "v2" {
+			t.Errorf("preferred version = %s, want v2 over the deprecated v1", g.PreferredVersion.Version)
+		}
+	}
+	resources, err := disc.ServerResourcesForGroupVersion("apps.maisem.dev/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := resources.APIResources[0].Categories; len(c) == 0 || c[len(c)-1] != "deprecated" {
+		t.Errorf("categories of a deprecated resource = %v, want deprecated", c)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, s.Config.Host+"/metrics", nil)
+	metricsResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metricsResp.Body.Close()
+	body, _ := ioutil.ReadAll(metricsResp.Body)
+	// Clients are counted by name if they are known, without their version.
+	for _, want := range []string{
+		`proxy_deprecated_requests_total{group="apps.maisem.dev",resource="deployments",user_agent="other",verb="list",version="v1"} 1`,
+		`proxy_deprecated_requests_total{group="apps.maisem.dev",resource="deployments",user_agent="kubectl",verb="list",version="v1"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-apiserver-e2e-protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := mapping.Default()
+	m.Resources = append(m.Resources, mapping.Resource{
+		External: mapping.GroupVersionKindResource{Group: "notes.maisem.dev", Version: "v1", Kind: "Note", Resource: "notes"},
+		Backend:  mapping.Backend{File: &mapping.FileBackend{Directory: dir}},
+	})
+	s := startServerWithMapping(t, m)
+	defer s.Stop()
+	deployments := schema.GroupVersionResource{Group: "apps.maisem.dev", Version: "v1", Resource: "deployments"}
+	if _, err := s.Dynamic(t).Resource(deployments).Namespace("default").Create(newFacadeDeployment("web"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	transport, err := rest.TransportFor(s.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, s.Config.Host+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/vnd.kubernetes.protobuf")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get("/apis/apps.maisem.dev/v1/namespaces/default/deployments")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/vnd.kubernetes.protobuf" {
+		t.Fatalf("protobuf list returned %s %s: %s", resp.Status, resp.Header.Get("Content-Type"), body)
+	}
+	if !strings.HasPrefix(string(body), "k8s\x00") || !strings.Contains(string(body), "apps.maisem.dev/v1") || !strings.Contains(string(body), "web") {
+		t.Errorf("protobuf list is not a facade list containing web: %q", body)
+	}
+	// Notes have no Go type to encode them as.
+	if resp, body := get("/apis/notes.maisem.dev/v1/namespaces/default/notes"); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("protobuf list of notes returned %s, want 406: %s", resp.Status, body)
+	}
+}
@@ -0,0 +1,176 @@
+package e2e
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/maisem/proxy-apiserver/pkg/apiserver"
+	"github.com/maisem/proxy-apiserver/pkg/mapping"
+	"github.com/maisem/proxy-apiserver/pkg/storage"
+	"github.com/maisem/proxy-apiserver/pkg/testing/fakeupstream"
+)
+
+var (
+	facadeGVR   = schema.GroupVersionResource{Group: "apps.maisem.dev", Version: "v1", Resource: "deployments"}
+	upstreamGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+// testServer is a proxy API server running in-process against a fake
+// upstream.
+type testServer struct {
+	Upstream *fakeupstream.Server
+	// Config authenticates as the privileged loopback user.
+	Config *rest.Config
+	Server *apiserver.Server
+
+	// stops tear the server down, in reverse order.
+	stops []func()
+}
+
+// Stop stops the server and its fake upstream.
+func (s *testServer) Stop() {
+	for i := len(s.stops) - 1; i >= 0; i-- {
+		s.stops[i]()
+	}
+	s.stops = nil
+}
+
+// Dynamic returns a dynamic client for the facade API.
+func (s *testServer) Dynamic(t *testing.T) dynamic.Interface {
+	t.Helper()
+	c, err := dynamic.NewForConfig(s.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// startServer starts the proxy with only loopback authentication and
+// authorization configured. Callers stop it with Stop.
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	return startServerWithMapping(t, nil)
+}
+
+// startServerWithMapping is like startServer but serves the resources in m
+// instead of the default mapping.
+func startServerWithMapping(t *testing.T, m *mapping.Config) *testServer {
+	t.Helper()
+	return startServerWithConfig(t, func(c *apiserver.ExtraConfig) { c.Mapping = m })
+}
+
+// startServerWithConfig is like startServer but lets configure change the
+// config of the proxy before it starts.
+func startServerWithConfig(t *testing.T, configure func(*apiserver.ExtraConfig)) *testServer {
+	t.Helper()
+	fake := fakeupstream.New()
+	s := &testServer{Upstream: fake, stops: []func(){fake.Close}}
+	started := false
+	defer func() {
+		// Tear down what was started if the test fails during setup.
+		if !started {
+			s.Stop()
+		}
+	}()
+
+	certDir, err := ioutil.TempDir("", "proxy-apiserver-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stops = append(s.stops, func() { os.RemoveAll(certDir) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving := genericoptions.NewSecureServingOptions().WithLoopback()
+	serving.Listener = ln
+	serving.ServerCert.CertDirectory = certDir
+	if err := serving.MaybeDefaultWithSelfSignedCerts("localhost", nil, []net.IP{net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	genericConfig := genericapiserver.NewRecommendedConfig(apiserver.Codecs)
+	if err := serving.ApplyTo(&genericConfig.SecureServing, &genericConfig.LoopbackClientConfig); err != nil {
+		t.Fatal(err)
+	}
+	// Reject everyone but the loopback client.
+	genericConfig.Authentication.Authenticator = authenticator.RequestFunc(func(*http.Request) (*authenticator.Response, bool, error) {
+		return nil, false, nil
+	})
+	genericConfig.Authorization.Authorizer = authorizerfactory.NewAlwaysDenyAuthorizer()
+	genericapiserver.AuthorizeClientBearerToken(genericConfig.LoopbackClientConfig, &genericConfig.Authentication, &genericConfig.Authorization)
+
+	upstream, err := storage.NewUpstream("fake", fake.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopEvents := make(chan struct{})
+	s.stops = append(s.stops, func() { close(stopEvents) })
+	if upstream.Recorder, err = upstream.StartEventRecorder("proxy-apiserver", stopEvents); err != nil {
+		t.Fatal(err)
+	}
+	config := &apiserver.Config{
+		GenericConfig: genericConfig,
+		ExtraConfig: &apiserver.ExtraConfig{
+			Upstream: upstream,
+		},
+	}
+	configure(config.ExtraConfig)
+	server, err := config.Complete().New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		defer close(done)
+		runErr = server.GenericAPIServer.PrepareRun().Run(stopCh)
+	}()
+	s.stops = append(s.stops, func() {
+		close(stopCh)
+		<-done
+		if runErr != nil {
+			t.Errorf("server exited with error: %v", runErr)
+		}
+	})
+
+	clientConfig := rest.CopyConfig(genericConfig.LoopbackClientConfig)
+	client, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(100*time.Millisecond, 30*time.Second, func() (bool, error) {
+		select {
+		case <-done:
+			return false, fmt.Errorf("server exited: %v", runErr)
+		default:
+		}
+		result := client.Discovery().RESTClient().Get().AbsPath("/healthz").Do()
+		var code int
+		result.StatusCode(&code)
+		return code == 200, nil
+	})
+	if err != nil {
+		t.Fatalf("server did not become healthy: %v", err)
+	}
+	s.Config, s.Server = clientConfig, server
+	started = true
+	return s
+}